@@ -0,0 +1,10 @@
+package main
+
+import (
+	amprunner "superdev/michael"
+)
+
+func main() {
+	// Execute the runner inside a worker container
+	amprunner.Execute()
+}
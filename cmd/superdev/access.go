@@ -0,0 +1,282 @@
+package superdev
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+// Thread access roles, from least to most privileged
+const (
+	RoleNone  = ""
+	RoleRead  = "read"
+	RoleWrite = "write"
+	RoleOwner = "owner"
+)
+
+// Headers used to identify the caller. The server expects these to be set by
+// an authenticating proxy in front of it.
+const (
+	userHeader  = client.UserHeader
+	teamHeader  = client.TeamHeader
+	shareHeader = client.ShareHeader
+)
+
+// Caller identifies the user making a request
+type Caller struct {
+	User string
+	Team string
+}
+
+// ShareLink grants access to a thread to anyone holding its token
+type ShareLink struct {
+	Token     string    `json:"token"`
+	Role      string    `json:"role"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ThreadInfo stores the metadata, ownership and sharing settings of a thread
+type ThreadInfo struct {
+	ID         string
+	Title      string
+	Repository string
+	Image      string
+	Template   string // template the thread was started from, if any
+	Agent      string // host agent running the container; empty for this server
+	Owner      string
+	Team       string
+	Status     string   // one of the client.ThreadStatus values
+	Secrets    []string // names of the secrets injected into the container
+	Shares     map[string]*ShareLink
+	CreatedAt  time.Time
+
+	// Settings is the start request the thread was created with, without its
+	// prompt and title, so it can be forked
+	Settings   client.StartThreadRequest
+	ForkedFrom string // thread this one was forked from, if any
+	ForkedAt   string // ID of the last message copied from that thread
+	Answered   int    // leading messages answered before the fork, which its worker skips
+
+	// Approvals are the tool runs the worker asked a human to approve
+	Approvals []*client.ToolApproval
+
+	// Usage holds every inference the worker reported, priced when it was reported
+	Usage []usageRecord
+
+	// WorkerToken is handed to the thread's container and required by every
+	// worker endpoint, so only that container can act as the thread's worker
+	WorkerToken string
+}
+
+// threadInfos holds the metadata for every thread, guarded by outputMutex
+var threadInfos = make(map[string]*ThreadInfo)
+
+// callerFromRequest reads the caller identity from the request headers
+func callerFromRequest(r *http.Request) Caller {
+	return Caller{
+		User: r.Header.Get(userHeader),
+		Team: r.Header.Get(teamHeader),
+	}
+}
+
+// shareTokenFromRequest returns the share token passed as a query parameter or header
+func shareTokenFromRequest(r *http.Request) string {
+	if token := r.URL.Query().Get("share"); token != "" {
+		return token
+	}
+	return r.Header.Get(shareHeader)
+}
+
+// authorizeWorker checks a request carries the worker token of the thread
+func authorizeWorker(r *http.Request, threadID string) *apiError {
+	outputMutex.Lock()
+	var expected string
+	if info := threadInfos[threadID]; info != nil {
+		expected = info.WorkerToken
+	}
+	outputMutex.Unlock()
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return newAPIError(http.StatusUnauthorized, "A valid worker token for the thread is required")
+	}
+	return nil
+}
+
+// roleRank orders roles so they can be compared
+func roleRank(role string) int {
+	switch role {
+	case RoleRead:
+		return 1
+	case RoleWrite:
+		return 2
+	case RoleOwner:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// validShareRole reports whether a role can be granted through a share link
+func validShareRole(role string) bool {
+	return role == RoleRead || role == RoleWrite
+}
+
+// RoleFor returns the role the caller holds on the thread
+func (t *ThreadInfo) RoleFor(caller Caller, shareToken string) string {
+	// Threads started without an identified caller are open to everyone
+	if t.Owner == "" {
+		return RoleWrite
+	}
+
+	if caller.User != "" && caller.User == t.Owner {
+		return RoleOwner
+	}
+
+	role := RoleNone
+
+	// Teammates collaborate on team threads
+	if t.Team != "" && caller.Team == t.Team {
+		role = RoleWrite
+	}
+
+	if shareToken != "" {
+		if link, ok := t.Shares[shareToken]; ok && roleRank(link.Role) > roleRank(role) {
+			role = link.Role
+		}
+	}
+
+	return role
+}
+
+// authorizeThread checks that the caller holds at least the required role on a thread.
+// Threads the caller cannot see at all are reported as not found. The caller must hold outputMutex.
+func authorizeThread(r *http.Request, threadID, required string) (*ThreadInfo, *apiError) {
+	info, exists := threadInfos[threadID]
+	if !exists {
+		return nil, newAPIError(http.StatusNotFound, "Thread not found")
+	}
+
+	role := info.RoleFor(callerFromRequest(r), shareTokenFromRequest(r))
+	if role == RoleNone {
+		return nil, newAPIError(http.StatusNotFound, "Thread not found")
+	}
+	if roleRank(role) < roleRank(required) {
+		return nil, newAPIError(http.StatusForbidden, "Insufficient permissions for thread")
+	}
+
+	return info, nil
+}
+
+// createShareLink creates a share link for a thread owned by the caller
+func createShareLink(r *http.Request, threadID, role string) (*client.ShareResponse, *apiError) {
+	if threadID == "" {
+		return nil, newAPIError(http.StatusBadRequest, "ThreadId is required")
+	}
+
+	if role == "" {
+		role = RoleRead
+	}
+	if !validShareRole(role) {
+		return nil, newAPIError(http.StatusBadRequest, "Role must be read or write")
+	}
+
+	token, err := generateThreadID()
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Error generating share token")
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	info, apiErr := authorizeThread(r, threadID, RoleOwner)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	link := &ShareLink{
+		Token:     token,
+		Role:      role,
+		CreatedBy: callerFromRequest(r).User,
+		CreatedAt: time.Now(),
+	}
+	if info.Shares == nil {
+		info.Shares = make(map[string]*ShareLink)
+	}
+	info.Shares[token] = link
+
+	return &client.ShareResponse{
+		ThreadID: threadID,
+		Token:    link.Token,
+		Role:     link.Role,
+		URL:      fmt.Sprintf("/v1/threads/%s?share=%s", threadID, link.Token),
+	}, nil
+}
+
+// revokeShareLink deletes a share link from a thread owned by the caller
+func revokeShareLink(r *http.Request, threadID, token string) *apiError {
+	if threadID == "" {
+		return newAPIError(http.StatusBadRequest, "Missing thread_id parameter")
+	}
+
+	if token == "" {
+		return newAPIError(http.StatusBadRequest, "Missing token parameter")
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	info, apiErr := authorizeThread(r, threadID, RoleOwner)
+	if apiErr != nil {
+		return apiErr
+	}
+
+	if _, ok := info.Shares[token]; !ok {
+		return newAPIError(http.StatusNotFound, "Share link not found")
+	}
+	delete(info.Shares, token)
+
+	return nil
+}
+
+// handleShareRequest creates (POST) or revokes (DELETE) share links for a thread
+func handleShareRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			ThreadId string `json:"thread_id"`
+			client.ShareRequest
+		}
+		if !decodeLegacyRequest(w, r, &req) {
+			return
+		}
+
+		share, apiErr := createShareLink(r, req.ThreadId, req.Role)
+		if apiErr != nil {
+			http.Error(w, apiErr.Message, apiErr.Status)
+			return
+		}
+		share.URL = fmt.Sprintf("/output?thread_id=%s&share=%s", share.ThreadID, share.Token)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(share)
+
+	case http.MethodDelete:
+		apiErr := revokeShareLink(r, r.URL.Query().Get("thread_id"), r.URL.Query().Get("token"))
+		if apiErr != nil {
+			http.Error(w, apiErr.Message, apiErr.Status)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
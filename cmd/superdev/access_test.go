@@ -0,0 +1,250 @@
+package superdev
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+// resetThreads clears the in-memory server state between tests
+func resetThreads(t *testing.T) {
+	t.Helper()
+	outputMutex.Lock()
+	threads = make(map[string][]*client.ThreadMessage)
+	threadContainers = make(map[string]string)
+	threadInfos = make(map[string]*ThreadInfo)
+	outputMutex.Unlock()
+}
+
+// addTestThread registers a thread with a single input message
+func addTestThread(id, owner, team string) *ThreadInfo {
+	info := &ThreadInfo{ID: id, Owner: owner, Team: team, Status: "running", CreatedAt: time.Now(), WorkerToken: "worker-" + id}
+	outputMutex.Lock()
+	threadInfos[id] = info
+	threadContainers[id] = "container-" + id
+	threads[id] = []*client.ThreadMessage{{ID: "1", Direction: "input", Output: "hello", CreatedAt: time.Now()}}
+	outputMutex.Unlock()
+	return info
+}
+
+// workerClient returns a client authenticated as the worker of a thread
+func workerClient(serverURL, threadID string) *client.Client {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	var token string
+	if info := threadInfos[threadID]; info != nil {
+		token = info.WorkerToken
+	}
+	return client.New(serverURL, client.WithWorkerToken(token))
+}
+
+// newWorkerRequest builds a request carrying the worker token of a test thread
+func newWorkerRequest(method, target, body, threadID string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer worker-"+threadID)
+	return req
+}
+
+func newCallerRequest(method, target, body, user, team string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if user != "" {
+		req.Header.Set(userHeader, user)
+	}
+	if team != "" {
+		req.Header.Set(teamHeader, team)
+	}
+	return req
+}
+
+func TestRoleFor(t *testing.T) {
+	info := &ThreadInfo{
+		Owner: "alice",
+		Team:  "core",
+		Shares: map[string]*ShareLink{
+			"read-token":  {Token: "read-token", Role: RoleRead},
+			"write-token": {Token: "write-token", Role: RoleWrite},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		caller Caller
+		token  string
+		want   string
+	}{
+		{"owner", Caller{User: "alice"}, "", RoleOwner},
+		{"teammate", Caller{User: "bob", Team: "core"}, "", RoleWrite},
+		{"stranger", Caller{User: "eve", Team: "other"}, "", RoleNone},
+		{"read share", Caller{User: "eve"}, "read-token", RoleRead},
+		{"write share", Caller{}, "write-token", RoleWrite},
+		{"unknown share", Caller{User: "eve"}, "bogus", RoleNone},
+	}
+
+	for _, tt := range tests {
+		if got := info.RoleFor(tt.caller, tt.token); got != tt.want {
+			t.Errorf("%s: expected role %q, got %q", tt.name, tt.want, got)
+		}
+	}
+
+	private := &ThreadInfo{Owner: "alice"}
+	if got := private.RoleFor(Caller{User: "bob", Team: ""}, ""); got != RoleNone {
+		t.Errorf("Expected private thread to be hidden, got role %q", got)
+	}
+
+	unowned := &ThreadInfo{}
+	if got := unowned.RoleFor(Caller{User: "bob"}, ""); got != RoleWrite {
+		t.Errorf("Expected unowned thread to be writable, got role %q", got)
+	}
+}
+
+func TestThreadsListFiltersByAccess(t *testing.T) {
+	resetThreads(t)
+	addTestThread("private-alice", "alice", "")
+	addTestThread("team-alice", "alice", "core")
+	addTestThread("private-bob", "bob", "")
+
+	list := func(target, user, team string) []string {
+		rec := httptest.NewRecorder()
+		handleThreadsRequest(rec, newCallerRequest(http.MethodGet, target, "", user, team))
+		var resp struct {
+			ThreadIDs []string               `json:"thread_ids"`
+			Threads   []client.ThreadSummary `json:"threads"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode threads response: %v", err)
+		}
+		if len(resp.Threads) != len(resp.ThreadIDs) {
+			t.Fatalf("Expected a summary for each of %v, got %+v", resp.ThreadIDs, resp.Threads)
+		}
+		return resp.ThreadIDs
+	}
+
+	// Like /v1/threads, threads without messages are listed too
+	outputMutex.Lock()
+	threads["private-bob"] = nil
+	outputMutex.Unlock()
+
+	if ids := list("/threads", "bob", "core"); len(ids) != 2 {
+		t.Errorf("Expected bob to see 2 threads, got %v", ids)
+	}
+
+	if ids := list("/threads?owner=me", "bob", "core"); len(ids) != 1 || ids[0] != "private-bob" {
+		t.Errorf("Expected bob's own thread only, got %v", ids)
+	}
+
+	if ids := list("/threads", "eve", ""); len(ids) != 0 {
+		t.Errorf("Expected eve to see no threads, got %v", ids)
+	}
+}
+
+func TestOutputAndStoreMessageEnforceRoles(t *testing.T) {
+	resetThreads(t)
+	info := addTestThread("thread-1", "alice", "")
+	info.Shares = map[string]*ShareLink{"read-token": {Token: "read-token", Role: RoleRead}}
+
+	rec := httptest.NewRecorder()
+	handleOutputRequest(rec, newCallerRequest(http.MethodGet, "/output?thread_id=thread-1", "", "eve", ""))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for stranger, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handleOutputRequest(rec, newCallerRequest(http.MethodGet, "/output?thread_id=thread-1&share=read-token", "", "eve", ""))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 with read share, got %d", rec.Code)
+	}
+
+	body := `{"thread_id":"thread-1","prompt":"more"}`
+	req := newCallerRequest(http.MethodPost, "/storeMessage", body, "eve", "")
+	req.Header.Set(shareHeader, "read-token")
+	rec = httptest.NewRecorder()
+	handleStoreMessageRequest(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 storing with read share, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handleStoreMessageRequest(rec, newCallerRequest(http.MethodPost, "/storeMessage", body, "alice", ""))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 storing as owner, got %d", rec.Code)
+	}
+	if got := len(threads["thread-1"]); got != 2 {
+		t.Errorf("Expected 2 messages after store, got %d", got)
+	}
+}
+
+func TestShareLinkLifecycle(t *testing.T) {
+	resetThreads(t)
+	addTestThread("thread-1", "alice", "")
+
+	rec := httptest.NewRecorder()
+	handleShareRequest(rec, newCallerRequest(http.MethodPost, "/share", `{"thread_id":"thread-1","role":"write"}`, "bob", ""))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 sharing someone else's thread, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handleShareRequest(rec, newCallerRequest(http.MethodPost, "/share", `{"thread_id":"thread-1","role":"admin"}`, "alice", ""))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid role, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handleShareRequest(rec, newCallerRequest(http.MethodPost, "/share", `{"thread_id":"thread-1","role":"write"}`, "alice", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 creating share, got %d", rec.Code)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode share response: %v", err)
+	}
+
+	if role := threadInfos["thread-1"].RoleFor(Caller{User: "bob"}, resp.Token); role != RoleWrite {
+		t.Errorf("Expected share token to grant write, got %q", role)
+	}
+
+	rec = httptest.NewRecorder()
+	handleShareRequest(rec, newCallerRequest(http.MethodDelete, "/share?thread_id=thread-1&token="+resp.Token, "", "alice", ""))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 revoking share, got %d", rec.Code)
+	}
+
+	if role := threadInfos["thread-1"].RoleFor(Caller{User: "bob"}, resp.Token); role != RoleNone {
+		t.Errorf("Expected revoked token to grant nothing, got %q", role)
+	}
+}
+
+func TestCancelRequiresWriteAccess(t *testing.T) {
+	resetThreads(t)
+	info := addTestThread("thread-1", "alice", "")
+	// No container recorded so cancellation does not shell out to docker
+	delete(threadContainers, "thread-1")
+
+	rec := httptest.NewRecorder()
+	handleCancelRequest(rec, newCallerRequest(http.MethodPost, "/cancel", `{"thread_id":"thread-1"}`, "eve", ""))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 cancelling as stranger, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handleCancelRequest(rec, newCallerRequest(http.MethodPost, "/cancel", `{"thread_id":"thread-1"}`, "alice", ""))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 cancelling as owner, got %d", rec.Code)
+	}
+	if info.Status != "cancelled" {
+		t.Errorf("Expected thread status cancelled, got %q", info.Status)
+	}
+
+	rec = httptest.NewRecorder()
+	handleStoreMessageRequest(rec, newCallerRequest(http.MethodPost, "/storeMessage", `{"thread_id":"thread-1","prompt":"hi"}`, "alice", ""))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 storing to cancelled thread, got %d", rec.Code)
+	}
+}
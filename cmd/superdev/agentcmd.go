@@ -0,0 +1,414 @@
+package superdev
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"superdev/cmd/superdev/client"
+	"superdev/cmd/superdev/tracing"
+
+	"github.com/spf13/cobra"
+)
+
+// agentTokenEnv holds the token shared by the server and its host agents
+const agentTokenEnv = "SUPERDEV_AGENT_TOKEN"
+
+// Timings of the agent loop
+const (
+	agentRetryDelay  = 5 * time.Second // after failing to reach the server
+	logFlushInterval = time.Second     // how often job output is forwarded
+)
+
+// newAgentCmd builds `superdev agent`, which provisions threads on this machine
+// for a server
+func newAgentCmd() *cobra.Command {
+	opts := &threadsOptions{}
+	var (
+		name     string
+		capacity int
+		labels   []string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "Run threads on this machine for a superdev server",
+		Long: `Run threads on this machine for a superdev server.
+
+The agent registers with the server, advertising its capacity and labels, then
+polls for threads to provision on the local Docker daemon and reports back how
+they do. It only makes outgoing requests, so it can run behind NAT. Both sides
+need the same $` + agentTokenEnv + `.`,
+		Args:          cobra.NoArgs,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return opts.validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			token := os.Getenv(agentTokenEnv)
+			if token == "" {
+				return fmt.Errorf("$%s must be set to the server's agent token", agentTokenEnv)
+			}
+			if capacity < 1 {
+				return fmt.Errorf("--capacity must be at least 1")
+			}
+			if name == "" {
+				hostname, err := os.Hostname()
+				if err != nil {
+					return fmt.Errorf("failed to read hostname, set --name: %w", err)
+				}
+				name = hostname
+			}
+			parsed, err := parseLabels(labels)
+			if err != nil {
+				return err
+			}
+
+			agent := &hostAgent{
+				client:   client.New(opts.server, client.WithAgentToken(token)),
+				runtime:  dockerRuntime{},
+				info:     client.RegisterAgentRequest{Name: name, Capacity: capacity, Labels: parsed},
+				pollWait: defaultAgentPollWait,
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return agent.Run(ctx)
+		},
+	}
+
+	addServerFlags(cmd, opts)
+	cmd.PersistentFlags().StringVar(&opts.format, "format", formatTable, "Output format: table or json")
+	cmd.Flags().StringVar(&name, "name", "", "Name to register under (defaults to the hostname)")
+	cmd.Flags().IntVar(&capacity, "capacity", 4, "Threads to run at once")
+	cmd.Flags().StringArrayVar(&labels, "label", nil, "Label as key=value that threads can select this agent by (repeatable)")
+
+	cmd.AddCommand(newAgentListCmd(opts))
+
+	return cmd
+}
+
+func newAgentListCmd(opts *threadsOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:           "list",
+		Short:         "List the agents registered with a server",
+		Args:          cobra.NoArgs,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			list, err := opts.client().ListAgents(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("failed to list agents: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), list)
+			}
+			return writeAgentTable(cmd.OutOrStdout(), list.Agents)
+		},
+	}
+}
+
+// writeAgentTable prints agents as aligned columns
+func writeAgentTable(w io.Writer, agents []client.Agent) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATUS\tTHREADS\tLABELS\tLAST SEEN")
+	for _, agent := range agents {
+		fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%s\t%s\n",
+			agent.Name,
+			agent.Status,
+			len(agent.Threads),
+			agent.Capacity,
+			formatLabels(agent.Labels),
+			agent.LastSeenAt.Local().Format(time.DateTime),
+		)
+	}
+	return tw.Flush()
+}
+
+// parseLabels turns key=value flags into a map
+func parseLabels(flags []string) (map[string]string, error) {
+	if len(flags) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(flags))
+	for _, flag := range flags {
+		key, value, ok := strings.Cut(flag, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("label %q must be key=value", flag)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// Runtime provisions thread containers on an agent's machine
+type Runtime interface {
+	// Start clones the job's repository and starts its container, logging
+	// progress through log. It returns the container ID.
+	Start(ctx context.Context, job client.AgentJob, log logFunc) (string, error)
+	// Wait forwards a container's output to log until it exits
+	Wait(ctx context.Context, containerID string, log logFunc) error
+	// Stop stops a container
+	Stop(ctx context.Context, containerID string) error
+}
+
+// dockerRuntime provisions containers on the local Docker daemon the same way the
+// server does
+type dockerRuntime struct{}
+
+func (dockerRuntime) Start(ctx context.Context, job client.AgentJob, log logFunc) (string, error) {
+	spec := containerSpec{
+		ThreadID:       job.ThreadID,
+		RepositoryLink: job.RepositoryLink,
+		Ref:            job.Ref,
+		DockerImage:    job.DockerImage,
+		ServerURL:      job.ServerURL,
+		ContextFiles:   job.ContextFiles,
+		Guidance:       job.Guidance,
+		Sandbox:        job.Sandbox,
+	}
+	for _, secret := range job.Secrets {
+		spec.Secrets = append(spec.Secrets, threadSecret{Name: secret.Name, Value: secret.Value, Mount: secret.Mount})
+	}
+
+	output, _, err := provisionContainer(tracing.WithTraceParent(ctx, job.TraceParent), spec, log)
+	return strings.TrimSpace(output), err
+}
+
+func (dockerRuntime) Wait(ctx context.Context, containerID string, log logFunc) error {
+	cmd := exec.CommandContext(ctx, "docker", "logs", "-f", containerID)
+	return runLoggedCommand(log, PhaseContainer, cmd, nil)
+}
+
+func (dockerRuntime) Stop(ctx context.Context, containerID string) error {
+	return stopDockerContainer(containerID)
+}
+
+// hostAgent registers with a server and runs the jobs it hands out
+type hostAgent struct {
+	client   *client.Client
+	runtime  Runtime
+	info     client.RegisterAgentRequest
+	pollWait time.Duration
+
+	id   string
+	jobs sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]bool // IDs of the jobs being handled, which the server may hand out again
+}
+
+// Run polls for jobs until ctx is cancelled, registering again whenever the
+// server has forgotten the agent. Containers keep running when the agent stops.
+func (a *hostAgent) Run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		if a.id == "" {
+			agent, err := a.client.RegisterAgent(ctx, a.info)
+			if err != nil {
+				var apiErr *client.Error
+				if errors.As(err, &apiErr) && apiErr.StatusCode < http.StatusInternalServerError {
+					return fmt.Errorf("failed to register with server: %w", err)
+				}
+				slog.Warn("failed to register with server, retrying", "error", err)
+				a.sleep(ctx)
+				continue
+			}
+			a.id = agent.ID
+			slog.Info("registered with server", "agent_id", a.id, "agent", a.info.Name, "capacity", a.info.Capacity)
+		}
+
+		list, err := a.client.PollAgentJobs(ctx, a.id, a.pollWait)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			if client.IsNotFound(err) {
+				slog.Warn("server has forgotten this agent, registering again")
+				a.id = ""
+				continue
+			}
+			slog.Warn("failed to poll for jobs, retrying", "error", err)
+			a.sleep(ctx)
+			continue
+		}
+
+		// Jobs keep the ID they were handed out under; it changes if the server restarts
+		agentID := a.id
+		for _, job := range list.Jobs {
+			a.jobs.Add(1)
+			go func() {
+				defer a.jobs.Done()
+				// Jobs are handed out until they are acknowledged, so a job whose
+				// acknowledgement was lost arrives again while it is running
+				err := a.report(ctx, agentID, job, client.AgentJobUpdate{Status: client.JobStatusAccepted})
+				if client.IsNotFound(err) || !a.claim(job.ID) {
+					return
+				}
+				defer a.release(job.ID)
+				a.handle(ctx, agentID, job)
+			}()
+		}
+	}
+
+	a.jobs.Wait()
+	return nil
+}
+
+// claim marks a job as being handled, reporting false if it already is
+func (a *hostAgent) claim(jobID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running[jobID] {
+		return false
+	}
+	if a.running == nil {
+		a.running = make(map[string]bool)
+	}
+	a.running[jobID] = true
+	return true
+}
+
+// release forgets a job once it has been handled
+func (a *hostAgent) release(jobID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.running, jobID)
+}
+
+// handle runs a single job
+func (a *hostAgent) handle(ctx context.Context, agentID string, job client.AgentJob) {
+	switch job.Kind {
+	case client.AgentJobStart:
+		a.start(ctx, agentID, job)
+	case client.AgentJobStop:
+		if err := a.runtime.Stop(ctx, job.ContainerID); err != nil {
+			slog.Error("failed to stop container", "thread_id", job.ThreadID, "container_id", job.ContainerID, "error", err)
+		}
+	default:
+		slog.Warn("ignoring job of unknown kind", "job_id", job.ID, "kind", job.Kind)
+	}
+}
+
+// start provisions a thread and reports on its container until it exits
+func (a *hostAgent) start(ctx context.Context, agentID string, job client.AgentJob) {
+	logs := a.forwardLogs(ctx, agentID, job.ID)
+	defer logs.close(ctx)
+
+	slog.Info("provisioning thread", "thread_id", job.ThreadID, "job_id", job.ID)
+	containerID, err := a.runtime.Start(ctx, job, logs.log)
+	logs.flush(ctx)
+	if err != nil {
+		slog.Error("failed to provision thread", "thread_id", job.ThreadID, "error", err)
+		a.report(ctx, agentID, job, client.AgentJobUpdate{Status: client.JobStatusFailed, Error: err.Error()})
+		return
+	}
+
+	// A thread cancelled while it was provisioning no longer wants the container
+	if err := a.report(ctx, agentID, job, client.AgentJobUpdate{Status: client.JobStatusStarted, ContainerID: containerID, Image: job.DockerImage}); err != nil {
+		if err := a.runtime.Stop(ctx, containerID); err != nil {
+			slog.Error("failed to stop container", "thread_id", job.ThreadID, "container_id", containerID, "error", err)
+		}
+		return
+	}
+
+	if err := a.runtime.Wait(ctx, containerID, logs.log); err != nil && ctx.Err() == nil {
+		slog.Warn("container log stream ended", "thread_id", job.ThreadID, "container_id", containerID, "error", err)
+	}
+
+	// The container outlives an agent that is shutting down
+	if ctx.Err() != nil {
+		return
+	}
+	logs.flush(ctx)
+	a.report(ctx, agentID, job, client.AgentJobUpdate{Status: client.JobStatusExited, ContainerID: containerID})
+}
+
+// report sends a job update to the server
+func (a *hostAgent) report(ctx context.Context, agentID string, job client.AgentJob, update client.AgentJobUpdate) error {
+	err := a.client.UpdateAgentJob(ctx, agentID, job.ID, update)
+	if err != nil {
+		slog.Error("failed to report job status", "thread_id", job.ThreadID, "job_id", job.ID, "status", update.Status, "error", err)
+	}
+	return err
+}
+
+// sleep waits before retrying, returning early if ctx is cancelled
+func (a *hostAgent) sleep(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(agentRetryDelay):
+	}
+}
+
+// jobLogs batches a job's output and forwards it to the server periodically
+type jobLogs struct {
+	client  *client.Client
+	agentID string
+	jobID   string
+	mu      sync.Mutex
+	entries []client.ThreadLogEntry
+	sending sync.Mutex // keeps batches in order
+	done    chan struct{}
+}
+
+// forwardLogs starts forwarding a job's output until the returned jobLogs is closed
+func (a *hostAgent) forwardLogs(ctx context.Context, agentID, jobID string) *jobLogs {
+	logs := &jobLogs{client: a.client, agentID: agentID, jobID: jobID, done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(logFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				logs.flush(ctx)
+			case <-logs.done:
+				return
+			}
+		}
+	}()
+	return logs
+}
+
+// log is the logFunc handed to the runtime
+func (l *jobLogs) log(phase, stream, message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, client.ThreadLogEntry{Time: time.Now(), Phase: phase, Stream: stream, Message: message})
+}
+
+// flush sends the output collected so far
+func (l *jobLogs) flush(ctx context.Context) {
+	l.sending.Lock()
+	defer l.sending.Unlock()
+
+	l.mu.Lock()
+	entries := l.entries
+	l.entries = nil
+	l.mu.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+
+	if err := l.client.SendAgentJobLogs(ctx, l.agentID, l.jobID, entries); err != nil {
+		slog.Warn("failed to forward job logs", "job_id", l.jobID, "entries", len(entries), "error", err)
+	}
+}
+
+// close stops forwarding after sending what is left
+func (l *jobLogs) close(ctx context.Context) {
+	close(l.done)
+	l.flush(ctx)
+}
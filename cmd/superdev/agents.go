@@ -0,0 +1,500 @@
+package superdev
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"superdev/cmd/superdev/client"
+	"superdev/cmd/superdev/tracing"
+)
+
+// Timings of the agent protocol
+const (
+	agentOfflineAfter    = 90 * time.Second // agents that haven't polled for this long get no new threads
+	defaultAgentPollWait = 30 * time.Second // when a poll doesn't say how long to wait
+	maxAgentPollWait     = 60 * time.Second
+	agentRedeliverAfter  = 30 * time.Second // jobs an agent hasn't acknowledged are handed out again
+)
+
+// agentProvisionTimeout is how long an agent may take to start a thread's
+// container, set by the server command's flags; provisioning never times out if 0
+var agentProvisionTimeout = 15 * time.Minute
+
+var agentNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// errAgentsDisabled is returned by every agent operation when the server has no agent token
+var errAgentsDisabled = newAPIError(http.StatusServiceUnavailable, "Host agents are not enabled on this server")
+
+// AgentPool tracks the host agents provisioning threads on other machines. Agents
+// poll for jobs, so the server never needs to reach them.
+type AgentPool struct {
+	mu      sync.Mutex
+	token   string
+	agents  map[string]*agentRecord // by ID
+	jobs    map[string]*agentJob    // start jobs of threads placed on agents, by job ID
+	threads map[string]*agentJob    // the same jobs by thread ID
+}
+
+// agentRecord is a registered agent and the jobs it hasn't acknowledged yet
+type agentRecord struct {
+	client.Agent
+	pending []pendingJob
+	wake    chan struct{} // closed when jobs are queued
+}
+
+// pendingJob is a job queued for an agent. It is handed out again if the agent
+// doesn't acknowledge it soon after a poll, in case the poll's response was lost.
+type pendingJob struct {
+	client.AgentJob
+	deliveredAt time.Time // zero until a poll hands it out
+}
+
+// agentJob is a thread placed on an agent
+type agentJob struct {
+	id       string
+	threadID string
+	agentID  string
+	result   chan client.AgentJobUpdate // receives whether the container started
+}
+
+// agentPool is nil when the server was started without SUPERDEV_AGENT_TOKEN;
+// every thread then runs on the server's own Docker daemon
+var agentPool *AgentPool
+
+// NewAgentPool creates an empty pool; agents authenticate with token
+func NewAgentPool(token string) *AgentPool {
+	return &AgentPool{
+		token:   token,
+		agents:  make(map[string]*agentRecord),
+		jobs:    make(map[string]*agentJob),
+		threads: make(map[string]*agentJob),
+	}
+}
+
+// authorizeAgent checks a request carries the agent token
+func authorizeAgent(r *http.Request) *apiError {
+	if agentPool == nil {
+		return errAgentsDisabled
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(agentPool.token)) != 1 {
+		return newAPIError(http.StatusUnauthorized, "A valid agent token is required")
+	}
+	return nil
+}
+
+// Register adds an agent, or updates the agent registered under the same name so
+// a restarted agent keeps its identity
+func (p *AgentPool) Register(req client.RegisterAgentRequest) (*client.Agent, *apiError) {
+	if !agentNamePattern.MatchString(req.Name) {
+		return nil, newAPIError(http.StatusBadRequest, "Agent name must be 1-64 letters, digits, '.', '_' or '-'")
+	}
+	if req.Capacity < 1 {
+		return nil, newAPIError(http.StatusBadRequest, "Agent capacity must be at least 1")
+	}
+	for key := range req.Labels {
+		if key == "" {
+			return nil, newAPIError(http.StatusBadRequest, "Agent label names must not be empty")
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var agent *agentRecord
+	for _, existing := range p.agents {
+		if existing.Name == req.Name {
+			agent = existing
+			break
+		}
+	}
+	if agent == nil {
+		id, err := generateThreadID()
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, "Error generating agent ID")
+		}
+		agent = &agentRecord{wake: make(chan struct{})}
+		agent.ID = id
+		agent.Name = req.Name
+		agent.RegisteredAt = now
+		p.agents[id] = agent
+	}
+	agent.Capacity = req.Capacity
+	agent.Labels = req.Labels
+	agent.LastSeenAt = now
+
+	slog.Info("agent registered", "agent_id", agent.ID, "agent", agent.Name, "capacity", agent.Capacity, "labels", agent.Labels)
+	summary := p.summarize(agent, now)
+	return &summary, nil
+}
+
+// List returns every registered agent, sorted by name
+func (p *AgentPool) List() []client.Agent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	agents := make([]client.Agent, 0, len(p.agents))
+	for _, agent := range p.agents {
+		agents = append(agents, p.summarize(agent, now))
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	return agents
+}
+
+// Poll hands an agent its queued jobs, waiting up to wait for some to arrive. Jobs
+// stay queued until the agent acknowledges them, and are handed out again if it
+// hasn't within agentRedeliverAfter.
+func (p *AgentPool) Poll(ctx context.Context, agentID string, wait time.Duration) ([]client.AgentJob, *apiError) {
+	wait = min(wait, maxAgentPollWait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		p.mu.Lock()
+		agent := p.agents[agentID]
+		if agent == nil {
+			p.mu.Unlock()
+			return nil, newAPIError(http.StatusNotFound, "Agent not found; register again")
+		}
+		now := time.Now()
+		agent.LastSeenAt = now
+		var (
+			jobs []client.AgentJob
+			next time.Time // when the next handed out job is due again
+		)
+		for i := range agent.pending {
+			job := &agent.pending[i]
+			due := job.deliveredAt.Add(agentRedeliverAfter)
+			if job.deliveredAt.IsZero() || !now.Before(due) {
+				job.deliveredAt = now
+				jobs = append(jobs, job.AgentJob)
+			} else if next.IsZero() || due.Before(next) {
+				next = due
+			}
+		}
+		wake := agent.wake
+		p.mu.Unlock()
+		if len(jobs) > 0 {
+			return jobs, nil
+		}
+		var retry <-chan time.Time
+		if !next.IsZero() {
+			retry = time.After(next.Sub(now))
+		}
+
+		select {
+		case <-wake:
+		case <-retry:
+		case <-timer.C:
+			return []client.AgentJob{}, nil
+		case <-ctx.Done():
+			return []client.AgentJob{}, nil
+		}
+	}
+}
+
+// Start provisions a thread on an agent. Threads with agent labels must run on an
+// agent carrying them; other threads go to the online agent with the most free
+// capacity. It returns the agent's name and the container ID, or an empty name
+// if the thread should run on this server instead.
+func (p *AgentPool) Start(ctx context.Context, threadID string, req client.StartThreadRequest, secrets []threadSecret) (string, string, error) {
+	p.mu.Lock()
+	agent := p.place(req.AgentLabels, time.Now())
+	if agent == nil {
+		p.mu.Unlock()
+		if len(req.AgentLabels) > 0 {
+			return "", "", fmt.Errorf("no online agent with labels %s has free capacity", formatLabels(req.AgentLabels))
+		}
+		return "", "", nil
+	}
+
+	jobID, err := generateThreadID()
+	if err != nil {
+		p.mu.Unlock()
+		return "", "", fmt.Errorf("failed to generate job ID: %w", err)
+	}
+	job := &agentJob{
+		id:       jobID,
+		threadID: threadID,
+		agentID:  agent.ID,
+		result:   make(chan client.AgentJobUpdate, 1),
+	}
+	p.jobs[jobID] = job
+	p.threads[threadID] = job
+
+	spec := client.AgentJob{
+		ID:             jobID,
+		Kind:           client.AgentJobStart,
+		ThreadID:       threadID,
+		RepositoryLink: req.RepositoryLink,
+		Ref:            req.Ref,
+		DockerImage:    req.DockerImage,
+		ServerURL:      req.ServerURL,
+		ContextFiles:   req.ContextFiles,
+		Guidance:       req.Guidance,
+		Sandbox:        req.Sandbox,
+		TraceParent:    tracing.TraceParent(ctx),
+	}
+	for _, secret := range secrets {
+		spec.Secrets = append(spec.Secrets, client.AgentSecret{Name: secret.Name, Value: secret.Value, Mount: secret.Mount})
+	}
+	p.queue(agent, spec)
+	name := agent.Name
+	p.mu.Unlock()
+
+	appendThreadLog(threadID, PhaseProvision, "", "Provisioning on agent "+name)
+
+	// An agent that stops polling is given up on, as is one that takes too long
+	ticker := time.NewTicker(agentOfflineAfter / 3)
+	defer ticker.Stop()
+	var deadline <-chan time.Time
+	if agentProvisionTimeout > 0 {
+		timer := time.NewTimer(agentProvisionTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		select {
+		case update := <-job.result:
+			if update.Status == client.JobStatusFailed {
+				p.forget(job)
+				return name, "", fmt.Errorf("agent %s failed to provision the thread: %s", name, update.Error)
+			}
+			return name, update.ContainerID, nil
+		case <-ticker.C:
+			if !p.online(job.agentID, time.Now()) {
+				p.forget(job)
+				return name, "", fmt.Errorf("agent %s went offline while provisioning the thread", name)
+			}
+		case <-deadline:
+			p.forget(job)
+			return name, "", fmt.Errorf("agent %s didn't provision the thread within %s", name, agentProvisionTimeout)
+		case <-ctx.Done():
+			p.forget(job)
+			return name, "", ctx.Err()
+		}
+	}
+}
+
+// Stop asks the agent running a thread to stop its container. It reports false if
+// the thread isn't on an agent.
+func (p *AgentPool) Stop(threadID, containerID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	job := p.threads[threadID]
+	if job == nil {
+		return false
+	}
+	agent := p.agents[job.agentID]
+	if agent == nil {
+		return true
+	}
+	jobID, err := generateThreadID()
+	if err != nil {
+		slog.Error("failed to generate job ID", "thread_id", threadID, "error", err)
+		return true
+	}
+	p.queue(agent, client.AgentJob{ID: jobID, Kind: client.AgentJobStop, ThreadID: threadID, ContainerID: containerID})
+	return true
+}
+
+// Update records an agent's report on a job. Any report acknowledges the job, so
+// it isn't handed out again; stop jobs are only ever acknowledged. A container that
+// started after the server gave up on it is refused with a conflict so the agent
+// stops it.
+func (p *AgentPool) Update(agentID, jobID string, update client.AgentJobUpdate) *apiError {
+	p.mu.Lock()
+	acknowledged := false
+	if agent := p.agents[agentID]; agent != nil {
+		acknowledged = p.dequeue(agent, jobID)
+	}
+	if update.Status == client.JobStatusAccepted {
+		_, known := p.jobs[jobID]
+		p.mu.Unlock()
+		if !acknowledged && !known {
+			return newAPIError(http.StatusNotFound, "Job not found")
+		}
+		return nil
+	}
+	job := p.jobs[jobID]
+	if job == nil || job.agentID != agentID {
+		p.mu.Unlock()
+		if update.Status == client.JobStatusStarted {
+			return newAPIError(http.StatusConflict, "The thread no longer wants this container")
+		}
+		return newAPIError(http.StatusNotFound, "Job not found")
+	}
+
+	switch update.Status {
+	case client.JobStatusStarted:
+		if update.ContainerID == "" {
+			p.mu.Unlock()
+			return newAPIError(http.StatusBadRequest, "Started jobs need a container ID")
+		}
+	case client.JobStatusFailed:
+	case client.JobStatusExited:
+		p.removeJob(job)
+		p.mu.Unlock()
+		appendThreadLog(job.threadID, PhaseContainer, "", "Container exited on agent")
+		threadScheduler.Release(job.threadID)
+		return nil
+	default:
+		p.mu.Unlock()
+		return newAPIError(http.StatusBadRequest, "Status must be accepted, started, failed or exited")
+	}
+	p.mu.Unlock()
+
+	select {
+	case job.result <- update:
+	default:
+	}
+	return nil
+}
+
+// Logs appends an agent's output for a job to its thread's log
+func (p *AgentPool) Logs(agentID, jobID string, logs []client.ThreadLogEntry) *apiError {
+	p.mu.Lock()
+	job := p.jobs[jobID]
+	p.mu.Unlock()
+	if job == nil || job.agentID != agentID {
+		return newAPIError(http.StatusNotFound, "Job not found")
+	}
+
+	for _, entry := range logs {
+		appendThreadLog(job.threadID, entry.Phase, entry.Stream, entry.Message)
+	}
+	return nil
+}
+
+// place picks the agent for a thread: the online agent carrying every label with
+// the most free capacity, ties going to the first by name. The caller must hold p.mu.
+func (p *AgentPool) place(labels map[string]string, now time.Time) *agentRecord {
+	var best *agentRecord
+	bestFree := 0
+	for _, agent := range p.agents {
+		if now.Sub(agent.LastSeenAt) > agentOfflineAfter || !hasLabels(agent.Labels, labels) {
+			continue
+		}
+		free := agent.Capacity - p.placed(agent.ID)
+		if free <= 0 {
+			continue
+		}
+		if best == nil || free > bestFree || free == bestFree && agent.Name < best.Name {
+			best, bestFree = agent, free
+		}
+	}
+	return best
+}
+
+// placed counts the threads on an agent. The caller must hold p.mu.
+func (p *AgentPool) placed(agentID string) int {
+	count := 0
+	for _, job := range p.threads {
+		if job.agentID == agentID {
+			count++
+		}
+	}
+	return count
+}
+
+// queue hands a job to an agent's next poll. The caller must hold p.mu.
+func (p *AgentPool) queue(agent *agentRecord, job client.AgentJob) {
+	agent.pending = append(agent.pending, pendingJob{AgentJob: job})
+	close(agent.wake)
+	agent.wake = make(chan struct{})
+}
+
+// dequeue drops a job from an agent's queue, reporting whether it was there. The
+// caller must hold p.mu.
+func (p *AgentPool) dequeue(agent *agentRecord, jobID string) bool {
+	for i, job := range agent.pending {
+		if job.ID == jobID {
+			agent.pending = append(agent.pending[:i], agent.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// online reports whether an agent has polled recently
+func (p *AgentPool) online(agentID string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	agent := p.agents[agentID]
+	return agent != nil && now.Sub(agent.LastSeenAt) <= agentOfflineAfter
+}
+
+// forget drops a start job the server has given up on, freeing the agent's capacity
+func (p *AgentPool) forget(job *agentJob) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removeJob(job)
+}
+
+// removeJob drops a start job, along with its place in the agent's queue if the
+// agent never acknowledged it. The caller must hold p.mu.
+func (p *AgentPool) removeJob(job *agentJob) {
+	if agent := p.agents[job.agentID]; agent != nil {
+		p.dequeue(agent, job.id)
+	}
+	delete(p.jobs, job.id)
+	if p.threads[job.threadID] == job {
+		delete(p.threads, job.threadID)
+	}
+}
+
+// summarize returns an agent's public view. The caller must hold p.mu.
+func (p *AgentPool) summarize(agent *agentRecord, now time.Time) client.Agent {
+	summary := agent.Agent
+	summary.Status = client.AgentStatusOnline
+	if now.Sub(agent.LastSeenAt) > agentOfflineAfter {
+		summary.Status = client.AgentStatusOffline
+	}
+	summary.Threads = []string{}
+	for threadID, job := range p.threads {
+		if job.agentID == agent.ID {
+			summary.Threads = append(summary.Threads, threadID)
+		}
+	}
+	sort.Strings(summary.Threads)
+	return summary
+}
+
+// hasLabels reports whether have carries every label in want
+func hasLabels(have, want map[string]string) bool {
+	for key, value := range want {
+		if got, ok := have[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// formatLabels renders labels as sorted key=value pairs
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// listAgents returns the registered agents; anyone may see them
+func listAgents() ([]client.Agent, *apiError) {
+	if agentPool == nil {
+		return nil, errAgentsDisabled
+	}
+	return agentPool.List(), nil
+}
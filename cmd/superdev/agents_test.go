@@ -0,0 +1,370 @@
+package superdev
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+const testAgentToken = "agent-secret"
+
+// setupAgentPool enables host agents for the test
+func setupAgentPool(t *testing.T) *AgentPool {
+	t.Helper()
+	agentPool = NewAgentPool(testAgentToken)
+	t.Cleanup(func() { agentPool = nil })
+	return agentPool
+}
+
+// fakeRuntime pretends to run containers, which run until they are stopped
+type fakeRuntime struct {
+	name    string
+	mu      sync.Mutex
+	running map[string]chan struct{} // closed when the container stops
+	tokens  map[string]string        // worker token each thread's container got
+}
+
+func newFakeRuntime(name string) *fakeRuntime {
+	return &fakeRuntime{name: name, running: make(map[string]chan struct{}), tokens: make(map[string]string)}
+}
+
+func (f *fakeRuntime) Start(ctx context.Context, job client.AgentJob, log logFunc) (string, error) {
+	log(PhaseClone, "stdout", "Cloning "+job.RepositoryLink+" on "+f.name)
+	if strings.Contains(job.RepositoryLink, "broken") {
+		return "", errors.New("clone failed")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	containerID := f.name + "-" + job.ThreadID
+	f.running[containerID] = make(chan struct{})
+	for _, secret := range job.Secrets {
+		if secret.Name == client.EnvWorkerToken {
+			f.tokens[job.ThreadID] = secret.Value
+		}
+	}
+	return containerID, nil
+}
+
+func (f *fakeRuntime) Wait(ctx context.Context, containerID string, log logFunc) error {
+	f.mu.Lock()
+	stopped := f.running[containerID]
+	f.mu.Unlock()
+	select {
+	case <-stopped:
+		log(PhaseContainer, "stdout", "Worker exiting")
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func (f *fakeRuntime) Stop(ctx context.Context, containerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if stopped, ok := f.running[containerID]; ok {
+		close(stopped)
+		delete(f.running, containerID)
+	}
+	return nil
+}
+
+// startTestAgent runs an agent with a fake runtime against serverURL until the test ends
+func startTestAgent(t *testing.T, serverURL, name string, capacity int, labels map[string]string) *fakeRuntime {
+	t.Helper()
+	runtime := newFakeRuntime(name)
+	agent := &hostAgent{
+		client:   client.New(serverURL, client.WithAgentToken(testAgentToken)),
+		runtime:  runtime,
+		info:     client.RegisterAgentRequest{Name: name, Capacity: capacity, Labels: labels},
+		pollWait: time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- agent.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Agent %s failed: %v", name, err)
+		}
+	})
+	return runtime
+}
+
+// waitFor polls condition until it holds or the test times out
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAgentEndpointsNeedToken(t *testing.T) {
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	register := client.RegisterAgentRequest{Name: "alpha", Capacity: 1}
+
+	_, err := client.New(server.URL).ListAgents(ctx)
+	expectStatus(t, err, http.StatusServiceUnavailable)
+	_, err = client.New(server.URL, client.WithAgentToken(testAgentToken)).RegisterAgent(ctx, register)
+	expectStatus(t, err, http.StatusServiceUnavailable)
+
+	setupAgentPool(t)
+	_, err = client.New(server.URL).RegisterAgent(ctx, register)
+	expectStatus(t, err, http.StatusUnauthorized)
+	_, err = client.New(server.URL, client.WithAgentToken("wrong")).PollAgentJobs(ctx, "any", 0)
+	expectStatus(t, err, http.StatusUnauthorized)
+
+	agents := client.New(server.URL, client.WithAgentToken(testAgentToken))
+	_, err = agents.RegisterAgent(ctx, client.RegisterAgentRequest{Name: "alpha", Capacity: 0})
+	expectStatus(t, err, http.StatusBadRequest)
+	_, err = agents.PollAgentJobs(ctx, "unknown", 0)
+	expectStatus(t, err, http.StatusNotFound)
+
+	// Registering again under the same name keeps the agent's ID
+	first, err := agents.RegisterAgent(ctx, register)
+	if err != nil {
+		t.Fatalf("RegisterAgent failed: %v", err)
+	}
+	register.Capacity = 3
+	second, _ := agents.RegisterAgent(ctx, register)
+	if second.ID != first.ID || second.Capacity != 3 {
+		t.Fatalf("Expected the registration to be updated in place, got %+v then %+v", first, second)
+	}
+	list, err := client.New(server.URL).ListAgents(ctx)
+	if err != nil || len(list.Agents) != 1 || list.Agents[0].Status != client.AgentStatusOnline {
+		t.Fatalf("Expected one online agent, got %+v (%v)", list, err)
+	}
+}
+
+func TestAgentPlacement(t *testing.T) {
+	pool := NewAgentPool(testAgentToken)
+	now := time.Now()
+	for _, req := range []client.RegisterAgentRequest{
+		{Name: "beta", Capacity: 2},
+		{Name: "alpha", Capacity: 2, Labels: map[string]string{"gpu": "true"}},
+		{Name: "gamma", Capacity: 4},
+	} {
+		if _, apiErr := pool.Register(req); apiErr != nil {
+			t.Fatalf("Register failed: %s", apiErr.Message)
+		}
+	}
+	byName := func(name string) *agentRecord {
+		for _, agent := range pool.agents {
+			if agent.Name == name {
+				return agent
+			}
+		}
+		return nil
+	}
+	placedOn := func(labels map[string]string) string {
+		if agent := pool.place(labels, now); agent != nil {
+			return agent.Name
+		}
+		return ""
+	}
+
+	if got := placedOn(nil); got != "gamma" {
+		t.Fatalf("Expected the agent with the most free capacity, got %q", got)
+	}
+	if got := placedOn(map[string]string{"gpu": "true"}); got != "alpha" {
+		t.Fatalf("Expected the labelled agent, got %q", got)
+	}
+
+	// Offline agents and full agents are skipped; ties go to the first by name
+	byName("gamma").LastSeenAt = now.Add(-2 * agentOfflineAfter)
+	if got := placedOn(nil); got != "alpha" {
+		t.Fatalf("Expected alpha to win the tie with beta, got %q", got)
+	}
+	for i, name := range []string{"alpha", "alpha", "beta", "beta"} {
+		job := &agentJob{id: name + string(rune('0'+i)), threadID: "t" + string(rune('0'+i)), agentID: byName(name).ID}
+		pool.jobs[job.id] = job
+		pool.threads[job.threadID] = job
+	}
+	if got := placedOn(nil); got != "" {
+		t.Fatalf("Expected no agent with free capacity, got %q", got)
+	}
+	if got := placedOn(map[string]string{"gpu": "false"}); got != "" {
+		t.Fatalf("Expected no agent with mismatched labels, got %q", got)
+	}
+}
+
+func TestAgentJobsRedeliveredUntilAcknowledged(t *testing.T) {
+	setupDataDir(t)
+	pool := NewAgentPool(testAgentToken)
+	agent, apiErr := pool.Register(client.RegisterAgentRequest{Name: "alpha", Capacity: 1})
+	if apiErr != nil {
+		t.Fatalf("Register failed: %s", apiErr.Message)
+	}
+	ctx := context.Background()
+	poll := func() []client.AgentJob {
+		t.Helper()
+		jobs, apiErr := pool.Poll(ctx, agent.ID, 0)
+		if apiErr != nil {
+			t.Fatalf("Poll failed: %s", apiErr.Message)
+		}
+		return jobs
+	}
+
+	pool.mu.Lock()
+	pool.queue(pool.agents[agent.ID], client.AgentJob{ID: "stop-1", Kind: client.AgentJobStop, ThreadID: "t1", ContainerID: "c1"})
+	pool.mu.Unlock()
+	if jobs := poll(); len(jobs) != 1 || jobs[0].ID != "stop-1" {
+		t.Fatalf("Expected the queued job, got %+v", jobs)
+	}
+	if jobs := poll(); len(jobs) != 0 {
+		t.Fatalf("Expected a job just handed out to wait for its acknowledgement, got %+v", jobs)
+	}
+
+	// A poll whose response was lost leaves the job unacknowledged, so it comes back
+	pool.mu.Lock()
+	pool.agents[agent.ID].pending[0].deliveredAt = time.Now().Add(-agentRedeliverAfter)
+	pool.mu.Unlock()
+	if jobs := poll(); len(jobs) != 1 || jobs[0].ID != "stop-1" {
+		t.Fatalf("Expected the unacknowledged job to be handed out again, got %+v", jobs)
+	}
+	if apiErr := pool.Update(agent.ID, "stop-1", client.AgentJobUpdate{Status: client.JobStatusAccepted}); apiErr != nil {
+		t.Fatalf("Acknowledging the job failed: %s", apiErr.Message)
+	}
+	pool.mu.Lock()
+	pending := len(pool.agents[agent.ID].pending)
+	pool.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("Expected the acknowledged job to leave the queue, %d still pending", pending)
+	}
+	if apiErr := pool.Update(agent.ID, "stop-1", client.AgentJobUpdate{Status: client.JobStatusAccepted}); apiErr == nil || apiErr.Status != http.StatusNotFound {
+		t.Fatalf("Expected acknowledging a finished job to be not found, got %v", apiErr)
+	}
+
+	// An agent that keeps polling but never starts the container is given up on
+	saved := agentProvisionTimeout
+	agentProvisionTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { agentProvisionTimeout = saved })
+	name, containerID, err := pool.Start(ctx, "t2", client.StartThreadRequest{DockerImage: "worker:latest"}, nil)
+	if name != "alpha" || containerID != "" || err == nil || !strings.Contains(err.Error(), "didn't provision the thread within") {
+		t.Fatalf("Expected provisioning on alpha to time out, got %q %q (%v)", name, containerID, err)
+	}
+	pool.mu.Lock()
+	pending = len(pool.agents[agent.ID].pending)
+	placed := pool.placed(agent.ID)
+	pool.mu.Unlock()
+	if pending != 0 || placed != 0 {
+		t.Fatalf("Expected the abandoned job to be dropped, got %d pending and %d placed", pending, placed)
+	}
+}
+
+func TestAgentsRunThreads(t *testing.T) {
+	resetThreads(t)
+	setupDataDir(t)
+	setupAgentPool(t)
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	c := client.New(server.URL, client.WithCaller("alice", ""))
+
+	gpu := startTestAgent(t, server.URL, "alpha", 1, map[string]string{"gpu": "true"})
+	startTestAgent(t, server.URL, "beta", 2, nil)
+	waitFor(t, "both agents to register", func() bool {
+		list, err := c.ListAgents(ctx)
+		return err == nil && len(list.Agents) == 2
+	})
+
+	start := func(repo string, labels map[string]string) *client.Thread {
+		t.Helper()
+		resp, err := c.StartThread(ctx, client.StartThreadRequest{
+			RepositoryLink: repo,
+			DockerImage:    "worker:latest",
+			Prompt:         "hi",
+			AgentLabels:    labels,
+		})
+		if err != nil {
+			t.Fatalf("StartThread failed: %v", err)
+		}
+		thread, err := c.GetThread(ctx, resp.ThreadID, client.GetThreadOptions{})
+		if err != nil {
+			t.Fatalf("GetThread failed: %v", err)
+		}
+		return thread
+	}
+
+	onGPU := start("https://example.com/model.git", map[string]string{"gpu": "true"})
+	if onGPU.Status != client.ThreadStatusRunning || onGPU.Agent != "alpha" || onGPU.ContainerID != "alpha-"+onGPU.ThreadID {
+		t.Fatalf("Expected the thread to run on alpha, got %s on %q in %q", onGPU.Status, onGPU.Agent, onGPU.ContainerID)
+	}
+	outputMutex.Lock()
+	workerToken := threadInfos[onGPU.ThreadID].WorkerToken
+	outputMutex.Unlock()
+	gpu.mu.Lock()
+	passed := gpu.tokens[onGPU.ThreadID]
+	gpu.mu.Unlock()
+	if workerToken == "" || passed != workerToken {
+		t.Fatalf("Expected the container to get the thread's worker token, got %q", passed)
+	}
+	logs, err := c.ThreadLogs(ctx, onGPU.ThreadID, client.ThreadLogsOptions{Phase: PhaseClone})
+	if err != nil || len(logs.Logs) != 1 || logs.Logs[0].Message != "Cloning https://example.com/model.git on alpha" {
+		t.Fatalf("Expected the agent's clone output in the thread's logs, got %+v (%v)", logs, err)
+	}
+
+	// alpha is full, so unlabelled threads go to beta and labelled ones fail
+	other := start("https://example.com/app.git", nil)
+	if other.Agent != "beta" {
+		t.Fatalf("Expected the thread to run on beta, got %q", other.Agent)
+	}
+	full := start("https://example.com/model.git", map[string]string{"gpu": "true"})
+	if full.Status != client.ThreadStatusFailed {
+		t.Fatalf("Expected the thread to fail without a free gpu agent, got %s", full.Status)
+	}
+	broken := start("https://example.com/broken.git", nil)
+	if broken.Status != client.ThreadStatusFailed || broken.Agent != "beta" {
+		t.Fatalf("Expected the agent's provisioning failure to fail the thread, got %s on %q", broken.Status, broken.Agent)
+	}
+
+	// Cancelling stops the container on its agent, which reports it exited
+	if _, err := c.CancelThread(ctx, onGPU.ThreadID); err != nil {
+		t.Fatalf("CancelThread failed: %v", err)
+	}
+	waitFor(t, "alpha to free its slot", func() bool {
+		list, _ := c.ListAgents(ctx)
+		return len(list.Agents) == 2 && len(list.Agents[0].Threads) == 0 && len(list.Agents[1].Threads) == 1
+	})
+	gpu.mu.Lock()
+	remaining := len(gpu.running)
+	gpu.mu.Unlock()
+	if remaining != 0 {
+		t.Fatalf("Expected alpha's container to be stopped, %d still running", remaining)
+	}
+	waitFor(t, "the exit to be logged", func() bool {
+		logs, _ := c.ThreadLogs(ctx, onGPU.ThreadID, client.ThreadLogsOptions{Phase: PhaseContainer})
+		return logs != nil && len(logs.Logs) == 2 && logs.Logs[0].Message == "Worker exiting"
+	})
+
+	if again := start("https://example.com/model.git", map[string]string{"gpu": "true"}); again.Agent != "alpha" {
+		t.Fatalf("Expected the freed agent to take a new thread, got %s on %q", again.Status, again.Agent)
+	}
+}
+
+func TestStartThreadAgentLabelsNeedAgents(t *testing.T) {
+	resetThreads(t)
+	req := client.StartThreadRequest{RepositoryLink: "https://example.com/repo.git", DockerImage: "worker:latest", AgentLabels: map[string]string{"gpu": "true"}}
+	if _, apiErr := startThread(context.Background(), Caller{User: "alice"}, req); apiErr == nil || apiErr.Status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected agent labels to need agents, got %+v", apiErr)
+	}
+
+	setupAgentPool(t)
+	req.DockerImage = ""
+	if _, apiErr := startThread(context.Background(), Caller{User: "alice"}, req); apiErr == nil || apiErr.Status != http.StatusBadRequest {
+		t.Fatalf("Expected dev container threads to be refused on agents, got %+v", apiErr)
+	}
+}
@@ -0,0 +1,678 @@
+package superdev
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+// openAPISpec documents the /v1 API
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// maxRequestBody limits the size of /v1 request bodies
+const maxRequestBody = 32 << 20
+
+// apiError is an error with the HTTP status and machine readable code to report it with
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// newAPIError creates an error whose code is derived from its HTTP status
+func newAPIError(status int, message string) *apiError {
+	return &apiError{Status: status, Code: errorCode(status), Message: message}
+}
+
+// errorCode maps an HTTP status to the code reported in JSON error bodies
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "too_many_requests"
+	case http.StatusServiceUnavailable:
+		return "service_unavailable"
+	default:
+		return "internal_error"
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError writes err as a JSON error body
+func writeAPIError(w http.ResponseWriter, err *apiError) {
+	writeJSON(w, err.Status, client.ErrorResponse{
+		Error: &client.Error{StatusCode: err.Status, Code: err.Code, Message: err.Message},
+	})
+}
+
+// decodeJSON reads a JSON request body into v, writing a JSON error on failure
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	defer r.Body.Close()
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if err := decoder.Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			writeAPIError(w, newAPIError(http.StatusRequestEntityTooLarge, "Request body too large"))
+		case errors.Is(err, io.EOF):
+			writeAPIError(w, newAPIError(http.StatusBadRequest, "Request body is empty"))
+		default:
+			writeAPIError(w, newAPIError(http.StatusBadRequest, "Error parsing JSON: "+err.Error()))
+		}
+		return false
+	}
+
+	return true
+}
+
+// registerV1Routes registers the versioned API. Routes use method and path patterns,
+// IDs are path segments and every error is a JSON ErrorResponse.
+func registerV1Routes(mux *http.ServeMux) {
+	// Threads
+	handleFunc(mux, "POST /v1/threads", handleV1StartThread)
+	handleFunc(mux, "GET /v1/threads", handleV1ListThreads)
+	handleFunc(mux, "GET /v1/threads/{id}", handleV1GetThread)
+	handleFunc(mux, "POST /v1/threads/{id}/messages", handleV1StoreMessage)
+	handleFunc(mux, "POST /v1/threads/{id}/cancel", handleV1CancelThread)
+	handleFunc(mux, "POST /v1/threads/{id}/fork", handleV1ForkThread)
+	handleFunc(mux, "GET /v1/threads/{id}/snapshots", handleV1ListSnapshots)
+	handleFunc(mux, "GET /v1/threads/{id}/snapshots/diff", handleV1DiffSnapshots)
+	handleFunc(mux, "POST /v1/threads/{id}/snapshots/restore", handleV1RestoreSnapshot)
+	handleFunc(mux, "GET /v1/threads/{id}/approvals", handleV1ListApprovals)
+	handleFunc(mux, "POST /v1/threads/{id}/approvals/{approval}/decision", handleV1DecideApproval)
+	handleFunc(mux, "GET /v1/threads/{id}/logs", handleThreadLogsRequest)
+
+	// Token usage and cost
+	handleFunc(mux, "GET /v1/usage", handleV1Usage)
+
+	// Worker endpoints, which require the thread's worker token
+	handleFunc(mux, "GET /v1/threads/{id}/messages/pending", handleV1PullMessages)
+	handleFunc(mux, "POST /v1/threads/{id}/responses", handleV1AnswerMessage)
+	handleFunc(mux, "GET /v1/threads/{id}/workspace", handleV1ThreadWorkspace)
+	handleFunc(mux, "POST /v1/threads/{id}/approvals", handleV1RequestApproval)
+	handleFunc(mux, "GET /v1/threads/{id}/approvals/{approval}", handleV1GetApproval)
+	handleFunc(mux, "GET /v1/threads/{id}/tool-policy", handleV1ThreadToolPolicy)
+
+	// Sharing
+	handleFunc(mux, "POST /v1/threads/{id}/shares", handleV1CreateShare)
+	handleFunc(mux, "DELETE /v1/threads/{id}/shares/{token}", handleV1RevokeShare)
+
+	// Secrets
+	handleFunc(mux, "GET /v1/secrets", handleV1ListSecrets)
+	handleFunc(mux, "POST /v1/secrets", handleV1StoreSecret)
+	handleFunc(mux, "DELETE /v1/secrets/{name}", handleV1DeleteSecret)
+
+	// Images
+	handleFunc(mux, "GET /v1/images", handleV1ListImages)
+	handleFunc(mux, "POST /v1/images", handleV1BuildImage)
+	handleFunc(mux, "GET /v1/images/builds/{id}", handleV1GetImageBuild)
+	handleFunc(mux, "GET /v1/images/builds/{id}/logs", handleV1ImageBuildLogs)
+	handleFunc(mux, "GET /v1/images/{hash}", handleV1GetImage)
+	handleFunc(mux, "PUT /v1/images/{hash}", handleV1RegisterImage)
+	handleFunc(mux, "DELETE /v1/images/{hash}", handleV1DeleteImage)
+
+	// Templates
+	handleFunc(mux, "GET /v1/templates", handleV1ListTemplates)
+	handleFunc(mux, "GET /v1/templates/{name}", handleV1GetTemplate)
+	handleFunc(mux, "PUT /v1/templates/{name}", handleV1StoreTemplate)
+	handleFunc(mux, "DELETE /v1/templates/{name}", handleV1DeleteTemplate)
+
+	// Host agents
+	handleFunc(mux, "GET /v1/agents", handleV1ListAgents)
+	handleFunc(mux, "POST /v1/agents", handleV1RegisterAgent)
+	handleFunc(mux, "GET /v1/agents/{id}/jobs", handleV1PollAgentJobs)
+	handleFunc(mux, "POST /v1/agents/{id}/jobs/{job}/status", handleV1UpdateAgentJob)
+	handleFunc(mux, "POST /v1/agents/{id}/jobs/{job}/logs", handleV1AgentJobLogs)
+
+	handleFunc(mux, "GET /v1/openapi.json", handleV1OpenAPI)
+
+	// CORS preflight for every route, and JSON errors for unknown ones
+	handleFunc(mux, "OPTIONS /v1/", func(w http.ResponseWriter, r *http.Request) {})
+	handleFunc(mux, "/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, newAPIError(http.StatusNotFound, "No route for "+r.Method+" "+r.URL.Path))
+	})
+}
+
+func handleV1StartThread(w http.ResponseWriter, r *http.Request) {
+	var req client.StartThreadRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	threadID, apiErr := startThread(r.Context(), callerFromRequest(r), req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/threads/"+threadID)
+	writeJSON(w, http.StatusCreated, client.StartThreadResponse{ThreadID: threadID})
+}
+
+func handleV1ListThreads(w http.ResponseWriter, r *http.Request) {
+	query, apiErr := threadQueryFromRequest(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if query.Sort == "" {
+		query.Sort = "-" + SortCreated
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultThreadPageSize
+	}
+
+	list, apiErr := listThreads(callerFromRequest(r), query)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleV1GetThread(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil {
+			writeAPIError(w, newAPIError(http.StatusBadRequest, "limit must be a non-negative integer"))
+			return
+		}
+	}
+
+	thread, apiErr := getThread(r, r.PathValue("id"), r.URL.Query().Get("after"), limit)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, thread)
+}
+
+func handleV1StoreMessage(w http.ResponseWriter, r *http.Request) {
+	var req client.StoreMessageRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	messageID, apiErr := storeMessage(r, r.PathValue("id"), req.Prompt)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, client.MessageResponse{MessageID: messageID})
+}
+
+func handleV1CancelThread(w http.ResponseWriter, r *http.Request) {
+	threadID := r.PathValue("id")
+	if apiErr := cancelThread(r, threadID); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, client.CancelResponse{ThreadID: threadID, Status: "cancelled"})
+}
+
+func handleV1PullMessages(w http.ResponseWriter, r *http.Request) {
+	if apiErr := authorizeWorker(r, r.PathValue("id")); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	messages := pullMessages(r.PathValue("id"), r.URL.Query().Get("after"))
+	if messages == nil {
+		messages = []client.Message{}
+	}
+	writeJSON(w, http.StatusOK, client.MessageList{Messages: messages})
+}
+
+func handleV1AnswerMessage(w http.ResponseWriter, r *http.Request) {
+	if apiErr := authorizeWorker(r, r.PathValue("id")); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	var req client.AnswerMessageRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	messageID, apiErr := answerMessage(r.PathValue("id"), req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, client.MessageResponse{MessageID: messageID})
+}
+
+func handleV1ForkThread(w http.ResponseWriter, r *http.Request) {
+	// The body is optional; without one the fork just waits for messages
+	var req client.ForkThreadRequest
+	if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+		return
+	}
+
+	threadID, apiErr := forkThread(r, r.PathValue("id"), r.URL.Query().Get("at"), req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/threads/"+threadID)
+	writeJSON(w, http.StatusCreated, client.StartThreadResponse{ThreadID: threadID})
+}
+
+func handleV1ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	list, apiErr := listSnapshots(r, r.PathValue("id"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleV1DiffSnapshots(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	diff, apiErr := diffSnapshots(r, r.PathValue("id"), query.Get("from"), query.Get("to"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, diff)
+}
+
+func handleV1RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	messageID, apiErr := restoreSnapshot(r, r.PathValue("id"), r.URL.Query().Get("at"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, client.MessageResponse{MessageID: messageID})
+}
+
+func handleV1ThreadWorkspace(w http.ResponseWriter, r *http.Request) {
+	if apiErr := authorizeWorker(r, r.PathValue("id")); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	snapshot, apiErr := threadWorkspace(r.PathValue("id"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func handleV1ListApprovals(w http.ResponseWriter, r *http.Request) {
+	list, apiErr := listApprovals(r, r.PathValue("id"), r.URL.Query().Get("status"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleV1DecideApproval(w http.ResponseWriter, r *http.Request) {
+	var req client.ApprovalDecision
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	approval, apiErr := decideApproval(r, r.PathValue("id"), r.PathValue("approval"), req.Approved)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, approval)
+}
+
+func handleV1RequestApproval(w http.ResponseWriter, r *http.Request) {
+	if apiErr := authorizeWorker(r, r.PathValue("id")); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	var req client.RequestApprovalRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	threadID := r.PathValue("id")
+	approval, apiErr := requestApproval(threadID, req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	w.Header().Set("Location", "/v1/threads/"+threadID+"/approvals/"+approval.ID)
+	writeJSON(w, http.StatusCreated, approval)
+}
+
+func handleV1GetApproval(w http.ResponseWriter, r *http.Request) {
+	if apiErr := authorizeWorker(r, r.PathValue("id")); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	approval, apiErr := getApproval(r.PathValue("id"), r.PathValue("approval"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, approval)
+}
+
+func handleV1ThreadToolPolicy(w http.ResponseWriter, r *http.Request) {
+	if apiErr := authorizeWorker(r, r.PathValue("id")); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	policy, apiErr := threadToolPolicy(r.PathValue("id"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, policy)
+}
+
+func handleV1Usage(w http.ResponseWriter, r *http.Request) {
+	since, err := parseQueryTime(r.URL.Query().Get("since"))
+	if err != nil {
+		writeAPIError(w, newAPIError(http.StatusBadRequest, "since must be an RFC 3339 time or a YYYY-MM-DD date"))
+		return
+	}
+
+	report, apiErr := usageReport(callerFromRequest(r), r.URL.Query().Get("group_by"), since)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func handleV1CreateShare(w http.ResponseWriter, r *http.Request) {
+	var req client.ShareRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	share, apiErr := createShareLink(r, r.PathValue("id"), req.Role)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, share)
+}
+
+func handleV1RevokeShare(w http.ResponseWriter, r *http.Request) {
+	if apiErr := revokeShareLink(r, r.PathValue("id"), r.PathValue("token")); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleV1ListSecrets(w http.ResponseWriter, r *http.Request) {
+	secrets, apiErr := listSecrets(callerFromRequest(r))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, client.SecretList{Secrets: secrets})
+}
+
+func handleV1StoreSecret(w http.ResponseWriter, r *http.Request) {
+	var req client.StoreSecretRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if apiErr := storeSecret(callerFromRequest(r), req); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]string{"name": req.Name})
+}
+
+func handleV1DeleteSecret(w http.ResponseWriter, r *http.Request) {
+	if apiErr := deleteSecret(callerFromRequest(r), r.PathValue("name")); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleV1ListImages(w http.ResponseWriter, r *http.Request) {
+	images, apiErr := listImages()
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, client.ImageList{Images: images})
+}
+
+func handleV1GetImage(w http.ResponseWriter, r *http.Request) {
+	image, apiErr := getImage(r.PathValue("hash"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, image)
+}
+
+func handleV1RegisterImage(w http.ResponseWriter, r *http.Request) {
+	var req client.RegisterImageRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	image, apiErr := registerImage(callerFromRequest(r), r.PathValue("hash"), req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, image)
+}
+
+func handleV1DeleteImage(w http.ResponseWriter, r *http.Request) {
+	if apiErr := deleteImage(callerFromRequest(r), r.PathValue("hash")); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleV1ListTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, apiErr := listTemplates(callerFromRequest(r))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, client.TemplateList{Templates: templates})
+}
+
+func handleV1GetTemplate(w http.ResponseWriter, r *http.Request) {
+	template, apiErr := getTemplate(callerFromRequest(r), r.PathValue("name"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, template)
+}
+
+func handleV1StoreTemplate(w http.ResponseWriter, r *http.Request) {
+	var req client.TemplateSettings
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	template, apiErr := storeTemplate(callerFromRequest(r), r.PathValue("name"), req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, template)
+}
+
+func handleV1DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	if apiErr := deleteTemplate(callerFromRequest(r), r.PathValue("name")); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleV1ListAgents(w http.ResponseWriter, r *http.Request) {
+	agents, apiErr := listAgents()
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, client.AgentList{Agents: agents})
+}
+
+func handleV1RegisterAgent(w http.ResponseWriter, r *http.Request) {
+	if apiErr := authorizeAgent(r); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	var req client.RegisterAgentRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	agent, apiErr := agentPool.Register(req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, agent)
+}
+
+func handleV1PollAgentJobs(w http.ResponseWriter, r *http.Request) {
+	if apiErr := authorizeAgent(r); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	wait := defaultAgentPollWait
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		if wait, err = time.ParseDuration(value); err != nil || wait < 0 {
+			writeAPIError(w, newAPIError(http.StatusBadRequest, "wait must be a non-negative duration such as 30s"))
+			return
+		}
+	}
+
+	jobs, apiErr := agentPool.Poll(r.Context(), r.PathValue("id"), wait)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, client.AgentJobList{Jobs: jobs})
+}
+
+func handleV1UpdateAgentJob(w http.ResponseWriter, r *http.Request) {
+	if apiErr := authorizeAgent(r); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	var update client.AgentJobUpdate
+	if !decodeJSON(w, r, &update) {
+		return
+	}
+
+	if apiErr := agentPool.Update(r.PathValue("id"), r.PathValue("job"), update); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleV1AgentJobLogs(w http.ResponseWriter, r *http.Request) {
+	if apiErr := authorizeAgent(r); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	var req client.AgentJobLogs
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if apiErr := agentPool.Logs(r.PathValue("id"), r.PathValue("job"), req.Logs); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleV1OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,373 @@
+package superdev
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"superdev/cmd/superdev/client"
+)
+
+// doV1Request sends a request to the test server as the given user
+func doV1Request(t *testing.T, server *httptest.Server, method, path, body, user string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if user != "" {
+		req.Header.Set(userHeader, user)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// doWorkerRequest sends a request to a worker endpoint with the thread's worker token
+func doWorkerRequest(t *testing.T, server *httptest.Server, method, path, body, threadID string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer worker-"+threadID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// expectAPIError checks that resp is a JSON error with the given status and code
+func expectAPIError(t *testing.T, resp *http.Response, status int, code string) {
+	t.Helper()
+	if resp.StatusCode != status {
+		t.Fatalf("Expected status %d, got %d", status, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Expected JSON error, got content type %q", ct)
+	}
+	var body client.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode error body: %v", err)
+	}
+	if body.Error == nil || body.Error.Code != code || body.Error.Message == "" {
+		t.Fatalf("Expected error code %q with a message, got %+v", code, body.Error)
+	}
+}
+
+func TestV1MessageFlow(t *testing.T) {
+	resetThreads(t)
+	addTestThread("thread-1", "alice", "")
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	resp := doV1Request(t, server, http.MethodPost, "/v1/threads/thread-1/messages", `{"prompt":"fix the bug"}`, "alice")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 storing message, got %d", resp.StatusCode)
+	}
+	var stored client.MessageResponse
+	json.NewDecoder(resp.Body).Decode(&stored)
+	if stored.MessageID == "" {
+		t.Fatal("Expected a message ID")
+	}
+
+	// Only the thread's worker may pull its messages
+	resp = doV1Request(t, server, http.MethodGet, "/v1/threads/thread-1/messages/pending?after=1", "", "alice")
+	expectAPIError(t, resp, http.StatusUnauthorized, "unauthorized")
+
+	// The worker pulls everything after the initial message
+	resp = doWorkerRequest(t, server, http.MethodGet, "/v1/threads/thread-1/messages/pending?after=1", "", "thread-1")
+	var pending struct {
+		Messages []client.Message `json:"messages"`
+	}
+	json.NewDecoder(resp.Body).Decode(&pending)
+	if len(pending.Messages) != 1 || pending.Messages[0].Content != "fix the bug" {
+		t.Fatalf("Expected the stored prompt to be pending, got %+v", pending.Messages)
+	}
+
+	resp = doWorkerRequest(t, server, http.MethodPost, "/v1/threads/thread-1/responses", `{"payload":"done"}`, "thread-1")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 answering, got %d", resp.StatusCode)
+	}
+
+	resp = doV1Request(t, server, http.MethodGet, "/v1/threads/thread-1", "", "alice")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 reading thread, got %d", resp.StatusCode)
+	}
+	var thread client.Thread
+	json.NewDecoder(resp.Body).Decode(&thread)
+	if thread.ThreadID != "thread-1" || len(thread.Messages) != 3 {
+		t.Fatalf("Expected 3 messages in thread-1, got %+v", thread)
+	}
+	if last := thread.Messages[2]; last.Direction != "output" || last.Output != "done" {
+		t.Fatalf("Expected the worker's answer last, got %+v", last)
+	}
+
+	// The legacy route serves the same messages, encoded once
+	resp = doV1Request(t, server, http.MethodGet, "/output?thread_id=thread-1", "", "alice")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected legacy /output to keep working, got %d", resp.StatusCode)
+	}
+	var legacy struct {
+		ThreadID string                 `json:"thread_id"`
+		Thread   []client.ThreadMessage `json:"thread"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&legacy); err != nil {
+		t.Fatalf("Expected /output to return the messages as JSON: %v", err)
+	}
+	if legacy.ThreadID != "thread-1" || len(legacy.Thread) != 3 || legacy.Thread[2].Output != "done" {
+		t.Fatalf("Expected the same 3 messages from /output, got %+v", legacy)
+	}
+}
+
+func TestV1ThreadDocument(t *testing.T) {
+	resetThreads(t)
+	info := addTestThread("thread-1", "alice", "")
+	info.Title = "Fix the bug"
+	info.Repository = "https://github.com/sourcegraph/amp.git"
+	info.Image = "superdev-wrapped-image"
+
+	outputMutex.Lock()
+	for _, id := range []string{"2", "3", "4"} {
+		threads["thread-1"] = append(threads["thread-1"], &client.ThreadMessage{ID: id, Direction: client.DirectionOutput, Output: "output " + id})
+	}
+	outputMutex.Unlock()
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	resp := doV1Request(t, server, http.MethodGet, "/v1/threads/thread-1?after=1&limit=2", "", "alice")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+
+	// Decode loosely to check the field names on the wire
+	var doc map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&doc)
+	for field, want := range map[string]interface{}{
+		"title":         "Fix the bug",
+		"repository":    "https://github.com/sourcegraph/amp.git",
+		"image":         "superdev-wrapped-image",
+		"status":        client.ThreadStatusRunning,
+		"container_id":  "container-thread-1",
+		"message_count": float64(4),
+		"has_more":      true,
+	} {
+		if doc[field] != want {
+			t.Errorf("Expected %s to be %v, got %v", field, want, doc[field])
+		}
+	}
+
+	messages, _ := doc["messages"].([]interface{})
+	if len(messages) != 2 {
+		t.Fatalf("Expected a page of 2 messages, got %d", len(messages))
+	}
+	first := messages[0].(map[string]interface{})
+	if first["id"] != "2" || first["direction"] != "output" || first["output"] != "output 2" {
+		t.Fatalf("Expected message 2 with JSON field names, got %v", first)
+	}
+
+	resp = doV1Request(t, server, http.MethodGet, "/v1/threads/thread-1?after=3", "", "alice")
+	var rest client.Thread
+	json.NewDecoder(resp.Body).Decode(&rest)
+	if len(rest.Messages) != 1 || rest.Messages[0].ID != "4" || rest.HasMore {
+		t.Fatalf("Expected only message 4 after 3, got %+v", rest)
+	}
+
+	resp = doV1Request(t, server, http.MethodGet, "/v1/threads/thread-1?after=missing", "", "alice")
+	expectAPIError(t, resp, http.StatusBadRequest, "bad_request")
+}
+
+func TestThreadTitle(t *testing.T) {
+	if got := threadTitle("  Fix the login bug\nIt fails on Safari"); got != "Fix the login bug" {
+		t.Errorf("Expected the first line, got %q", got)
+	}
+	if got := threadTitle(strings.Repeat("a", 100)); len(got) != maxTitleLength+3 {
+		t.Errorf("Expected a truncated title, got %q", got)
+	}
+}
+
+func TestV1ErrorsAreJSON(t *testing.T) {
+	resetThreads(t)
+	addTestThread("thread-1", "alice", "")
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		user   string
+		status int
+		code   string
+	}{
+		{"unknown thread", http.MethodGet, "/v1/threads/missing", "", "alice", http.StatusNotFound, "not_found"},
+		{"hidden thread", http.MethodGet, "/v1/threads/thread-1", "", "eve", http.StatusNotFound, "not_found"},
+		{"invalid JSON", http.MethodPost, "/v1/threads/thread-1/messages", `{`, "alice", http.StatusBadRequest, "bad_request"},
+		{"empty body", http.MethodPost, "/v1/threads", "", "alice", http.StatusBadRequest, "bad_request"},
+		{"missing repository", http.MethodPost, "/v1/threads", `{"docker_image":"x"}`, "alice", http.StatusBadRequest, "bad_request"},
+		{"secrets disabled", http.MethodGet, "/v1/secrets", "", "alice", http.StatusServiceUnavailable, "service_unavailable"},
+		{"unknown route", http.MethodGet, "/v1/nope", "", "alice", http.StatusNotFound, "not_found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := doV1Request(t, server, tt.method, tt.path, tt.body, tt.user)
+			expectAPIError(t, resp, tt.status, tt.code)
+		})
+	}
+
+	// Legacy routes keep their plain text errors
+	resp := doV1Request(t, server, http.MethodGet, "/output?thread_id=missing", "", "alice")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusNotFound || strings.HasPrefix(string(body), "{") {
+		t.Fatalf("Expected plain text 404 from legacy route, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestV1ShareLinks(t *testing.T) {
+	resetThreads(t)
+	addTestThread("thread-1", "alice", "")
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	resp := doV1Request(t, server, http.MethodPost, "/v1/threads/thread-1/shares", `{"role":"read"}`, "bob")
+	expectAPIError(t, resp, http.StatusNotFound, "not_found")
+
+	resp = doV1Request(t, server, http.MethodPost, "/v1/threads/thread-1/shares", `{"role":"read"}`, "alice")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 creating share, got %d", resp.StatusCode)
+	}
+	var share client.ShareResponse
+	json.NewDecoder(resp.Body).Decode(&share)
+
+	resp = doV1Request(t, server, http.MethodGet, share.URL, "", "bob")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected share URL to grant access, got %d", resp.StatusCode)
+	}
+
+	resp = doV1Request(t, server, http.MethodDelete, "/v1/threads/thread-1/shares/"+share.Token, "", "alice")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 revoking share, got %d", resp.StatusCode)
+	}
+
+	resp = doV1Request(t, server, http.MethodGet, share.URL, "", "bob")
+	expectAPIError(t, resp, http.StatusNotFound, "not_found")
+}
+
+func TestV1OpenAPIDocument(t *testing.T) {
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	resp := doV1Request(t, server, http.MethodGet, "/v1/openapi.json", "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("Failed to decode OpenAPI document: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Fatalf("Expected an OpenAPI 3 document, got %q", doc.OpenAPI)
+	}
+
+	// Every registered /v1 route should be documented
+	for _, path := range []string{
+		"/v1/threads",
+		"/v1/threads/{id}",
+		"/v1/threads/{id}/messages",
+		"/v1/threads/{id}/messages/pending",
+		"/v1/threads/{id}/responses",
+		"/v1/threads/{id}/cancel",
+		"/v1/threads/{id}/fork",
+		"/v1/threads/{id}/snapshots",
+		"/v1/threads/{id}/snapshots/diff",
+		"/v1/threads/{id}/snapshots/restore",
+		"/v1/threads/{id}/workspace",
+		"/v1/threads/{id}/approvals",
+		"/v1/threads/{id}/tool-policy",
+		"/v1/threads/{id}/approvals/{approval}",
+		"/v1/threads/{id}/approvals/{approval}/decision",
+		"/v1/threads/{id}/logs",
+		"/v1/threads/{id}/shares",
+		"/v1/threads/{id}/shares/{token}",
+		"/v1/usage",
+		"/v1/secrets",
+		"/v1/secrets/{name}",
+		"/v1/images",
+		"/v1/images/{hash}",
+		"/v1/images/builds/{id}",
+		"/v1/images/builds/{id}/logs",
+		"/v1/templates",
+		"/v1/templates/{name}",
+		"/v1/agents",
+		"/v1/agents/{id}/jobs",
+		"/v1/agents/{id}/jobs/{job}/status",
+		"/v1/agents/{id}/jobs/{job}/logs",
+	} {
+		if _, ok := doc.Paths[path]; !ok {
+			t.Errorf("Expected %s to be documented", path)
+		}
+	}
+}
+
+func TestClientAgainstServer(t *testing.T) {
+	resetThreads(t)
+	addTestThread("thread-1", "alice", "")
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	ctx := context.Background()
+	alice := client.New(server.URL, client.WithCaller("alice", ""))
+	worker := workerClient(server.URL, "thread-1")
+
+	if _, err := alice.SendMessage(ctx, "thread-1", "fix the bug"); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	pending, err := worker.PullMessages(ctx, "thread-1", "1")
+	if err != nil || len(pending) != 1 || pending[0].Content != "fix the bug" {
+		t.Fatalf("Expected the stored prompt to be pending, got %+v, %v", pending, err)
+	}
+
+	if _, err := worker.AnswerMessage(ctx, "thread-1", client.AnswerMessageRequest{Payload: "done"}); err != nil {
+		t.Fatalf("AnswerMessage failed: %v", err)
+	}
+
+	thread, err := alice.GetThread(ctx, "thread-1", client.GetThreadOptions{})
+	if err != nil || len(thread.Messages) != 3 || thread.Messages[2].Output != "done" {
+		t.Fatalf("Expected the answer in the thread, got %+v, %v", thread, err)
+	}
+
+	list, err := alice.ListThreads(ctx, client.ListThreadsOptions{Owner: "me"})
+	if err != nil || len(list.Threads) != 1 || list.Threads[0].Messages != 3 {
+		t.Fatalf("Expected thread-1 in alice's threads, got %+v, %v", list, err)
+	}
+
+	_, err = client.New(server.URL, client.WithCaller("eve", "")).GetThread(ctx, "thread-1", client.GetThreadOptions{})
+	if !client.IsNotFound(err) {
+		t.Fatalf("Expected not found for eve, got %v", err)
+	}
+
+	if _, err := alice.CancelThread(ctx, "thread-1"); err != nil {
+		t.Fatalf("CancelThread failed: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package superdev
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+// approvalTimeout is how long a tool run waits for a human before it is
+// rejected, set by the server command's flags; approvals don't expire if 0
+var approvalTimeout = 30 * time.Minute
+
+// requestApproval records a tool run a thread's worker is waiting for a human
+// to approve, or the decision its tool policy made. A tool use that already has
+// an approval gets it back, so a restarted worker keeps waiting on the same
+// decision.
+func requestApproval(threadID string, req client.RequestApprovalRequest) (*client.ToolApproval, *apiError) {
+	if req.ToolUseID == "" || req.Tool == "" {
+		return nil, newAPIError(http.StatusBadRequest, "tool_use_id and tool are required")
+	}
+	if req.Decision != "" && req.Decision != client.ApprovalApproved && req.Decision != client.ApprovalRejected {
+		return nil, newAPIError(http.StatusBadRequest, "decision must be approved or rejected")
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	info := threadInfos[threadID]
+	if info == nil {
+		return nil, newAPIError(http.StatusNotFound, "Thread not found")
+	}
+	expireApprovals(info)
+	for _, approval := range info.Approvals {
+		if approval.ToolUseID == req.ToolUseID {
+			copied := *approval
+			return &copied, nil
+		}
+	}
+
+	approval := &client.ToolApproval{
+		ID:        strconv.Itoa(len(info.Approvals) + 1),
+		ToolUseID: req.ToolUseID,
+		Tool:      req.Tool,
+		Input:     req.Input,
+		Status:    client.ApprovalPending,
+		CreatedAt: time.Now(),
+		Reason:    req.Reason,
+	}
+	if req.Decision != "" {
+		approval.Status = req.Decision
+		approval.DecidedBy = client.PolicyDecider
+		approval.DecidedAt = approval.CreatedAt
+		policyDecisions.WithLabelValues(req.Decision).Inc()
+	} else {
+		if approvalTimeout > 0 {
+			approval.ExpiresAt = approval.CreatedAt.Add(approvalTimeout)
+		}
+		approvalsRequested.Inc()
+	}
+	info.Approvals = append(info.Approvals, approval)
+
+	copied := *approval
+	return &copied, nil
+}
+
+// getApproval returns one of a thread's tool approvals for its worker to poll
+func getApproval(threadID, approvalID string) (*client.ToolApproval, *apiError) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	info := threadInfos[threadID]
+	if info == nil {
+		return nil, newAPIError(http.StatusNotFound, "Thread not found")
+	}
+	expireApprovals(info)
+	approval := findApproval(info, approvalID)
+	if approval == nil {
+		return nil, newAPIError(http.StatusNotFound, "Approval not found")
+	}
+	copied := *approval
+	return &copied, nil
+}
+
+// listApprovals returns a thread's tool approvals, only those with status if set
+func listApprovals(r *http.Request, threadID, status string) (*client.ApprovalList, *apiError) {
+	switch status {
+	case "", client.ApprovalPending, client.ApprovalApproved, client.ApprovalRejected:
+	default:
+		return nil, newAPIError(http.StatusBadRequest, "status must be pending, approved or rejected")
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	info, apiErr := authorizeThread(r, threadID, RoleRead)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	expireApprovals(info)
+
+	list := &client.ApprovalList{Approvals: []client.ToolApproval{}}
+	for _, approval := range info.Approvals {
+		if status == "" || approval.Status == status {
+			list.Approvals = append(list.Approvals, *approval)
+		}
+	}
+	return list, nil
+}
+
+// decideApproval approves or rejects a pending tool run. The worker picks the
+// decision up on its next poll and passes it on to the agent.
+func decideApproval(r *http.Request, threadID, approvalID string, approved bool) (*client.ToolApproval, *apiError) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	info, apiErr := authorizeThread(r, threadID, RoleWrite)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if info.Status == client.ThreadStatusCancelled {
+		return nil, newAPIError(http.StatusConflict, "Thread has been cancelled")
+	}
+
+	expireApprovals(info)
+	approval := findApproval(info, approvalID)
+	if approval == nil {
+		return nil, newAPIError(http.StatusNotFound, "Approval not found")
+	}
+	if approval.Status != client.ApprovalPending {
+		return nil, newAPIError(http.StatusConflict, "Approval was already "+approval.Status)
+	}
+
+	approval.Status = client.ApprovalRejected
+	if approved {
+		approval.Status = client.ApprovalApproved
+	}
+	approval.DecidedBy = callerFromRequest(r).User
+	approval.DecidedAt = time.Now()
+	approvalsDecided.WithLabelValues(approval.Status).Inc()
+
+	copied := *approval
+	return &copied, nil
+}
+
+// threadToolPolicy returns the tool policy a thread's runner enforces
+func threadToolPolicy(threadID string) (*client.ToolPolicy, *apiError) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	info := threadInfos[threadID]
+	if info == nil {
+		return nil, newAPIError(http.StatusNotFound, "Thread not found")
+	}
+	if info.Settings.ToolPolicy == nil {
+		return nil, newAPIError(http.StatusNotFound, "Thread has no tool policy")
+	}
+	return info.Settings.ToolPolicy, nil
+}
+
+// findApproval returns a thread's approval with ID approvalID, or nil.
+// Callers hold outputMutex.
+func findApproval(info *ThreadInfo, approvalID string) *client.ToolApproval {
+	for _, approval := range info.Approvals {
+		if approval.ID == approvalID {
+			return approval
+		}
+	}
+	return nil
+}
+
+// expireApprovals rejects a thread's pending approvals that nobody decided in
+// time, so its worker stops waiting. Callers hold outputMutex.
+func expireApprovals(info *ThreadInfo) {
+	now := time.Now()
+	for _, approval := range info.Approvals {
+		if approval.Status != client.ApprovalPending || approval.ExpiresAt.IsZero() || now.Before(approval.ExpiresAt) {
+			continue
+		}
+		approval.Status = client.ApprovalRejected
+		approval.DecidedBy = client.TimeoutDecider
+		approval.DecidedAt = approval.ExpiresAt
+		approvalsExpired.Inc()
+	}
+}
+
+// pendingApprovals counts the tool runs a thread is waiting on a human for.
+// Callers hold outputMutex.
+func pendingApprovals(info *ThreadInfo) int {
+	expireApprovals(info)
+	pending := 0
+	for _, approval := range info.Approvals {
+		if approval.Status == client.ApprovalPending {
+			pending++
+		}
+	}
+	return pending
+}
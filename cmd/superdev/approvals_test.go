@@ -0,0 +1,203 @@
+package superdev
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+func TestToolApprovals(t *testing.T) {
+	resetThreads(t)
+	addTestThread("t1", "alice", "")
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	worker := workerClient(server.URL, "t1")
+	alice := client.New(server.URL, client.WithCaller("alice", ""))
+
+	// Approvals can only be requested by the thread's worker, so nobody else can
+	// decide a tool run in advance
+	_, err := alice.RequestApproval(ctx, "t1", client.RequestApprovalRequest{ToolUseID: "toolu_1", Tool: "Bash", Decision: client.ApprovalApproved})
+	expectStatus(t, err, http.StatusUnauthorized)
+
+	// The worker asks about a shell command and waits for a decision
+	request := client.RequestApprovalRequest{ToolUseID: "toolu_1", Tool: "Bash", Input: map[string]interface{}{"cmd": "rm -rf build"}}
+	approval, err := worker.RequestApproval(ctx, "t1", request)
+	if err != nil {
+		t.Fatalf("RequestApproval failed: %v", err)
+	}
+	if approval.ID != "1" || approval.Status != client.ApprovalPending || approval.Input["cmd"] != "rm -rf build" {
+		t.Fatalf("Expected a pending approval, got %+v", approval)
+	}
+	if again, err := worker.RequestApproval(ctx, "t1", request); err != nil || again.ID != approval.ID {
+		t.Fatalf("Expected asking again to return the same approval, got %+v (%v)", again, err)
+	}
+
+	thread, err := alice.GetThread(ctx, "t1", client.GetThreadOptions{})
+	if err != nil || thread.PendingApprovals != 1 {
+		t.Fatalf("Expected the thread to show a pending approval, got %+v (%v)", thread, err)
+	}
+	list, err := alice.ListApprovals(ctx, "t1", client.ApprovalPending)
+	if err != nil || len(list.Approvals) != 1 || list.Approvals[0].Tool != "Bash" {
+		t.Fatalf("Expected the pending approval to be listed, got %+v (%v)", list, err)
+	}
+
+	// Only writers decide, and only once
+	_, err = client.New(server.URL, client.WithCaller("bob", "")).DecideApproval(ctx, "t1", approval.ID, true)
+	expectStatus(t, err, http.StatusNotFound)
+	decided, err := alice.DecideApproval(ctx, "t1", approval.ID, false)
+	if err != nil || decided.Status != client.ApprovalRejected || decided.DecidedBy != "alice" || decided.DecidedAt.IsZero() {
+		t.Fatalf("Expected alice to reject the tool run, got %+v (%v)", decided, err)
+	}
+	_, err = alice.DecideApproval(ctx, "t1", approval.ID, true)
+	expectStatus(t, err, http.StatusConflict)
+
+	// The worker's next poll sees the decision
+	polled, err := worker.GetApproval(ctx, "t1", approval.ID)
+	if err != nil || polled.Status != client.ApprovalRejected {
+		t.Fatalf("Expected the worker to see the rejection, got %+v (%v)", polled, err)
+	}
+	if list, _ := alice.ListApprovals(ctx, "t1", client.ApprovalPending); len(list.Approvals) != 0 {
+		t.Fatalf("Expected nothing pending, got %+v", list)
+	}
+	if list, _ := alice.ListApprovals(ctx, "t1", ""); len(list.Approvals) != 1 {
+		t.Fatalf("Expected decided approvals to stay listed, got %+v", list)
+	}
+
+	second, err := worker.RequestApproval(ctx, "t1", client.RequestApprovalRequest{ToolUseID: "toolu_2", Tool: "edit_file"})
+	if err != nil || second.ID != "2" {
+		t.Fatalf("Expected a second approval, got %+v (%v)", second, err)
+	}
+	if approved, err := alice.DecideApproval(ctx, "t1", second.ID, true); err != nil || approved.Status != client.ApprovalApproved {
+		t.Fatalf("Expected the edit to be approved, got %+v (%v)", approved, err)
+	}
+}
+
+func TestToolApprovalErrors(t *testing.T) {
+	resetThreads(t)
+	info := addTestThread("t1", "alice", "")
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	worker := workerClient(server.URL, "t1")
+	alice := client.New(server.URL, client.WithCaller("alice", ""))
+
+	_, err := worker.RequestApproval(ctx, "t1", client.RequestApprovalRequest{Tool: "Bash"})
+	expectStatus(t, err, http.StatusBadRequest)
+	_, err = worker.RequestApproval(ctx, "unknown", client.RequestApprovalRequest{ToolUseID: "toolu_1", Tool: "Bash"})
+	expectStatus(t, err, http.StatusUnauthorized)
+	_, err = worker.GetApproval(ctx, "t1", "1")
+	expectStatus(t, err, http.StatusNotFound)
+	_, err = alice.ListApprovals(ctx, "t1", "maybe")
+	expectStatus(t, err, http.StatusBadRequest)
+	_, err = alice.DecideApproval(ctx, "t1", "1", true)
+	expectStatus(t, err, http.StatusNotFound)
+
+	// Cancelled threads have no worker left to pass the decision to
+	approval, _ := worker.RequestApproval(ctx, "t1", client.RequestApprovalRequest{ToolUseID: "toolu_1", Tool: "Bash"})
+	outputMutex.Lock()
+	info.Status = client.ThreadStatusCancelled
+	outputMutex.Unlock()
+	_, err = alice.DecideApproval(ctx, "t1", approval.ID, true)
+	expectStatus(t, err, http.StatusConflict)
+}
+
+func TestToolPolicyDecisions(t *testing.T) {
+	resetThreads(t)
+	info := addTestThread("t1", "alice", "")
+	addTestThread("t2", "alice", "")
+	policy := &client.ToolPolicy{DeniedCommands: []string{"^git push"}, OnViolation: client.PolicyEscalate}
+	outputMutex.Lock()
+	info.Settings.ToolPolicy = policy
+	outputMutex.Unlock()
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	worker := workerClient(server.URL, "t1")
+	alice := client.New(server.URL, client.WithCaller("alice", ""))
+
+	// The runner fetches the policy it enforces; threads without one are a 404
+	fetched, err := worker.ThreadToolPolicy(ctx, "t1")
+	if err != nil || len(fetched.DeniedCommands) != 1 || fetched.OnViolation != client.PolicyEscalate {
+		t.Fatalf("Expected the thread's tool policy, got %+v (%v)", fetched, err)
+	}
+	_, err = worker.ThreadToolPolicy(ctx, "t2")
+	expectStatus(t, err, http.StatusUnauthorized)
+	if _, err := workerClient(server.URL, "t2").ThreadToolPolicy(ctx, "t2"); !client.IsNotFound(err) {
+		t.Fatalf("Expected no tool policy on t2, got %v", err)
+	}
+
+	// Decisions the policy makes are recorded without waiting for anyone
+	rejected, err := worker.RequestApproval(ctx, "t1", client.RequestApprovalRequest{
+		ToolUseID: "toolu_1",
+		Tool:      "Bash",
+		Input:     map[string]interface{}{"cmd": "git push origin main"},
+		Decision:  client.ApprovalRejected,
+		Reason:    "command matches denied pattern",
+	})
+	if err != nil || rejected.Status != client.ApprovalRejected || rejected.DecidedBy != client.PolicyDecider || rejected.Reason == "" || rejected.DecidedAt.IsZero() {
+		t.Fatalf("Expected the policy's rejection to be recorded, got %+v (%v)", rejected, err)
+	}
+	approved, err := worker.RequestApproval(ctx, "t1", client.RequestApprovalRequest{ToolUseID: "toolu_2", Tool: "Read", Decision: client.ApprovalApproved})
+	if err != nil || approved.Status != client.ApprovalApproved {
+		t.Fatalf("Expected the policy's approval to be recorded, got %+v (%v)", approved, err)
+	}
+	_, err = alice.DecideApproval(ctx, "t1", rejected.ID, true)
+	expectStatus(t, err, http.StatusConflict)
+
+	thread, err := alice.GetThread(ctx, "t1", client.GetThreadOptions{})
+	if err != nil || thread.PendingApprovals != 0 {
+		t.Fatalf("Expected nothing pending, got %+v (%v)", thread, err)
+	}
+	if list, _ := alice.ListApprovals(ctx, "t1", ""); len(list.Approvals) != 2 {
+		t.Fatalf("Expected both decisions in the thread's history, got %+v", list)
+	}
+
+	_, err = worker.RequestApproval(ctx, "t1", client.RequestApprovalRequest{ToolUseID: "toolu_3", Tool: "Bash", Decision: "maybe"})
+	expectStatus(t, err, http.StatusBadRequest)
+}
+
+func TestToolApprovalsExpire(t *testing.T) {
+	resetThreads(t)
+	addTestThread("t1", "alice", "")
+	saved := approvalTimeout
+	approvalTimeout = time.Millisecond
+	t.Cleanup(func() { approvalTimeout = saved })
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	worker := workerClient(server.URL, "t1")
+	alice := client.New(server.URL, client.WithCaller("alice", ""))
+
+	approval, err := worker.RequestApproval(ctx, "t1", client.RequestApprovalRequest{ToolUseID: "toolu_1", Tool: "Bash"})
+	if err != nil || approval.ExpiresAt.IsZero() {
+		t.Fatalf("Expected an approval that expires, got %+v (%v)", approval, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// Nobody decided in time, so the worker's next poll sees a rejection
+	polled, err := worker.GetApproval(ctx, "t1", approval.ID)
+	if err != nil || polled.Status != client.ApprovalRejected || polled.DecidedBy != client.TimeoutDecider || !polled.DecidedAt.Equal(polled.ExpiresAt) {
+		t.Fatalf("Expected the approval to be rejected by timeout, got %+v (%v)", polled, err)
+	}
+	_, err = alice.DecideApproval(ctx, "t1", approval.ID, true)
+	expectStatus(t, err, http.StatusConflict)
+	if thread, err := alice.GetThread(ctx, "t1", client.GetThreadOptions{}); err != nil || thread.PendingApprovals != 0 {
+		t.Fatalf("Expected nothing pending, got %+v (%v)", thread, err)
+	}
+
+	// Without a timeout approvals wait for as long as it takes
+	approvalTimeout = 0
+	second, err := worker.RequestApproval(ctx, "t1", client.RequestApprovalRequest{ToolUseID: "toolu_2", Tool: "Bash"})
+	if err != nil || !second.ExpiresAt.IsZero() || second.Status != client.ApprovalPending {
+		t.Fatalf("Expected an approval that doesn't expire, got %+v (%v)", second, err)
+	}
+}
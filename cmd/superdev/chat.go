@@ -0,0 +1,366 @@
+package superdev
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"superdev/cmd/superdev/client"
+	superdev "superdev/cmd/superdev/cliwrapper"
+
+	"github.com/charmbracelet/bubbles/textarea"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/spf13/cobra"
+)
+
+// Layout of the chat view
+const (
+	chatSidePanelWidth = 34
+	chatInputHeight    = 3
+	chatPickerLimit    = 20
+)
+
+var (
+	chatPanelStyle  = lipgloss.NewStyle().Border(lipgloss.RoundedBorder()).Padding(0, 1)
+	chatCursorStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("12"))
+)
+
+// Messages driving the chat model
+type (
+	threadsListedMsg struct {
+		threads []client.ThreadSummary
+		err     error
+	}
+	threadPolledMsg struct {
+		thread    *client.Thread
+		approvals []client.ToolApproval
+		err       error
+	}
+	pollTickMsg    struct{}
+	messageSentMsg struct {
+		messageID string
+		err       error
+	}
+	approvalDecidedMsg struct {
+		approval *client.ToolApproval
+		err      error
+	}
+)
+
+// chatModel is the bubbletea model for `superdev chat`. Without a thread it first
+// shows a picker of the caller's recent threads.
+type chatModel struct {
+	ctx      context.Context
+	client   *client.Client
+	interval time.Duration
+
+	// Thread picker
+	choices []client.ThreadSummary
+	cursor  int
+
+	threadID     string
+	thread       *client.Thread          // metadata from the latest poll
+	messages     []*client.ThreadMessage // every message received so far
+	agentState   *superdev.AmpThread     // latest state reported by the agent
+	approvals    []client.ToolApproval   // tool runs waiting for a decision, oldest first
+	showThinking bool
+	sending      bool
+	err          error
+
+	viewport viewport.Model
+	input    textarea.Model
+	width    int
+	height   int
+}
+
+func newChatModel(ctx context.Context, c *client.Client, threadID string, interval time.Duration) *chatModel {
+	input := textarea.New()
+	input.Placeholder = "Send a follow-up (enter to send, alt+enter for a new line)"
+	input.ShowLineNumbers = false
+	input.SetHeight(chatInputHeight)
+	input.KeyMap.InsertNewline.SetKeys("alt+enter", "ctrl+j")
+	input.Focus()
+
+	return &chatModel{
+		ctx:      ctx,
+		client:   c,
+		interval: interval,
+		threadID: threadID,
+		viewport: viewport.New(0, 0),
+		input:    input,
+	}
+}
+
+func (m *chatModel) Init() tea.Cmd {
+	if m.threadID == "" {
+		return m.listThreads()
+	}
+	return tea.Batch(textarea.Blink, m.poll())
+}
+
+// listThreads fetches the caller's most recently updated threads for the picker
+func (m *chatModel) listThreads() tea.Cmd {
+	return func() tea.Msg {
+		list, err := m.client.ListThreads(m.ctx, client.ListThreadsOptions{Owner: "me", Sort: "-" + SortUpdated, Limit: chatPickerLimit})
+		if err != nil {
+			return threadsListedMsg{err: err}
+		}
+		return threadsListedMsg{threads: list.Threads}
+	}
+}
+
+// poll fetches the messages after the last one received
+func (m *chatModel) poll() tea.Cmd {
+	after := ""
+	if len(m.messages) > 0 {
+		after = m.messages[len(m.messages)-1].ID
+	}
+	threadID := m.threadID
+	return func() tea.Msg {
+		thread, err := m.client.GetThread(m.ctx, threadID, client.GetThreadOptions{After: after})
+		if err != nil || thread.PendingApprovals == 0 {
+			return threadPolledMsg{thread: thread, err: err}
+		}
+		list, err := m.client.ListApprovals(m.ctx, threadID, client.ApprovalPending)
+		if err != nil {
+			return threadPolledMsg{thread: thread, err: err}
+		}
+		return threadPolledMsg{thread: thread, approvals: list.Approvals}
+	}
+}
+
+func (m *chatModel) send(prompt string) tea.Cmd {
+	threadID := m.threadID
+	return func() tea.Msg {
+		resp, err := m.client.SendMessage(m.ctx, threadID, prompt)
+		if err != nil {
+			return messageSentMsg{err: err}
+		}
+		return messageSentMsg{messageID: resp.MessageID}
+	}
+}
+
+// decide approves or rejects the oldest pending tool run
+func (m *chatModel) decide(approved bool) tea.Cmd {
+	if len(m.approvals) == 0 {
+		return nil
+	}
+	threadID, approvalID := m.threadID, m.approvals[0].ID
+	return func() tea.Msg {
+		approval, err := m.client.DecideApproval(m.ctx, threadID, approvalID, approved)
+		return approvalDecidedMsg{approval: approval, err: err}
+	}
+}
+
+func (m *chatModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.layout()
+		return m, nil
+
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "ctrl+c", "esc":
+			return m, tea.Quit
+		}
+		if m.threadID == "" {
+			return m, m.updatePicker(msg)
+		}
+		switch msg.String() {
+		case "ctrl+t":
+			m.showThinking = !m.showThinking
+			m.refresh()
+			return m, nil
+		case "ctrl+y":
+			return m, m.decide(true)
+		case "ctrl+r":
+			return m, m.decide(false)
+		case "pgup", "pgdown":
+			var cmd tea.Cmd
+			m.viewport, cmd = m.viewport.Update(msg)
+			return m, cmd
+		case "enter":
+			prompt := strings.TrimSpace(m.input.Value())
+			if prompt == "" || m.sending {
+				return m, nil
+			}
+			m.sending = true
+			m.input.Reset()
+			return m, m.send(prompt)
+		}
+
+	case threadsListedMsg:
+		m.err = msg.err
+		m.choices = msg.threads
+		return m, nil
+
+	case threadPolledMsg:
+		// Keep polling through errors so a restarted server is picked up again
+		m.err = msg.err
+		if msg.err == nil {
+			m.thread = msg.thread
+			m.approvals = msg.approvals
+			m.messages = append(m.messages, msg.thread.Messages...)
+			for _, message := range msg.thread.Messages {
+				if _, state := parseAmpOutput(message.Output); state != nil {
+					m.agentState = state
+				}
+			}
+			m.refresh()
+			if msg.thread.HasMore {
+				return m, m.poll()
+			}
+		}
+		return m, tea.Tick(m.interval, func(time.Time) tea.Msg { return pollTickMsg{} })
+
+	case pollTickMsg:
+		return m, m.poll()
+
+	case messageSentMsg:
+		m.sending = false
+		m.err = msg.err
+		return m, nil
+
+	case approvalDecidedMsg:
+		// Drop the decided approval now rather than on the next poll
+		m.err = msg.err
+		if msg.err == nil {
+			m.approvals = slices.DeleteFunc(m.approvals, func(approval client.ToolApproval) bool {
+				return approval.ID == msg.approval.ID
+			})
+		}
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+// updatePicker moves the picker cursor and opens the chosen thread
+func (m *chatModel) updatePicker(msg tea.KeyMsg) tea.Cmd {
+	switch msg.String() {
+	case "up", "k":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+	case "down", "j":
+		if m.cursor < len(m.choices)-1 {
+			m.cursor++
+		}
+	case "enter":
+		if len(m.choices) == 0 {
+			return nil
+		}
+		m.threadID = m.choices[m.cursor].ThreadID
+		return tea.Batch(textarea.Blink, m.poll())
+	}
+	return nil
+}
+
+// layout sizes the panes to the terminal
+func (m *chatModel) layout() {
+	frame := chatPanelStyle.GetHorizontalFrameSize()
+	m.viewport.Width = max(m.width-chatSidePanelWidth-2*frame, 10)
+	m.viewport.Height = max(m.height-chatInputHeight-2*chatPanelStyle.GetVerticalFrameSize()-1, 3)
+	m.input.SetWidth(m.width - frame)
+	m.refresh()
+}
+
+// refresh re-renders the conversation, staying at the bottom if already there
+func (m *chatModel) refresh() {
+	atBottom := m.viewport.AtBottom()
+
+	parts := make([]string, 0, len(m.messages))
+	for _, message := range m.messages {
+		parts = append(parts, renderThreadMessage(message, m.showThinking, m.viewport.Width))
+	}
+	m.viewport.SetContent(strings.Join(parts, "\n"))
+
+	if atBottom {
+		m.viewport.GotoBottom()
+	}
+}
+
+func (m *chatModel) View() string {
+	if m.threadID == "" {
+		return m.pickerView()
+	}
+
+	sideWidth := chatSidePanelWidth - chatPanelStyle.GetHorizontalFrameSize()
+	side := chatPanelStyle.Width(sideWidth).Height(m.viewport.Height).
+		Render(renderSidePanel(m.thread, m.agentState, sideWidth) + renderApprovals(m.approvals, sideWidth))
+	conversation := chatPanelStyle.Render(m.viewport.View())
+
+	status := chatDimStyle.Render("ctrl+t thinking · pgup/pgdown scroll · esc quit")
+	if len(m.approvals) > 0 {
+		status = chatToolStyle.Render("ctrl+y approve · ctrl+r reject") + chatDimStyle.Render(" · ctrl+t thinking · pgup/pgdown scroll · esc quit")
+	}
+	if m.sending {
+		status = chatDimStyle.Render("Sending...")
+	}
+	if m.err != nil {
+		status = chatErrorStyle.Render("Error: " + m.err.Error())
+	}
+
+	return lipgloss.JoinVertical(lipgloss.Left,
+		lipgloss.JoinHorizontal(lipgloss.Top, conversation, side),
+		chatPanelStyle.Render(m.input.View()),
+		status,
+	)
+}
+
+func (m *chatModel) pickerView() string {
+	var sb strings.Builder
+	sb.WriteString(chatHeadingStyle.Render("Choose a thread") + "\n\n")
+	if m.err != nil {
+		sb.WriteString(chatErrorStyle.Render("Error: "+m.err.Error()) + "\n")
+	} else if m.choices == nil {
+		sb.WriteString(chatDimStyle.Render("Loading threads...") + "\n")
+	} else if len(m.choices) == 0 {
+		sb.WriteString("You have no threads yet. Start one with superdev run.\n")
+	}
+	for i, summary := range m.choices {
+		line := fmt.Sprintf("%s  %-10s %s", summary.ThreadID, summary.Status, summary.Title)
+		if i == m.cursor {
+			sb.WriteString(chatCursorStyle.Render("> "+line) + "\n")
+		} else {
+			sb.WriteString("  " + line + "\n")
+		}
+	}
+	sb.WriteString("\n" + chatDimStyle.Render("↑/↓ choose · enter open · esc quit"))
+	return sb.String()
+}
+
+func newChatCmd() *cobra.Command {
+	opts := &threadsOptions{format: formatTable}
+	var interval time.Duration
+
+	cmd := &cobra.Command{
+		Use:           "chat [thread]",
+		Short:         "Converse with a thread on a server in an interactive terminal UI",
+		Args:          cobra.MaximumNArgs(1),
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			threadID := ""
+			if len(args) == 1 {
+				threadID = args[0]
+			}
+
+			model := newChatModel(cmd.Context(), opts.client(), threadID, interval)
+			_, err := tea.NewProgram(model, tea.WithAltScreen(), tea.WithContext(cmd.Context())).Run()
+			return err
+		},
+	}
+
+	addServerFlags(cmd, opts)
+	cmd.Flags().DurationVar(&interval, "interval", client.DefaultPollInterval, "How often to poll for new messages")
+
+	return cmd
+}
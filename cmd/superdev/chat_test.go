@@ -0,0 +1,139 @@
+package superdev
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"superdev/cmd/superdev/client"
+	superdev "superdev/cmd/superdev/cliwrapper"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const ampThreadOutput = `{
+	"id": "T-1",
+	"state": "idle",
+	"inferenceState": "done",
+	"fileChanges": {"files": [{"path": "auth/login.go"}]},
+	"messages": [
+		{"role": "user", "content": [{"type": "text", "text": "Fix login"}]},
+		{"role": "assistant", "content": [
+			{"type": "thinking", "thinking": "Look at the handler\nthen the callback"},
+			{"type": "tool_use", "name": "edit_file", "input": {"path": "auth/login.go", "line": 12}},
+			{"type": "text", "text": "Fixed the redirect."}
+		]}
+	]
+}`
+
+func TestParseAmpOutput(t *testing.T) {
+	messages, state := parseAmpOutput(ampThreadOutput)
+	if state == nil || state.State != "idle" || len(state.FileChanges.Files) != 1 {
+		t.Fatalf("Expected the thread state, got %+v", state)
+	}
+	if len(messages) != 1 || messages[0].Role != "assistant" {
+		t.Fatalf("Expected only the assistant's reply, got %+v", messages)
+	}
+
+	messages, state = parseAmpOutput(`[{"role": "assistant", "content": [{"type": "text", "text": "hi"}]}]`)
+	if state != nil || len(messages) != 1 {
+		t.Fatalf("Expected a message list, got %+v %+v", messages, state)
+	}
+
+	messages, _ = parseAmpOutput(`{"role": "assistant", "content": [{"type": "text", "text": "hi"}]}`)
+	if len(messages) != 1 {
+		t.Fatalf("Expected a single message, got %+v", messages)
+	}
+
+	for _, plain := range []string{"Plain amp output", `{"unrelated": true}`, "[not json"} {
+		if messages, state := parseAmpOutput(plain); messages != nil || state != nil {
+			t.Fatalf("Expected %q to be plain text, got %+v %+v", plain, messages, state)
+		}
+	}
+}
+
+func TestRenderAmpMessage(t *testing.T) {
+	messages, _ := parseAmpOutput(ampThreadOutput)
+
+	collapsed := renderAmpMessage(messages[0], false, 0)
+	if strings.Contains(collapsed, "then the callback") || !strings.Contains(collapsed, "thinking (2 lines") {
+		t.Fatalf("Expected thinking to be collapsed, got:\n%s", collapsed)
+	}
+	if !strings.Contains(collapsed, "edit_file") || !strings.Contains(collapsed, "line: 12") || !strings.Contains(collapsed, "path: auth/login.go") {
+		t.Fatalf("Expected the tool call and its inputs, got:\n%s", collapsed)
+	}
+	if !strings.Contains(collapsed, "Fixed the redirect.") {
+		t.Fatalf("Expected the text block, got:\n%s", collapsed)
+	}
+
+	expanded := renderAmpMessage(messages[0], true, 0)
+	if !strings.Contains(expanded, "then the callback") {
+		t.Fatalf("Expected thinking to be shown, got:\n%s", expanded)
+	}
+
+	panel := renderSidePanel(&client.Thread{ThreadID: "t1", Status: "running"}, &superdev.AmpThread{
+		State:       "idle",
+		FileChanges: &superdev.AmpFileChanges{Files: []superdev.AmpFile{{Path: "auth/login.go"}}},
+	}, 0)
+	if !strings.Contains(panel, "running") || !strings.Contains(panel, "idle") || !strings.Contains(panel, "auth/login.go") {
+		t.Fatalf("Expected status, agent state and file changes in the side panel, got:\n%s", panel)
+	}
+}
+
+func TestChatModel(t *testing.T) {
+	setupListedThreads(t)
+	outputMutex.Lock()
+	threads["t1"] = append(threads["t1"], &client.ThreadMessage{
+		ID:        "state",
+		Direction: client.DirectionOutput,
+		Output:    ampThreadOutput,
+		CreatedAt: time.Now(),
+	})
+	outputMutex.Unlock()
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	m := newChatModel(context.Background(), client.New(server.URL, client.WithCaller("alice", "")), "", time.Hour)
+	m.Update(tea.WindowSizeMsg{Width: 120, Height: 40})
+
+	// Without a thread the picker lists the caller's threads, most recently updated first
+	m.Update(m.Init()())
+	if len(m.choices) != 3 || m.choices[0].ThreadID != "t1" {
+		t.Fatalf("Expected t1 first in the picker, got %+v", m.choices)
+	}
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if m.threadID != "t1" || cmd == nil {
+		t.Fatalf("Expected enter to open t1, got %q", m.threadID)
+	}
+
+	m.Update(m.poll()())
+	if len(m.messages) != 3 || m.agentState == nil || m.thread.Title != "Fix login" {
+		t.Fatalf("Expected the thread's messages and state, got %d messages, state %+v", len(m.messages), m.agentState)
+	}
+	view := m.View()
+	for _, want := range []string{"Fix login", "Fixed the redirect.", "auth/login.go", "idle"} {
+		if !strings.Contains(view, want) {
+			t.Fatalf("Expected %q in the view:\n%s", want, view)
+		}
+	}
+
+	// Typing and pressing enter posts a follow-up
+	m.input.SetValue("Add a test")
+	_, cmd = m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if cmd == nil || !m.sending || m.input.Value() != "" {
+		t.Fatal("Expected enter to send the prompt")
+	}
+	m.Update(cmd())
+	if m.sending || m.err != nil {
+		t.Fatalf("Expected the message to be sent, got %v", m.err)
+	}
+
+	// The next poll picks up only the new message
+	m.Update(m.poll()())
+	if len(m.messages) != 4 || m.messages[3].Output != "Add a test" {
+		t.Fatalf("Expected the follow-up to be appended, got %d messages", len(m.messages))
+	}
+}
@@ -0,0 +1,207 @@
+package superdev
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"superdev/cmd/superdev/client"
+	superdev "superdev/cmd/superdev/cliwrapper"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Styles used by the chat view
+var (
+	chatUserStyle      = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("12"))
+	chatAssistantStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("10"))
+	chatDimStyle       = lipgloss.NewStyle().Faint(true)
+	chatToolStyle      = lipgloss.NewStyle().Foreground(lipgloss.Color("11"))
+	chatErrorStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+	chatHeadingStyle   = lipgloss.NewStyle().Bold(true).Underline(true)
+)
+
+// parseAmpOutput interprets a thread output message. Workers may answer with an
+// Amp thread, a list of Amp messages or a single message as JSON. Anything else is
+// plain text and returns no messages.
+func parseAmpOutput(output string) ([]superdev.AmpMessage, *superdev.AmpThread) {
+	trimmed := strings.TrimSpace(output)
+	switch {
+	case strings.HasPrefix(trimmed, "["):
+		var messages []superdev.AmpMessage
+		if err := json.Unmarshal([]byte(trimmed), &messages); err == nil {
+			return messages, nil
+		}
+	case strings.HasPrefix(trimmed, "{"):
+		var thread superdev.AmpThread
+		if err := json.Unmarshal([]byte(trimmed), &thread); err == nil && (thread.ID != "" || len(thread.Messages) > 0) {
+			// The thread repeats the whole conversation; the user's turns are already shown
+			var replies []superdev.AmpMessage
+			for _, message := range thread.Messages {
+				if message.Role == "assistant" {
+					replies = append(replies, message)
+				}
+			}
+			return replies, &thread
+		}
+
+		var message superdev.AmpMessage
+		if err := json.Unmarshal([]byte(trimmed), &message); err == nil && message.Role != "" {
+			return []superdev.AmpMessage{message}, nil
+		}
+	}
+	return nil, nil
+}
+
+// renderThreadMessage renders a server message for the conversation pane
+func renderThreadMessage(message *client.ThreadMessage, showThinking bool, width int) string {
+	var sb strings.Builder
+	timestamp := chatDimStyle.Render(message.CreatedAt.Local().Format(time.Kitchen))
+
+	if message.Direction == client.DirectionInput {
+		sb.WriteString(chatUserStyle.Render("you") + " " + timestamp + "\n")
+		sb.WriteString(wrap(message.Output, width))
+		return sb.String()
+	}
+
+	sb.WriteString(chatAssistantStyle.Render("amp") + " " + timestamp + "\n")
+	if message.Error != "" {
+		sb.WriteString(chatErrorStyle.Render("error: "+message.Error) + "\n")
+	}
+
+	messages, _ := parseAmpOutput(message.Output)
+	if messages == nil {
+		sb.WriteString(wrap(message.Output, width))
+		return sb.String()
+	}
+	for _, ampMessage := range messages {
+		sb.WriteString(renderAmpMessage(ampMessage, showThinking, width))
+	}
+	return sb.String()
+}
+
+// renderAmpMessage renders the content blocks of an Amp message. Thinking is
+// collapsed to a single line unless showThinking is set.
+func renderAmpMessage(message superdev.AmpMessage, showThinking bool, width int) string {
+	var sb strings.Builder
+	for _, content := range message.Content {
+		switch content.Type {
+		case "text":
+			sb.WriteString(wrap(content.Text, width))
+		case "thinking":
+			if showThinking {
+				sb.WriteString(chatDimStyle.Render(wrap(content.Thinking, width)))
+			} else {
+				lines := strings.Count(strings.TrimSpace(content.Thinking), "\n") + 1
+				sb.WriteString(chatDimStyle.Render(fmt.Sprintf("▸ thinking (%d lines, ctrl+t to expand)", lines)) + "\n")
+			}
+		case "tool_use":
+			sb.WriteString(chatToolStyle.Render("⚙ "+content.Name) + "\n")
+			sb.WriteString(renderToolInput(content.Input, width))
+		default:
+			sb.WriteString(chatDimStyle.Render("("+content.Type+")") + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// renderToolInput lists a tool call's inputs, one per line in key order
+func renderToolInput(input map[string]interface{}, width int) string {
+	keys := make([]string, 0, len(input))
+	for key := range input {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, key := range keys {
+		value, ok := input[key].(string)
+		if !ok {
+			data, _ := json.Marshal(input[key])
+			value = string(data)
+		}
+		sb.WriteString(wrap("  "+key+": "+value, width))
+	}
+	return sb.String()
+}
+
+// renderSidePanel shows the thread's metadata and, once the agent has reported
+// it, its state and changed files
+func renderSidePanel(thread *client.Thread, state *superdev.AmpThread, width int) string {
+	var sb strings.Builder
+	if thread == nil {
+		return chatDimStyle.Render("Loading thread...")
+	}
+
+	sb.WriteString(chatHeadingStyle.Render("Thread") + "\n")
+	for _, field := range []struct{ name, value string }{
+		{"id", thread.ThreadID},
+		{"title", thread.Title},
+		{"status", thread.Status},
+		{"owner", thread.Owner},
+		{"repo", thread.Repository},
+		{"image", thread.Image},
+		{"messages", fmt.Sprint(thread.MessageCount)},
+		{"usage", chatUsage(thread.Usage)},
+	} {
+		if field.value != "" {
+			sb.WriteString(wrap(chatDimStyle.Render(field.name+":")+" "+field.value, width))
+		}
+	}
+
+	if state == nil {
+		return sb.String()
+	}
+
+	if state.State != "" || state.InferenceState != "" {
+		sb.WriteString("\n" + chatHeadingStyle.Render("Agent") + "\n")
+		if state.State != "" {
+			sb.WriteString(chatDimStyle.Render("state:") + " " + state.State + "\n")
+		}
+		if state.InferenceState != "" {
+			sb.WriteString(chatDimStyle.Render("inference:") + " " + state.InferenceState + "\n")
+		}
+	}
+
+	if state.FileChanges != nil && len(state.FileChanges.Files) > 0 {
+		sb.WriteString("\n" + chatHeadingStyle.Render(fmt.Sprintf("Files changed (%d)", len(state.FileChanges.Files))) + "\n")
+		for _, file := range state.FileChanges.Files {
+			sb.WriteString(wrap("  "+file.Path, width))
+		}
+	}
+
+	return sb.String()
+}
+
+// chatUsage summarizes a thread's usage for the side panel, or returns "" if it has none
+func chatUsage(usage *client.Usage) string {
+	if usage == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d tokens, $%.2f", usage.TotalTokens, usage.Cost)
+}
+
+// renderApprovals shows the oldest tool run waiting for a decision, which the
+// chat's approve and reject keys act on
+func renderApprovals(approvals []client.ToolApproval, width int) string {
+	if len(approvals) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\n" + chatHeadingStyle.Render(fmt.Sprintf("Awaiting approval (%d)", len(approvals))) + "\n")
+	sb.WriteString(chatToolStyle.Render("⚙ "+approvals[0].Tool) + "\n")
+	sb.WriteString(renderToolInput(approvals[0].Input, width))
+	return sb.String()
+}
+
+// wrap word-wraps text to width and ends it with a newline
+func wrap(text string, width int) string {
+	text = strings.TrimRight(text, "\n")
+	if width > 0 {
+		text = lipgloss.NewStyle().Width(width).Render(text)
+	}
+	return text + "\n"
+}
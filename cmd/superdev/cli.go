@@ -1,15 +1,11 @@
 package superdev
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"text/template"
+	"superdev/cmd/superdev/client"
+	"superdev/cmd/superdev/tracing"
 
 	"github.com/spf13/cobra"
 )
@@ -32,6 +28,37 @@ func InitCommands() {
 	// Add flags to run command
 	runCmd.Flags().StringVar(&serverURL, "server", "http://localhost:8080", "Server URL to send the Docker image to")
 	runCmd.Flags().StringVar(&prompt, "prompt", "Hello from the CLI", "Prompt to send to the server")
+	runCmd.Flags().StringVar(&repoLink, "repo", "https://github.com/sourcegraph/amp.git", "Repository for the thread to work on")
+	runCmd.Flags().StringVar(&wrapConfigPath, "wrap-config", "", "JSON file configuring how the image is wrapped")
+	runCmd.Flags().StringVar(&wrapOverrides.BaseTag, "base-tag", "", "Tag for the image built from the Dockerfile (default "+defaultBaseTag+")")
+	runCmd.Flags().StringVar(&wrapOverrides.Tag, "tag", "", "Tag for the wrapped image (default "+defaultWrappedTag+" with a content hash tag)")
+	runCmd.Flags().StringVar(&wrapOverrides.Distro, "distro", "", "Base distribution: debian, alpine or rhel (detected if unset)")
+	runCmd.Flags().StringVar(&wrapOverrides.NodeVersion, "node-version", "", "Node.js major version to install (default "+defaultNodeVersion+")")
+	runCmd.Flags().StringVar(&wrapOverrides.AmpVersion, "amp-version", "", "Version or dist-tag of @sourcegraph/amp to install (default "+defaultAmpVersion+")")
+	runCmd.Flags().StringSliceVar(&wrapOverrides.Packages, "package", nil, "Extra distribution package to install (repeatable)")
+	runCmd.Flags().StringVar(&wrapOverrides.RunnerBinary, "runner-binary", "", "Prebuilt linux superdev-amprunner to install instead of building it")
+	runCmd.Flags().BoolVar(&wrapOverrides.SkipValidation, "skip-validation", false, "Don't check that the wrapped image can run its tools")
+	runCmd.Flags().BoolVar(&rebuildImage, "rebuild", false, "Build the image even if an identical one is registered")
+	runCmd.Flags().BoolVar(&remoteBuild, "remote", false, "Upload the Dockerfile and build context for the server to build")
+
+	// Add flags to server command
+	serverCmd.Flags().StringVar(&dataDir, "data-dir", defaultDataDir(), "Directory for persistent server state such as secrets and thread logs")
+	serverCmd.Flags().StringVar(&logFormat, "log-format", "text", "Log output format: text or json")
+	serverCmd.Flags().StringVar(&logLevel, "log-level", "info", "Minimum log level: debug, info, warn or error")
+	serverCmd.Flags().StringVar(&otlpEndpoint, "otlp-endpoint", os.Getenv(tracing.EnvOTLPEndpoint), "OTLP/HTTP endpoint to export traces to")
+	serverCmd.Flags().BoolVar(&allowUnregisteredImages, "allow-unregistered-images", false, "Let threads run images that are not in the image registry")
+	serverCmd.Flags().StringSliceVar(&allowedImages, "allowed-image", nil, "Image pattern threads may run without registering it, such as superdev-worker:* (repeatable)")
+	serverCmd.Flags().StringVar(&traceFile, "trace-file", os.Getenv(tracing.EnvTraceFile), "File to write traces to as JSON")
+	serverCmd.Flags().IntVar(&maxRunningThreads, "max-running", defaultMaxRunning, "Maximum threads running at once; further starts are queued (0 for no limit)")
+	serverCmd.Flags().IntVar(&maxRunningPerUser, "max-running-per-user", 0, "Maximum threads running at once for each user (0 for no limit)")
+	serverCmd.Flags().IntVar(&maxQueuedThreads, "max-queued", defaultMaxQueued, "Maximum queued thread starts; further starts are rejected (0 for no limit)")
+	serverCmd.Flags().StringVar(&threadRuntime, "runtime", RuntimeDocker, "Where the server runs thread containers: docker or kubernetes")
+	serverCmd.Flags().StringVar(&kubeNamespace, "kube-namespace", "", "Namespace for thread pods (defaults to the kubeconfig context's)")
+	serverCmd.Flags().StringVar(&priceTablePath, "price-table", "", "JSON file pricing each model's prompt and completion tokens in US dollars per million")
+	serverCmd.Flags().Float64Var(&userDailyBudget, "user-daily-budget", 0, "US dollars each user's threads may spend in 24 hours (0 for no limit)")
+	serverCmd.Flags().DurationVar(&approvalTimeout, "approval-timeout", approvalTimeout, "How long a tool run waits for a human to approve it before it is rejected (0 to wait forever)")
+	serverCmd.Flags().DurationVar(&agentProvisionTimeout, "agent-provision-timeout", agentProvisionTimeout, "How long a host agent may take to start a thread's container before the thread fails (0 to wait forever)")
+	serverCmd.Flags().StringVar(&kubeGitImage, "kube-git-image", defaultKubeGitImage, "Image of the init container that clones the repository")
 
 	// Add flags to thread command
 	threadCmd.Flags().StringVar(&promptText, "prompt", "", "The prompt to send to the model (required)")
@@ -42,220 +69,96 @@ func InitCommands() {
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(serverCmd)
 	rootCmd.AddCommand(threadCmd)
+	rootCmd.AddCommand(newThreadsCmd())
+	rootCmd.AddCommand(newChatCmd())
+	rootCmd.AddCommand(newImagesCmd())
+	rootCmd.AddCommand(newTemplatesCmd())
+	rootCmd.AddCommand(newAgentCmd())
+	rootCmd.AddCommand(newUsageCmd())
 }
 
-// sendImageToServer sends a request to the server with the Docker image and prompt
-func sendImageToServer(serverURL, dockerImage, prompt string) (string, error) {
-	// Create request body
-	requestBody := map[string]string{
-		"docker_image":    dockerImage,
-		"repository_link": "https://github.com/sourcegraph/amp.git", // Hardcoded for now
-		"prompt":          prompt,
-	}
-
-	// Convert request body to JSON
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal JSON: %w", err)
-	}
-
-	// Create HTTP request
-	req, err := http.NewRequest("POST", serverURL+"/start", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
-
-	// Set Content-Type header
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Read response body
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
-	}
-
-	// Check status code
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("server returned non-OK status: %d, body: %s", resp.StatusCode, string(respBody))
-	}
-
-	// Parse response JSON
-	var responseData struct {
-		Status   string `json:"status"`
-		Message  string `json:"message"`
-		ThreadID string `json:"thread_id"`
-	}
-
-	err = json.Unmarshal(respBody, &responseData)
+// sendImageToServer starts a thread on the server with the Docker image and prompt.
+// Without an image the server builds the repository's dev container.
+func sendImageToServer(serverURL, dockerImage, repoLink, prompt string) (string, error) {
+	resp, err := client.New(serverURL).StartThread(context.Background(), client.StartThreadRequest{
+		DockerImage:    dockerImage,
+		RepositoryLink: repoLink,
+		Prompt:         prompt,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to parse response JSON: %w", err)
+		return "", fmt.Errorf("failed to start thread: %w", err)
 	}
 
 	// Return thread ID
-	return responseData.ThreadID, nil
+	return resp.ThreadID, nil
 }
 
 var (
-	serverURL string
-	prompt    string
+	serverURL      string
+	prompt         string
+	repoLink       string
+	wrapConfigPath string
+	wrapOverrides  WrapConfig
+	rebuildImage   bool
+	remoteBuild    bool
 )
 
 var runCmd = &cobra.Command{
 	Use:   "run [dockerfile]",
-	Short: "Build a Docker image from the specified Dockerfile and send it to the server",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		dockerfilePath := args[0]
-
-		// Check if file exists
-		if _, err := os.Stat(dockerfilePath); os.IsNotExist(err) {
-			fmt.Printf("Error: Dockerfile not found at %s\n", dockerfilePath)
-			os.Exit(1)
-		}
-
-		// Build Docker image
-		fmt.Printf("Building Docker image from %s...\n", dockerfilePath)
-
-		// Execute docker build command
-		dockerCmd := exec.Command("docker", "build", "-f", dockerfilePath, "-t", "superdev-image", ".")
-		dockerCmd.Stdout = os.Stdout
-		dockerCmd.Stderr = os.Stderr
-
-		err := dockerCmd.Run()
-		if err != nil {
-			fmt.Printf("Error building Docker image: %v\n", err)
-			os.Exit(1)
-		}
-
-		fmt.Printf("Successfully built Docker image from %s\n", dockerfilePath)
-
-		// Create a wrapper Dockerfile using a template
-		wrapperTemplate := `FROM ubuntu:latest as wrapper
-
-# Additional wrapper configuration
-LABEL wrapped.by="superdev"
-LABEL original.dockerfile="{{.OriginalFile}}"
-
-# Install Node.js 22 and npm
-RUN apt-get update && \
-    apt-get install -y curl gnupg2 && \
-    mkdir -p /etc/apt/keyrings && \
-    curl -fsSL https://deb.nodesource.com/gpgkey/nodesource-repo.gpg.key | gpg --dearmor -o /etc/apt/keyrings/nodesource.gpg && \
-    echo "deb [signed-by=/etc/apt/keyrings/nodesource.gpg] https://deb.nodesource.com/node_22.x nodistro main" | tee /etc/apt/sources.list.d/nodesource.list && \
-    apt-get update && \
-    apt-get install -y nodejs && \
-    apt-get clean && \
-    rm -rf /var/lib/apt/lists/*
-
-# Install pnpm via npm
-RUN npm install -g pnpm
-
-# Install ripgrep
-RUN apt-get update && \
-    apt-get install -y ripgrep && \
-    apt-get clean && \
-    rm -rf /var/lib/apt/lists/*
-
-# Setup PNPM environment
-RUN mkdir -p /usr/local/pnpm-global
-ENV PNPM_HOME=/usr/local/pnpm-global
-ENV PATH="$PNPM_HOME:$PNPM_HOME/node_modules/.bin:$PATH"
-ENV SHELL=/bin/bash
-
-# Install Sourcegraph AMP
-RUN pnpm setup && pnpm add -g @sourcegraph/amp
-
-# Create final image with original content included
-FROM superdev-image
+	Short: "Build a Docker image from the specified Dockerfile, locally or on the server, and start a thread with it",
+	Long: `Build a Docker image from the specified Dockerfile, locally or on the server, and start a thread with it.
 
-# Copy all installed tools from wrapper
-COPY --from=wrapper /usr/bin /usr/bin
-COPY --from=wrapper /usr/local /usr/local
-COPY --from=wrapper /usr/lib /usr/lib
-COPY --from=wrapper /usr/share /usr/share
-COPY --from=wrapper /lib /lib
-COPY --from=wrapper /etc/apt /etc/apt
-
-# Set environment variables
-ENV PNPM_HOME=/usr/local/pnpm-global
-ENV PATH="$PNPM_HOME:$PNPM_HOME/node_modules/.bin:$PATH"
-ENV SHELL=/bin/bash
-
-CMD ["echo", "This image was wrapped by SuperDev with all requested tools installed"]
-`
-
-		// Create a temporary directory for the wrapper Dockerfile
-		tempDir, err := os.MkdirTemp("", "superdev-wrapper")
-		if err != nil {
-			fmt.Printf("Error creating temp directory: %v\n", err)
-			os.Exit(1)
-		}
-		defer os.RemoveAll(tempDir)
-
-		// Create wrapper Dockerfile
-		wrapperPath := filepath.Join(tempDir, "Dockerfile.wrapper")
-
-		// Parse and execute the template
-		tmpl, err := template.New("wrapper").Parse(wrapperTemplate)
-		if err != nil {
-			fmt.Printf("Error parsing template: %v\n", err)
-			os.Exit(1)
-		}
-
-		// Create the wrapper Dockerfile
-		wrapperFile, err := os.Create(wrapperPath)
-		if err != nil {
-			fmt.Printf("Error creating wrapper Dockerfile: %v\n", err)
-			os.Exit(1)
-		}
-		defer wrapperFile.Close()
-
-		// Execute the template with data
-		templateData := struct {
-			OriginalFile string
-		}{
-			OriginalFile: dockerfilePath,
-		}
-
-		err = tmpl.Execute(wrapperFile, templateData)
-		if err != nil {
-			fmt.Printf("Error writing wrapper Dockerfile: %v\n", err)
-			os.Exit(1)
-		}
-		wrapperFile.Close()
-
-		// Build the wrapped image
-		fmt.Println("Building wrapped Docker image...")
-		wrapperCmd := exec.Command("docker", "build", "-f", wrapperPath, "-t", "superdev-wrapped-image", ".")
-		wrapperCmd.Stdout = os.Stdout
-		wrapperCmd.Stderr = os.Stderr
-
-		err = wrapperCmd.Run()
-		if err != nil {
-			fmt.Printf("Error building wrapped Docker image: %v\n", err)
-			os.Exit(1)
+Without a Dockerfile the server builds the worker from the repository's
+.devcontainer/devcontainer.json.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		tag := ""
+		if len(args) == 0 {
+			fmt.Printf("No Dockerfile given, the server will use the dev container of %s\n", repoLink)
+		} else {
+			tag = buildRunImage(cmd, args[0])
 		}
 
-		fmt.Printf("Successfully built wrapped Docker image from %s\n", dockerfilePath)
-
 		// Use the server URL and prompt provided via flags
 
 		fmt.Printf("Sending wrapped Docker image to the server...\n")
-		threadID, err := sendImageToServer(serverURL, "superdev-wrapped-image", prompt)
+		threadID, err := sendImageToServer(serverURL, tag, repoLink, prompt)
 		if err != nil {
 			fmt.Printf("Error sending image to server: %v\n", err)
 			os.Exit(1)
 		}
 
 		fmt.Printf("Successfully sent image to server. Thread ID: %s\n", threadID)
-		fmt.Printf("To check status, use: curl -X GET \"http://localhost:8080/output?thread_id=%s\"\n", threadID)
+		fmt.Printf("To follow the thread, use: superdev threads tail %s --server %s\n", threadID, serverURL)
 	},
 }
+
+// buildRunImage builds or reuses the wrapped image for superdev run, exiting on errors
+func buildRunImage(cmd *cobra.Command, dockerfilePath string) string {
+	// Check if file exists
+	if _, err := os.Stat(dockerfilePath); os.IsNotExist(err) {
+		fmt.Printf("Error: Dockerfile not found at %s\n", dockerfilePath)
+		os.Exit(1)
+	}
+
+	// Flags override the config file
+	cfg, err := loadWrapConfig(wrapConfigPath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	cfg.merge(wrapOverrides)
+	cfg.applyDefaults()
+
+	// Unchanged images are reused; new ones are registered so the server accepts them
+	build := buildOrReuseImage
+	if remoteBuild {
+		build = buildRemoteImage
+	}
+	tag, err := build(cmd.Context(), client.New(serverURL), cfg, dockerfilePath, ".", rebuildImage, os.Stdout)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	return tag
+}
@@ -9,9 +9,9 @@ import (
 func TestSendImageToServer(t *testing.T) {
 	// Setup a mock server
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check that the request is a POST to /run
-		if r.Method != http.MethodPost || r.URL.Path != "/run" {
-			t.Errorf("Expected POST /run request, got %s %s", r.Method, r.URL.Path)
+		// Check that the request is a POST to /v1/threads
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/threads" {
+			t.Errorf("Expected POST /v1/threads request, got %s %s", r.Method, r.URL.Path)
 		}
 
 		// Check that the Content-Type is application/json
@@ -28,7 +28,7 @@ func TestSendImageToServer(t *testing.T) {
 	defer server.Close()
 
 	// Call the function to test
-	threadID, err := sendImageToServer(server.URL, "superdev-wrapped-image", "test prompt")
+	threadID, err := sendImageToServer(server.URL, "superdev-wrapped-image", "https://github.com/sourcegraph/amp.git", "test prompt")
 
 	// Verify the results
 	if err != nil {
@@ -0,0 +1,805 @@
+// Package client is a Go client for the superdev server's /v1 API. The request and
+// response models are shared with the server.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"superdev/cmd/superdev/tracing"
+)
+
+// Headers identifying the caller, normally set by an authenticating proxy
+const (
+	UserHeader  = "X-Superdev-User"
+	TeamHeader  = "X-Superdev-Team"
+	ShareHeader = "X-Superdev-Share"
+)
+
+// Environment variables the server sets for a runner in a dev container
+const (
+	EnvRemoteEnv         = "SUPERDEV_REMOTE_ENV"          // JSON object of the spec's remoteEnv
+	EnvPostCreateCommand = "SUPERDEV_POST_CREATE_COMMAND" // shell command to run before the first turn
+	EnvWorkerToken       = "SUPERDEV_WORKER_TOKEN"        // token the worker endpoints require for the thread
+)
+
+// Client talks to a superdev server
+type Client struct {
+	baseURL     string
+	httpClient  *http.Client
+	user        string
+	team        string
+	shareToken  string
+	agentToken  string
+	workerToken string
+	maxRetries  int
+	backoff     time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithCaller identifies requests as coming from user in team
+func WithCaller(user, team string) Option {
+	return func(c *Client) {
+		c.user = user
+		c.team = team
+	}
+}
+
+// WithShareToken sends a share token with every request
+func WithShareToken(token string) Option {
+	return func(c *Client) {
+		c.shareToken = token
+	}
+}
+
+// WithAgentToken authenticates requests as a host agent using the server's
+// shared agent token
+func WithAgentToken(token string) Option {
+	return func(c *Client) {
+		c.agentToken = token
+	}
+}
+
+// WithWorkerToken authenticates requests as the worker of the thread the token
+// was issued for
+func WithWorkerToken(token string) Option {
+	return func(c *Client) {
+		c.workerToken = token
+	}
+}
+
+// WithRetries sets how many times idempotent requests are retried after network
+// errors or temporary server errors, and the delay before the first retry. The
+// delay doubles on each attempt.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+// New creates a client for the server at baseURL, e.g. http://localhost:8080
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		maxRetries: 3,
+		backoff:    500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is an error returned by the server
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("server returned %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsNotFound reports whether err is a not found error from the server
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// StartThread starts a thread
+func (c *Client) StartThread(ctx context.Context, req StartThreadRequest) (*StartThreadResponse, error) {
+	var resp StartThreadResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/threads", nil, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListThreadsOptions filters, sorts and pages a thread listing
+type ListThreadsOptions struct {
+	Owner         string // "me" for the caller
+	Team          string
+	Status        string
+	Repository    string // substring of the repository link
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Query         string // full-text search over titles and messages
+	Sort          string // created, updated, title or messages, prefixed with "-" for descending
+	Limit         int    // page size, zero for the server default
+	Cursor        string // NextCursor of the previous page
+}
+
+func (o ListThreadsOptions) query() url.Values {
+	query := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	set("owner", o.Owner)
+	set("team", o.Team)
+	set("status", o.Status)
+	set("repo", o.Repository)
+	set("q", o.Query)
+	set("sort", o.Sort)
+	set("cursor", o.Cursor)
+	if !o.CreatedAfter.IsZero() {
+		query.Set("created_after", o.CreatedAfter.Format(time.RFC3339))
+	}
+	if !o.CreatedBefore.IsZero() {
+		query.Set("created_before", o.CreatedBefore.Format(time.RFC3339))
+	}
+	if o.Limit > 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	return query
+}
+
+// ListThreads returns a page of the threads visible to the caller. Pass
+// NextCursor back as Cursor to fetch the next page.
+func (c *Client) ListThreads(ctx context.Context, opts ListThreadsOptions) (*ThreadList, error) {
+	var resp ThreadList
+	if err := c.do(ctx, http.MethodGet, "/v1/threads", opts.query(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetThreadOptions selects a page of a thread's messages
+type GetThreadOptions struct {
+	After string // only return messages after this message ID
+	Limit int    // maximum number of messages, zero for all
+}
+
+func (o GetThreadOptions) query() url.Values {
+	query := url.Values{}
+	if o.After != "" {
+		query.Set("after", o.After)
+	}
+	if o.Limit > 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	return query
+}
+
+// GetThread returns a thread's metadata and a page of its messages
+func (c *Client) GetThread(ctx context.Context, threadID string, opts GetThreadOptions) (*Thread, error) {
+	var resp Thread
+	if err := c.do(ctx, http.MethodGet, threadPath(threadID), opts.query(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SendMessage sends a human message to a thread
+func (c *Client) SendMessage(ctx context.Context, threadID, prompt string) (*MessageResponse, error) {
+	var resp MessageResponse
+	if err := c.do(ctx, http.MethodPost, threadPath(threadID, "messages"), nil, StoreMessageRequest{Prompt: prompt}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CancelThread stops a thread's container
+func (c *Client) CancelThread(ctx context.Context, threadID string) (*CancelResponse, error) {
+	var resp CancelResponse
+	if err := c.do(ctx, http.MethodPost, threadPath(threadID, "cancel"), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ForkThread starts a new thread with the history of threadID up to and
+// including the message with ID at, and the thread's workspace as of that
+// message. An empty at forks from the latest message.
+func (c *Client) ForkThread(ctx context.Context, threadID, at string, req ForkThreadRequest) (*StartThreadResponse, error) {
+	query := url.Values{}
+	if at != "" {
+		query.Set("at", at)
+	}
+
+	var resp StartThreadResponse
+	if err := c.do(ctx, http.MethodPost, threadPath(threadID, "fork"), query, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// PullMessages returns a thread's input messages after the given message ID. Used by workers.
+func (c *Client) PullMessages(ctx context.Context, threadID, after string) ([]Message, error) {
+	query := url.Values{}
+	if after != "" {
+		query.Set("after", after)
+	}
+
+	var resp MessageList
+	if err := c.do(ctx, http.MethodGet, threadPath(threadID, "messages", "pending"), query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+// AnswerMessage records a worker's output for a thread. Used by workers.
+func (c *Client) AnswerMessage(ctx context.Context, threadID string, req AnswerMessageRequest) (*MessageResponse, error) {
+	var resp MessageResponse
+	if err := c.do(ctx, http.MethodPost, threadPath(threadID, "responses"), nil, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ThreadWorkspace returns the workspace a thread's worker should start from.
+// Threads that don't start from another thread's workspace return a not found
+// error. Used by workers.
+func (c *Client) ThreadWorkspace(ctx context.Context, threadID string) (*WorkspaceSnapshot, error) {
+	var resp WorkspaceSnapshot
+	if err := c.do(ctx, http.MethodGet, threadPath(threadID, "workspace"), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListSnapshots returns the workspace snapshots taken with a thread's answers
+func (c *Client) ListSnapshots(ctx context.Context, threadID string) (*SnapshotList, error) {
+	var resp SnapshotList
+	if err := c.do(ctx, http.MethodGet, threadPath(threadID, "snapshots"), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DiffSnapshots returns the changes between the snapshots taken with the answers
+// from and to. An empty from diffs against the commit the thread started from;
+// an empty to uses the latest snapshot.
+func (c *Client) DiffSnapshots(ctx context.Context, threadID, from, to string) (*SnapshotDiff, error) {
+	query := url.Values{}
+	if from != "" {
+		query.Set("from", from)
+	}
+	if to != "" {
+		query.Set("to", to)
+	}
+
+	var resp SnapshotDiff
+	if err := c.do(ctx, http.MethodGet, threadPath(threadID, "snapshots", "diff"), query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RestoreSnapshot asks a thread's worker to restore its workspace to the
+// snapshot taken with the answer at. The restore is queued like a message.
+func (c *Client) RestoreSnapshot(ctx context.Context, threadID, at string) (*MessageResponse, error) {
+	var resp MessageResponse
+	if err := c.do(ctx, http.MethodPost, threadPath(threadID, "snapshots", "restore"), url.Values{"at": {at}}, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RequestApproval asks a human to approve a tool run. Requesting approval for
+// the same tool use again returns the existing request. Used by workers.
+func (c *Client) RequestApproval(ctx context.Context, threadID string, req RequestApprovalRequest) (*ToolApproval, error) {
+	var resp ToolApproval
+	if err := c.do(ctx, http.MethodPost, threadPath(threadID, "approvals"), nil, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetApproval returns a tool approval, which workers poll until it is decided
+func (c *Client) GetApproval(ctx context.Context, threadID, approvalID string) (*ToolApproval, error) {
+	var resp ToolApproval
+	if err := c.do(ctx, http.MethodGet, threadPath(threadID, "approvals", approvalID), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ThreadToolPolicy returns the tool policy a thread's worker enforces. Threads
+// without one return a not found error. Used by workers.
+func (c *Client) ThreadToolPolicy(ctx context.Context, threadID string) (*ToolPolicy, error) {
+	var resp ToolPolicy
+	if err := c.do(ctx, http.MethodGet, threadPath(threadID, "tool-policy"), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListApprovals returns a thread's tool approvals, optionally only those with status
+func (c *Client) ListApprovals(ctx context.Context, threadID, status string) (*ApprovalList, error) {
+	query := url.Values{}
+	if status != "" {
+		query.Set("status", status)
+	}
+
+	var resp ApprovalList
+	if err := c.do(ctx, http.MethodGet, threadPath(threadID, "approvals"), query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DecideApproval approves or rejects a pending tool run
+func (c *Client) DecideApproval(ctx context.Context, threadID, approvalID string, approved bool) (*ToolApproval, error) {
+	var resp ToolApproval
+	if err := c.do(ctx, http.MethodPost, threadPath(threadID, "approvals", approvalID, "decision"), nil, ApprovalDecision{Approved: approved}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UsageOptions selects how a usage report is grouped and what it covers
+type UsageOptions struct {
+	GroupBy string    // UsageByThread, UsageByUser or UsageByTemplate; the server defaults to user
+	Since   time.Time // only count inferences from then on
+}
+
+func (o UsageOptions) query() url.Values {
+	query := url.Values{}
+	if o.GroupBy != "" {
+		query.Set("group_by", o.GroupBy)
+	}
+	if !o.Since.IsZero() {
+		query.Set("since", o.Since.Format(time.RFC3339))
+	}
+	return query
+}
+
+// GetUsage reports the token usage and cost of the threads visible to the caller
+func (c *Client) GetUsage(ctx context.Context, opts UsageOptions) (*UsageReport, error) {
+	var resp UsageReport
+	if err := c.do(ctx, http.MethodGet, "/v1/usage", opts.query(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ThreadLogsOptions selects which log entries to return
+type ThreadLogsOptions struct {
+	Phase string
+	Tail  int
+}
+
+func (o ThreadLogsOptions) query() url.Values {
+	query := url.Values{}
+	if o.Phase != "" {
+		query.Set("phase", o.Phase)
+	}
+	if o.Tail > 0 {
+		query.Set("tail", strconv.Itoa(o.Tail))
+	}
+	return query
+}
+
+// ThreadLogs returns a thread's provisioning and container logs
+func (c *Client) ThreadLogs(ctx context.Context, threadID string, opts ThreadLogsOptions) (*ThreadLogs, error) {
+	var resp ThreadLogs
+	if err := c.do(ctx, http.MethodGet, threadPath(threadID, "logs"), opts.query(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateShare creates a share link granting role ("read" or "write") on a thread
+func (c *Client) CreateShare(ctx context.Context, threadID, role string) (*ShareResponse, error) {
+	var resp ShareResponse
+	if err := c.do(ctx, http.MethodPost, threadPath(threadID, "shares"), nil, ShareRequest{Role: role}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RevokeShare deletes a share link
+func (c *Client) RevokeShare(ctx context.Context, threadID, token string) error {
+	return c.do(ctx, http.MethodDelete, threadPath(threadID, "shares", token), nil, nil, nil)
+}
+
+// ListSecrets lists the secrets the caller may use
+func (c *Client) ListSecrets(ctx context.Context) (*SecretList, error) {
+	var resp SecretList
+	if err := c.do(ctx, http.MethodGet, "/v1/secrets", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// StoreSecret creates or replaces a secret
+func (c *Client) StoreSecret(ctx context.Context, req StoreSecretRequest) error {
+	return c.do(ctx, http.MethodPost, "/v1/secrets", nil, req, nil)
+}
+
+// DeleteSecret deletes a secret
+func (c *Client) DeleteSecret(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/secrets/"+url.PathEscape(name), nil, nil, nil)
+}
+
+// ListImages lists the registered worker images
+func (c *Client) ListImages(ctx context.Context) (*ImageList, error) {
+	var resp ImageList
+	if err := c.do(ctx, http.MethodGet, "/v1/images", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetImage returns the image registered under a content hash
+func (c *Client) GetImage(ctx context.Context, hash string) (*Image, error) {
+	var resp Image
+	if err := c.do(ctx, http.MethodGet, "/v1/images/"+url.PathEscape(hash), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RegisterImage records a built image under its content hash so threads may use it
+func (c *Client) RegisterImage(ctx context.Context, hash string, req RegisterImageRequest) (*Image, error) {
+	var resp Image
+	if err := c.do(ctx, http.MethodPut, "/v1/images/"+url.PathEscape(hash), nil, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteImage removes an image from the registry
+func (c *Client) DeleteImage(ctx context.Context, hash string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/images/"+url.PathEscape(hash), nil, nil, nil)
+}
+
+// ListTemplates lists the templates the caller may use
+func (c *Client) ListTemplates(ctx context.Context) (*TemplateList, error) {
+	var resp TemplateList
+	if err := c.do(ctx, http.MethodGet, "/v1/templates", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetTemplate returns a template
+func (c *Client) GetTemplate(ctx context.Context, name string) (*Template, error) {
+	var resp Template
+	if err := c.do(ctx, http.MethodGet, "/v1/templates/"+url.PathEscape(name), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// StoreTemplate creates or replaces a template
+func (c *Client) StoreTemplate(ctx context.Context, name string, settings TemplateSettings) (*Template, error) {
+	var resp Template
+	if err := c.do(ctx, http.MethodPut, "/v1/templates/"+url.PathEscape(name), nil, settings, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteTemplate deletes a template
+func (c *Client) DeleteTemplate(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/templates/"+url.PathEscape(name), nil, nil, nil)
+}
+
+// ListAgents lists the host agents registered with the server
+func (c *Client) ListAgents(ctx context.Context) (*AgentList, error) {
+	var resp AgentList
+	if err := c.do(ctx, http.MethodGet, "/v1/agents", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RegisterAgent registers a host agent, or takes over the registration of an
+// agent with the same name. It needs the agent token.
+func (c *Client) RegisterAgent(ctx context.Context, req RegisterAgentRequest) (*Agent, error) {
+	var resp Agent
+	if err := c.do(ctx, http.MethodPost, "/v1/agents", nil, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// PollAgentJobs waits up to wait for jobs for an agent. An empty list means
+// nothing arrived in time. Polling also tells the server the agent is alive.
+func (c *Client) PollAgentJobs(ctx context.Context, agentID string, wait time.Duration) (*AgentJobList, error) {
+	query := url.Values{}
+	query.Set("wait", wait.String())
+
+	var resp AgentJobList
+	if err := c.do(ctx, http.MethodGet, agentPath(agentID, "jobs"), query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UpdateAgentJob reports the progress of a start job
+func (c *Client) UpdateAgentJob(ctx context.Context, agentID, jobID string, update AgentJobUpdate) error {
+	return c.do(ctx, http.MethodPost, agentPath(agentID, "jobs", jobID, "status"), nil, update, nil)
+}
+
+// SendAgentJobLogs forwards a job's output to its thread's logs
+func (c *Client) SendAgentJobLogs(ctx context.Context, agentID, jobID string, logs []ThreadLogEntry) error {
+	return c.do(ctx, http.MethodPost, agentPath(agentID, "jobs", jobID, "logs"), nil, AgentJobLogs{Logs: logs}, nil)
+}
+
+// BuildImageRequest uploads a Dockerfile for the server to build and wrap
+type BuildImageRequest struct {
+	Dockerfile []byte
+	Source     string      // name of the Dockerfile, recorded in the registry
+	Context    io.Reader   // tar archive of the build context, optionally gzipped; empty if nil
+	Config     interface{} // wrap config, encoded as JSON
+	Rebuild    bool        // build even if an identical image is registered
+}
+
+// BuildImage uploads a Dockerfile and build context. The server builds in the
+// background; follow the returned build with FollowImageBuildLogs and
+// GetImageBuild. Uploads are not retried.
+func (c *Client) BuildImage(ctx context.Context, req BuildImageRequest) (*ImageBuild, error) {
+	config, err := json.Marshal(req.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal wrap config: %w", err)
+	}
+
+	// Stream the form so large contexts aren't held in memory
+	body, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeBuildForm(form, req, config))
+	}()
+
+	query := url.Values{}
+	if req.Rebuild {
+		query.Set("rebuild", "true")
+	}
+	resp, err := c.sendBody(ctx, http.MethodPost, "/v1/images", query, body, form.FormDataContentType())
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var build ImageBuild
+	if err := decodeResponse(resp, &build); err != nil {
+		return nil, err
+	}
+	return &build, nil
+}
+
+// writeBuildForm writes the parts of a BuildImage upload
+func writeBuildForm(form *multipart.Writer, req BuildImageRequest, config []byte) error {
+	if err := form.WriteField("config", string(config)); err != nil {
+		return err
+	}
+	if err := form.WriteField("source", req.Source); err != nil {
+		return err
+	}
+
+	part, err := form.CreateFormFile("dockerfile", "Dockerfile")
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(req.Dockerfile); err != nil {
+		return err
+	}
+
+	if req.Context != nil {
+		part, err := form.CreateFormFile("context", "context.tar")
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, req.Context); err != nil {
+			return fmt.Errorf("failed to upload build context: %w", err)
+		}
+	}
+	return form.Close()
+}
+
+// GetImageBuild returns the state of a server-side build
+func (c *Client) GetImageBuild(ctx context.Context, buildID string) (*ImageBuild, error) {
+	var resp ImageBuild
+	if err := c.do(ctx, http.MethodGet, imageBuildPath(buildID), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ImageBuildLogs returns a build's output so far
+func (c *Client) ImageBuildLogs(ctx context.Context, buildID string) (*ImageBuildLogs, error) {
+	var resp ImageBuildLogs
+	if err := c.do(ctx, http.MethodGet, imageBuildPath(buildID, "logs"), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// imageBuildPath builds /v1/images/builds/{id}/... with escaped segments
+func imageBuildPath(buildID string, segments ...string) string {
+	path := "/v1/images/builds/" + url.PathEscape(buildID)
+	for _, segment := range segments {
+		path += "/" + url.PathEscape(segment)
+	}
+	return path
+}
+
+// agentPath builds /v1/agents/{id}/... with escaped segments
+func agentPath(agentID string, segments ...string) string {
+	path := "/v1/agents/" + url.PathEscape(agentID)
+	for _, segment := range segments {
+		path += "/" + url.PathEscape(segment)
+	}
+	return path
+}
+
+// threadPath builds /v1/threads/{id}/... with escaped segments
+func threadPath(threadID string, segments ...string) string {
+	path := "/v1/threads/" + url.PathEscape(threadID)
+	for _, segment := range segments {
+		path += "/" + url.PathEscape(segment)
+	}
+	return path
+}
+
+// do sends a request with body encoded as JSON and decodes the response into out.
+// Idempotent requests are retried on network errors and temporary server errors.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+	}
+
+	retries := 0
+	if method == http.MethodGet || method == http.MethodPut || method == http.MethodDelete {
+		retries = c.maxRetries
+	}
+
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, query, payload)
+		retry := attempt < retries && ctx.Err() == nil && (err != nil || retryableStatus(resp.StatusCode))
+		if !retry {
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			return decodeResponse(resp, out)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send builds and sends a single request with an optional JSON payload
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, payload []byte) (*http.Response, error) {
+	if payload == nil {
+		return c.sendBody(ctx, method, path, query, nil, "")
+	}
+	return c.sendBody(ctx, method, path, query, bytes.NewReader(payload), "application/json")
+}
+
+// sendBody sends a single request with a body of the given content type
+func (c *Client) sendBody(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.user != "" {
+		req.Header.Set(UserHeader, c.user)
+	}
+	if c.team != "" {
+		req.Header.Set(TeamHeader, c.team)
+	}
+	if c.shareToken != "" {
+		req.Header.Set(ShareHeader, c.shareToken)
+	}
+	if c.agentToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.agentToken)
+	}
+	if c.workerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.workerToken)
+	}
+	tracing.InjectHeaders(ctx, req.Header)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	return resp, nil
+}
+
+// retryableStatus reports whether a response status is worth retrying
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// decodeResponse turns error statuses into *Error and decodes successful bodies into out
+func decodeResponse(resp *http.Response, out interface{}) error {
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(resp.Body)
+
+		var errResp ErrorResponse
+		if json.Unmarshal(body, &errResp) == nil && errResp.Error != nil {
+			errResp.Error.StatusCode = resp.StatusCode
+			return errResp.Error
+		}
+
+		// Not a /v1 error body, e.g. from a proxy in front of the server
+		return &Error{
+			StatusCode: resp.StatusCode,
+			Code:       http.StatusText(resp.StatusCode),
+			Message:    strings.TrimSpace(string(body)),
+		}
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetriesIdempotentRequests(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(ThreadList{Threads: []ThreadSummary{{ThreadID: "t1"}}})
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(3, time.Millisecond))
+	list, err := c.ListThreads(context.Background(), ListThreadsOptions{})
+	if err != nil {
+		t.Fatalf("Expected retries to succeed, got %v", err)
+	}
+	if len(list.Threads) != 1 || attempts.Load() != 3 {
+		t.Fatalf("Expected 1 thread after 3 attempts, got %d threads after %d attempts", len(list.Threads), attempts.Load())
+	}
+}
+
+func TestDoesNotRetryPosts(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(3, time.Millisecond))
+	if _, err := c.StartThread(context.Background(), StartThreadRequest{}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if attempts.Load() != 1 {
+		t.Fatalf("Expected a single attempt, got %d", attempts.Load())
+	}
+}
+
+func TestDecodesErrorsAndSendsCaller(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(UserHeader) != "alice" || r.Header.Get(TeamHeader) != "core" {
+			t.Errorf("Expected caller headers, got %v", r.Header)
+		}
+		if r.URL.EscapedPath() != "/v1/threads/a%2Fb" {
+			t.Errorf("Expected escaped thread ID, got %s", r.URL.EscapedPath())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: &Error{Code: "not_found", Message: "Thread not found"}})
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithCaller("alice", "core"), WithRetries(0, 0))
+	_, err := c.GetThread(context.Background(), "a/b", GetThreadOptions{})
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Expected *Error, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusNotFound || apiErr.Code != "not_found" || apiErr.Message != "Thread not found" {
+		t.Fatalf("Unexpected error %+v", apiErr)
+	}
+	if !IsNotFound(err) {
+		t.Fatal("Expected IsNotFound to be true")
+	}
+}
+
+func TestFollowLogs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("follow") != "true" || r.URL.Query().Get("phase") != "container" {
+			t.Errorf("Unexpected query %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		encoder.Encode(ThreadLogEntry{Phase: "container", Message: "first"})
+		encoder.Encode(ThreadLogEntry{Phase: "container", Message: "second"})
+	}))
+	defer server.Close()
+
+	var messages []string
+	err := New(server.URL).FollowLogs(context.Background(), "t1", ThreadLogsOptions{Phase: "container"}, func(entry ThreadLogEntry) error {
+		messages = append(messages, entry.Message)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("FollowLogs failed: %v", err)
+	}
+	if len(messages) != 2 || messages[0] != "first" || messages[1] != "second" {
+		t.Fatalf("Expected both entries, got %v", messages)
+	}
+}
+
+func TestWatchPendingMessagesAdvancesCursor(t *testing.T) {
+	var afters []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		after := r.URL.Query().Get("after")
+		afters = append(afters, after)
+
+		var list MessageList
+		switch after {
+		case "":
+			list.Messages = []Message{{ID: "1", Content: "one"}, {ID: "2", Content: "two"}}
+		case "2":
+			list.Messages = []Message{{ID: "3", Content: "three"}}
+		}
+		json.NewEncoder(w).Encode(list)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var got []string
+	err := New(server.URL).WatchPendingMessages(ctx, "t1", "", time.Millisecond, func(message Message) error {
+		got = append(got, message.Content)
+		if len(got) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected cancellation to end the watch cleanly, got %v", err)
+	}
+	if len(got) != 3 || got[2] != "three" {
+		t.Fatalf("Expected three messages, got %v", got)
+	}
+	if len(afters) < 2 || afters[1] != "2" {
+		t.Fatalf("Expected the second poll to continue after message 2, got %v", afters)
+	}
+}
@@ -0,0 +1,530 @@
+package client
+
+import (
+	"time"
+
+	superdev "superdev/cmd/superdev/cliwrapper"
+)
+
+// StartThreadRequest describes a new thread: the worker image, the repository to
+// work on and the first prompt
+type StartThreadRequest struct {
+	RepositoryLink string      `json:"repository_link"`
+	ContextFiles   [][]byte    `json:"context_files,omitempty"`
+	DockerImage    string      `json:"docker_image,omitempty"` // built from the repository's devcontainer.json if empty
+	ServerURL      string      `json:"server_url,omitempty"`
+	Prompt         string      `json:"prompt,omitempty"`
+	Title          string      `json:"title,omitempty"` // defaults to the first line of the prompt
+	Team           string      `json:"team,omitempty"`
+	Secrets        []SecretRef `json:"secrets,omitempty"`
+
+	// Template names a stored template to start from; the fields above and
+	// below override its settings when set
+	Template string            `json:"template,omitempty"`
+	Priority int               `json:"priority,omitempty"` // -10 to 10; queued starts with a higher priority start first
+	Ref      string            `json:"ref,omitempty"`      // branch, tag or commit to check out instead of main
+	Guidance map[string][]byte `json:"guidance,omitempty"` // files for /workdir/guidance, keyed by name
+	Sandbox  *SandboxPolicy    `json:"sandbox,omitempty"`
+
+	// ToolPolicy restricts the tools the agent may use
+	ToolPolicy *ToolPolicy `json:"tool_policy,omitempty"`
+
+	// Budget is how much, in US dollars, the thread may spend on inference;
+	// once spent it takes no more messages. No limit if zero.
+	Budget float64 `json:"budget,omitempty"`
+
+	// AgentLabels restricts the thread to host agents carrying all of these labels
+	AgentLabels map[string]string `json:"agent_labels,omitempty"`
+}
+
+// SandboxPolicy limits the resources a thread's container may use
+type SandboxPolicy struct {
+	Memory    string `json:"memory,omitempty"` // Docker memory limit such as "4g"
+	CPUs      string `json:"cpus,omitempty"`   // number of CPUs such as "1.5"
+	PidsLimit int    `json:"pids_limit,omitempty"`
+}
+
+// StartThreadResponse is returned when a thread is started
+type StartThreadResponse struct {
+	ThreadID string `json:"thread_id"`
+}
+
+// Snapshot describes a workspace snapshot taken with a worker's answer
+type Snapshot struct {
+	MessageID string    `json:"message_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Base      string    `json:"base"`  // commit the changes are against
+	Files     []string  `json:"files"` // paths changed since base
+	Size      int       `json:"size"`  // bytes in the patch
+}
+
+// SnapshotList is a thread's workspace snapshots, oldest first
+type SnapshotList struct {
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// SnapshotDiff is the difference between two of a thread's workspace snapshots
+type SnapshotDiff struct {
+	From string `json:"from,omitempty"` // empty for the commit the thread started from
+	To   string `json:"to"`
+	Diff string `json:"diff"` // git diff with binary changes
+}
+
+// ForkThreadRequest starts a new thread from another thread's history
+type ForkThreadRequest struct {
+	Prompt string `json:"prompt,omitempty"` // first message of the fork, if any
+	Title  string `json:"title,omitempty"`  // defaults to the original thread's title
+}
+
+// StoreMessageRequest is a human message for a thread
+type StoreMessageRequest struct {
+	Prompt string `json:"prompt"`
+}
+
+// AnswerMessageRequest is a worker's response to the pending messages of a thread
+type AnswerMessageRequest struct {
+	Payload string                 `json:"payload"`
+	Deltas  []superdev.ThreadDelta `json:"deltas,omitempty"` // worker-reported deltas, used for usage accounting
+
+	// Workspace is the state of the repository after the turn
+	Workspace *WorkspaceSnapshot `json:"workspace,omitempty"`
+}
+
+// WorkspaceSnapshot is the state of a thread's repository: its changes as a
+// binary git diff against the commit the thread started from
+type WorkspaceSnapshot struct {
+	Base  string `json:"base"`
+	Patch []byte `json:"patch,omitempty"`
+}
+
+// MessageResponse identifies a stored message
+type MessageResponse struct {
+	MessageID string `json:"message_id"`
+}
+
+// Message is an input message delivered to a worker
+type Message struct {
+	ID          string `json:"id"`
+	Content     string `json:"content"`
+	TraceParent string `json:"traceparent,omitempty"`
+
+	// Workspace is set when the message asks the worker to restore the
+	// repository to this snapshot instead of running a prompt
+	Workspace *WorkspaceSnapshot `json:"workspace,omitempty"`
+}
+
+// MessageList is the pending input messages of a thread
+type MessageList struct {
+	Messages []Message `json:"messages"`
+}
+
+// Thread lifecycle statuses
+const (
+	ThreadStatusQueued    = "queued" // waiting for a scheduler slot
+	ThreadStatusRunning   = "running"
+	ThreadStatusCompleted = "completed" // the worker exited cleanly
+	ThreadStatusFailed    = "failed"
+	ThreadStatusCancelled = "cancelled"
+)
+
+// Message directions
+const (
+	DirectionInput  = "input"
+	DirectionOutput = "output"
+)
+
+// ThreadMessage is a message in a thread's history
+type ThreadMessage struct {
+	ID          string    `json:"id"`
+	Output      string    `json:"output"`
+	Direction   string    `json:"direction"`        // "input" for prompts, "output" for worker responses
+	Status      string    `json:"status,omitempty"` // "processing", "completed", or "error"
+	CreatedAt   time.Time `json:"created_at"`       // For cleanup purposes
+	PulledAt    time.Time `json:"-"`                // When a worker first pulled this message
+	TraceParent string    `json:"traceparent,omitempty"`
+	Error       string    `json:"error,omitempty"`    // Error message if status is "error"
+	Snapshot    bool      `json:"snapshot,omitempty"` // a workspace snapshot was taken with this answer
+
+	// Restore is the snapshot an input message asks the worker to restore
+	Restore *WorkspaceSnapshot `json:"-"`
+}
+
+// Tool approval statuses
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// TimeoutDecider is the DecidedBy of approvals rejected because nobody decided
+// before they expired
+const TimeoutDecider = "timeout"
+
+// ToolApproval is a tool run the agent is waiting for a human to approve
+type ToolApproval struct {
+	ID        string                 `json:"id"`
+	ToolUseID string                 `json:"tool_use_id"`
+	Tool      string                 `json:"tool"`
+	Input     map[string]interface{} `json:"input,omitempty"`
+	Status    string                 `json:"status"` // one of the Approval statuses
+	CreatedAt time.Time              `json:"created_at"`
+	DecidedBy string                 `json:"decided_by,omitempty"` // "policy" when the thread's tool policy decided, "timeout" when nobody did
+	DecidedAt time.Time              `json:"decided_at,omitzero"`
+	ExpiresAt time.Time              `json:"expires_at,omitzero"` // when a pending approval is rejected if nobody has decided
+	Reason    string                 `json:"reason,omitempty"`    // how the tool use broke the tool policy
+}
+
+// ApprovalList is a thread's tool approvals, oldest first
+type ApprovalList struct {
+	Approvals []ToolApproval `json:"approvals"`
+}
+
+// RequestApprovalRequest asks a human to approve a tool run, or records the
+// decision the thread's tool policy made about it
+type RequestApprovalRequest struct {
+	ToolUseID string                 `json:"tool_use_id"`
+	Tool      string                 `json:"tool"`
+	Input     map[string]interface{} `json:"input,omitempty"`
+	Decision  string                 `json:"decision,omitempty"` // "approved" or "rejected" when the tool policy decided
+	Reason    string                 `json:"reason,omitempty"`
+}
+
+// ApprovalDecision approves or rejects a tool run
+type ApprovalDecision struct {
+	Approved bool `json:"approved"`
+}
+
+// Usage is the tokens a thread's inferences used and what they cost
+type Usage struct {
+	Inferences       int     `json:"inferences"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost"` // US dollars, from the server's price table
+}
+
+// Add adds other's usage to u
+func (u *Usage) Add(other Usage) {
+	u.Inferences += other.Inferences
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+	u.Cost += other.Cost
+}
+
+// What usage reports can be grouped by
+const (
+	UsageByThread   = "thread"
+	UsageByUser     = "user"
+	UsageByTemplate = "template"
+)
+
+// UsageReport is the usage of the threads visible to the caller, grouped by
+// thread, owner or template
+type UsageReport struct {
+	GroupBy string       `json:"group_by"`
+	Since   time.Time    `json:"since,omitzero"` // only inferences from then on are counted
+	Groups  []UsageGroup `json:"groups"`         // by cost, highest first
+	Total   Usage        `json:"total"`
+}
+
+// UsageGroup is the usage of a thread, a user's threads or a template's threads
+type UsageGroup struct {
+	Key     string `json:"key"` // thread ID, user or template; empty for threads without a template
+	Threads int    `json:"threads"`
+	Usage
+}
+
+// Thread is a thread's metadata and a page of its messages
+type Thread struct {
+	ThreadID         string           `json:"thread_id"`
+	Title            string           `json:"title"`
+	Repository       string           `json:"repository"`
+	Image            string           `json:"image"`
+	Template         string           `json:"template,omitempty"`
+	Status           string           `json:"status"`
+	QueuePosition    int              `json:"queue_position,omitempty"` // 1-based, while queued
+	Owner            string           `json:"owner,omitempty"`
+	Team             string           `json:"team,omitempty"`
+	ContainerID      string           `json:"container_id,omitempty"`
+	Agent            string           `json:"agent,omitempty"`             // host agent running the container; empty for the server's own daemon
+	ForkedFrom       string           `json:"forked_from,omitempty"`       // thread this one was forked from
+	ForkedAt         string           `json:"forked_at,omitempty"`         // last message copied from that thread
+	PendingApprovals int              `json:"pending_approvals,omitempty"` // tool runs waiting for a human
+	Usage            *Usage           `json:"usage,omitempty"`             // absent until the worker reports an inference
+	CreatedAt        time.Time        `json:"created_at"`
+	MessageCount     int              `json:"message_count"`
+	Messages         []*ThreadMessage `json:"messages"`
+	HasMore          bool             `json:"has_more"` // more messages follow the last one returned
+}
+
+// ThreadSummary is the listing entry for a thread
+type ThreadSummary struct {
+	ThreadID         string    `json:"thread_id"`
+	Title            string    `json:"title"`
+	Repository       string    `json:"repository"`
+	Image            string    `json:"image"`
+	Status           string    `json:"status"`
+	QueuePosition    int       `json:"queue_position,omitempty"` // 1-based, while queued
+	Owner            string    `json:"owner,omitempty"`
+	Team             string    `json:"team,omitempty"`
+	PendingApprovals int       `json:"pending_approvals,omitempty"` // tool runs waiting for a human
+	Usage            *Usage    `json:"usage,omitempty"`
+	Messages         int       `json:"message_count"`
+	InputCount       int       `json:"input_count"`
+	OutputCount      int       `json:"output_count"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"` // when the last message was added
+}
+
+// ThreadList is a page of thread summaries
+type ThreadList struct {
+	Threads    []ThreadSummary `json:"threads"`
+	Total      int             `json:"total"`                 // threads matching the filters, across all pages
+	NextCursor string          `json:"next_cursor,omitempty"` // pass as cursor to fetch the next page
+}
+
+// CancelResponse is returned when a thread is cancelled
+type CancelResponse struct {
+	ThreadID string `json:"thread_id"`
+	Status   string `json:"status"`
+}
+
+// ThreadLogEntry is a single line of a thread's provisioning or container output
+type ThreadLogEntry struct {
+	Time    time.Time `json:"time"`
+	Phase   string    `json:"phase"`
+	Stream  string    `json:"stream,omitempty"` // "stdout", "stderr" or empty for server messages
+	Message string    `json:"message"`
+}
+
+// ThreadLogs is a thread's persisted logs
+type ThreadLogs struct {
+	ThreadID string           `json:"thread_id"`
+	Logs     []ThreadLogEntry `json:"logs"`
+}
+
+// ShareRequest asks for a share link granting role on a thread
+type ShareRequest struct {
+	Role string `json:"role"`
+}
+
+// ShareResponse describes a newly created share link
+type ShareResponse struct {
+	ThreadID string `json:"thread_id"`
+	Token    string `json:"token"`
+	Role     string `json:"role"`
+	URL      string `json:"url"`
+}
+
+// SecretRef selects a secret for a thread and how it is exposed
+type SecretRef struct {
+	Name  string `json:"name"`
+	Mount string `json:"mount,omitempty"` // "env" (default) or "file"
+}
+
+// SecretSummary describes a secret without its value
+type SecretSummary struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner,omitempty"`
+	Team      string    `json:"team,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SecretList is the secrets a caller may use
+type SecretList struct {
+	Secrets []SecretSummary `json:"secrets"`
+}
+
+// StoreSecretRequest creates or replaces a secret
+type StoreSecretRequest struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Team  string `json:"team,omitempty"`
+}
+
+// Image is a wrapped worker image in the server's registry
+type Image struct {
+	Hash       string    `json:"hash"` // sha256 of the source Dockerfile and wrap config
+	Tag        string    `json:"tag"`
+	Source     string    `json:"source,omitempty"` // Dockerfile the image was built from
+	Distro     string    `json:"distro,omitempty"`
+	AmpVersion string    `json:"amp_version,omitempty"`
+	ImageID    string    `json:"image_id,omitempty"` // Docker image ID the server saw when the image was registered
+	Owner      string    `json:"owner,omitempty"`
+	Team       string    `json:"team,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitzero"`
+}
+
+// ImageList is the registered images, newest first
+type ImageList struct {
+	Images []Image `json:"images"`
+}
+
+// RegisterImageRequest records a built image
+type RegisterImageRequest struct {
+	Tag        string `json:"tag"`
+	Source     string `json:"source,omitempty"`
+	Distro     string `json:"distro,omitempty"`
+	AmpVersion string `json:"amp_version,omitempty"`
+}
+
+// TemplateSettings are the thread settings a template stores. Any of them may be
+// overridden when a thread is started from the template.
+type TemplateSettings struct {
+	Description    string            `json:"description,omitempty"`
+	DockerImage    string            `json:"docker_image,omitempty"`
+	RepositoryLink string            `json:"repository_link,omitempty"`
+	Ref            string            `json:"ref,omitempty"`
+	ContextFiles   [][]byte          `json:"context_files,omitempty"`
+	Guidance       map[string][]byte `json:"guidance,omitempty"`
+	ServerURL      string            `json:"server_url,omitempty"`
+	Sandbox        *SandboxPolicy    `json:"sandbox,omitempty"`
+	ToolPolicy     *ToolPolicy       `json:"tool_policy,omitempty"`
+	Budget         float64           `json:"budget,omitempty"` // US dollars each thread may spend
+	Secrets        []SecretRef       `json:"secrets,omitempty"`
+	PromptPrefix   string            `json:"prompt_prefix,omitempty"` // prepended to the first prompt
+	Team           string            `json:"team,omitempty"`          // team the template is shared with
+}
+
+// Template is a named preset for starting threads
+type Template struct {
+	Name string `json:"name"`
+	TemplateSettings
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TemplateList is the templates a caller may use, sorted by name
+type TemplateList struct {
+	Templates []Template `json:"templates"`
+}
+
+// Image build statuses
+const (
+	BuildStatusBuilding  = "building"
+	BuildStatusSucceeded = "succeeded"
+	BuildStatusFailed    = "failed"
+)
+
+// ImageBuild is a server-side build of an uploaded Dockerfile
+type ImageBuild struct {
+	ID         string    `json:"id"`
+	Hash       string    `json:"hash"`
+	Tag        string    `json:"tag"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Reused     bool      `json:"reused,omitempty"` // an identical image was already registered
+	Image      *Image    `json:"image,omitempty"`  // set once the build succeeds
+	Owner      string    `json:"owner,omitempty"`
+	Team       string    `json:"team,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+}
+
+// ImageBuildLogEntry is one line of build output
+type ImageBuildLogEntry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// ImageBuildLogs is a build's output so far
+type ImageBuildLogs struct {
+	BuildID string               `json:"build_id"`
+	Status  string               `json:"status"`
+	Logs    []ImageBuildLogEntry `json:"logs"`
+}
+
+// Host agent statuses
+const (
+	AgentStatusOnline  = "online"
+	AgentStatusOffline = "offline" // hasn't polled for jobs recently
+)
+
+// RegisterAgentRequest announces a host agent and what it can run
+type RegisterAgentRequest struct {
+	Name     string            `json:"name"`
+	Capacity int               `json:"capacity"` // threads the agent runs at once
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// Agent is a host agent that provisions thread containers on its own machine
+type Agent struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Capacity     int               `json:"capacity"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Status       string            `json:"status"`
+	Threads      []string          `json:"threads"` // threads placed on the agent
+	RegisteredAt time.Time         `json:"registered_at"`
+	LastSeenAt   time.Time         `json:"last_seen_at"`
+}
+
+// AgentList is the registered host agents, sorted by name
+type AgentList struct {
+	Agents []Agent `json:"agents"`
+}
+
+// Agent job kinds
+const (
+	AgentJobStart = "start" // clone the repository and start the thread's container
+	AgentJobStop  = "stop"  // stop a thread's container
+)
+
+// AgentJob is work for a host agent. Start jobs carry everything needed to
+// provision the thread, including secret values.
+type AgentJob struct {
+	ID             string            `json:"id"`
+	Kind           string            `json:"kind"`
+	ThreadID       string            `json:"thread_id"`
+	ContainerID    string            `json:"container_id,omitempty"` // for stop jobs
+	RepositoryLink string            `json:"repository_link,omitempty"`
+	Ref            string            `json:"ref,omitempty"`
+	DockerImage    string            `json:"docker_image,omitempty"`
+	ServerURL      string            `json:"server_url,omitempty"`
+	ContextFiles   [][]byte          `json:"context_files,omitempty"`
+	Guidance       map[string][]byte `json:"guidance,omitempty"`
+	Sandbox        *SandboxPolicy    `json:"sandbox,omitempty"`
+	Secrets        []AgentSecret     `json:"secrets,omitempty"`
+	TraceParent    string            `json:"traceparent,omitempty"`
+}
+
+// AgentSecret is a resolved secret for an agent to inject into a container
+type AgentSecret struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Mount string `json:"mount"`
+}
+
+// AgentJobList is the jobs handed to an agent by one poll
+type AgentJobList struct {
+	Jobs []AgentJob `json:"jobs"`
+}
+
+// Agent job statuses reported by agents
+const (
+	JobStatusAccepted = "accepted" // the agent received the job
+	JobStatusStarted  = "started"  // the container is running
+	JobStatusFailed   = "failed"   // provisioning failed
+	JobStatusExited   = "exited"   // the container has stopped
+)
+
+// AgentJobUpdate reports the progress of a job
+type AgentJobUpdate struct {
+	Status      string `json:"status"`
+	ContainerID string `json:"container_id,omitempty"`
+	Image       string `json:"image,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// AgentJobLogs is provisioning and container output forwarded by an agent
+type AgentJobLogs struct {
+	Logs []ThreadLogEntry `json:"logs"`
+}
+
+// ErrorResponse is the body of every /v1 error
+type ErrorResponse struct {
+	Error *Error `json:"error"`
+}
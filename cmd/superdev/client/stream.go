@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultPollInterval is how often the watch helpers poll the server
+const DefaultPollInterval = time.Second
+
+// watchPageSize is how many messages WatchThread fetches per request
+const watchPageSize = 100
+
+// FollowLogs streams a thread's log entries to fn until ctx is cancelled, the
+// server closes the stream or fn returns an error
+func (c *Client) FollowLogs(ctx context.Context, threadID string, opts ThreadLogsOptions, fn func(ThreadLogEntry) error) error {
+	query := opts.query()
+	query.Set("follow", "true")
+
+	resp, err := c.send(ctx, http.MethodGet, threadPath(threadID, "logs"), query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeResponse(resp, nil)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var entry ThreadLogEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to decode log entry: %w", err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// FollowImageBuildLogs streams a server-side build's output to fn until the build
+// finishes, ctx is cancelled or fn returns an error. Use GetImageBuild afterwards
+// for the outcome.
+func (c *Client) FollowImageBuildLogs(ctx context.Context, buildID string, fn func(ImageBuildLogEntry) error) error {
+	query := url.Values{}
+	query.Set("follow", "true")
+
+	resp, err := c.send(ctx, http.MethodGet, imageBuildPath(buildID, "logs"), query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeResponse(resp, nil)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var entry ImageBuildLogEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to decode build log entry: %w", err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// WatchPendingMessages polls for a thread's input messages after the given message
+// ID and passes each new one to fn. Used by workers. It returns when ctx is
+// cancelled, a request fails or fn returns an error.
+func (c *Client) WatchPendingMessages(ctx context.Context, threadID, after string, interval time.Duration, fn func(Message) error) error {
+	return poll(ctx, interval, func() error {
+		messages, err := c.PullMessages(ctx, threadID, after)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			if err := fn(message); err != nil {
+				return err
+			}
+			after = message.ID
+		}
+		return nil
+	})
+}
+
+// WatchThread polls a thread and passes each message after the given message ID
+// to fn. Pass an empty ID to receive the whole thread. It returns when ctx is
+// cancelled, a request fails or fn returns an error.
+func (c *Client) WatchThread(ctx context.Context, threadID, after string, interval time.Duration, fn func(*ThreadMessage) error) error {
+	return poll(ctx, interval, func() error {
+		for {
+			thread, err := c.GetThread(ctx, threadID, GetThreadOptions{After: after, Limit: watchPageSize})
+			if err != nil {
+				return err
+			}
+			for _, message := range thread.Messages {
+				if err := fn(message); err != nil {
+					return err
+				}
+				after = message.ID
+			}
+			if !thread.HasMore {
+				return nil
+			}
+		}
+	})
+}
+
+// poll calls fn immediately and then every interval until it fails or ctx is done.
+// Cancellation is not reported as an error.
+func poll(ctx context.Context, interval time.Duration, fn func() error) error {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := fn(); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// How a thread's runner handles tool uses that break its tool policy
+const (
+	PolicyReject   = "reject"   // reject the tool run without asking anyone
+	PolicyEscalate = "escalate" // ask a human whether the tool may run
+)
+
+// PolicyDecider is who tool approvals decided by a thread's tool policy are attributed to
+const PolicyDecider = "policy"
+
+// Input fields holding the command of shell tools and the paths of file tools
+var (
+	commandInputs = []string{"cmd", "command"}
+	pathInputs    = []string{"path", "file_path", "cwd"}
+)
+
+// ToolPolicy restricts the tools a thread's agent may use. The runner checks
+// every tool use against it.
+type ToolPolicy struct {
+	AllowedTools   []string `json:"allowed_tools,omitempty"`   // tool names the agent may use; any if empty
+	DeniedCommands []string `json:"denied_commands,omitempty"` // regular expressions for shell commands the agent may not run
+	AllowedPaths   []string `json:"allowed_paths,omitempty"`   // files and directories, relative to the repository, tools may touch; any if empty
+	OnViolation    string   `json:"on_violation,omitempty"`    // "reject" (default) or "escalate"
+}
+
+// Validate checks that the policy's command patterns compile and its paths
+// stay inside the repository
+func (p *ToolPolicy) Validate() error {
+	if p.OnViolation != "" && p.OnViolation != PolicyReject && p.OnViolation != PolicyEscalate {
+		return fmt.Errorf("invalid on_violation %q, must be %s or %s", p.OnViolation, PolicyReject, PolicyEscalate)
+	}
+	for _, pattern := range p.DeniedCommands {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid denied command %q: %w", pattern, err)
+		}
+	}
+	for _, path := range p.AllowedPaths {
+		if !filepath.IsLocal(path) {
+			return fmt.Errorf("invalid allowed path %q, must be relative to the repository", path)
+		}
+	}
+	return nil
+}
+
+// Check returns why a tool use breaks the policy, or "" if it doesn't. Relative
+// paths in the tool's input are resolved against root, the repository.
+func (p *ToolPolicy) Check(tool string, input map[string]interface{}, root string) string {
+	if len(p.AllowedTools) > 0 && !slices.Contains(p.AllowedTools, tool) {
+		return fmt.Sprintf("tool %s isn't allowed", tool)
+	}
+
+	for _, key := range commandInputs {
+		command, ok := input[key].(string)
+		if !ok {
+			continue
+		}
+		for _, pattern := range p.DeniedCommands {
+			if matched, _ := regexp.MatchString(pattern, command); matched {
+				return fmt.Sprintf("command %q matches denied pattern %q", command, pattern)
+			}
+		}
+	}
+
+	if len(p.AllowedPaths) == 0 {
+		return ""
+	}
+	for _, key := range pathInputs {
+		path, ok := input[key].(string)
+		if !ok {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		relative, err := filepath.Rel(root, filepath.Clean(path))
+		if err != nil || !p.pathAllowed(relative) {
+			return fmt.Sprintf("path %s is outside the allowed paths", input[key])
+		}
+	}
+	return ""
+}
+
+// pathAllowed reports whether a path relative to the repository is one of the
+// allowed paths or inside one of them
+func (p *ToolPolicy) pathAllowed(relative string) bool {
+	for _, allowed := range p.AllowedPaths {
+		allowed = filepath.Clean(allowed)
+		if allowed == "." {
+			if filepath.IsLocal(relative) {
+				return true
+			}
+			continue
+		}
+		if relative == allowed || strings.HasPrefix(relative, allowed+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package client
+
+import "testing"
+
+func TestToolPolicyCheck(t *testing.T) {
+	policy := &ToolPolicy{
+		AllowedTools:   []string{"Bash", "Read", "edit_file"},
+		DeniedCommands: []string{`^git push`, `rm -rf /`},
+		AllowedPaths:   []string{"src", "README.md"},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		tool   string
+		input  map[string]interface{}
+		denied bool
+	}{
+		{"allowed command", "Bash", map[string]interface{}{"cmd": "go test ./..."}, false},
+		{"denied command", "Bash", map[string]interface{}{"cmd": "git push --force"}, true},
+		{"denied command key", "Bash", map[string]interface{}{"command": "sudo rm -rf /"}, true},
+		{"unknown tool", "web_search", map[string]interface{}{"query": "go"}, true},
+		{"allowed file", "Read", map[string]interface{}{"path": "README.md"}, false},
+		{"allowed directory", "edit_file", map[string]interface{}{"path": "/workdir/repo/src/app/main.go"}, false},
+		{"sibling with prefix", "edit_file", map[string]interface{}{"path": "srcs/main.go"}, true},
+		{"outside repository", "Read", map[string]interface{}{"path": "../../etc/passwd"}, true},
+		{"absolute outside", "Read", map[string]interface{}{"file_path": "/etc/passwd"}, true},
+		{"working directory", "Bash", map[string]interface{}{"cmd": "ls", "cwd": "docs"}, true},
+	} {
+		reason := policy.Check(tc.tool, tc.input, "/workdir/repo")
+		if (reason != "") != tc.denied {
+			t.Errorf("%s: expected denied=%v, got reason %q", tc.name, tc.denied, reason)
+		}
+	}
+
+	// Without allowed paths or tools only the command patterns apply
+	open := &ToolPolicy{DeniedCommands: []string{"^curl"}}
+	if reason := open.Check("anything", map[string]interface{}{"path": "/etc/hosts"}, "/workdir/repo"); reason != "" {
+		t.Errorf("Expected an open policy to allow any path, got %q", reason)
+	}
+	if reason := (&ToolPolicy{AllowedPaths: []string{"."}}).Check("Read", map[string]interface{}{"path": "deep/file"}, "/workdir/repo"); reason != "" {
+		t.Errorf("Expected . to allow the whole repository, got %q", reason)
+	}
+}
+
+func TestToolPolicyValidate(t *testing.T) {
+	valid := &ToolPolicy{DeniedCommands: []string{`^git (push|reset)`}, AllowedPaths: []string{"src/app", "."}, OnViolation: PolicyEscalate}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Expected a valid policy, got %v", err)
+	}
+	for name, policy := range map[string]*ToolPolicy{
+		"pattern":      {DeniedCommands: []string{"(unclosed"}},
+		"absolute":     {AllowedPaths: []string{"/etc"}},
+		"escape":       {AllowedPaths: []string{"src/../../other"}},
+		"on_violation": {OnViolation: "ignore"},
+	} {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("Expected an invalid %s to be rejected", name)
+		}
+	}
+}
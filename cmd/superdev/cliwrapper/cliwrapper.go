@@ -2,9 +2,11 @@ package superdev
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"sync"
 	"time"
@@ -20,8 +22,20 @@ type AmpClient struct {
 
 // NewAmpClient creates a new client for the Amp CLI worker
 func NewAmpClient() (*AmpClient, error) {
+	return NewAmpClientWithEnv(nil)
+}
+
+// NewAmpClientWithEnv creates a new client for an Amp CLI worker run with
+// extra environment variables
+func NewAmpClientWithEnv(env []string) (*AmpClient, error) {
+	return newAmpClient(env, "worker")
+}
+
+// newAmpClient starts amp with args and extra environment variables
+func newAmpClient(env []string, args ...string) (*AmpClient, error) {
 	// Create command
-	cmd := exec.Command("amp", "worker")
+	cmd := exec.Command("amp", args...)
+	cmd.Env = append(os.Environ(), env...)
 
 	// Get stdin and stdout pipes
 	stdin, err := cmd.StdinPipe()
@@ -55,6 +69,23 @@ func NewAmpClient() (*AmpClient, error) {
 
 // Call sends an RPC request to the worker and returns the raw response
 func (c *AmpClient) Call(method string, args []interface{}) (string, error) {
+	if err := c.send(method, args); err != nil {
+		return "", err
+	}
+
+	// Read response
+	if !c.stdout.Scan() {
+		if err := c.stdout.Err(); err != nil {
+			return "", fmt.Errorf("failed to read response: %w", err)
+		}
+		return "", fmt.Errorf("unexpected EOF")
+	}
+
+	return c.stdout.Text(), nil
+}
+
+// send writes an RPC request to the worker without waiting for its response
+func (c *AmpClient) send(method string, args []interface{}) error {
 	// Create request
 	request := map[string]interface{}{
 		"streamId": c.nextID,
@@ -66,22 +97,13 @@ func (c *AmpClient) Call(method string, args []interface{}) (string, error) {
 	// Marshal and send request
 	requestJSON, err := json.Marshal(request)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+		return fmt.Errorf("failed to marshal request: %w", err)
 	}
 
 	if _, err := c.stdin.Write(append(requestJSON, '\n')); err != nil {
-		return "", fmt.Errorf("failed to write request: %w", err)
+		return fmt.Errorf("failed to write request: %w", err)
 	}
-
-	// Read response
-	if !c.stdout.Scan() {
-		if err := c.stdout.Err(); err != nil {
-			return "", fmt.Errorf("failed to read response: %w", err)
-		}
-		return "", fmt.Errorf("unexpected EOF")
-	}
-
-	return c.stdout.Text(), nil
+	return nil
 }
 
 // Shutdown closes the client
@@ -364,3 +386,194 @@ func ContinueThreadWithPrompt(prompt string, threadID string, messages []AmpMess
 
 	return ch, cleanup, nil
 }
+
+// ToolDecider decides whether a tool run waiting for the user to accept it may go ahead
+type ToolDecider func(toolUse AmpContent) (bool, error)
+
+// confirmAllSettings are Amp settings that make it ask for confirmation before
+// every tool run, so that no run starts before it has been decided
+const confirmAllSettings = `{"amp.permissions": [{"tool": "*", "action": "ask"}]}`
+
+// RunThreadTurn sends a prompt to a thread on a new worker, run with extra
+// environment variables, and observes the thread until the assistant has
+// answered. Tool runs waiting for the user are passed to decide, and the
+// decisions are sent back as user:tool-input deltas. With confirmAll, Amp asks
+// before every tool run instead of only the ones it considers risky. It returns
+// the thread as last observed, and an inference:completed delta with the usage
+// of each of the turn's inferences. Ending ctx kills the worker and returns
+// ctx's error.
+func RunThreadTurn(ctx context.Context, threadID, prompt string, env []string, confirmAll bool, decide ToolDecider) (*AmpThread, []ThreadDelta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	args := []string{"worker"}
+	if confirmAll {
+		settings, err := os.CreateTemp("", "amp-settings-*.json")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create amp settings: %w", err)
+		}
+		defer os.Remove(settings.Name())
+		_, err = settings.WriteString(confirmAllSettings)
+		if closeErr := settings.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to write amp settings: %w", err)
+		}
+		args = []string{"--settings-file", settings.Name(), "worker"}
+	}
+	client, err := newAmpClient(env, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	defer client.Shutdown()
+	stop := context.AfterFunc(ctx, func() { client.cmd.Process.Kill() })
+	defer stop()
+	// A killed worker fails whatever call was in flight; report why it was killed
+	failed := func(err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+
+	// The worker picks the thread up where the previous turn left it
+	response, err := client.Call("startThreadWorker", []interface{}{threadID})
+	if err != nil {
+		return nil, nil, failed(fmt.Errorf("failed to start thread worker: %w", err))
+	}
+	var respObj AmpWorkerResponse
+	if err := json.Unmarshal([]byte(response), &respObj); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse start response: %w", err)
+	}
+	if respObj.StreamEvent != "next" {
+		return nil, nil, fmt.Errorf("unexpected start response: %s", response)
+	}
+
+	delta := ThreadDelta{
+		Type: ThreadDeltaUserMessage,
+		Message: &ThreadUserMessage{
+			Content: []map[string]interface{}{{"type": "text", "text": prompt}},
+		},
+	}
+	if _, err := client.Call("handleThreadDelta", []interface{}{threadID, delta}); err != nil {
+		return nil, nil, failed(fmt.Errorf("failed to send user message: %w", err))
+	}
+	if _, err := client.Call("observeThread", []interface{}{threadID}); err != nil {
+		return nil, nil, failed(fmt.Errorf("failed to observe thread: %w", err))
+	}
+
+	// Responses to the deltas sent below arrive on the same stream and are skipped
+	var thread *AmpThread
+	observer := newTurnObserver(decide)
+	for client.stdout.Scan() {
+		var respObj AmpWorkerResponse
+		if err := json.Unmarshal(client.stdout.Bytes(), &respObj); err != nil || respObj.StreamEvent != "next" || respObj.Data == nil {
+			continue
+		}
+		dataBytes, _ := json.Marshal(respObj.Data)
+		var observed AmpThread
+		if err := json.Unmarshal(dataBytes, &observed); err != nil || observed.ID == "" {
+			continue
+		}
+		thread = &observed
+
+		deltas, finished, err := observer.observe(thread)
+		for _, delta := range deltas {
+			if err := client.send("handleThreadDelta", []interface{}{threadID, delta}); err != nil {
+				return thread, observer.inferences, failed(fmt.Errorf("failed to send %s delta: %w", delta.Type, err))
+			}
+		}
+		if err != nil || finished {
+			return thread, observer.inferences, err
+		}
+	}
+	if err := client.stdout.Err(); err != nil {
+		return thread, observer.inferences, failed(fmt.Errorf("failed to read thread: %w", err))
+	}
+	return thread, observer.inferences, failed(fmt.Errorf("worker exited before the turn finished"))
+}
+
+// turnObserver follows the snapshots of a thread during one turn, deciding on
+// the turn's tool runs and collecting the usage of its inferences
+type turnObserver struct {
+	decide     ToolDecider
+	answered   map[string]bool // runs whose user input has been sent
+	inferences []ThreadDelta
+	inferred   map[int]bool // assistant messages whose inference was counted
+}
+
+func newTurnObserver(decide ToolDecider) *turnObserver {
+	return &turnObserver{
+		decide:   decide,
+		answered: make(map[string]bool),
+		inferred: make(map[int]bool),
+	}
+}
+
+// observe handles a snapshot of the thread. It returns the deltas to send to
+// the worker and whether the turn has finished.
+func (o *turnObserver) observe(thread *AmpThread) ([]ThreadDelta, bool, error) {
+	// Earlier turns were decided when they ran; only this turn's messages count
+	prompt := thread.LastPrompt()
+	turn := AmpThread{Messages: thread.Messages[prompt+1:]}
+
+	// Each assistant message after the prompt is one inference, but Amp only
+	// keeps the usage of the newest. It is taken when that message completes;
+	// older messages that completed between snapshots have no usage left to take.
+	newest := -1
+	for i, message := range turn.Messages {
+		if message.Role == "assistant" {
+			newest = i
+		}
+	}
+	for i, message := range turn.Messages {
+		index := prompt + 1 + i
+		if message.Role != "assistant" || message.State == nil || message.State.Type == "streaming" || o.inferred[index] {
+			continue
+		}
+		o.inferred[index] = true
+		if i != newest {
+			continue
+		}
+		if inference := thread.LastInference(); inference != nil {
+			o.inferences = append(o.inferences, *inference)
+		}
+	}
+
+	// Runs Amp didn't ask about are already going, so there's nothing to decide
+	var deltas []ThreadDelta
+	for _, run := range turn.ToolRuns() {
+		id := run.ToolUse.ID
+		if !run.AwaitingInput() || o.answered[id] {
+			continue
+		}
+		accepted, err := o.decide(run.ToolUse)
+		if err != nil {
+			return deltas, false, err
+		}
+		o.answered[id] = true
+		deltas = append(deltas, NewToolInputDelta(ThreadToolUseID(id), accepted))
+	}
+
+	finished := thread.InferenceState == "idle" && turnFinished(thread)
+	return deltas, finished, nil
+}
+
+// turnFinished reports whether the assistant has stopped working on the thread:
+// its last message is no longer streaming and doesn't wait on any tools
+func turnFinished(thread *AmpThread) bool {
+	if len(thread.Messages) == 0 {
+		return false
+	}
+	last := thread.Messages[len(thread.Messages)-1]
+	if last.Role != "assistant" || last.State == nil || last.State.Type == "streaming" {
+		return false
+	}
+	for _, content := range last.Content {
+		if content.Type == "tool_use" {
+			return false
+		}
+	}
+	return true
+}
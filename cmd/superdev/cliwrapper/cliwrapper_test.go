@@ -1,6 +1,7 @@
 package superdev
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
@@ -111,3 +112,92 @@ func TestContinueConversation(t *testing.T) {
 		t.Fatal("No items received from the second conversation")
 	}
 }
+
+// observeSnapshot passes a thread snapshot, given as JSON, to observer
+func observeSnapshot(t *testing.T, observer *turnObserver, snapshot string) ([]ThreadDelta, bool) {
+	t.Helper()
+	var thread AmpThread
+	if err := json.Unmarshal([]byte(snapshot), &thread); err != nil {
+		t.Fatalf("Failed to unmarshal thread: %v", err)
+	}
+	deltas, finished, err := observer.observe(&thread)
+	if err != nil {
+		t.Fatalf("observe failed: %v", err)
+	}
+	return deltas, finished
+}
+
+func TestTurnObserverOnlyDecidesTheCurrentTurn(t *testing.T) {
+	var decided []string
+	decide := func(toolUse AmpContent) (bool, error) {
+		decided = append(decided, toolUse.ID)
+		return toolUse.Input["cmd"] != "git push", nil
+	}
+
+	// Turn 1: the push waits for confirmation and is rejected before it runs
+	turn1 := `{"id": "T-1", "inferenceState": "running", "messages": [
+		{"role": "user", "content": [{"type": "text", "text": "Ship it"}]},
+		{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_1", "name": "Bash", "input": {"cmd": "git push"}}], "state": {"type": "complete"}},
+		{"role": "user", "content": [{"type": "tool_result", "toolUseID": "toolu_1", "run": {"status": "blocked-on-user"}}]}
+	]}`
+	observer := newTurnObserver(decide)
+	deltas, finished := observeSnapshot(t, observer, turn1)
+	if len(deltas) != 1 || deltas[0].Type != ThreadDeltaUserToolInput || deltas[0].Value == nil || deltas[0].Value.Accepted || finished {
+		t.Fatalf("Expected the push to be rejected, got %+v (finished %v)", deltas, finished)
+	}
+	if deltas, _ := observeSnapshot(t, observer, turn1); len(deltas) != 0 || len(decided) != 1 {
+		t.Fatalf("Expected the run to be answered once, got %+v after %v", deltas, decided)
+	}
+
+	// Turn 2 repeats the history, but only its own tool runs are decided. A run
+	// Amp didn't ask about is already going, so it isn't decided at all.
+	decided = nil
+	turn2 := `{"id": "T-1", "inferenceState": "idle", "messages": [
+		{"role": "user", "content": [{"type": "text", "text": "Ship it"}]},
+		{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_1", "name": "Bash", "input": {"cmd": "git push"}}], "state": {"type": "complete"}},
+		{"role": "user", "content": [{"type": "tool_result", "toolUseID": "toolu_1", "run": {"status": "blocked-on-user"}}]},
+		{"role": "user", "content": [{"type": "text", "text": "Run the tests instead"}]},
+		{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_2", "name": "Bash", "input": {"cmd": "go test ./..."}}], "state": {"type": "complete"}},
+		{"role": "user", "content": [{"type": "tool_result", "toolUseID": "toolu_2", "run": {"status": "blocked-on-user"}}]},
+		{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_3", "name": "Read", "input": {"path": "go.mod"}}], "state": {"type": "complete"}},
+		{"role": "user", "content": [{"type": "tool_result", "toolUseID": "toolu_3", "run": {"status": "done"}}]},
+		{"role": "assistant", "content": [{"type": "text", "text": "Tests pass"}], "state": {"type": "complete"}}
+	]}`
+	deltas, finished = observeSnapshot(t, newTurnObserver(decide), turn2)
+	if len(decided) != 1 || decided[0] != "toolu_2" {
+		t.Fatalf("Expected only turn 2's waiting run to be decided, got %v", decided)
+	}
+	if len(deltas) != 1 || !deltas[0].Value.Accepted || !finished {
+		t.Fatalf("Expected turn 2's run to be accepted, got %+v (finished %v)", deltas, finished)
+	}
+}
+
+func TestTurnObserverCountsEachInferenceOnce(t *testing.T) {
+	observer := newTurnObserver(func(AmpContent) (bool, error) { return true, nil })
+	snapshot := func(messages string, promptTokens int) string {
+		return fmt.Sprintf(`{"id": "T-1", "inferenceState": "running", "messages": [
+			{"role": "user", "content": [{"type": "text", "text": "Add a test"}]}, %s
+		], "~debug": {"lastInferenceInput": {"model": "claude-sonnet-4"}, "lastInferenceUsage": {"promptTokens": %d, "completionTokens": 10}}}`, messages, promptTokens)
+	}
+	const (
+		toolUse  = `{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_1", "name": "Bash", "input": {"cmd": "go test"}}], "state": {"type": "complete"}}`
+		result   = `{"role": "user", "content": [{"type": "tool_result", "toolUseID": "toolu_1", "run": {"status": "done"}}]}`
+		reply    = `{"role": "assistant", "content": [{"type": "text", "text": "Done"}], "state": {"type": "%s"}}`
+		followUp = `{"role": "assistant", "content": [{"type": "text", "text": "Also"}], "state": {"type": "complete"}}`
+	)
+
+	// The first inference is counted when it completes, and only then
+	observeSnapshot(t, observer, snapshot(toolUse, 100))
+	observeSnapshot(t, observer, snapshot(toolUse+","+result, 100))
+	observeSnapshot(t, observer, snapshot(toolUse+","+result+","+fmt.Sprintf(reply, "streaming"), 100))
+	observeSnapshot(t, observer, snapshot(toolUse+","+result+","+fmt.Sprintf(reply, "complete"), 200))
+	if len(observer.inferences) != 2 || observer.inferences[0].Usage.PromptTokens != 100 || observer.inferences[1].Usage.PromptTokens != 200 {
+		t.Fatalf("Expected each inference's own usage once, got %+v", observer.inferences)
+	}
+
+	// Of two messages completing between snapshots only the newest has its usage
+	observeSnapshot(t, observer, snapshot(toolUse+","+result+","+fmt.Sprintf(reply, "complete")+","+followUp+","+followUp, 400))
+	if len(observer.inferences) != 3 || observer.inferences[2].Usage.PromptTokens != 400 {
+		t.Fatalf("Expected only the newest message's usage to be added, got %+v", observer.inferences)
+	}
+}
@@ -19,7 +19,20 @@ const (
 
 // ToolRunUserInput represents user input for a tool
 type ToolRunUserInput struct {
-	Value string `json:"value,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Accepted bool   `json:"accepted"` // whether the user allowed the tool to run
+}
+
+// ToolRunStatusBlockedOnUser is the status of a tool run waiting for the user to accept it
+const ToolRunStatusBlockedOnUser = "blocked-on-user"
+
+// NewToolInputDelta answers a tool run that is blocked on the user
+func NewToolInputDelta(toolUse ThreadToolUseID, accepted bool) ThreadDelta {
+	return ThreadDelta{
+		Type:    ThreadDeltaUserToolInput,
+		ToolUse: toolUse,
+		Value:   &ToolRunUserInput{Accepted: accepted},
+	}
 }
 
 // ThreadToolUseID is the ID of a tool use
@@ -240,3 +240,76 @@ func TestAmpMessageToDelta(t *testing.T) {
 		})
 	}
 }
+
+func TestToolUsesAwaitingInput(t *testing.T) {
+	var thread AmpThread
+	err := json.Unmarshal([]byte(`{
+		"id": "T-1",
+		"messages": [
+			{"role": "user", "content": [{"type": "text", "text": "Clean up"}]},
+			{"role": "assistant", "content": [
+				{"type": "tool_use", "id": "toolu_1", "name": "Bash", "input": {"cmd": "ls"}},
+				{"type": "tool_use", "id": "toolu_2", "name": "Bash", "input": {"cmd": "rm -rf build"}},
+				{"type": "tool_use", "id": "toolu_3", "name": "Bash", "input": {"cmd": "rm -rf dist"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "toolUseID": "toolu_1", "run": {"status": "done"}},
+				{"type": "tool_result", "toolUseID": "toolu_2", "run": {"status": "blocked-on-user"}},
+				{"type": "tool_result", "toolUseID": "toolu_3", "run": {"status": "blocked-on-user"}, "userInput": {"accepted": false}}
+			]}
+		]
+	}`), &thread)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal thread: %v", err)
+	}
+
+	awaiting := thread.ToolUsesAwaitingInput()
+	if len(awaiting) != 1 || awaiting[0].ID != "toolu_2" || awaiting[0].Input["cmd"] != "rm -rf build" {
+		t.Fatalf("Expected only the unanswered blocked run, got %+v", awaiting)
+	}
+
+	deltaJSON, err := json.Marshal(NewToolInputDelta(ThreadToolUseID(awaiting[0].ID), true))
+	if err != nil {
+		t.Fatalf("Failed to marshal tool input delta: %v", err)
+	}
+	if want := `{"type":"user:tool-input","toolUse":"toolu_2","value":{"accepted":true}}`; string(deltaJSON) != want {
+		t.Errorf("\nExpected: %s\nGot: %s", want, deltaJSON)
+	}
+}
+
+func TestLastInference(t *testing.T) {
+	var thread AmpThread
+	err := json.Unmarshal([]byte(`{
+		"id": "T-1",
+		"messages": [
+			{"role": "user", "content": [{"type": "text", "text": "Add a test"}]},
+			{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_1", "name": "Bash", "input": {"cmd": "go test"}}], "state": {"type": "complete"}},
+			{"role": "user", "content": [{"type": "tool_result", "toolUseID": "toolu_1", "run": {"status": "done"}}]},
+			{"role": "assistant", "content": [{"type": "text", "text": "Done"}], "state": {"type": "complete"}}
+		],
+		"~debug": {
+			"lastInferenceInput": {"model": "claude-sonnet-4", "max_tokens": 32000},
+			"lastInferenceUsage": {"promptTokens": 1200, "completionTokens": 80, "totalTokens": 1280}
+		}
+	}`), &thread)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal thread: %v", err)
+	}
+
+	if got := thread.LastPrompt(); got != 0 {
+		t.Errorf("Expected the prompt to be the first message, not the tool results, got %d", got)
+	}
+
+	delta := thread.LastInference()
+	if delta == nil || delta.Type != ThreadDeltaInferenceComplete || delta.Usage.PromptTokens != 1200 || delta.Usage.TotalTokens != 1280 {
+		t.Fatalf("Expected an inference:completed delta with the usage, got %+v", delta)
+	}
+	if params, _ := delta.Params.(map[string]interface{}); params["model"] != "claude-sonnet-4" {
+		t.Errorf("Expected the model from the inference input, got %+v", delta.Params)
+	}
+
+	thread.Debug = nil
+	if delta := thread.LastInference(); delta != nil {
+		t.Errorf("Expected no delta without debug information, got %+v", delta)
+	}
+}
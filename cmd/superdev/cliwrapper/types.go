@@ -29,6 +29,95 @@ type AmpThread struct {
 	FileChanges    *AmpFileChanges `json:"fileChanges,omitempty"`
 	State          string          `json:"state,omitempty"`
 	InferenceState string          `json:"inferenceState,omitempty"`
+	Debug          *AmpThreadDebug `json:"~debug,omitempty"`
+}
+
+// AmpThreadDebug is the debugging information Amp keeps about a thread's last inference
+type AmpThreadDebug struct {
+	LastInferenceInput json.RawMessage `json:"lastInferenceInput,omitempty"` // the request sent to the model
+	LastInferenceUsage *DebugUsage     `json:"lastInferenceUsage,omitempty"`
+}
+
+// LastInference returns an inference:completed delta with the usage of the
+// thread's last inference and the model it ran on, or nil if Amp didn't report it
+func (t AmpThread) LastInference() *ThreadDelta {
+	if t.Debug == nil || t.Debug.LastInferenceUsage == nil {
+		return nil
+	}
+	usage := *t.Debug.LastInferenceUsage
+	delta := &ThreadDelta{Type: ThreadDeltaInferenceComplete, Usage: &usage}
+
+	var input struct {
+		Model string `json:"model"`
+	}
+	if json.Unmarshal(t.Debug.LastInferenceInput, &input) == nil && input.Model != "" {
+		delta.Params = map[string]interface{}{"model": input.Model}
+	}
+	return delta
+}
+
+// LastPrompt returns the index of the thread's last user prompt, a user
+// message that isn't tool results, or -1 if it has none
+func (t AmpThread) LastPrompt() int {
+	for i := len(t.Messages) - 1; i >= 0; i-- {
+		message := t.Messages[i]
+		if message.Role != "user" {
+			continue
+		}
+		prompt := true
+		for _, content := range message.Content {
+			if content.Type == "tool_result" {
+				prompt = false
+				break
+			}
+		}
+		if prompt {
+			return i
+		}
+	}
+	return -1
+}
+
+// AmpToolRun pairs a tool_use block with the tool_result block of its run
+type AmpToolRun struct {
+	ToolUse AmpContent
+	Result  AmpContent
+}
+
+// AwaitingInput reports whether the run is blocked until the user accepts or rejects it
+func (r AmpToolRun) AwaitingInput() bool {
+	return r.Result.Run != nil && r.Result.Run.Status == ToolRunStatusBlockedOnUser && r.Result.UserInput == nil
+}
+
+// ToolRuns returns the thread's tool uses that have started running, in order
+func (t AmpThread) ToolRuns() []AmpToolRun {
+	toolUses := make(map[string]AmpContent)
+	var runs []AmpToolRun
+	for _, msg := range t.Messages {
+		for _, content := range msg.Content {
+			switch content.Type {
+			case "tool_use":
+				toolUses[content.ID] = content
+			case "tool_result":
+				if toolUse, ok := toolUses[content.ToolUseID]; ok {
+					runs = append(runs, AmpToolRun{ToolUse: toolUse, Result: content})
+				}
+			}
+		}
+	}
+	return runs
+}
+
+// ToolUsesAwaitingInput returns the tool_use blocks whose runs are blocked
+// until the user accepts or rejects them
+func (t AmpThread) ToolUsesAwaitingInput() []AmpContent {
+	var awaiting []AmpContent
+	for _, run := range t.ToolRuns() {
+		if run.AwaitingInput() {
+			awaiting = append(awaiting, run.ToolUse)
+		}
+	}
+	return awaiting
 }
 
 // AmpGenericItem allows unknown types to implement AmpItem
@@ -277,6 +366,11 @@ type AmpContent struct {
 	Name             string                 `json:"name,omitempty"`
 	Input            map[string]interface{} `json:"input,omitempty"`
 	InputPartialJSON *AmpPartialJSON        `json:"inputPartialJSON,omitempty"`
+
+	// For tool_result
+	ToolUseID string            `json:"toolUseID,omitempty"`
+	Run       *ToolRun          `json:"run,omitempty"`
+	UserInput *ToolRunUserInput `json:"userInput,omitempty"`
 }
 
 type AmpPartialJSON struct {
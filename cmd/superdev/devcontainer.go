@@ -0,0 +1,510 @@
+package superdev
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"superdev/cmd/superdev/client"
+)
+
+// devContainerPaths are where a repository's dev container spec is looked for, in order
+var devContainerPaths = []string{".devcontainer/devcontainer.json", ".devcontainer.json"}
+
+// errNoDevContainer is returned for repositories without a dev container spec
+var errNoDevContainer = errors.New("no docker_image was given and the repository has no .devcontainer/devcontainer.json")
+
+// Where worker containers see the repository, and the tags of dev container images
+const (
+	devContainerWorkspace = "/workdir/repo"
+	devContainerBaseTag   = "superdev-devcontainer-base"
+	devContainerTag       = "superdev-devcontainer"
+)
+
+// devContainerVolumePrefix namespaces the named volumes dev containers mount, so a
+// repository can't mount volumes the server uses for anything else
+const devContainerVolumePrefix = "superdev-devcontainer-"
+
+var (
+	devContainerVarPattern = regexp.MustCompile(`\$\{([^}]+)\}`)
+	volumeNamePattern      = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// DevContainer is the subset of the devcontainer.json spec superdev understands.
+// See https://containers.dev/implementors/json_reference/.
+type DevContainer struct {
+	Name              string                     `json:"name"`
+	Image             string                     `json:"image"`
+	Build             *DevContainerBuild         `json:"build"`
+	DockerFile        string                     `json:"dockerFile"` // older spelling of build.dockerfile
+	Context           string                     `json:"context"`    // older spelling of build.context
+	Features          map[string]json.RawMessage `json:"features"`
+	PostCreateCommand json.RawMessage            `json:"postCreateCommand"` // string, array or object of either
+	ContainerEnv      map[string]string          `json:"containerEnv"`
+	RemoteEnv         map[string]string          `json:"remoteEnv"`
+	Mounts            []json.RawMessage          `json:"mounts"` // "type=volume,source=x,target=/y" or an object
+}
+
+// DevContainerBuild builds the dev container from a Dockerfile in the repository
+type DevContainerBuild struct {
+	Dockerfile string            `json:"dockerfile"`
+	Context    string            `json:"context"`
+	Args       map[string]string `json:"args"`
+	Target     string            `json:"target"`
+}
+
+// devContainerPlan is the worker image and container config a spec asks for
+type devContainerPlan struct {
+	Source         string // spec path relative to the repository
+	Dockerfile     []byte
+	DockerfilePath string // empty when the Dockerfile is generated from an image
+	ContextDir     string
+	Wrap           WrapConfig
+	ContainerEnv   map[string]string
+	RemoteEnv      map[string]string
+	Mounts         []string // values for docker run --mount
+	PostCreate     string   // shell command run once before the first turn
+	Warnings       []string // parts of the spec that were ignored
+}
+
+// loadDevContainer finds and plans the dev container spec in a cloned repository
+func loadDevContainer(repoDir string) (*devContainerPlan, error) {
+	for _, rel := range devContainerPaths {
+		specPath := filepath.Join(repoDir, rel)
+		data, err := os.ReadFile(specPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+
+		var spec DevContainer
+		if err := json.Unmarshal(stripJSONC(data), &spec); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", rel, err)
+		}
+		plan, err := planDevContainer(spec, repoDir, filepath.Dir(specPath))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rel, err)
+		}
+		plan.Source = rel
+		return plan, nil
+	}
+	return nil, errNoDevContainer
+}
+
+// planDevContainer turns a spec found in specDir into a plan. Paths in the spec
+// are relative to specDir and must stay inside repoDir.
+func planDevContainer(spec DevContainer, repoDir, specDir string) (*devContainerPlan, error) {
+	plan := &devContainerPlan{
+		Wrap:         WrapConfig{BaseTag: devContainerBaseTag, Tag: devContainerTag},
+		ContainerEnv: map[string]string{},
+		RemoteEnv:    map[string]string{},
+	}
+
+	build := spec.Build
+	if build == nil && spec.DockerFile != "" {
+		build = &DevContainerBuild{Dockerfile: spec.DockerFile, Context: spec.Context}
+	}
+	switch {
+	case build != nil && build.Dockerfile != "":
+		dockerfile, err := repoPath(repoDir, specDir, build.Dockerfile)
+		if err != nil {
+			return nil, err
+		}
+		context := build.Context
+		if context == "" {
+			context = "."
+		}
+		contextDir, err := repoPath(repoDir, specDir, context)
+		if err != nil {
+			return nil, err
+		}
+		if plan.Dockerfile, err = os.ReadFile(dockerfile); err != nil {
+			return nil, fmt.Errorf("failed to read build.dockerfile: %w", err)
+		}
+		plan.DockerfilePath, plan.ContextDir = dockerfile, contextDir
+
+		plan.Wrap.Target = build.Target
+		for name, value := range build.Args {
+			if plan.Wrap.BuildArgs == nil {
+				plan.Wrap.BuildArgs = make(map[string]string)
+			}
+			plan.Wrap.BuildArgs[name] = expandDevContainerVars(value)
+		}
+	case spec.Image != "":
+		if !imageTagPattern.MatchString(spec.Image) {
+			return nil, fmt.Errorf("image %q is not a valid image reference", spec.Image)
+		}
+		plan.Dockerfile = []byte("FROM " + spec.Image + "\n")
+	default:
+		return nil, fmt.Errorf("either image or build.dockerfile is required")
+	}
+
+	for _, id := range sortedKeys(spec.Features) {
+		plan.applyFeature(id, spec.Features[id])
+	}
+
+	for name, value := range spec.ContainerEnv {
+		plan.setEnv(plan.ContainerEnv, "containerEnv", name, value)
+	}
+	for name, value := range spec.RemoteEnv {
+		plan.setEnv(plan.RemoteEnv, "remoteEnv", name, value)
+	}
+
+	for _, raw := range spec.Mounts {
+		plan.addMount(raw)
+	}
+
+	command, err := postCreateShell(spec.PostCreateCommand)
+	if err != nil {
+		return nil, err
+	}
+	plan.PostCreate = expandDevContainerVars(command)
+
+	cfg := plan.Wrap
+	cfg.applyDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// repoPath resolves a path from the spec, following symlinks, and checks that it
+// stays inside the repository
+func repoPath(repoDir, base, rel string) (string, error) {
+	root, err := filepath.EvalSymlinks(repoDir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(base, rel))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", rel, err)
+	}
+	inside, err := filepath.Rel(root, resolved)
+	if err != nil || !filepath.IsLocal(inside) {
+		return "", fmt.Errorf("%s is outside the repository", rel)
+	}
+	return resolved, nil
+}
+
+// applyFeature maps a dev container feature onto the wrap config. Only features
+// the wrapper can provide are supported; others are skipped with a warning.
+func (p *devContainerPlan) applyFeature(id string, rawOptions json.RawMessage) {
+	var options map[string]interface{}
+	json.Unmarshal(rawOptions, &options)
+
+	// ghcr.io/devcontainers/features/node:1 is the node feature
+	name := id[strings.LastIndex(id, "/")+1:]
+	name, _, _ = strings.Cut(name, "@")
+	name, _, _ = strings.Cut(name, ":")
+
+	switch name {
+	case "common-utils", "git":
+		// Every wrapped image already has them
+	case "node":
+		version, _ := options["version"].(string)
+		switch {
+		case version == "" || version == "lts" || version == "latest":
+		case nodeVersionExpr.MatchString(version):
+			p.Wrap.NodeVersion = version
+		default:
+			p.Warnings = append(p.Warnings, fmt.Sprintf("feature %s: node version %q is not a major version, using %s", id, version, defaultNodeVersion))
+		}
+	case "python":
+		p.Wrap.Packages = append(p.Wrap.Packages, "python3")
+	default:
+		p.Warnings = append(p.Warnings, fmt.Sprintf("feature %s is not supported and was skipped", id))
+	}
+}
+
+// setEnv records an environment variable with a valid name
+func (p *devContainerPlan) setEnv(env map[string]string, field, name, value string) {
+	if !buildArgPattern.MatchString(name) {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("%s %q is not a valid variable name and was skipped", field, name))
+		return
+	}
+	env[name] = expandDevContainerVars(value)
+}
+
+// addMount records a volume or tmpfs mount. Bind mounts would expose the
+// server's filesystem, so they are skipped.
+func (p *devContainerPlan) addMount(raw json.RawMessage) {
+	var mount struct {
+		Type   string `json:"type"`
+		Source string `json:"source"`
+		Target string `json:"target"`
+	}
+
+	var short string
+	if err := json.Unmarshal(raw, &short); err == nil {
+		for _, field := range strings.Split(short, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "type":
+				mount.Type = value
+			case "source", "src":
+				mount.Source = value
+			case "target", "destination", "dst":
+				mount.Target = value
+			}
+		}
+	} else if err := json.Unmarshal(raw, &mount); err != nil {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("mount %s is not a string or object and was skipped", raw))
+		return
+	}
+	mount.Source = expandDevContainerVars(mount.Source)
+	mount.Target = expandDevContainerVars(mount.Target)
+
+	target := filepath.Clean(mount.Target)
+	switch {
+	case !filepath.IsAbs(mount.Target) || strings.Contains(mount.Target, ","):
+		p.Warnings = append(p.Warnings, fmt.Sprintf("mount target %q is not an absolute path and was skipped", mount.Target))
+	case target == "/" || target == "/workdir" || target == devContainerWorkspace || target == "/workdir/context" || target == "/workdir/guidance":
+		p.Warnings = append(p.Warnings, fmt.Sprintf("mount target %s is reserved and was skipped", target))
+	case mount.Type == "tmpfs":
+		p.Mounts = append(p.Mounts, "type=tmpfs,target="+target)
+	case mount.Type == "volume" && volumeNamePattern.MatchString(mount.Source):
+		p.Mounts = append(p.Mounts, "type=volume,source="+devContainerVolumePrefix+mount.Source+",target="+target)
+	default:
+		p.Warnings = append(p.Warnings, fmt.Sprintf("%s mount of %q is not supported and was skipped; only named volumes and tmpfs are", mount.Type, mount.Source))
+	}
+}
+
+// postCreateShell turns postCreateCommand into one shell command. Arrays are run
+// without a shell in the spec, so each element is quoted; the commands of an
+// object run one after another, in name order.
+func postCreateShell(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+
+	var command string
+	if err := json.Unmarshal(raw, &command); err == nil {
+		return command, nil
+	}
+
+	var args []string
+	if err := json.Unmarshal(raw, &args); err == nil {
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = shellQuote(arg)
+		}
+		return strings.Join(quoted, " "), nil
+	}
+
+	var named map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &named); err != nil {
+		return "", fmt.Errorf("postCreateCommand must be a string, an array or an object")
+	}
+	var commands []string
+	for _, name := range sortedKeys(named) {
+		command, err := postCreateShell(named[name])
+		if err != nil {
+			return "", err
+		}
+		if command != "" {
+			commands = append(commands, "("+command+")")
+		}
+	}
+	return strings.Join(commands, " && "), nil
+}
+
+// shellQuote quotes s for sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+// expandDevContainerVars substitutes the spec's ${...} variables. The server's
+// environment is never exposed, so ${localEnv:NAME} becomes its default, and
+// ${containerEnv:NAME} is left for the runner to resolve inside the container.
+func expandDevContainerVars(s string) string {
+	return devContainerVarPattern.ReplaceAllStringFunc(s, func(match string) string {
+		parts := strings.SplitN(match[2:len(match)-1], ":", 3)
+		switch parts[0] {
+		case "containerWorkspaceFolder", "localWorkspaceFolder":
+			return devContainerWorkspace
+		case "containerWorkspaceFolderBasename", "localWorkspaceFolderBasename":
+			return filepath.Base(devContainerWorkspace)
+		case "localEnv":
+			if len(parts) == 3 {
+				return parts[2]
+			}
+			return ""
+		}
+		return match
+	})
+}
+
+// stripJSONC removes the comments and trailing commas devcontainer.json allows
+func stripJSONC(data []byte) []byte {
+	var out bytes.Buffer
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			out.WriteByte(c)
+			if c == '\\' && i+1 < len(data) {
+				i++
+				out.WriteByte(data[i])
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			out.WriteByte(c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			out.WriteByte('\n')
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return out.Bytes()
+			}
+			i += end + 3
+			out.WriteByte(' ')
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	// Drop commas followed only by whitespace before a closing bracket
+	cleaned := out.Bytes()
+	result := make([]byte, 0, len(cleaned))
+	inString = false
+	for i := 0; i < len(cleaned); i++ {
+		c := cleaned[i]
+		if inString {
+			if c == '\\' && i+1 < len(cleaned) {
+				result = append(result, c, cleaned[i+1])
+				i++
+				continue
+			}
+			inString = c != '"'
+		} else if c == '"' {
+			inString = true
+		} else if c == ',' {
+			next := bytes.TrimLeft(cleaned[i+1:], " \t\r\n")
+			if len(next) > 0 && (next[0] == '}' || next[0] == ']') {
+				continue
+			}
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// dockerArgs returns the docker run arguments applying the plan to a container
+func (p *devContainerPlan) dockerArgs() []string {
+	var args []string
+	for _, name := range sortedKeys(p.ContainerEnv) {
+		args = append(args, "-e", name+"="+p.ContainerEnv[name])
+	}
+	for _, mount := range p.Mounts {
+		args = append(args, "--mount", mount)
+	}
+	if len(p.RemoteEnv) > 0 {
+		remoteEnv, _ := json.Marshal(p.RemoteEnv)
+		args = append(args, "-e", client.EnvRemoteEnv+"="+string(remoteEnv))
+	}
+	if p.PostCreate != "" {
+		args = append(args, "-e", client.EnvPostCreateCommand+"="+p.PostCreate)
+	}
+	return args
+}
+
+// prepareDevContainer plans the dev container of a cloned repository and builds
+// its worker image, reusing a registered image when nothing has changed. Build
+// output goes to the thread's log.
+func prepareDevContainer(threadID, repoDir string, caller Caller) (*devContainerPlan, string, error) {
+	plan, err := loadDevContainer(repoDir)
+	if err != nil {
+		return nil, "", err
+	}
+	appendThreadLog(threadID, PhaseBuild, "", "Using dev container spec "+plan.Source)
+	for _, warning := range plan.Warnings {
+		appendThreadLog(threadID, PhaseBuild, "stderr", "Warning: "+warning)
+	}
+
+	cfg := plan.Wrap
+	cfg.applyDefaults()
+	hash, err := imageHash(plan.Dockerfile, plan.ContextDir, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	cfg.BaseTag = contentTag(cfg.BaseTag, hash)
+	cfg.Tag = contentTag(cfg.Tag, hash)
+
+	if imageRegistry != nil {
+		if image, ok := imageRegistry.Get(hash); ok && runDocker(io.Discard, "image", "inspect", image.Tag) == nil {
+			appendThreadLog(threadID, PhaseBuild, "", "Reusing dev container image "+image.Tag)
+			return plan, image.Tag, nil
+		}
+	}
+
+	// Images are built from a generated Dockerfile and an empty context
+	dockerfilePath, contextDir := plan.DockerfilePath, plan.ContextDir
+	if dockerfilePath == "" {
+		dir, err := os.MkdirTemp("", "superdev-devcontainer")
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		contextDir = filepath.Join(dir, "context")
+		if err := os.Mkdir(contextDir, 0o755); err != nil {
+			return nil, "", fmt.Errorf("failed to create build context: %w", err)
+		}
+		dockerfilePath = filepath.Join(dir, "Dockerfile")
+		if err := os.WriteFile(dockerfilePath, plan.Dockerfile, 0o644); err != nil {
+			return nil, "", fmt.Errorf("failed to write Dockerfile: %w", err)
+		}
+	}
+
+	output, logs := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		streamLog(threadLogger(threadID), PhaseBuild, "stdout", output, nil)
+		close(done)
+	}()
+	built, err := wrapImage(cfg, hash, dockerfilePath, contextDir, logs)
+	logs.Close()
+	<-done
+	if err != nil {
+		return nil, "", err
+	}
+
+	if imageRegistry != nil {
+		_, apiErr := registerImage(caller, hash, client.RegisterImageRequest{
+			Tag:        built.Tag,
+			Source:     plan.Source,
+			Distro:     built.Distro,
+			AmpVersion: built.AmpVersion,
+		})
+		if apiErr != nil {
+			// The image still works for this thread
+			slog.Error("failed to register dev container image", "thread_id", threadID, "error", apiErr.Message)
+		}
+	}
+	return plan, built.Tag, nil
+}
+
+// sortedKeys returns a map's keys in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
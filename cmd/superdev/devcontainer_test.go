@@ -0,0 +1,185 @@
+package superdev
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"superdev/cmd/superdev/client"
+)
+
+// writeRepo creates a repository with the given files
+func writeRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	repo := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(repo, name)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return repo
+}
+
+func TestStripJSONC(t *testing.T) {
+	input := `{
+		// The image to use
+		"image": "mcr.microsoft.com/devcontainers/go:1", /* pinned */
+		"remoteEnv": {"URL": "http://example.com/a//b", "GLOB": "/* not a comment */",},
+		"mounts": ["type=tmpfs,target=/tmp/cache",],
+	}`
+
+	var spec DevContainer
+	if err := json.Unmarshal(stripJSONC([]byte(input)), &spec); err != nil {
+		t.Fatalf("Expected JSONC to parse, got %v", err)
+	}
+	if spec.Image != "mcr.microsoft.com/devcontainers/go:1" || spec.RemoteEnv["URL"] != "http://example.com/a//b" || spec.RemoteEnv["GLOB"] != "/* not a comment */" || len(spec.Mounts) != 1 {
+		t.Fatalf("Expected strings to be left alone, got %+v", spec)
+	}
+}
+
+func TestLoadDevContainer(t *testing.T) {
+	repo := writeRepo(t, map[string]string{
+		"Dockerfile.dev": "FROM debian\n",
+		".devcontainer/devcontainer.json": `{
+			"build": {"dockerfile": "../Dockerfile.dev", "context": "..", "args": {"GO_VERSION": "1.24", "HOME_DIR": "${localEnv:HOME:/root}"}, "target": "dev"},
+			"features": {
+				"ghcr.io/devcontainers/features/node:1": {"version": "20"},
+				"ghcr.io/devcontainers/features/python:1": {},
+				"ghcr.io/devcontainers/features/docker-in-docker:2": {}
+			},
+			"containerEnv": {"GOFLAGS": "-mod=mod", "bad name": "x"},
+			"remoteEnv": {"PATH": "${containerEnv:PATH}:${containerWorkspaceFolder}/bin"},
+			"mounts": [
+				"source=gomod,target=/go/pkg/mod,type=volume",
+				"source=/var/run/docker.sock,target=/var/run/docker.sock,type=bind",
+				{"type": "tmpfs", "target": "/tmp/cache"},
+				{"type": "volume", "source": "repo", "target": "/workdir/repo"}
+			],
+			"postCreateCommand": {"deps": "go mod download", "tools": ["make", "it's ready"]}
+		}`,
+	})
+
+	plan, err := loadDevContainer(repo)
+	if err != nil {
+		t.Fatalf("loadDevContainer failed: %v", err)
+	}
+	if plan.Source != ".devcontainer/devcontainer.json" || string(plan.Dockerfile) != "FROM debian\n" {
+		t.Fatalf("Expected the build's Dockerfile, got %+v", plan)
+	}
+	if resolved, _ := filepath.EvalSymlinks(repo); plan.ContextDir != resolved {
+		t.Errorf("Expected the repository root as the context, got %s", plan.ContextDir)
+	}
+	if plan.Wrap.Target != "dev" || plan.Wrap.BuildArgs["GO_VERSION"] != "1.24" || plan.Wrap.BuildArgs["HOME_DIR"] != "/root" {
+		t.Errorf("Expected build args and target, with localEnv defaulted, got %+v", plan.Wrap)
+	}
+	if plan.Wrap.NodeVersion != "20" || fmt.Sprint(plan.Wrap.Packages) != "[python3]" {
+		t.Errorf("Expected the node and python features, got %+v", plan.Wrap)
+	}
+	if plan.RemoteEnv["PATH"] != "${containerEnv:PATH}:/workdir/repo/bin" {
+		t.Errorf("Expected containerEnv to be left for the runner, got %q", plan.RemoteEnv["PATH"])
+	}
+	if want := "(go mod download) && ('make' 'it'\"'\"'s ready')"; plan.PostCreate != want {
+		t.Errorf("Expected postCreateCommand %s, got %s", want, plan.PostCreate)
+	}
+
+	args := strings.Join(plan.dockerArgs(), " ")
+	for _, want := range []string{
+		"-e GOFLAGS=-mod=mod",
+		"--mount type=volume,source=superdev-devcontainer-gomod,target=/go/pkg/mod",
+		"--mount type=tmpfs,target=/tmp/cache",
+		"-e " + client.EnvPostCreateCommand + "=",
+		"-e " + client.EnvRemoteEnv + "=",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("Expected %q in docker args %s", want, args)
+		}
+	}
+	if strings.Contains(args, "docker.sock") || strings.Contains(args, "target=/workdir/repo") || strings.Contains(args, "bad name") {
+		t.Errorf("Expected bind mounts, reserved targets and bad names to be skipped, got %s", args)
+	}
+
+	warnings := strings.Join(plan.Warnings, "\n")
+	for _, want := range []string{"docker-in-docker", "bind mount", "/workdir/repo is reserved", "bad name"} {
+		if !strings.Contains(warnings, want) {
+			t.Errorf("Expected a warning about %s, got:\n%s", want, warnings)
+		}
+	}
+}
+
+func TestLoadDevContainerRejectsPathsOutsideRepo(t *testing.T) {
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "Dockerfile"), []byte("FROM debian\n"), 0o644)
+
+	repo := writeRepo(t, map[string]string{
+		".devcontainer.json": `{"build": {"dockerfile": "link/Dockerfile"}}`,
+	})
+	os.Symlink(outside, filepath.Join(repo, "link"))
+	if _, err := loadDevContainer(repo); err == nil || !strings.Contains(err.Error(), "outside the repository") {
+		t.Fatalf("Expected a symlink out of the repository to be rejected, got %v", err)
+	}
+
+	os.WriteFile(filepath.Join(repo, ".devcontainer.json"), []byte(`{"build": {"dockerfile": "Dockerfile", "context": "../.."}}`), 0o644)
+	os.WriteFile(filepath.Join(repo, "Dockerfile"), []byte("FROM debian\n"), 0o644)
+	if _, err := loadDevContainer(repo); err == nil || !strings.Contains(err.Error(), "outside the repository") {
+		t.Fatalf("Expected a context outside the repository to be rejected, got %v", err)
+	}
+
+	if _, err := loadDevContainer(t.TempDir()); err != errNoDevContainer {
+		t.Fatalf("Expected errNoDevContainer without a spec, got %v", err)
+	}
+}
+
+func TestPrepareDevContainer(t *testing.T) {
+	setupDataDir(t)
+	stubRunnerSource(t)
+	setupImageRegistry(t)
+	repo := writeRepo(t, map[string]string{
+		".devcontainer/devcontainer.json": `{"image": "mcr.microsoft.com/devcontainers/base:debian", "postCreateCommand": "make setup"}`,
+	})
+
+	var built []string
+	images := newFakeImages()
+	calls := stubDocker(t, func(args []string) (string, error) {
+		if output, err, handled := images.respond(args); handled {
+			return output, err
+		}
+		switch args[0] {
+		case "build":
+			dockerfile, _ := os.ReadFile(args[2])
+			built = append(built, string(dockerfile))
+			return "Step 1/1\n", nil
+		case "image":
+			return "", nil
+		}
+		return "ID=debian\n", nil
+	})
+
+	plan, image, err := prepareDevContainer("t1", repo, Caller{User: "alice"})
+	if err != nil {
+		t.Fatalf("prepareDevContainer failed: %v", err)
+	}
+	if !strings.HasPrefix(image, devContainerTag+":") || plan.PostCreate != "make setup" {
+		t.Fatalf("Expected a dev container image and plan, got %s %+v", image, plan)
+	}
+	if len(built) != 2 || built[0] != "FROM mcr.microsoft.com/devcontainers/base:debian\n" {
+		t.Fatalf("Expected the spec's image to be built and wrapped, got %q", built)
+	}
+	if images := imageRegistry.List(); len(images) != 1 || images[0].Tag != image || images[0].Owner != "alice" {
+		t.Fatalf("Expected the image to be registered, got %+v", images)
+	}
+	entries, _, _ := readThreadLog("t1", PhaseBuild, 0)
+	if len(entries) == 0 || !strings.Contains(entries[0].Message, ".devcontainer/devcontainer.json") {
+		t.Fatalf("Expected the build to be logged, got %+v", entries)
+	}
+
+	// An unchanged spec reuses the registered image
+	*calls = nil
+	if _, reused, err := prepareDevContainer("t2", repo, Caller{User: "bob"}); err != nil || reused != image || len(*calls) != 1 {
+		t.Fatalf("Expected %s to be reused, got %s, %v after %v", image, reused, err, *calls)
+	}
+}
@@ -0,0 +1,92 @@
+package superdev
+
+import (
+	"log/slog"
+	"net/http"
+
+	"superdev/cmd/superdev/client"
+)
+
+// threadFork is the part of another thread a forked thread starts from
+type threadFork struct {
+	parentID  string
+	at        string                    // ID of the last message copied
+	messages  []*client.ThreadMessage   // copies of the parent's messages up to at
+	answered  int                       // leading messages the fork's worker skips
+	workspace *client.WorkspaceSnapshot // parent's workspace as of the last answer, if any
+}
+
+// forkThread starts a new thread owned by the caller with the settings of
+// another thread, its messages up to and including the one with ID at (the
+// latest if empty), and its workspace as of the last answer among them. Inputs
+// after that answer are run again by the fork's worker, followed by prompt.
+func forkThread(r *http.Request, parentID, at string, req client.ForkThreadRequest) (string, *apiError) {
+	caller := callerFromRequest(r)
+
+	outputMutex.Lock()
+	parent, apiErr := authorizeThread(r, parentID, RoleRead)
+	if apiErr != nil {
+		outputMutex.Unlock()
+		return "", apiErr
+	}
+
+	messages := threads[parentID]
+	end := len(messages)
+	if at != "" {
+		end = -1
+		for i, msg := range messages {
+			if msg.ID == at {
+				end = i + 1
+				break
+			}
+		}
+		if end < 0 {
+			outputMutex.Unlock()
+			return "", newAPIError(http.StatusBadRequest, "No message with ID "+at+" in thread")
+		}
+	}
+
+	// The fork only has a snapshot of the workspace it starts from
+	fork := &threadFork{parentID: parentID, messages: make([]*client.ThreadMessage, end)}
+	for i, msg := range messages[:end] {
+		copied := *msg
+		copied.Snapshot = false
+		fork.messages[i] = &copied
+		if msg.Direction == client.DirectionOutput {
+			fork.answered = i + 1
+		}
+	}
+	if end > 0 {
+		fork.at = messages[end-1].ID
+	}
+
+	settings := parent.Settings
+	settings.Prompt = req.Prompt
+	settings.Title = req.Title
+	if settings.Title == "" {
+		settings.Title = parent.Title
+	}
+	// Forks of threads shared from another team aren't shared with it
+	if settings.Team != caller.Team {
+		settings.Team = ""
+	}
+	outputMutex.Unlock()
+
+	if fork.answered > 0 {
+		workspace, err := loadWorkspace(parentID, fork.answered-1)
+		if err != nil {
+			slog.Error("failed to load workspace snapshot", "thread_id", parentID, "error", err)
+			return "", newAPIError(http.StatusInternalServerError, "Error loading workspace")
+		}
+		fork.workspace = workspace
+		fork.messages[fork.answered-1].Snapshot = workspace != nil
+	}
+
+	threadID, apiErr := createThread(r.Context(), caller, settings, fork)
+	if apiErr != nil {
+		return "", apiErr
+	}
+	threadsForked.Inc()
+	slog.Info("thread forked", "thread_id", threadID, "forked_from", parentID, "forked_at", fork.at)
+	return threadID, nil
+}
@@ -0,0 +1,131 @@
+package superdev
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"superdev/cmd/superdev/client"
+)
+
+func TestForkThread(t *testing.T) {
+	resetThreads(t)
+	setupDataDir(t)
+	// The parent holds the only slot, so forks stay queued rather than provisioning
+	scheduler := setupScheduler(t, 1, 0, 10)
+	scheduler.Admit("parent", "alice", 0, nil)
+	parent := addTestThread("parent", "alice", "")
+	parent.Title = "Refactor the parser"
+	parent.Settings = client.StartThreadRequest{RepositoryLink: "https://example.com/repo.git", DockerImage: "worker:1", Ref: "develop"}
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	c := client.New(server.URL, client.WithCaller("alice", ""))
+
+	base := strings.Repeat("ab", 20)
+	answer := func(patch string) string {
+		t.Helper()
+		resp, err := workerClient(server.URL, "parent").AnswerMessage(ctx, "parent", client.AnswerMessageRequest{
+			Payload:   "done: " + patch,
+			Workspace: &client.WorkspaceSnapshot{Base: base, Patch: []byte(patch)},
+		})
+		if err != nil {
+			t.Fatalf("AnswerMessage failed: %v", err)
+		}
+		return resp.MessageID
+	}
+	answer("first")
+	second, err := c.SendMessage(ctx, "parent", "Now the lexer")
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	answer("second")
+
+	// Forking at an unanswered input runs it again from the workspace before it
+	resp, err := c.ForkThread(ctx, "parent", second.MessageID, client.ForkThreadRequest{Prompt: "Keep the old lexer"})
+	if err != nil {
+		t.Fatalf("ForkThread failed: %v", err)
+	}
+	fork, err := c.GetThread(ctx, resp.ThreadID, client.GetThreadOptions{})
+	if err != nil {
+		t.Fatalf("GetThread failed: %v", err)
+	}
+	if fork.ForkedFrom != "parent" || fork.ForkedAt != second.MessageID || fork.Title != "Refactor the parser" || fork.Owner != "alice" {
+		t.Fatalf("Expected a fork of parent owned by alice, got %+v", fork)
+	}
+	if fork.MessageCount != 4 || fork.Messages[2].ID != second.MessageID || fork.Messages[3].Output != "Keep the old lexer" {
+		t.Fatalf("Expected the history up to the fork point and the new prompt, got %+v", fork.Messages)
+	}
+
+	pending, err := workerClient(server.URL, fork.ThreadID).PullMessages(ctx, fork.ThreadID, "")
+	if err != nil || len(pending) != 2 || pending[0].Content != "Now the lexer" || pending[1].Content != "Keep the old lexer" {
+		t.Fatalf("Expected the fork's worker to get the unanswered input and the new prompt, got %+v (%v)", pending, err)
+	}
+	workspace, err := workerClient(server.URL, fork.ThreadID).ThreadWorkspace(ctx, fork.ThreadID)
+	if err != nil || workspace.Base != base || string(workspace.Patch) != "first" {
+		t.Fatalf("Expected the workspace after the first answer, got %+v (%v)", workspace, err)
+	}
+	_, err = workerClient(server.URL, "parent").ThreadWorkspace(ctx, fork.ThreadID)
+	expectStatus(t, err, http.StatusUnauthorized)
+	if list, err := c.ListSnapshots(ctx, fork.ThreadID); err != nil || len(list.Snapshots) != 1 || list.Snapshots[0].MessageID != fork.Messages[1].ID {
+		t.Fatalf("Expected the fork's only snapshot to be the one it starts from, got %+v (%v)", list, err)
+	}
+	outputMutex.Lock()
+	settings := threadInfos[fork.ThreadID].Settings
+	outputMutex.Unlock()
+	if settings.Ref != "develop" || settings.DockerImage != "worker:1" {
+		t.Fatalf("Expected the fork to keep the parent's settings, got %+v", settings)
+	}
+
+	// Forking at the latest message leaves nothing to run until a prompt arrives
+	resp, err = c.ForkThread(ctx, "parent", "", client.ForkThreadRequest{Title: "Alternative"})
+	if err != nil {
+		t.Fatalf("ForkThread failed: %v", err)
+	}
+	if pending, _ := workerClient(server.URL, resp.ThreadID).PullMessages(ctx, resp.ThreadID, ""); len(pending) != 0 {
+		t.Fatalf("Expected no pending messages, got %+v", pending)
+	}
+	if workspace, _ := workerClient(server.URL, resp.ThreadID).ThreadWorkspace(ctx, resp.ThreadID); workspace == nil || string(workspace.Patch) != "second" {
+		t.Fatalf("Expected the latest workspace, got %+v", workspace)
+	}
+
+	// Before the first answer there is no workspace to restore
+	resp, err = c.ForkThread(ctx, "parent", "1", client.ForkThreadRequest{})
+	if err != nil {
+		t.Fatalf("ForkThread failed: %v", err)
+	}
+	if pending, _ := workerClient(server.URL, resp.ThreadID).PullMessages(ctx, resp.ThreadID, ""); len(pending) != 1 || pending[0].Content != "hello" {
+		t.Fatalf("Expected the first prompt to run again, got %+v", pending)
+	}
+	_, err = workerClient(server.URL, resp.ThreadID).ThreadWorkspace(ctx, resp.ThreadID)
+	expectStatus(t, err, http.StatusNotFound)
+
+	// The parent keeps its own history and workspace
+	workspace, err = workerClient(server.URL, "parent").ThreadWorkspace(ctx, "parent")
+	if err != nil || string(workspace.Patch) != "second" {
+		t.Fatalf("Expected the parent's latest workspace, got %+v (%v)", workspace, err)
+	}
+	if thread, _ := c.GetThread(ctx, "parent", client.GetThreadOptions{}); thread.MessageCount != 4 || thread.ForkedFrom != "" {
+		t.Fatalf("Expected the parent to be unchanged, got %+v", thread)
+	}
+}
+
+func TestForkThreadErrors(t *testing.T) {
+	resetThreads(t)
+	setupDataDir(t)
+	addTestThread("parent", "alice", "")
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+
+	_, err := client.New(server.URL, client.WithCaller("alice", "")).ForkThread(ctx, "parent", "missing", client.ForkThreadRequest{})
+	expectStatus(t, err, http.StatusBadRequest)
+	_, err = client.New(server.URL, client.WithCaller("bob", "")).ForkThread(ctx, "parent", "", client.ForkThreadRequest{})
+	expectStatus(t, err, http.StatusNotFound)
+	_, err = workerClient(server.URL, "parent").ThreadWorkspace(ctx, "unknown")
+	expectStatus(t, err, http.StatusUnauthorized)
+}
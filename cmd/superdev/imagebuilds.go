@@ -0,0 +1,518 @@
+package superdev
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+// Limits on uploaded builds
+const (
+	maxImageUpload    = 1 << 30 // Dockerfile, config and build context together
+	maxDockerfileSize = 1 << 20
+	maxWrapConfigSize = 64 << 10
+)
+
+// Limits on an unpacked build context, which a small gzipped upload can exceed
+// by far; variables so tests can lower them
+var (
+	maxContextSize    int64 = 4 << 30
+	maxContextEntries       = 100_000
+)
+
+// errContextTooLarge is returned when an unpacked build context exceeds its limits
+var errContextTooLarge = errors.New("build context is too large")
+
+// maxFinishedBuilds is how many finished builds are kept for their status and logs
+const maxFinishedBuilds = 100
+
+// imageBuild is a server-side build and its output, which followers wait on
+type imageBuild struct {
+	mu      sync.Mutex
+	build   client.ImageBuild
+	logs    []client.ImageBuildLogEntry
+	partial []byte        // output after the last newline
+	changed chan struct{} // closed and replaced whenever logs or status change
+}
+
+// Builds by ID, guarded by imageBuildsMutex
+var (
+	imageBuildsMutex sync.Mutex
+	imageBuilds      = make(map[string]*imageBuild)
+)
+
+func newImageBuild(build client.ImageBuild) *imageBuild {
+	return &imageBuild{build: build, changed: make(chan struct{})}
+}
+
+// Write records build output, one log entry per line
+func (b *imageBuild) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.partial = append(b.partial, p...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+		b.appendLocked(string(b.partial[:i]))
+		b.partial = b.partial[i+1:]
+	}
+	b.notifyLocked()
+	return len(p), nil
+}
+
+// appendLocked adds a log entry. The caller must hold b.mu.
+func (b *imageBuild) appendLocked(line string) {
+	b.logs = append(b.logs, client.ImageBuildLogEntry{Time: time.Now(), Message: redactSecrets(line)})
+}
+
+// notifyLocked wakes followers. The caller must hold b.mu.
+func (b *imageBuild) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// finish records the build's outcome
+func (b *imageBuild) finish(image *client.Image, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.partial) > 0 {
+		b.appendLocked(string(b.partial))
+		b.partial = nil
+	}
+	b.build.FinishedAt = time.Now()
+	if err != nil {
+		b.build.Status = client.BuildStatusFailed
+		b.build.Error = redactSecrets(err.Error())
+		b.appendLocked("Error: " + b.build.Error)
+	} else {
+		b.build.Status = client.BuildStatusSucceeded
+		b.build.Image = image
+	}
+	b.notifyLocked()
+}
+
+// snapshot returns the build, its log entries from index after onwards, and a
+// channel closed on the next change
+func (b *imageBuild) snapshot(after int) (client.ImageBuild, []client.ImageBuildLogEntry, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var entries []client.ImageBuildLogEntry
+	if after < len(b.logs) {
+		entries = append(entries, b.logs[after:]...)
+	}
+	return b.build, entries, b.changed
+}
+
+// imageUpload is a received build request, unpacked into dir
+type imageUpload struct {
+	dir        string // holds the Dockerfile and the context directory
+	dockerfile []byte
+	source     string
+	config     WrapConfig
+}
+
+func (u *imageUpload) dockerfilePath() string { return filepath.Join(u.dir, "Dockerfile") }
+func (u *imageUpload) contextDir() string     { return filepath.Join(u.dir, "context") }
+
+// receiveImageUpload reads a multipart upload with a dockerfile part, an optional
+// context tarball and an optional JSON wrap config, unpacking it into a temp dir
+func receiveImageUpload(w http.ResponseWriter, r *http.Request) (*imageUpload, *apiError) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageUpload)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "Expected a multipart/form-data upload")
+	}
+
+	dir, err := os.MkdirTemp("", "superdev-build")
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to create build directory")
+	}
+	upload := &imageUpload{dir: dir}
+	if err := os.Mkdir(upload.contextDir(), 0o755); err != nil {
+		os.RemoveAll(dir)
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to create build directory")
+	}
+
+	if apiErr := upload.readParts(reader); apiErr != nil {
+		os.RemoveAll(dir)
+		return nil, apiErr
+	}
+	return upload, nil
+}
+
+func (u *imageUpload) readParts(reader *multipart.Reader) *apiError {
+	var config []byte
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return uploadError(err)
+		}
+
+		switch part.FormName() {
+		case "dockerfile":
+			u.dockerfile, err = readLimited(part, maxDockerfileSize)
+		case "config":
+			config, err = readLimited(part, maxWrapConfigSize)
+		case "source":
+			var source []byte
+			source, err = readLimited(part, 1024)
+			u.source = string(source)
+		case "context":
+			err = extractBuildContext(part, u.contextDir())
+		default:
+			err = fmt.Errorf("unexpected form field %q", part.FormName())
+		}
+		part.Close()
+		if err != nil {
+			return uploadError(err)
+		}
+	}
+
+	if len(u.dockerfile) == 0 {
+		return newAPIError(http.StatusBadRequest, "A dockerfile part is required")
+	}
+	if err := os.WriteFile(u.dockerfilePath(), u.dockerfile, 0o644); err != nil {
+		return newAPIError(http.StatusInternalServerError, "Failed to write Dockerfile")
+	}
+
+	if len(bytes.TrimSpace(config)) > 0 && string(bytes.TrimSpace(config)) != "null" {
+		decoder := json.NewDecoder(bytes.NewReader(config))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&u.config); err != nil {
+			return newAPIError(http.StatusBadRequest, "Invalid wrap config: "+err.Error())
+		}
+	}
+	// The runner binary is a path on the client, and must never read server files
+	if u.config.RunnerBinary != "" {
+		return newAPIError(http.StatusBadRequest, "runner_binary can't be used for server-side builds")
+	}
+	return nil
+}
+
+// uploadError maps a failure reading the upload to an API error
+func uploadError(err error) *apiError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newAPIError(http.StatusRequestEntityTooLarge, "Upload too large")
+	}
+	if errors.Is(err, errContextTooLarge) {
+		return newAPIError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Build context too large; it may hold at most %d bytes in %d entries once unpacked", maxContextSize, maxContextEntries))
+	}
+	return newAPIError(http.StatusBadRequest, "Invalid upload: "+err.Error())
+}
+
+// readLimited reads all of r, failing if it's longer than limit
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("part is larger than %d bytes", limit)
+	}
+	return data, nil
+}
+
+// extractBuildContext unpacks a tar archive, gzipped or not, into dir. Only
+// regular files and directories inside dir are accepted, up to maxContextEntries
+// entries and maxContextSize bytes in total.
+func extractBuildContext(r io.Reader, dir string) error {
+	buffered := bufio.NewReader(r)
+	var archive io.Reader = buffered
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("invalid gzip context: %w", err)
+		}
+		defer gz.Close()
+		archive = gz
+	}
+
+	tr := tar.NewReader(archive)
+	var size int64
+	for entries := 1; ; entries++ {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid context archive: %w", err)
+		}
+		if entries > maxContextEntries {
+			return errContextTooLarge
+		}
+		if !filepath.IsLocal(header.Name) {
+			return fmt.Errorf("context entry %q is outside the build context", header.Name)
+		}
+		target := filepath.Join(dir, header.Name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode().Perm()|0o600)
+			if err != nil {
+				return err
+			}
+			// Headers can understate the size, so the copy itself is limited
+			n, err := io.Copy(f, io.LimitReader(tr, maxContextSize-size+1))
+			f.Close()
+			if err != nil {
+				return err
+			}
+			if size += n; size > maxContextSize {
+				return errContextTooLarge
+			}
+		default:
+			// Links could point outside the build directory
+			return fmt.Errorf("context entry %q is not a regular file or directory", header.Name)
+		}
+	}
+}
+
+// startImageBuild builds and wraps an upload in the background and registers the
+// result. An identical registered image is reused unless rebuild is set, and an
+// identical build already running is returned instead of starting another.
+func startImageBuild(caller Caller, upload *imageUpload, rebuild bool) (*client.ImageBuild, *apiError) {
+	if imageRegistry == nil {
+		os.RemoveAll(upload.dir)
+		return nil, errImagesDisabled
+	}
+
+	cfg := upload.config
+	cfg.applyDefaults()
+	if err := cfg.validate(); err != nil {
+		os.RemoveAll(upload.dir)
+		return nil, newAPIError(http.StatusBadRequest, err.Error())
+	}
+	hash, err := imageHash(upload.dockerfile, upload.contextDir(), cfg)
+	if err != nil {
+		os.RemoveAll(upload.dir)
+		return nil, newAPIError(http.StatusInternalServerError, err.Error())
+	}
+	// Concurrent builds must not share the intermediate tag
+	cfg.BaseTag = contentTag(cfg.BaseTag, hash)
+	cfg.Tag = contentTag(cfg.Tag, hash)
+
+	id, err := generateThreadID()
+	if err != nil {
+		os.RemoveAll(upload.dir)
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to generate build ID")
+	}
+	build := newImageBuild(client.ImageBuild{
+		ID:        id,
+		Hash:      hash,
+		Tag:       cfg.Tag,
+		Status:    client.BuildStatusBuilding,
+		Owner:     caller.User,
+		Team:      caller.Team,
+		CreatedAt: time.Now(),
+	})
+
+	imageBuildsMutex.Lock()
+	defer imageBuildsMutex.Unlock()
+
+	if !rebuild {
+		for _, existing := range imageBuilds {
+			if current, _, _ := existing.snapshot(0); current.Hash == hash && current.Status == client.BuildStatusBuilding {
+				os.RemoveAll(upload.dir)
+				return &current, nil
+			}
+		}
+		if image, ok := imageRegistry.Get(hash); ok && runDocker(io.Discard, "image", "inspect", image.Tag) == nil {
+			os.RemoveAll(upload.dir)
+			build.build.Tag = image.Tag
+			build.build.Reused = true
+			fmt.Fprintf(build, "Reusing wrapped Docker image %s\n", image.Tag)
+			build.finish(&image, nil)
+			imageBuilds[id] = build
+			pruneImageBuilds()
+			current, _, _ := build.snapshot(0)
+			return &current, nil
+		}
+	}
+
+	imageBuilds[id] = build
+	current, _, _ := build.snapshot(0)
+	go runImageBuild(build, upload, cfg, caller)
+	return &current, nil
+}
+
+// runImageBuild wraps an upload and registers the image, recording the outcome
+// on build
+func runImageBuild(build *imageBuild, upload *imageUpload, cfg WrapConfig, caller Caller) {
+	defer os.RemoveAll(upload.dir)
+	slog.Info("building image", "build_id", build.build.ID, "hash", build.build.Hash, "tag", cfg.Tag)
+
+	built, err := wrapImage(cfg, build.build.Hash, upload.dockerfilePath(), upload.contextDir(), build)
+	var image *client.Image
+	if err == nil {
+		var apiErr *apiError
+		image, apiErr = registerImage(caller, build.build.Hash, client.RegisterImageRequest{
+			Tag:        built.Tag,
+			Source:     upload.source,
+			Distro:     built.Distro,
+			AmpVersion: built.AmpVersion,
+		})
+		if apiErr != nil {
+			err = errors.New(apiErr.Message)
+		}
+	}
+	if err != nil {
+		slog.Error("image build failed", "build_id", build.build.ID, "error", err)
+	}
+	build.finish(image, err)
+
+	imageBuildsMutex.Lock()
+	pruneImageBuilds()
+	imageBuildsMutex.Unlock()
+}
+
+// pruneImageBuilds forgets the oldest finished builds beyond maxFinishedBuilds.
+// The caller must hold imageBuildsMutex.
+func pruneImageBuilds() {
+	var finished []client.ImageBuild
+	for _, build := range imageBuilds {
+		if current, _, _ := build.snapshot(0); current.Status != client.BuildStatusBuilding {
+			finished = append(finished, current)
+		}
+	}
+	if len(finished) <= maxFinishedBuilds {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].FinishedAt.Before(finished[j].FinishedAt) })
+	for _, build := range finished[:len(finished)-maxFinishedBuilds] {
+		delete(imageBuilds, build.ID)
+	}
+}
+
+// getImageBuild returns a build visible to the caller. Like threads, builds
+// started anonymously are visible to everyone, and team builds to the team.
+func getImageBuild(caller Caller, id string) (*imageBuild, *apiError) {
+	imageBuildsMutex.Lock()
+	build, ok := imageBuilds[id]
+	imageBuildsMutex.Unlock()
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "Build not found")
+	}
+
+	current, _, _ := build.snapshot(0)
+	if current.Owner != "" && caller.User != current.Owner && (current.Team == "" || caller.Team != current.Team) {
+		return nil, newAPIError(http.StatusNotFound, "Build not found")
+	}
+	return build, nil
+}
+
+// handleV1BuildImage accepts an upload to build on the server. It responds 202
+// with the build while building, or 200 if an identical image was reused.
+func handleV1BuildImage(w http.ResponseWriter, r *http.Request) {
+	rebuild, _ := strconv.ParseBool(r.URL.Query().Get("rebuild"))
+
+	upload, apiErr := receiveImageUpload(w, r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	build, apiErr := startImageBuild(callerFromRequest(r), upload, rebuild)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	status := http.StatusAccepted
+	if build.Status != client.BuildStatusBuilding {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, build)
+}
+
+func handleV1GetImageBuild(w http.ResponseWriter, r *http.Request) {
+	build, apiErr := getImageBuild(callerFromRequest(r), r.PathValue("id"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	current, _, _ := build.snapshot(0)
+	writeJSON(w, http.StatusOK, current)
+}
+
+// handleV1ImageBuildLogs returns a build's output. With ?follow=true it streams
+// entries as NDJSON until the build finishes.
+func handleV1ImageBuildLogs(w http.ResponseWriter, r *http.Request) {
+	build, apiErr := getImageBuild(callerFromRequest(r), r.PathValue("id"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	current, entries, changed := build.snapshot(0)
+
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+	if !follow {
+		if entries == nil {
+			entries = []client.ImageBuildLogEntry{}
+		}
+		writeJSON(w, http.StatusOK, client.ImageBuildLogs{BuildID: current.ID, Status: current.Status, Logs: entries})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, newAPIError(http.StatusInternalServerError, "Streaming not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	sent := 0
+	for {
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return
+			}
+		}
+		sent += len(entries)
+		flusher.Flush()
+
+		if current.Status != client.BuildStatusBuilding {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		}
+		current, entries, changed = build.snapshot(sent)
+	}
+}
@@ -0,0 +1,205 @@
+package superdev
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"superdev/cmd/superdev/client"
+)
+
+func TestContextArchiveRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	for name, content := range map[string]string{
+		"main.go":                   "package main",
+		"pkg/util.go":               "package pkg",
+		"debug.log":                 "noise",
+		"keep.log":                  "signal",
+		"node_modules/dep/index.js": "module.exports = {}",
+		".dockerignore":             "# build output\nnode_modules\n*.log\n!keep.log\n",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0o755)
+		os.WriteFile(filepath.Join(src, name), []byte(content), 0o644)
+	}
+	os.Symlink("main.go", filepath.Join(src, "link.go"))
+
+	var archive bytes.Buffer
+	if err := writeContextArchive(&archive, src); err != nil {
+		t.Fatalf("writeContextArchive failed: %v", err)
+	}
+
+	dst := t.TempDir()
+	if err := extractBuildContext(&archive, dst); err != nil {
+		t.Fatalf("extractBuildContext failed: %v", err)
+	}
+	for _, name := range []string{"main.go", "pkg/util.go", "keep.log", "link.go"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+			t.Errorf("Expected %s in the extracted context: %v", name, err)
+		}
+	}
+	for _, name := range []string{"debug.log", "node_modules"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); err == nil {
+			t.Errorf("Expected %s to be excluded by .dockerignore", name)
+		}
+	}
+	if info, err := os.Lstat(filepath.Join(dst, "link.go")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("Expected the symlink to be archived as a regular file, got %v, %v", info, err)
+	}
+}
+
+func TestExtractBuildContextRejectsEscapes(t *testing.T) {
+	for name, header := range map[string]*tar.Header{
+		"parent path":   {Name: "../evil", Typeflag: tar.TypeReg, Mode: 0o644},
+		"absolute path": {Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644},
+		"symlink":       {Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+	} {
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		tw.WriteHeader(header)
+		tw.Close()
+
+		if err := extractBuildContext(&archive, t.TempDir()); err == nil {
+			t.Errorf("Expected a %s entry to be rejected", name)
+		}
+	}
+}
+
+func TestExtractBuildContextLimits(t *testing.T) {
+	savedSize, savedEntries := maxContextSize, maxContextEntries
+	maxContextSize, maxContextEntries = 1024, 3
+	t.Cleanup(func() { maxContextSize, maxContextEntries = savedSize, savedEntries })
+
+	// A gzipped archive stays small however much it unpacks to
+	archive := func(files map[string]int) *bytes.Buffer {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for name, size := range files {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(size)})
+			tw.Write(make([]byte, size))
+		}
+		tw.Close()
+		gz.Close()
+		return &buf
+	}
+
+	if err := extractBuildContext(archive(map[string]int{"a": 512, "b": 512}), t.TempDir()); err != nil {
+		t.Fatalf("Expected a context within the limits to unpack, got %v", err)
+	}
+	for name, files := range map[string]map[string]int{
+		"too many bytes":   {"a": 512, "b": 513},
+		"too many entries": {"a": 1, "b": 1, "c": 1, "d": 1},
+	} {
+		err := extractBuildContext(archive(files), t.TempDir())
+		if !errors.Is(err, errContextTooLarge) {
+			t.Errorf("Expected a context with %s to be rejected, got %v", name, err)
+		}
+		if apiErr := uploadError(err); apiErr.Status != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected a context with %s to be too large, got %d", name, apiErr.Status)
+		}
+	}
+}
+
+func TestRemoteImageBuild(t *testing.T) {
+	stubRunnerSource(t)
+	setupImageRegistry(t)
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	c := client.New(server.URL, client.WithCaller("alice", ""))
+
+	contextDir := t.TempDir()
+	os.WriteFile(filepath.Join(contextDir, "app.txt"), []byte("hello"), 0o644)
+	dockerfile := filepath.Join(contextDir, "Dockerfile")
+	os.WriteFile(dockerfile, []byte("FROM debian\nCOPY app.txt /app.txt\n"), 0o644)
+	cfg := WrapConfig{Distro: DistroDebian, SkipValidation: true}
+
+	var uploaded, fail bool
+	images := newFakeImages()
+	stubDocker(t, func(args []string) (string, error) {
+		if output, err, handled := images.respond(args); handled {
+			return output, err
+		}
+		if args[0] == "build" && strings.HasPrefix(args[4], defaultBaseTag) {
+			_, err := os.Stat(filepath.Join(args[len(args)-1], "app.txt"))
+			uploaded = err == nil
+			if fail {
+				return "Step 1/2 : FROM debian\n", errors.New("exit status 1")
+			}
+			return "Step 1/2 : FROM debian\nStep 2/2 : COPY app.txt /app.txt\n", nil
+		}
+		return "", nil
+	})
+
+	var out bytes.Buffer
+	tag, err := buildRemoteImage(context.Background(), c, cfg, dockerfile, contextDir, false, &out)
+	if err != nil {
+		t.Fatalf("buildRemoteImage failed: %v\n%s", err, out.String())
+	}
+	if !uploaded {
+		t.Fatal("Expected the build context to be uploaded and unpacked")
+	}
+	if !strings.Contains(out.String(), "Step 2/2 : COPY app.txt /app.txt") {
+		t.Fatalf("Expected the server's build output to be streamed, got:\n%s", out.String())
+	}
+	image, ok := imageRegistry.Get(mustImageHash(t, dockerfile, contextDir, cfg))
+	if !ok || image.Tag != tag || image.Owner != "alice" {
+		t.Fatalf("Expected the server to register %s for alice, got %+v", tag, image)
+	}
+
+	// The same upload reuses the registered image without building
+	out.Reset()
+	reused, err := buildRemoteImage(context.Background(), c, cfg, dockerfile, contextDir, false, &out)
+	if err != nil || reused != tag || !strings.Contains(out.String(), "Reusing") {
+		t.Fatalf("Expected %s to be reused, got %s, %v:\n%s", tag, reused, err, out.String())
+	}
+
+	// A changed context is a different image
+	os.WriteFile(filepath.Join(contextDir, "app.txt"), []byte("hello again"), 0o644)
+	out.Reset()
+	changed, err := buildRemoteImage(context.Background(), c, cfg, dockerfile, contextDir, false, &out)
+	if err != nil || changed == tag || strings.Contains(out.String(), "Reusing") {
+		t.Fatalf("Expected the changed context to be built, got %s, %v:\n%s", changed, err, out.String())
+	}
+
+	fail = true
+	if _, err := buildRemoteImage(context.Background(), c, cfg, dockerfile, contextDir, true, &out); err == nil || !strings.Contains(err.Error(), "exit status 1") {
+		t.Fatalf("Expected the failed build to be reported, got %v", err)
+	}
+}
+
+func TestBuildImageRejectsRunnerBinary(t *testing.T) {
+	setupImageRegistry(t)
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	_, err := client.New(server.URL).BuildImage(context.Background(), client.BuildImageRequest{
+		Dockerfile: []byte("FROM debian\n"),
+		Config:     map[string]string{"runner_binary": "/etc/shadow"},
+	})
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected a 400 for runner_binary, got %v", err)
+	}
+}
+
+// mustImageHash returns the content hash of a Dockerfile and build context on disk
+func mustImageHash(t *testing.T, dockerfilePath, contextDir string, cfg WrapConfig) string {
+	t.Helper()
+	dockerfile, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		t.Fatalf("Failed to read Dockerfile: %v", err)
+	}
+	hash, err := imageHash(dockerfile, contextDir, cfg)
+	if err != nil {
+		t.Fatalf("imageHash failed: %v", err)
+	}
+	return hash
+}
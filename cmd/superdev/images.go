@@ -0,0 +1,287 @@
+package superdev
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+var imageHashPattern = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// ImageRegistry records the wrapped images threads may run, keyed by the content
+// hash of their source Dockerfile and wrap config, in a JSON file on disk
+type ImageRegistry struct {
+	mu     sync.Mutex
+	path   string
+	images map[string]*client.Image
+}
+
+// imageRegistry is nil until the server starts; without it any image may be used
+var imageRegistry *ImageRegistry
+
+// Images /start accepts without being registered
+var (
+	allowUnregisteredImages bool
+	allowedImages           []string // path.Match patterns such as "superdev-worker:*"
+)
+
+// NewImageRegistry opens the registry at path
+func NewImageRegistry(path string) (*ImageRegistry, error) {
+	registry := &ImageRegistry{
+		path:   path,
+		images: make(map[string]*client.Image),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image registry: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &registry.images); err != nil {
+		return nil, fmt.Errorf("failed to parse image registry: %w", err)
+	}
+	return registry, nil
+}
+
+// errImageTagTaken is returned when registering a tag another owner's image has
+var errImageTagTaken = errors.New("image tag is registered to another owner")
+
+// Register creates or replaces the image recorded under its hash. Rebuilding a
+// fixed tag from different content moves the tag, so the owner's older images
+// with the same tag are dropped; another owner's image keeps its tag.
+func (r *ImageRegistry) Register(image client.Image) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for hash, existing := range r.images {
+		if existing.Tag == image.Tag && hash != image.Hash && existing.Owner != image.Owner {
+			return errImageTagTaken
+		}
+	}
+	for hash, existing := range r.images {
+		if existing.Tag == image.Tag && hash != image.Hash {
+			delete(r.images, hash)
+		}
+	}
+	r.images[image.Hash] = &image
+	return r.save()
+}
+
+// Get returns the image registered under a hash
+func (r *ImageRegistry) Get(hash string) (client.Image, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	image, ok := r.images[hash]
+	if !ok {
+		return client.Image{}, false
+	}
+	return *image, true
+}
+
+// Delete removes an image
+func (r *ImageRegistry) Delete(hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.images, hash)
+	return r.save()
+}
+
+// List returns all images, newest first
+func (r *ImageRegistry) List() []client.Image {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]client.Image, 0, len(r.images))
+	for _, image := range r.images {
+		list = append(list, *image)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.After(list[j].CreatedAt)
+		}
+		return list[i].Hash < list[j].Hash
+	})
+	return list
+}
+
+// MarkUsed records that a thread was started with the image tagged tag, whose
+// Docker image ID is imageID. It reports whether the tag is registered for that
+// image, so a tag moved to another image since isn't admitted.
+func (r *ImageRegistry) MarkUsed(tag, imageID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, image := range r.images {
+		if image.Tag == tag && image.ImageID != "" && image.ImageID == imageID {
+			image.LastUsedAt = time.Now()
+			// Usage times are informational, so a failed write is not an error
+			r.save()
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the registry to disk. The caller must hold r.mu.
+func (r *ImageRegistry) save() error {
+	data, err := json.MarshalIndent(r.images, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal image registry: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0700); err != nil {
+		return fmt.Errorf("failed to create image registry directory: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated registry
+	tmpPath := r.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write image registry: %w", err)
+	}
+	if err := os.Rename(tmpPath, r.path); err != nil {
+		return fmt.Errorf("failed to replace image registry: %w", err)
+	}
+
+	return nil
+}
+
+// inspectImage returns the Docker image ID of tag on the server's daemon and
+// the content hash it was wrapped for, if any
+func inspectImage(tag string) (id, hash string, err error) {
+	var out bytes.Buffer
+	format := `{{.Id}} {{index .Config.Labels "` + imageHashLabel + `"}}`
+	if err := runDocker(&out, "image", "inspect", "--format", format, tag); err != nil {
+		return "", "", fmt.Errorf("failed to inspect image %s: %w", tag, err)
+	}
+	fields := strings.Fields(out.String())
+	if len(fields) == 0 {
+		return "", "", fmt.Errorf("failed to inspect image %s: no image ID", tag)
+	}
+	if len(fields) > 1 {
+		hash = fields[1]
+	}
+	return fields[0], hash, nil
+}
+
+// checkImageAllowed returns an error unless threads may be started with the image.
+// Registered images are admitted while their tag still names the image that was
+// registered on the server's Docker daemon.
+func checkImageAllowed(image string) *apiError {
+	if imageRegistry == nil || allowUnregisteredImages {
+		return nil
+	}
+	if id, _, err := inspectImage(image); err == nil && imageRegistry.MarkUsed(image, id) {
+		return nil
+	}
+	for _, pattern := range allowedImages {
+		if matched, _ := path.Match(pattern, image); matched {
+			return nil
+		}
+	}
+	return newAPIError(http.StatusForbidden, fmt.Sprintf("Image %s is not registered; build it with superdev run or allow it with --allowed-image", image))
+}
+
+var errImagesDisabled = newAPIError(http.StatusServiceUnavailable, "The image registry is not enabled on this server")
+
+// listImages returns every registered image
+func listImages() ([]client.Image, *apiError) {
+	if imageRegistry == nil {
+		return nil, errImagesDisabled
+	}
+	return imageRegistry.List(), nil
+}
+
+// getImage returns the image registered under a hash
+func getImage(hash string) (*client.Image, *apiError) {
+	if imageRegistry == nil {
+		return nil, errImagesDisabled
+	}
+	image, ok := imageRegistry.Get(hash)
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "Image not found")
+	}
+	return &image, nil
+}
+
+// registerImage records a built image under its content hash, owned by the caller.
+// The image must be on the server's Docker daemon, wrapped for that hash. Only
+// the owner can re-register a hash, which keeps its creation time.
+func registerImage(caller Caller, hash string, req client.RegisterImageRequest) (*client.Image, *apiError) {
+	if imageRegistry == nil {
+		return nil, errImagesDisabled
+	}
+	if !imageHashPattern.MatchString(hash) {
+		return nil, newAPIError(http.StatusBadRequest, "Image hash must be a hex-encoded sha256 digest")
+	}
+	if !imageTagPattern.MatchString(req.Tag) {
+		return nil, newAPIError(http.StatusBadRequest, "Image tag is required and must be a valid Docker tag")
+	}
+
+	image := client.Image{
+		Hash:       hash,
+		Tag:        req.Tag,
+		Source:     req.Source,
+		Distro:     req.Distro,
+		AmpVersion: req.AmpVersion,
+		Owner:      caller.User,
+		Team:       caller.Team,
+		CreatedAt:  time.Now(),
+	}
+	if existing, ok := imageRegistry.Get(hash); ok {
+		if existing.Owner != "" && existing.Owner != caller.User {
+			return nil, newAPIError(http.StatusForbidden, "Only the image's owner can re-register it")
+		}
+		image.Owner, image.Team, image.CreatedAt = existing.Owner, existing.Team, existing.CreatedAt
+	}
+
+	// The hash isn't taken on trust: the wrap labels the image with the hash it
+	// was built for, and the ID pins the tag to that image
+	id, labelled, err := inspectImage(req.Tag)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("Image %s is not on the server's Docker daemon", req.Tag))
+	}
+	if labelled != hash {
+		return nil, newAPIError(http.StatusBadRequest, fmt.Sprintf("Image %s was not wrapped by superdev for this hash", req.Tag))
+	}
+	image.ImageID = id
+
+	if err := imageRegistry.Register(image); errors.Is(err, errImageTagTaken) {
+		return nil, newAPIError(http.StatusConflict, fmt.Sprintf("Image tag %s is registered to another owner", req.Tag))
+	} else if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, err.Error())
+	}
+	return &image, nil
+}
+
+// deleteImage removes an image the caller registered
+func deleteImage(caller Caller, hash string) *apiError {
+	image, apiErr := getImage(hash)
+	if apiErr != nil {
+		return apiErr
+	}
+	if image.Owner != "" && image.Owner != caller.User {
+		return newAPIError(http.StatusForbidden, "Only the image's owner can delete it")
+	}
+
+	if err := imageRegistry.Delete(hash); err != nil {
+		return newAPIError(http.StatusInternalServerError, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package superdev
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"superdev/cmd/superdev/client"
+)
+
+var (
+	testImageHash  = strings.Repeat("a", 64)
+	otherImageHash = strings.Repeat("b", 64)
+)
+
+// setupImageRegistry gives the test an empty registry in a temp directory
+func setupImageRegistry(t *testing.T) *ImageRegistry {
+	t.Helper()
+	registry, err := NewImageRegistry(filepath.Join(t.TempDir(), "images.json"))
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	imageRegistry = registry
+	t.Cleanup(func() { imageRegistry = nil })
+	return registry
+}
+
+// fakeImages stands in for the images on the Docker daemon: stubbed builds
+// create them with the hash label they set, and inspects find them
+type fakeImages struct {
+	built  int
+	images map[string]fakeImage // by tag
+}
+
+type fakeImage struct {
+	id, hash string
+}
+
+func newFakeImages() *fakeImages {
+	return &fakeImages{images: make(map[string]fakeImage)}
+}
+
+// add creates or replaces the image tagged tag, returning its ID
+func (f *fakeImages) add(tag, hash string) string {
+	f.built++
+	id := fmt.Sprintf("sha256:%064d", f.built)
+	f.images[tag] = fakeImage{id: id, hash: hash}
+	return id
+}
+
+// respond handles image builds and inspects for stubDocker. Builds are recorded
+// and left to the test to answer; handled reports whether the test should.
+func (f *fakeImages) respond(args []string) (output string, err error, handled bool) {
+	switch {
+	case args[0] == "build":
+		var tag, hash string
+		for i := 1; i+1 < len(args); i++ {
+			switch args[i] {
+			case "-t":
+				tag = args[i+1]
+			case "--label":
+				hash = strings.TrimPrefix(args[i+1], imageHashLabel+"=")
+			}
+		}
+		f.add(tag, hash)
+		return "", nil, false
+	case len(args) > 1 && args[0] == "image" && args[1] == "inspect":
+		image, ok := f.images[args[len(args)-1]]
+		if !ok {
+			return "", errors.New("no such image"), true
+		}
+		if slices.Contains(args, "--format") {
+			return image.id + " " + image.hash + "\n", nil, true
+		}
+		return "[]", nil, true
+	}
+	return "", nil, false
+}
+
+// stubRunnerSource hashes a fixed runner instead of the embedded one
+func stubRunnerSource(t *testing.T) {
+	t.Helper()
+	original := RunnerSource
+	RunnerSource = fstest.MapFS{"cmd/superdev-amprunner/main.go": {Data: []byte("package main")}}
+	t.Cleanup(func() { RunnerSource = original })
+}
+
+func TestImageRegistryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "images.json")
+	registry, err := NewImageRegistry(path)
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	registry.Register(client.Image{Hash: testImageHash, Tag: "app:one", ImageID: "sha256:one"})
+	registry.Register(client.Image{Hash: otherImageHash, Tag: "app:two", ImageID: "sha256:two"})
+	if !registry.MarkUsed("app:one", "sha256:one") || registry.MarkUsed("app:unknown", "sha256:one") {
+		t.Fatal("Expected only registered tags to be marked used")
+	}
+	if registry.MarkUsed("app:two", "sha256:moved") {
+		t.Fatal("Expected a tag that names another image to not be marked used")
+	}
+
+	reopened, err := NewImageRegistry(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen registry: %v", err)
+	}
+	image, ok := reopened.Get(testImageHash)
+	if !ok || image.Tag != "app:one" || image.LastUsedAt.IsZero() {
+		t.Fatalf("Expected the image and its last use to round trip, got %+v", image)
+	}
+
+	// Rebuilding a fixed tag from new content moves the tag to the new hash
+	reopened.Register(client.Image{Hash: strings.Repeat("c", 64), Tag: "app:two"})
+	if _, ok := reopened.Get(otherImageHash); ok || len(reopened.List()) != 2 {
+		t.Fatalf("Expected the old image for app:two to be dropped, got %+v", reopened.List())
+	}
+
+	// ...but only the owner's own images give up the tag
+	reopened.Register(client.Image{Hash: strings.Repeat("d", 64), Tag: "app:mine", Owner: "alice"})
+	if err := reopened.Register(client.Image{Hash: strings.Repeat("e", 64), Tag: "app:mine", Owner: "bob"}); !errors.Is(err, errImageTagTaken) {
+		t.Fatalf("Expected bob to be refused alice's tag, got %v", err)
+	}
+	if _, ok := reopened.Get(strings.Repeat("d", 64)); !ok {
+		t.Fatal("Expected alice's image to keep its tag")
+	}
+}
+
+func TestV1Images(t *testing.T) {
+	setupImageRegistry(t)
+	images := newFakeImages()
+	stubDocker(t, func(args []string) (string, error) {
+		output, err, _ := images.respond(args)
+		return output, err
+	})
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	id := images.add("app:agent", testImageHash)
+	resp := doV1Request(t, server, http.MethodPut, "/v1/images/"+testImageHash, `{"tag": "app:agent", "distro": "debian"}`, "alice")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 registering an image, got %d", resp.StatusCode)
+	}
+
+	// Only the owner can re-register a hash
+	expectAPIError(t, doV1Request(t, server, http.MethodPut, "/v1/images/"+testImageHash, `{"tag": "app:agent"}`, "bob"), http.StatusForbidden, "forbidden")
+	c := client.New(server.URL, client.WithCaller("bob", ""))
+	list, err := c.ListImages(context.Background())
+	if err != nil || len(list.Images) != 1 || list.Images[0].Owner != "alice" || list.Images[0].ImageID != id {
+		t.Fatalf("Expected alice's image, got %+v, %v", list, err)
+	}
+
+	// The hash must be the one the image was wrapped for, so images that weren't
+	// wrapped, or don't exist, can't be registered
+	images.add("ubuntu:latest", "")
+	expectAPIError(t, doV1Request(t, server, http.MethodPut, "/v1/images/"+otherImageHash, `{"tag": "ubuntu:latest"}`, "bob"), http.StatusBadRequest, "bad_request")
+	expectAPIError(t, doV1Request(t, server, http.MethodPut, "/v1/images/"+otherImageHash, `{"tag": "app:missing"}`, "bob"), http.StatusBadRequest, "bad_request")
+
+	// Rewrapping alice's tag doesn't take it from her
+	images.add("app:agent", otherImageHash)
+	expectAPIError(t, doV1Request(t, server, http.MethodPut, "/v1/images/"+otherImageHash, `{"tag": "app:agent"}`, "bob"), http.StatusConflict, "conflict")
+
+	expectAPIError(t, doV1Request(t, server, http.MethodPut, "/v1/images/not-a-hash", `{"tag": "app:agent"}`, "alice"), http.StatusBadRequest, "bad_request")
+	expectAPIError(t, doV1Request(t, server, http.MethodPut, "/v1/images/"+otherImageHash, `{"tag": "Bad Tag"}`, "alice"), http.StatusBadRequest, "bad_request")
+	expectAPIError(t, doV1Request(t, server, http.MethodGet, "/v1/images/"+otherImageHash, "", "alice"), http.StatusNotFound, "not_found")
+	expectAPIError(t, doV1Request(t, server, http.MethodDelete, "/v1/images/"+testImageHash, "", "bob"), http.StatusForbidden, "forbidden")
+
+	resp = doV1Request(t, server, http.MethodDelete, "/v1/images/"+testImageHash, "", "alice")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 deleting an image, got %d", resp.StatusCode)
+	}
+}
+
+func TestStartRequiresRegisteredImage(t *testing.T) {
+	resetThreads(t)
+	registry := setupImageRegistry(t)
+	images := newFakeImages()
+	stubDocker(t, func(args []string) (string, error) {
+		output, err, _ := images.respond(args)
+		return output, err
+	})
+	registry.Register(client.Image{Hash: testImageHash, Tag: "app:agent", ImageID: images.add("app:agent", testImageHash)})
+
+	if apiErr := checkImageAllowed("app:agent"); apiErr != nil {
+		t.Fatalf("Expected a registered image to be allowed, got %v", apiErr.Message)
+	}
+
+	// Retagging another image under a registered tag doesn't get it admitted
+	images.add("app:agent", "")
+	if apiErr := checkImageAllowed("app:agent"); apiErr == nil || apiErr.Status != http.StatusForbidden {
+		t.Fatalf("Expected a retagged image to be refused, got %+v", apiErr)
+	}
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	resp := doV1Request(t, server, http.MethodPost, "/v1/threads", `{"docker_image": "ubuntu:latest", "repository_link": "https://example.com/repo.git", "prompt": "hi"}`, "alice")
+	expectAPIError(t, resp, http.StatusForbidden, "forbidden")
+
+	allowedImages = []string{"ubuntu:*"}
+	t.Cleanup(func() { allowedImages = nil })
+	if apiErr := checkImageAllowed("ubuntu:latest"); apiErr != nil {
+		t.Fatalf("Expected an allowed pattern to admit the image, got %v", apiErr.Message)
+	}
+}
+
+func TestImageHash(t *testing.T) {
+	stubRunnerSource(t)
+	dockerfile := []byte("FROM debian\n")
+
+	hash, err := imageHash(dockerfile, "", WrapConfig{})
+	if err != nil || !imageHashPattern.MatchString(hash) {
+		t.Fatalf("Expected a sha256 hash, got %q, %v", hash, err)
+	}
+
+	// Tags and validation don't change the image; defaults are the same as unset
+	same, _ := imageHash(dockerfile, "", WrapConfig{Tag: "team/app", BaseTag: "base", SkipValidation: true, NodeVersion: defaultNodeVersion})
+	if same != hash {
+		t.Error("Expected tags, validation and defaults not to change the hash")
+	}
+
+	for name, changed := range map[string]func() (string, error){
+		"dockerfile": func() (string, error) { return imageHash([]byte("FROM alpine\n"), "", WrapConfig{}) },
+		"packages":   func() (string, error) { return imageHash(dockerfile, "", WrapConfig{Packages: []string{"jq"}}) },
+		"context": func() (string, error) {
+			dir := t.TempDir()
+			os.WriteFile(filepath.Join(dir, "app.txt"), []byte("hello"), 0o644)
+			return imageHash(dockerfile, dir, WrapConfig{})
+		},
+		"runner": func() (string, error) {
+			RunnerSource = fstest.MapFS{"cmd/superdev-amprunner/main.go": {Data: []byte("package main // v2")}}
+			return imageHash(dockerfile, "", WrapConfig{})
+		},
+	} {
+		if other, _ := changed(); other == hash {
+			t.Errorf("Expected a different %s to change the hash", name)
+		}
+	}
+
+	// Files the context's .dockerignore leaves out aren't part of the image
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("*.log\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "app.txt"), []byte("hello"), 0o644)
+	withContext, _ := imageHash(dockerfile, dir, WrapConfig{})
+	os.WriteFile(filepath.Join(dir, "build.log"), []byte("noise"), 0o644)
+	if ignored, _ := imageHash(dockerfile, dir, WrapConfig{}); ignored != withContext {
+		t.Error("Expected ignored files not to change the hash")
+	}
+	os.WriteFile(filepath.Join(dir, "app.txt"), []byte("hello again"), 0o644)
+	if edited, _ := imageHash(dockerfile, dir, WrapConfig{}); edited == withContext {
+		t.Error("Expected an edited context file to change the hash")
+	}
+
+	for tag, want := range map[string]string{
+		"superdev-wrapped-image":    "superdev-wrapped-image:" + hash[:shortHashLength],
+		"team/app:agent":            "team/app:agent",
+		"registry.local:5000/app":   "registry.local:5000/app:" + hash[:shortHashLength],
+		"registry.local:5000/app:x": "registry.local:5000/app:x",
+	} {
+		if got := contentTag(tag, hash); got != want {
+			t.Errorf("contentTag(%q) = %q, want %q", tag, got, want)
+		}
+	}
+}
+
+func TestBuildOrReuseImage(t *testing.T) {
+	stubRunnerSource(t)
+	setupImageRegistry(t)
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	c := client.New(server.URL, client.WithCaller("alice", ""))
+
+	dockerfile := filepath.Join(t.TempDir(), "Dockerfile")
+	os.WriteFile(dockerfile, []byte("FROM debian\n"), 0o644)
+	cfg := WrapConfig{Distro: DistroDebian, SkipValidation: true}
+
+	images := newFakeImages()
+	calls := stubDocker(t, func(args []string) (string, error) {
+		output, err, _ := images.respond(args)
+		return output, err
+	})
+
+	// Two builds, then the server inspects the image it registers
+	tag, err := buildOrReuseImage(context.Background(), c, cfg, dockerfile, ".", false, io.Discard)
+	if err != nil {
+		t.Fatalf("buildOrReuseImage failed: %v", err)
+	}
+	if !strings.HasPrefix(tag, defaultWrappedTag+":") || len(*calls) != 3 {
+		t.Fatalf("Expected a build tagged with the content hash, got %s after %v", tag, *calls)
+	}
+	list, _ := c.ListImages(context.Background())
+	if len(list.Images) != 1 || list.Images[0].Tag != tag || list.Images[0].Distro != DistroDebian {
+		t.Fatalf("Expected the build to be registered, got %+v", list)
+	}
+
+	// An unchanged image is reused without building
+	*calls = nil
+	var out bytes.Buffer
+	reused, err := buildOrReuseImage(context.Background(), c, cfg, dockerfile, ".", false, &out)
+	if err != nil || reused != tag || len(*calls) != 1 || !strings.Contains(out.String(), "Reusing") {
+		t.Fatalf("Expected %s to be reused, got %s, %v after %v", tag, reused, err, *calls)
+	}
+
+	// ...unless it was removed locally or a rebuild is forced
+	delete(images.images, tag)
+	*calls = nil
+	buildOrReuseImage(context.Background(), c, cfg, dockerfile, ".", false, io.Discard)
+	if len(*calls) != 4 {
+		t.Fatalf("Expected a missing image to be rebuilt, got %v", *calls)
+	}
+	*calls = nil
+	buildOrReuseImage(context.Background(), c, cfg, dockerfile, ".", true, io.Discard)
+	if len(*calls) != 3 {
+		t.Fatalf("Expected --rebuild to skip the lookup and build, got %v", *calls)
+	}
+}
@@ -0,0 +1,517 @@
+package superdev
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"superdev/cmd/superdev/client"
+
+	"github.com/spf13/cobra"
+)
+
+// shortHashLength is how much of an image hash tags and tables show
+const shortHashLength = 12
+
+// imageHash returns the content hash identifying the image wrapped from a
+// Dockerfile and its build context with cfg. Tags and validation don't change
+// what gets built, so they are left out; the runner is included so a new runner
+// gets a new image. An empty contextDir is an empty build context.
+func imageHash(dockerfile []byte, contextDir string, cfg WrapConfig) (string, error) {
+	runner, err := runnerDigest(cfg)
+	if err != nil {
+		return "", err
+	}
+	buildContext, err := contextDigest(contextDir)
+	if err != nil {
+		return "", err
+	}
+
+	cfg.applyDefaults()
+	cfg.BaseTag, cfg.Tag, cfg.RunnerBinary, cfg.SkipValidation = "", "", "", false
+	config, err := json.Marshal(cfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal wrap config: %w", err)
+	}
+
+	h := sha256.New()
+	for _, part := range [][]byte{dockerfile, config, []byte(runner), []byte(buildContext)} {
+		// Length prefixes keep one part from bleeding into the next
+		fmt.Fprintf(h, "%d:", len(part))
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// contextDigest hashes the files of a build context that would be sent to
+// Docker, so the same context hashes the same locally and once uploaded
+func contextDigest(dir string) (string, error) {
+	h := sha256.New()
+	if dir == "" {
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	err := walkBuildContext(dir, func(rel, name string, info fs.FileInfo) error {
+		if info.IsDir() {
+			fmt.Fprintf(h, "%s/:", rel)
+			return nil
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		// Unpacking an upload can change other permission bits, so only the executable bit counts
+		fmt.Fprintf(h, "%s:%t:%d:", rel, info.Mode()&0o100 != 0, len(data))
+		h.Write(data)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to hash build context: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// runnerDigest hashes the runner binary, or the source it is built from
+func runnerDigest(cfg WrapConfig) (string, error) {
+	h := sha256.New()
+	if cfg.RunnerBinary != "" {
+		data, err := os.ReadFile(cfg.RunnerBinary)
+		if err != nil {
+			return "", fmt.Errorf("failed to read runner binary: %w", err)
+		}
+		h.Write(data)
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	if RunnerSource == nil {
+		return "", fmt.Errorf("no runner source is embedded in this build; set runner_binary")
+	}
+	err := fs.WalkDir(RunnerSource, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(RunnerSource, name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s:%d:", name, len(data))
+		h.Write(data)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to hash runner source: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// contentTag tags an untagged image name with the start of its content hash, so
+// each distinct build gets its own tag
+func contentTag(tag, hash string) string {
+	// A colon after the last slash is a tag rather than a registry port
+	if strings.Contains(tag[strings.LastIndex(tag, "/")+1:], ":") {
+		return tag
+	}
+	return tag + ":" + hash[:shortHashLength]
+}
+
+// buildOrReuseImage returns the tag of the wrapped image for a Dockerfile and
+// config. An image the server has registered under the same content hash is
+// reused if it's present locally; otherwise the image is built and registered.
+func buildOrReuseImage(ctx context.Context, c *client.Client, cfg WrapConfig, dockerfilePath, contextDir string, rebuild bool, out io.Writer) (string, error) {
+	dockerfile, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", dockerfilePath, err)
+	}
+	cfg.applyDefaults()
+	hash, err := imageHash(dockerfile, contextDir, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	if !rebuild {
+		image, err := c.GetImage(ctx, hash)
+		switch {
+		case err == nil && runDocker(io.Discard, "image", "inspect", image.Tag) == nil:
+			fmt.Fprintf(out, "Reusing wrapped Docker image %s (unchanged since %s)\n", image.Tag, image.CreatedAt.Local().Format(time.DateTime))
+			return image.Tag, nil
+		case err == nil:
+			fmt.Fprintf(out, "Registered image %s is missing locally, rebuilding\n", image.Tag)
+		case !client.IsNotFound(err):
+			fmt.Fprintf(out, "Warning: failed to look up image %s: %v\n", hash[:shortHashLength], err)
+		}
+	}
+
+	cfg.Tag = contentTag(cfg.Tag, hash)
+	built, err := wrapImage(cfg, hash, dockerfilePath, contextDir, out)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(out, "Successfully built wrapped Docker image %s from %s\n", built.Tag, dockerfilePath)
+
+	_, err = c.RegisterImage(ctx, hash, client.RegisterImageRequest{
+		Tag:        built.Tag,
+		Source:     dockerfilePath,
+		Distro:     built.Distro,
+		AmpVersion: built.AmpVersion,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to register image: %w", err)
+	}
+	return built.Tag, nil
+}
+
+// buildRemoteImage uploads a Dockerfile and its build context for the server to
+// build, wrap and register, streaming the build output to out. It returns the
+// tag of the server's image.
+func buildRemoteImage(ctx context.Context, c *client.Client, cfg WrapConfig, dockerfilePath, contextDir string, rebuild bool, out io.Writer) (string, error) {
+	if cfg.RunnerBinary != "" {
+		return "", fmt.Errorf("--runner-binary can't be used with --remote; the server builds the runner")
+	}
+	dockerfile, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", dockerfilePath, err)
+	}
+
+	archive, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeContextArchive(pw, contextDir))
+	}()
+	// Unblocks the archive writer if the upload stops early
+	defer archive.Close()
+
+	fmt.Fprintf(out, "Uploading %s and the build context in %s...\n", dockerfilePath, contextDir)
+	build, err := c.BuildImage(ctx, client.BuildImageRequest{
+		Dockerfile: dockerfile,
+		Source:     dockerfilePath,
+		Context:    archive,
+		Config:     cfg,
+		Rebuild:    rebuild,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload image: %w", err)
+	}
+
+	if build.Status == client.BuildStatusBuilding {
+		fmt.Fprintf(out, "Building on the server (build %s)...\n", build.ID)
+		err := c.FollowImageBuildLogs(ctx, build.ID, func(entry client.ImageBuildLogEntry) error {
+			fmt.Fprintln(out, entry.Message)
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to follow build %s: %w", build.ID, err)
+		}
+		finished, err := c.GetImageBuild(ctx, build.ID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get build %s: %w", build.ID, err)
+		}
+		build = finished
+	}
+
+	switch {
+	case build.Status == client.BuildStatusFailed:
+		return "", fmt.Errorf("server build %s failed: %s", build.ID, build.Error)
+	case build.Status != client.BuildStatusSucceeded:
+		return "", fmt.Errorf("server build %s is still %s", build.ID, build.Status)
+	case build.Reused:
+		fmt.Fprintf(out, "Reusing wrapped Docker image %s on the server\n", build.Tag)
+	default:
+		fmt.Fprintf(out, "Successfully built wrapped Docker image %s on the server\n", build.Tag)
+	}
+	return build.Tag, nil
+}
+
+// writeContextArchive writes dir as a gzipped tar archive of the files
+// walkBuildContext visits
+func writeContextArchive(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := walkBuildContext(dir, func(rel, name string, info fs.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive build context: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// walkBuildContext calls fn with the slash-separated relative path, the path
+// and the info of every directory and file in dir, in lexical order, leaving out
+// paths excluded by its .dockerignore. Symlinks to files are visited as the
+// files they point to; other symlinks are skipped.
+func walkBuildContext(dir string, fn func(rel, name string, info fs.FileInfo) error) error {
+	ignore, err := loadDockerignore(filepath.Join(dir, ".dockerignore"))
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if ignore.matches(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := os.Stat(name)
+		if err != nil || (!info.IsDir() && !info.Mode().IsRegular()) || (info.IsDir() && d.Type()&fs.ModeSymlink != 0) {
+			// Broken links, devices and linked directories aren't sent
+			return nil
+		}
+		return fn(rel, name, info)
+	})
+}
+
+// dockerignore holds .dockerignore patterns, applied in order so a later
+// pattern, or an exception starting with !, overrides an earlier one
+type dockerignore []string
+
+// loadDockerignore reads a .dockerignore file; a missing file ignores nothing
+func loadDockerignore(name string) (dockerignore, error) {
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .dockerignore: %w", err)
+	}
+
+	var patterns dockerignore
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		negated := strings.HasPrefix(line, "!")
+		pattern := strings.Trim(path.Clean(strings.TrimPrefix(line, "!")), "/")
+		if negated {
+			pattern = "!" + pattern
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// matches reports whether a slash-separated path relative to the context, or
+// one of its parent directories, is excluded
+func (d dockerignore) matches(rel string) bool {
+	ignored := false
+	for _, pattern := range d {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		for candidate := rel; candidate != "."; candidate = path.Dir(candidate) {
+			if matched, _ := path.Match(pattern, candidate); matched {
+				ignored = !negated
+				break
+			}
+		}
+	}
+	return ignored
+}
+
+// newImagesCmd builds the `superdev images` command group for the server's
+// image registry
+func newImagesCmd() *cobra.Command {
+	opts := &threadsOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "images",
+		Short: "List and remove the worker images registered on a server",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return opts.validate()
+		},
+	}
+
+	addServerFlags(cmd, opts)
+	cmd.PersistentFlags().StringVar(&opts.format, "format", formatTable, "Output format: table or json")
+
+	cmd.AddCommand(
+		newImagesListCmd(opts),
+		newImagesShowCmd(opts),
+		newImagesRemoveCmd(opts),
+	)
+
+	// Errors are printed once by Execute; usage only helps for bad arguments
+	for _, sub := range cmd.Commands() {
+		sub.SilenceErrors = true
+		sub.SilenceUsage = true
+	}
+
+	return cmd
+}
+
+func newImagesListCmd(opts *threadsOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List registered images, newest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			list, err := opts.client().ListImages(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("failed to list images: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), list)
+			}
+			return writeImageTable(cmd.OutOrStdout(), list.Images)
+		},
+	}
+}
+
+func newImagesShowCmd(opts *threadsOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "show <hash>",
+		Short: "Show a registered image; the hash may be abbreviated",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c := opts.client()
+			hash, err := resolveImageHash(cmd.Context(), c, args[0])
+			if err != nil {
+				return err
+			}
+			image, err := c.GetImage(cmd.Context(), hash)
+			if err != nil {
+				return fmt.Errorf("failed to get image: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), image)
+			}
+			return writeImage(cmd.OutOrStdout(), image)
+		},
+	}
+}
+
+func newImagesRemoveCmd(opts *threadsOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:     "rm <hash>",
+		Aliases: []string{"remove"},
+		Short:   "Remove an image you registered, so threads can no longer start with it",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c := opts.client()
+			hash, err := resolveImageHash(cmd.Context(), c, args[0])
+			if err != nil {
+				return err
+			}
+			if err := c.DeleteImage(cmd.Context(), hash); err != nil {
+				return fmt.Errorf("failed to remove image: %w", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed image %s\n", hash[:shortHashLength])
+			return nil
+		},
+	}
+}
+
+// resolveImageHash expands an abbreviated hash, as shown by images list, to the
+// registered image's full hash
+func resolveImageHash(ctx context.Context, c *client.Client, prefix string) (string, error) {
+	if imageHashPattern.MatchString(prefix) {
+		return prefix, nil
+	}
+
+	list, err := c.ListImages(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list images: %w", err)
+	}
+	var matches []string
+	for _, image := range list.Images {
+		if strings.HasPrefix(image.Hash, prefix) {
+			matches = append(matches, image.Hash)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no image matches %s", prefix)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("%s matches %d images, use more of the hash", prefix, len(matches))
+}
+
+// writeImageTable prints images as aligned columns
+func writeImageTable(w io.Writer, images []client.Image) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HASH\tTAG\tDISTRO\tAMP\tOWNER\tCREATED\tLAST USED")
+	for _, image := range images {
+		lastUsed := "never"
+		if !image.LastUsedAt.IsZero() {
+			lastUsed = image.LastUsedAt.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			image.Hash[:shortHashLength],
+			image.Tag,
+			image.Distro,
+			image.AmpVersion,
+			image.Owner,
+			image.CreatedAt.Local().Format(time.DateTime),
+			lastUsed,
+		)
+	}
+	return tw.Flush()
+}
+
+// writeImage prints an image's fields
+func writeImage(w io.Writer, image *client.Image) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fields := []struct{ name, value string }{
+		{"Hash", image.Hash},
+		{"Tag", image.Tag},
+		{"Source", image.Source},
+		{"Distro", image.Distro},
+		{"Amp", image.AmpVersion},
+		{"Owner", image.Owner},
+		{"Team", image.Team},
+		{"Created", image.CreatedAt.Local().Format(time.DateTime)},
+	}
+	if !image.LastUsedAt.IsZero() {
+		fields = append(fields, struct{ name, value string }{"Last used", image.LastUsedAt.Local().Format(time.DateTime)})
+	}
+	for _, field := range fields {
+		if field.value != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", field.name, field.value)
+		}
+	}
+	return tw.Flush()
+}
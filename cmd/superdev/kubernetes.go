@@ -0,0 +1,483 @@
+package superdev
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"superdev/cmd/superdev/client"
+	"superdev/cmd/superdev/tracing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Thread runtimes selectable with the server's --runtime flag
+const (
+	RuntimeDocker     = "docker"
+	RuntimeKubernetes = "kubernetes"
+)
+
+// Kubernetes settings set by the server command's flags
+var (
+	threadRuntime string
+	kubeNamespace string
+	kubeGitImage  string
+)
+
+// Defaults for the Kubernetes runtime
+const (
+	defaultKubeGitImage = "alpine/git:latest"
+	kubeStartTimeout    = 10 * time.Minute // how long a pod may take to start running
+)
+
+// kubePollInterval is how often pod status is checked
+var kubePollInterval = 2 * time.Second
+
+// Labels and container names of thread pods
+const (
+	kubeManagedByLabel  = "app.kubernetes.io/managed-by"
+	kubeThreadLabel     = "superdev.dev/thread-id"
+	kubeCloneContainer  = "clone"
+	kubeWorkerContainer = "worker"
+)
+
+// Waiting reasons that mean a container will never start without intervention
+var kubeFatalWaitingReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// KubernetesBackend runs each thread as a pod in a Kubernetes namespace. The
+// repository is cloned by an init container into a volume shared with the
+// worker; context and guidance files come from a ConfigMap and secrets from a
+// Secret, all named after the thread.
+type KubernetesBackend struct {
+	client    kubernetes.Interface
+	namespace string
+	gitImage  string
+
+	mu      sync.Mutex
+	threads map[string]bool // threads with resources in the cluster
+	follows sync.WaitGroup  // pods being followed
+}
+
+// kubeBackend is nil unless the server runs threads on Kubernetes
+var kubeBackend *KubernetesBackend
+
+// NewKubernetesBackend creates a backend creating pods in namespace through
+// clientset; init containers clone with gitImage
+func NewKubernetesBackend(clientset kubernetes.Interface, namespace, gitImage string) *KubernetesBackend {
+	return &KubernetesBackend{
+		client:    clientset,
+		namespace: namespace,
+		gitImage:  gitImage,
+		threads:   make(map[string]bool),
+	}
+}
+
+// newKubernetesClient connects with the current kubeconfig context, or the pod's
+// service account when running in a cluster. It returns the client and the
+// namespace to use when none was configured.
+func newKubernetesClient() (kubernetes.Interface, string, error) {
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+	config, err := loader.ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load Kubernetes configuration: %w", err)
+	}
+	namespace, _, err := loader.Namespace()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to determine Kubernetes namespace: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	return clientset, namespace, nil
+}
+
+// kubeName is the name of a thread's pod, ConfigMap and Secret
+func kubeName(threadID string) string {
+	return "superdev-" + threadID
+}
+
+// Start creates a thread's pod and waits for it to run. It returns the pod's
+// name; the pod is followed in the background until it ends.
+func (b *KubernetesBackend) Start(ctx context.Context, threadID string, req client.StartThreadRequest, secrets []threadSecret) (string, error) {
+	b.mu.Lock()
+	b.threads[threadID] = true
+	b.mu.Unlock()
+
+	ctx, span := startSpan(ctx, "kubernetes.pod", threadID)
+	podName, err := b.start(ctx, threadID, req, secrets)
+	endSpan(span, err)
+	if err != nil {
+		b.cleanup(threadID)
+		return "", err
+	}
+
+	b.follows.Add(1)
+	go b.follow(threadID, podName)
+	return podName, nil
+}
+
+// start creates the thread's resources and waits for its pod to run
+func (b *KubernetesBackend) start(ctx context.Context, threadID string, req client.StartThreadRequest, secrets []threadSecret) (string, error) {
+	log := threadLogger(threadID)
+	name := kubeName(threadID)
+	labels := map[string]string{kubeManagedByLabel: "superdev", kubeThreadLabel: threadID}
+	meta := metav1.ObjectMeta{Name: name, Namespace: b.namespace, Labels: labels}
+
+	files := &corev1.ConfigMap{ObjectMeta: meta, BinaryData: make(map[string][]byte)}
+	var contextItems, guidanceItems []corev1.KeyToPath
+	for i, content := range req.ContextFiles {
+		key := fmt.Sprintf("context_%d.txt", i)
+		files.BinaryData[key] = content
+		contextItems = append(contextItems, corev1.KeyToPath{Key: key, Path: key})
+	}
+	for _, fileName := range sortedKeys(req.Guidance) {
+		key := "guidance." + fileName
+		files.BinaryData[key] = req.Guidance[fileName]
+		guidanceItems = append(guidanceItems, corev1.KeyToPath{Key: key, Path: fileName})
+	}
+	if _, err := b.client.CoreV1().ConfigMaps(b.namespace).Create(ctx, files, metav1.CreateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to create ConfigMap: %w", err)
+	}
+
+	pod := b.podSpec(ctx, threadID, req, secrets, contextItems, guidanceItems)
+	pod.ObjectMeta = meta
+
+	if values := kubeSecretData(secrets); len(values) > 0 {
+		secret := &corev1.Secret{ObjectMeta: meta, Data: values}
+		if _, err := b.client.CoreV1().Secrets(b.namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			return "", fmt.Errorf("failed to create Secret: %w", err)
+		}
+	}
+	if req.Sandbox != nil && req.Sandbox.PidsLimit > 0 {
+		log(PhaseProvision, "", "pids_limit is not enforced on Kubernetes; set it in the kubelet configuration")
+	}
+
+	if _, err := b.client.CoreV1().Pods(b.namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to create pod: %w", err)
+	}
+	log(PhaseProvision, "", fmt.Sprintf("Created pod %s in namespace %s", name, b.namespace))
+
+	err := b.waitRunning(ctx, name)
+	b.copyLogs(ctx, threadID, name, kubeCloneContainer, PhaseClone)
+	if err != nil {
+		return "", err
+	}
+	log(PhaseProvision, "", fmt.Sprintf("Pod %s is running", name))
+	return name, nil
+}
+
+// podSpec builds a thread's pod
+func (b *KubernetesBackend) podSpec(ctx context.Context, threadID string, req client.StartThreadRequest, secrets []threadSecret, contextItems, guidanceItems []corev1.KeyToPath) *corev1.Pod {
+	name := kubeName(threadID)
+
+	// The init container gets the repository and ref through its environment so
+	// they are never interpreted by the shell
+	clone := corev1.Container{
+		Name:    kubeCloneContainer,
+		Image:   b.gitImage,
+		Command: []string{"sh", "-c", `git clone "$REPOSITORY" /workdir/repo && cd /workdir/repo && if [ -n "$REF" ]; then git checkout "$REF" --; else git pull origin main; fi`},
+		Env: []corev1.EnvVar{
+			{Name: "REPOSITORY", Value: req.RepositoryLink},
+			{Name: "REF", Value: req.Ref},
+		},
+		VolumeMounts: []corev1.VolumeMount{{Name: "repo", MountPath: "/workdir/repo"}},
+	}
+
+	worker := corev1.Container{
+		Name:  kubeWorkerContainer,
+		Image: req.DockerImage,
+		Env: []corev1.EnvVar{
+			{Name: "SERVER_URL", Value: req.ServerURL},
+			{Name: "THREAD_ID", Value: threadID},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "repo", MountPath: "/workdir/repo"},
+			{Name: "context", MountPath: "/workdir/context"},
+			{Name: "guidance", MountPath: "/workdir/guidance"},
+		},
+		Resources: kubeResources(req.Sandbox),
+	}
+
+	// Hand the trace context and exporter to the runner so its spans join this trace
+	if traceParent := tracing.TraceParent(ctx); traceParent != "" {
+		worker.Env = append(worker.Env, corev1.EnvVar{Name: tracing.EnvTraceParent, Value: traceParent})
+	}
+	if otlpEndpoint != "" {
+		worker.Env = append(worker.Env, corev1.EnvVar{Name: tracing.EnvOTLPEndpoint, Value: otlpEndpoint})
+	}
+
+	secretRef := func(key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		}}
+	}
+	if os.Getenv("ANTHROPIC_API_KEY") != "" {
+		worker.Env = append(worker.Env, corev1.EnvVar{Name: "ANTHROPIC_API_KEY", ValueFrom: secretRef("ANTHROPIC_API_KEY")})
+	}
+	var fileSecrets []corev1.KeyToPath
+	for _, secret := range secrets {
+		if secret.Mount == SecretMountFile {
+			fileSecrets = append(fileSecrets, corev1.KeyToPath{Key: secret.Name, Path: secret.Name})
+			continue
+		}
+		worker.Env = append(worker.Env, corev1.EnvVar{Name: secret.Name, ValueFrom: secretRef(secret.Name)})
+	}
+
+	filesVolume := func(volume string, items []corev1.KeyToPath) corev1.Volume {
+		if len(items) == 0 {
+			return corev1.Volume{Name: volume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}
+		}
+		return corev1.Volume{Name: volume, VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Items:                items,
+		}}}
+	}
+	volumes := []corev1.Volume{
+		{Name: "repo", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		filesVolume("context", contextItems),
+		filesVolume("guidance", guidanceItems),
+	}
+
+	// File secrets are projected read-only rather than written into the container
+	if len(fileSecrets) > 0 {
+		mode := int32(0o400)
+		volumes = append(volumes, corev1.Volume{Name: "secrets", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+			SecretName:  name,
+			Items:       fileSecrets,
+			DefaultMode: &mode,
+		}}})
+		worker.VolumeMounts = append(worker.VolumeMounts, corev1.VolumeMount{Name: "secrets", MountPath: secretsDir, ReadOnly: true})
+	}
+
+	return &corev1.Pod{
+		Spec: corev1.PodSpec{
+			RestartPolicy:  corev1.RestartPolicyNever,
+			InitContainers: []corev1.Container{clone},
+			Containers:     []corev1.Container{worker},
+			Volumes:        volumes,
+		},
+	}
+}
+
+// waitRunning polls a pod until it runs, fails or can't start
+func (b *KubernetesBackend) waitRunning(ctx context.Context, name string) error {
+	deadline := time.Now().Add(kubeStartTimeout)
+	for {
+		pod, err := b.client.CoreV1().Pods(b.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get pod %s: %w", name, err)
+		}
+		switch pod.Status.Phase {
+		case corev1.PodRunning, corev1.PodSucceeded:
+			return nil
+		case corev1.PodFailed:
+			return fmt.Errorf("pod %s failed: %s", name, podFailure(pod))
+		}
+		if reason := podWaitingFailure(pod); reason != "" {
+			return fmt.Errorf("pod %s can't start: %s", name, reason)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pod %s did not start within %s", name, kubeStartTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(kubePollInterval):
+		}
+	}
+}
+
+// follow streams a running pod's output into the thread's log and waits for
+// it to end. A failed pod fails the thread. The thread's resources are then
+// deleted and its scheduler slot released.
+func (b *KubernetesBackend) follow(threadID, name string) {
+	defer b.follows.Done()
+	ctx := context.Background()
+	logsDone := make(chan struct{})
+	go func() {
+		defer close(logsDone)
+		stream, err := b.client.CoreV1().Pods(b.namespace).GetLogs(name, &corev1.PodLogOptions{Container: kubeWorkerContainer, Follow: true}).Stream(ctx)
+		if err != nil {
+			slog.Warn("failed to follow pod logs", "thread_id", threadID, "pod", name, "error", err)
+			return
+		}
+		defer stream.Close()
+		streamLog(threadLogger(threadID), PhaseContainer, "stdout", stream, nil)
+	}()
+
+	for {
+		pod, err := b.client.CoreV1().Pods(b.namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// Deleted, normally by cancelling the thread
+			break
+		}
+		if err != nil {
+			slog.Warn("failed to get pod status", "thread_id", threadID, "pod", name, "error", err)
+		} else if pod.Status.Phase == corev1.PodSucceeded {
+			appendThreadLog(threadID, PhaseContainer, "", fmt.Sprintf("Pod %s completed", name))
+			markThreadEnded(threadID, client.ThreadStatusCompleted)
+			break
+		} else if pod.Status.Phase == corev1.PodFailed {
+			failure := podFailure(pod)
+			appendThreadLog(threadID, PhaseContainer, "", fmt.Sprintf("Pod %s failed: %s", name, failure))
+			markThreadEnded(threadID, client.ThreadStatusFailed)
+			break
+		}
+		time.Sleep(kubePollInterval)
+	}
+
+	// The log stream ends with the worker, or once the pod is deleted
+	<-logsDone
+	b.cleanup(threadID)
+	threadScheduler.Release(threadID)
+}
+
+// Stop deletes a thread's pod and its files. It reports false if the thread
+// doesn't run on Kubernetes.
+func (b *KubernetesBackend) Stop(threadID string) bool {
+	b.mu.Lock()
+	known := b.threads[threadID]
+	b.mu.Unlock()
+	if !known {
+		return false
+	}
+
+	b.cleanup(threadID)
+	return true
+}
+
+// cleanup deletes a thread's pod, ConfigMap and Secret, ignoring ones that are already gone
+func (b *KubernetesBackend) cleanup(threadID string) {
+	b.mu.Lock()
+	delete(b.threads, threadID)
+	b.mu.Unlock()
+
+	ctx := context.Background()
+	name := kubeName(threadID)
+	core := b.client.CoreV1()
+	for kind, remove := range map[string]func() error{
+		"pod":       func() error { return core.Pods(b.namespace).Delete(ctx, name, metav1.DeleteOptions{}) },
+		"ConfigMap": func() error { return core.ConfigMaps(b.namespace).Delete(ctx, name, metav1.DeleteOptions{}) },
+		"Secret":    func() error { return core.Secrets(b.namespace).Delete(ctx, name, metav1.DeleteOptions{}) },
+	} {
+		if err := remove(); err != nil && !apierrors.IsNotFound(err) {
+			slog.Error("failed to delete thread resource", "thread_id", threadID, "kind", kind, "name", name, "error", err)
+		}
+	}
+}
+
+// copyLogs appends a container's output so far to the thread's log under phase
+func (b *KubernetesBackend) copyLogs(ctx context.Context, threadID, name, container, phase string) {
+	output, err := b.client.CoreV1().Pods(b.namespace).GetLogs(name, &corev1.PodLogOptions{Container: container}).Do(ctx).Raw()
+	if err != nil {
+		slog.Warn("failed to get container logs", "thread_id", threadID, "pod", name, "container", container, "error", err)
+		return
+	}
+	streamLog(threadLogger(threadID), phase, "stdout", bytes.NewReader(output), nil)
+}
+
+// markThreadEnded records that a running thread's worker ended, with status
+// completed or failed. Threads that were cancelled keep their status.
+func markThreadEnded(threadID, status string) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	if info := threadInfos[threadID]; info != nil && info.Status == client.ThreadStatusRunning {
+		info.Status = status
+		if status == client.ThreadStatusFailed {
+			threadsFailed.Inc()
+		}
+	}
+}
+
+// podFailure describes why a pod failed from its terminated containers
+func podFailure(pod *corev1.Pod) string {
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+			failure := fmt.Sprintf("container %s exited with code %d", status.Name, terminated.ExitCode)
+			if terminated.Reason != "" {
+				failure += " (" + terminated.Reason + ")"
+			}
+			return failure
+		}
+	}
+	if pod.Status.Message != "" {
+		return pod.Status.Message
+	}
+	return "unknown reason"
+}
+
+// podWaitingFailure returns why a pod's container can't start, if it never will
+func podWaitingFailure(pod *corev1.Pod) string {
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if waiting := status.State.Waiting; waiting != nil && kubeFatalWaitingReasons[waiting.Reason] {
+			return strings.TrimSpace(fmt.Sprintf("container %s: %s %s", status.Name, waiting.Reason, waiting.Message))
+		}
+	}
+	return ""
+}
+
+// kubeSecretData returns the values for a thread's Secret: its secrets and the
+// server's API key
+func kubeSecretData(secrets []threadSecret) map[string][]byte {
+	data := make(map[string][]byte)
+	if key := os.Getenv("ANTHROPIC_API_KEY"); key != "" {
+		data["ANTHROPIC_API_KEY"] = []byte(key)
+	}
+	for _, secret := range secrets {
+		data[secret.Name] = []byte(secret.Value)
+	}
+	return data
+}
+
+// kubeResources converts a sandbox policy to container limits. Docker memory
+// suffixes are binary, so 4g becomes 4Gi.
+func kubeResources(sandbox *client.SandboxPolicy) corev1.ResourceRequirements {
+	var resources corev1.ResourceRequirements
+	if sandbox == nil {
+		return resources
+	}
+	limits := corev1.ResourceList{}
+	if sandbox.Memory != "" {
+		memory := strings.ToLower(sandbox.Memory)
+		for suffix, unit := range map[string]string{"b": "", "k": "Ki", "m": "Mi", "g": "Gi"} {
+			if strings.HasSuffix(memory, suffix) {
+				memory = strings.TrimSuffix(memory, suffix) + unit
+				break
+			}
+		}
+		if quantity, err := resource.ParseQuantity(memory); err == nil {
+			limits[corev1.ResourceMemory] = quantity
+		}
+	}
+	if sandbox.CPUs != "" {
+		if quantity, err := resource.ParseQuantity(sandbox.CPUs); err == nil {
+			limits[corev1.ResourceCPU] = quantity
+		}
+	}
+	if len(limits) > 0 {
+		resources.Limits = limits
+	}
+	return resources
+}
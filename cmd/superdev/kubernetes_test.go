@@ -0,0 +1,261 @@
+package superdev
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"superdev/cmd/superdev/client"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "threads"
+
+// setupKubernetes gives the test a backend on a fake clientset that polls quickly
+func setupKubernetes(t *testing.T) (*KubernetesBackend, *fake.Clientset) {
+	t.Helper()
+	original := kubePollInterval
+	kubePollInterval = 5 * time.Millisecond
+	t.Cleanup(func() { kubePollInterval = original })
+
+	clientset := fake.NewClientset()
+	backend := NewKubernetesBackend(clientset, testNamespace, "git:latest")
+	t.Cleanup(backend.follows.Wait)
+	return backend, clientset
+}
+
+// startPod starts a thread on the backend in the background, returning its pod
+// once it has been created and a channel with Start's result
+func startPod(t *testing.T, backend *KubernetesBackend, clientset *fake.Clientset, threadID string, req client.StartThreadRequest, secrets []threadSecret) (*corev1.Pod, chan error) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		name, err := backend.Start(context.Background(), threadID, req, secrets)
+		if err == nil && name != kubeName(threadID) {
+			t.Errorf("Expected the pod to be named %s, got %s", kubeName(threadID), name)
+		}
+		done <- err
+	}()
+
+	var pod *corev1.Pod
+	waitFor(t, "the pod to be created", func() bool {
+		var err error
+		pod, err = clientset.CoreV1().Pods(testNamespace).Get(context.Background(), kubeName(threadID), metav1.GetOptions{})
+		return err == nil
+	})
+	return pod, done
+}
+
+// setPodStatus replaces a pod's status as the kubelet would
+func setPodStatus(t *testing.T, clientset *fake.Clientset, pod *corev1.Pod, status corev1.PodStatus) {
+	t.Helper()
+	pod.Status = status
+	if _, err := clientset.CoreV1().Pods(testNamespace).UpdateStatus(context.Background(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update pod status: %v", err)
+	}
+}
+
+// expectResult waits for Start to return
+func expectResult(t *testing.T, done chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Start")
+		return nil
+	}
+}
+
+// expectDeleted waits for a thread's pod, ConfigMap and Secret to be deleted
+func expectDeleted(t *testing.T, clientset *fake.Clientset, threadID string) {
+	t.Helper()
+	ctx := context.Background()
+	name := kubeName(threadID)
+	waitFor(t, "the thread's resources to be deleted", func() bool {
+		_, podErr := clientset.CoreV1().Pods(testNamespace).Get(ctx, name, metav1.GetOptions{})
+		_, filesErr := clientset.CoreV1().ConfigMaps(testNamespace).Get(ctx, name, metav1.GetOptions{})
+		_, secretErr := clientset.CoreV1().Secrets(testNamespace).Get(ctx, name, metav1.GetOptions{})
+		return apierrors.IsNotFound(podErr) && apierrors.IsNotFound(filesErr) && apierrors.IsNotFound(secretErr)
+	})
+}
+
+func envValue(container corev1.Container, name string) (corev1.EnvVar, bool) {
+	for _, env := range container.Env {
+		if env.Name == name {
+			return env, true
+		}
+	}
+	return corev1.EnvVar{}, false
+}
+
+func TestKubernetesBackendRunsPod(t *testing.T) {
+	resetThreads(t)
+	setupDataDir(t)
+	t.Setenv("ANTHROPIC_API_KEY", "sk-test")
+	backend, clientset := setupKubernetes(t)
+	scheduler := setupScheduler(t, 0, 0, 0)
+	addTestThread("t1", "alice", "")
+	scheduler.Admit("t1", "alice", 0, nil)
+
+	req := client.StartThreadRequest{
+		RepositoryLink: "https://example.com/repo.git",
+		Ref:            "develop",
+		DockerImage:    "worker:1",
+		ServerURL:      "http://superdev:8080",
+		ContextFiles:   [][]byte{[]byte("context")},
+		Guidance:       map[string][]byte{"AGENTS.md": []byte("Be brief")},
+		Sandbox:        &client.SandboxPolicy{Memory: "4g", CPUs: "1.5"},
+	}
+	secrets := []threadSecret{
+		{Name: "NPM_TOKEN", Value: "npm-value", Mount: SecretMountEnv},
+		{Name: "SSH_KEY", Value: "ssh-value", Mount: SecretMountFile},
+	}
+	pod, done := startPod(t, backend, clientset, "t1", req, secrets)
+
+	clone := pod.Spec.InitContainers[0]
+	if clone.Image != "git:latest" {
+		t.Fatalf("Expected the clone image to be configurable, got %s", clone.Image)
+	}
+	if env, _ := envValue(clone, "REF"); env.Value != "develop" {
+		t.Fatalf("Expected the ref to be passed to the clone, got %+v", env)
+	}
+
+	worker := pod.Spec.Containers[0]
+	for name, want := range map[string]string{"SERVER_URL": "http://superdev:8080", "THREAD_ID": "t1"} {
+		if env, _ := envValue(worker, name); env.Value != want {
+			t.Fatalf("Expected %s=%s, got %+v", name, want, env)
+		}
+	}
+	for _, name := range []string{"NPM_TOKEN", "ANTHROPIC_API_KEY"} {
+		env, ok := envValue(worker, name)
+		if !ok || env.Value != "" || env.ValueFrom == nil || env.ValueFrom.SecretKeyRef.Key != name {
+			t.Fatalf("Expected %s to come from the thread's Secret, got %+v", name, env)
+		}
+	}
+	if _, ok := envValue(worker, "SSH_KEY"); ok {
+		t.Fatal("Expected file secrets to stay out of the environment")
+	}
+	limits := worker.Resources.Limits
+	if limits.Memory().String() != "4Gi" || limits.Cpu().String() != "1500m" {
+		t.Fatalf("Expected the sandbox limits to become resource limits, got %v", limits)
+	}
+
+	volumes := make(map[string]corev1.Volume)
+	for _, volume := range pod.Spec.Volumes {
+		volumes[volume.Name] = volume
+	}
+	if volumes["repo"].EmptyDir == nil {
+		t.Fatalf("Expected the repository in an emptyDir, got %+v", volumes["repo"])
+	}
+	if items := volumes["guidance"].ConfigMap.Items; len(items) != 1 || items[0].Path != "AGENTS.md" {
+		t.Fatalf("Expected the guidance file to be projected under its name, got %+v", items)
+	}
+	if items := volumes["secrets"].Secret.Items; len(items) != 1 || items[0].Key != "SSH_KEY" {
+		t.Fatalf("Expected only file secrets in the secrets volume, got %+v", items)
+	}
+
+	ctx := context.Background()
+	files, err := clientset.CoreV1().ConfigMaps(testNamespace).Get(ctx, kubeName("t1"), metav1.GetOptions{})
+	if err != nil || string(files.BinaryData["context_0.txt"]) != "context" || string(files.BinaryData["guidance.AGENTS.md"]) != "Be brief" {
+		t.Fatalf("Expected the ConfigMap to hold the files, got %+v (%v)", files, err)
+	}
+	secret, err := clientset.CoreV1().Secrets(testNamespace).Get(ctx, kubeName("t1"), metav1.GetOptions{})
+	if err != nil || string(secret.Data["NPM_TOKEN"]) != "npm-value" || string(secret.Data["SSH_KEY"]) != "ssh-value" || string(secret.Data["ANTHROPIC_API_KEY"]) != "sk-test" {
+		t.Fatalf("Expected the Secret to hold the values, got %v (%v)", secret, err)
+	}
+
+	setPodStatus(t, clientset, pod, corev1.PodStatus{Phase: corev1.PodRunning})
+	if err := expectResult(t, done); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	// A failed worker fails the thread and frees its resources and slot
+	setPodStatus(t, clientset, pod, corev1.PodStatus{
+		Phase: corev1.PodFailed,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  kubeWorkerContainer,
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 137, Reason: "OOMKilled"}},
+		}},
+	})
+	expectDeleted(t, clientset, "t1")
+	waitFor(t, "the slot to be released", func() bool {
+		scheduler.mu.Lock()
+		defer scheduler.mu.Unlock()
+		return len(scheduler.running) == 0
+	})
+
+	outputMutex.Lock()
+	status := threadInfos["t1"].Status
+	outputMutex.Unlock()
+	if status != client.ThreadStatusFailed {
+		t.Fatalf("Expected the thread to fail with its pod, got %s", status)
+	}
+	entries, _, _ := readThreadLog("t1", PhaseContainer, 0)
+	logged := false
+	for _, entry := range entries {
+		logged = logged || strings.Contains(entry.Message, "exited with code 137 (OOMKilled)")
+	}
+	if !logged {
+		t.Fatalf("Expected the failure to be logged, got %+v", entries)
+	}
+}
+
+func TestKubernetesPodCantStart(t *testing.T) {
+	setupDataDir(t)
+	backend, clientset := setupKubernetes(t)
+
+	pod, done := startPod(t, backend, clientset, "t2", client.StartThreadRequest{RepositoryLink: "https://example.com/repo.git", DockerImage: "missing:1"}, nil)
+	setPodStatus(t, clientset, pod, corev1.PodStatus{
+		Phase: corev1.PodPending,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  kubeWorkerContainer,
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "not found"}},
+		}},
+	})
+
+	err := expectResult(t, done)
+	if err == nil || !strings.Contains(err.Error(), "ImagePullBackOff not found") {
+		t.Fatalf("Expected the pull failure to fail the start, got %v", err)
+	}
+	expectDeleted(t, clientset, "t2")
+	if backend.Stop("t2") {
+		t.Fatal("Expected a failed start to be forgotten")
+	}
+}
+
+func TestKubernetesStopDeletesPod(t *testing.T) {
+	setupDataDir(t)
+	backend, clientset := setupKubernetes(t)
+
+	pod, done := startPod(t, backend, clientset, "t3", client.StartThreadRequest{RepositoryLink: "https://example.com/repo.git", DockerImage: "worker:1"}, nil)
+	setPodStatus(t, clientset, pod, corev1.PodStatus{Phase: corev1.PodRunning})
+	if err := expectResult(t, done); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	if !backend.Stop("t3") {
+		t.Fatal("Expected the backend to stop its own thread")
+	}
+	expectDeleted(t, clientset, "t3")
+	if backend.Stop("other") {
+		t.Fatal("Expected threads the backend doesn't run to be left alone")
+	}
+}
+
+func TestStartThreadOnKubernetesNeedsImage(t *testing.T) {
+	resetThreads(t)
+	kubeBackend, _ = setupKubernetes(t)
+	t.Cleanup(func() { kubeBackend = nil })
+
+	req := client.StartThreadRequest{RepositoryLink: "https://example.com/repo.git", Prompt: "hi"}
+	if _, apiErr := startThread(context.Background(), Caller{User: "alice"}, req); apiErr == nil || apiErr.Status != http.StatusBadRequest {
+		t.Fatalf("Expected dev container threads to be refused on Kubernetes, got %+v", apiErr)
+	}
+}
@@ -0,0 +1,315 @@
+package superdev
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+// Phases of a thread's lifecycle that produce logs
+const (
+	PhaseProvision = "provision"
+	PhaseClone     = "clone"
+	PhasePull      = "pull"
+	PhaseBuild     = "build" // building a dev container image
+	PhaseDocker    = "docker"
+	PhaseContainer = "container"
+)
+
+// Server logging flags
+var (
+	logFormat string
+	logLevel  string
+)
+
+// newLogger builds the server's logger. Every record is passed through
+// redactSecrets before it is written.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+
+	return slog.New(redactingHandler{handler}), nil
+}
+
+// redactingHandler strips secret values from log messages and string attributes
+type redactingHandler struct {
+	slog.Handler
+}
+
+func (h redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, redactSecrets(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = redactAttr(attr)
+	}
+	return redactingHandler{h.Handler.WithAttrs(redacted)}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{h.Handler.WithGroup(name)}
+}
+
+func redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, redactSecrets(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]any, len(group))
+		for i, member := range group {
+			redacted[i] = redactAttr(member)
+		}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindAny:
+		if err, ok := value.Any().(error); ok {
+			return slog.String(attr.Key, redactSecrets(err.Error()))
+		}
+	}
+	return attr
+}
+
+// threadLogMutex serializes writes to thread log files
+var threadLogMutex = &sync.Mutex{}
+
+// threadLogPath returns the file a thread's logs are persisted to
+func threadLogPath(threadID string) string {
+	return filepath.Join(dataDir, "logs", threadID+".jsonl")
+}
+
+// appendThreadLog persists a log line for a thread and mirrors it to the server log
+func appendThreadLog(threadID, phase, stream, message string) {
+	message = redactSecrets(message)
+
+	slog.Info(message, "thread_id", threadID, "phase", phase, "stream", stream)
+
+	entry := client.ThreadLogEntry{
+		Time:    time.Now(),
+		Phase:   phase,
+		Stream:  stream,
+		Message: message,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("failed to marshal thread log entry", "thread_id", threadID, "error", err)
+		return
+	}
+
+	threadLogMutex.Lock()
+	defer threadLogMutex.Unlock()
+
+	path := threadLogPath(threadID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		slog.Error("failed to create thread log directory", "thread_id", threadID, "error", err)
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Error("failed to open thread log", "thread_id", threadID, "error", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write thread log", "thread_id", threadID, "error", err)
+	}
+}
+
+// readThreadLog returns entries from offset onwards that match phase (all phases if empty),
+// along with the offset to continue reading from
+func readThreadLog(threadID, phase string, offset int64) ([]client.ThreadLogEntry, int64, error) {
+	f, err := os.Open(threadLogPath(threadID))
+	if os.IsNotExist(err) {
+		return nil, offset, nil
+	}
+	if err != nil {
+		return nil, offset, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+
+	var entries []client.ThreadLogEntry
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Leave partially written lines for the next read
+			break
+		}
+		if err != nil {
+			return entries, offset, err
+		}
+		offset += int64(len(line))
+
+		var entry client.ThreadLogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue
+		}
+		if phase != "" && entry.Phase != phase {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, offset, nil
+}
+
+// logFunc records a line of provisioning or container output under phase.
+// stream is "stdout", "stderr" or empty for superdev's own messages.
+type logFunc func(phase, stream, message string)
+
+// threadLogger returns a logFunc appending to a thread's log on this server
+func threadLogger(threadID string) logFunc {
+	return func(phase, stream, message string) {
+		appendThreadLog(threadID, phase, stream, message)
+	}
+}
+
+// streamLog copies lines from r into log and into buf
+func streamLog(log logFunc, phase, stream string, r io.Reader, buf *lockedBuffer) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		log(phase, stream, line)
+		if buf != nil {
+			buf.WriteString(line + "\n")
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that is safe to write from several goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) WriteString(s string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.WriteString(s)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// handleThreadLogsRequest returns a thread's persisted logs. Supports ?phase= to
+// filter, ?tail=N to return the last N entries and ?follow=true to keep streaming
+// new entries as newline-delimited JSON.
+func handleThreadLogsRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	threadID := r.PathValue("id")
+
+	outputMutex.Lock()
+	_, apiErr := authorizeThread(r, threadID, RoleRead)
+	outputMutex.Unlock()
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	phase := r.URL.Query().Get("phase")
+
+	tail := 0
+	if value := r.URL.Query().Get("tail"); value != "" {
+		var err error
+		tail, err = strconv.Atoi(value)
+		if err != nil || tail < 0 {
+			writeAPIError(w, newAPIError(http.StatusBadRequest, "tail must be a non-negative integer"))
+			return
+		}
+	}
+
+	entries, offset, err := readThreadLog(threadID, phase, 0)
+	if err != nil {
+		slog.Error("failed to read thread log", "thread_id", threadID, "error", err)
+		writeAPIError(w, newAPIError(http.StatusInternalServerError, "Error reading thread logs"))
+		return
+	}
+	if tail > 0 && len(entries) > tail {
+		entries = entries[len(entries)-tail:]
+	}
+
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+	if !follow {
+		if entries == nil {
+			entries = []client.ThreadLogEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(client.ThreadLogs{ThreadID: threadID, Logs: entries})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, newAPIError(http.StatusInternalServerError, "Streaming not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	for {
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		entries, offset, err = readThreadLog(threadID, phase, offset)
+		if err != nil {
+			slog.Error("failed to read thread log", "thread_id", threadID, "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package superdev
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"superdev/cmd/superdev/client"
+)
+
+// setupDataDir points dataDir at a temporary directory for the rest of the
+// test, so thread logs and other state aren't written to the working directory
+func setupDataDir(t *testing.T) string {
+	t.Helper()
+	original := dataDir
+	dataDir = t.TempDir()
+	t.Cleanup(func() { dataDir = original })
+	return dataDir
+}
+
+func TestThreadLogsFilterAndTail(t *testing.T) {
+	resetThreads(t)
+	setupDataDir(t)
+	addTestThread("thread-1", "alice", "")
+
+	appendThreadLog("thread-1", PhaseClone, "stderr", "Cloning into repo...")
+	appendThreadLog("thread-1", PhasePull, "stdout", "Already up to date.")
+	appendThreadLog("thread-1", PhaseContainer, "stdout", "first")
+	appendThreadLog("thread-1", PhaseContainer, "stdout", "second")
+
+	fetch := func(target string) []client.ThreadLogEntry {
+		req := newCallerRequest(http.MethodGet, target, "", "alice", "")
+		req.SetPathValue("id", "thread-1")
+		rec := httptest.NewRecorder()
+		handleThreadLogsRequest(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			Logs []client.ThreadLogEntry `json:"logs"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode logs: %v", err)
+		}
+		return resp.Logs
+	}
+
+	if logs := fetch("/threads/thread-1/logs"); len(logs) != 4 {
+		t.Errorf("Expected 4 log entries, got %d", len(logs))
+	}
+
+	logs := fetch("/threads/thread-1/logs?phase=container&tail=1")
+	if len(logs) != 1 || logs[0].Message != "second" || logs[0].Phase != PhaseContainer {
+		t.Errorf("Expected last container entry, got %+v", logs)
+	}
+
+	req := newCallerRequest(http.MethodGet, "/threads/thread-1/logs", "", "eve", "")
+	req.SetPathValue("id", "thread-1")
+	rec := httptest.NewRecorder()
+	handleThreadLogsRequest(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for stranger, got %d", rec.Code)
+	}
+}
+
+func TestLoggerRedactsSecrets(t *testing.T) {
+	store, err := NewSecretStore(filepath.Join(t.TempDir(), "secrets.json"), "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	store.Set("TOKEN", "s3cr3t-value", "", "")
+	secretStore = store
+	defer func() { secretStore = nil }()
+
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "info")
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	logger.With("url", "https://s3cr3t-value@example.com").Info("cloning s3cr3t-value", "thread_id", "t1")
+
+	if strings.Contains(buf.String(), "s3cr3t") {
+		t.Errorf("Expected secret to be redacted, got %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"thread_id":"t1"`) {
+		t.Errorf("Expected structured thread_id field, got %s", buf.String())
+	}
+
+	if _, err := newLogger(&buf, "xml", "info"); err == nil {
+		t.Error("Expected an error for an unknown log format")
+	}
+}
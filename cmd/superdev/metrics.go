@@ -0,0 +1,169 @@
+package superdev
+
+import (
+	"net/http"
+	"time"
+
+	superdev "superdev/cmd/superdev/cliwrapper"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds every metric exposed on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var metricsFactory = promauto.With(metricsRegistry)
+
+// Thread lifecycle metrics
+var (
+	threadsStarted = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "superdev_threads_started_total",
+		Help: "Threads whose container started successfully.",
+	})
+	threadsFailed = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "superdev_threads_failed_total",
+		Help: "Threads that failed during provisioning.",
+	})
+	threadsForked = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "superdev_threads_forked_total",
+		Help: "Threads started by forking another thread.",
+	})
+	snapshotsRestored = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "superdev_snapshots_restored_total",
+		Help: "Workspace restores requested for threads.",
+	})
+	threadsCancelled = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "superdev_threads_cancelled_total",
+		Help: "Threads cancelled by a user.",
+	})
+	threadsRejected = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "superdev_threads_rejected_total",
+		Help: "Thread starts rejected because the start queue was full.",
+	})
+	threadsRunning = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "superdev_threads_running",
+		Help: "Threads holding a scheduler slot, including those still provisioning.",
+	})
+	threadsQueued = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "superdev_threads_queued",
+		Help: "Thread starts waiting for a scheduler slot.",
+	})
+	provisionDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "superdev_provision_phase_duration_seconds",
+		Help:    "Duration of thread provisioning phases (clone, pull, docker).",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"phase", "result"})
+)
+
+// Message flow metrics
+var (
+	messagesPulled = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "superdev_messages_pulled_total",
+		Help: "Input messages delivered to workers, counted on their first pull.",
+	})
+	messagesAnswered = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "superdev_messages_answered_total",
+		Help: "Output messages received from workers.",
+	})
+	messagePullLatency = metricsFactory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "superdev_message_pull_latency_seconds",
+		Help:    "Time between a message being stored and a worker first pulling it.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+	})
+	approvalsRequested = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "superdev_tool_approvals_requested_total",
+		Help: "Tool runs workers asked a human to approve.",
+	})
+	approvalsDecided = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "superdev_tool_approvals_decided_total",
+		Help: "Tool approvals decided by a human, by decision.",
+	}, []string{"decision"})
+	approvalsExpired = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "superdev_tool_approvals_expired_total",
+		Help: "Tool approvals rejected because nobody decided before they expired.",
+	})
+	policyDecisions = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "superdev_tool_policy_decisions_total",
+		Help: "Tool uses decided by thread tool policies, by decision.",
+	}, []string{"decision"})
+	tokensUsed = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "superdev_tokens_total",
+		Help: "Tokens reported by workers in inference:completed deltas.",
+	}, []string{"type"})
+	tokenCost = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "superdev_token_cost_dollars_total",
+		Help: "Cost of the tokens reported by workers, in US dollars from the price table.",
+	})
+)
+
+// HTTP metrics, labelled by the route pattern that served the request
+var (
+	httpRequests = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "superdev_http_requests_total",
+		Help: "HTTP requests by handler, method and status code.",
+	}, []string{"handler", "method", "code"})
+	httpDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "superdev_http_request_duration_seconds",
+		Help:    "HTTP request latency by handler.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler", "method"})
+	httpInFlight = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "superdev_http_requests_in_flight",
+		Help: "HTTP requests currently being served.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	metricsFactory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "superdev_active_containers",
+		Help: "Thread containers currently running.",
+	}, func() float64 {
+		outputMutex.Lock()
+		defer outputMutex.Unlock()
+		return float64(len(threadContainers))
+	})
+}
+
+// instrumentHandler records request counts and latency for a handler
+func instrumentHandler(name string, handler http.HandlerFunc) http.HandlerFunc {
+	labels := prometheus.Labels{"handler": name}
+	instrumented := promhttp.InstrumentHandlerInFlight(httpInFlight,
+		promhttp.InstrumentHandlerDuration(httpDuration.MustCurryWith(labels),
+			promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels), handler),
+		),
+	)
+	return instrumented.ServeHTTP
+}
+
+// metricsHandler serves the registry in the Prometheus exposition format
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// observePhase records how long a provisioning phase took
+func observePhase(phase string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	provisionDuration.WithLabelValues(phase, result).Observe(time.Since(start).Seconds())
+}
+
+// recordDeltas accounts for worker-reported thread deltas
+func recordDeltas(deltas []superdev.ThreadDelta) {
+	for _, delta := range deltas {
+		if delta.Type != superdev.ThreadDeltaInferenceComplete || delta.Usage == nil {
+			continue
+		}
+		tokensUsed.WithLabelValues("prompt").Add(float64(delta.Usage.PromptTokens))
+		tokensUsed.WithLabelValues("completion").Add(float64(delta.Usage.CompletionTokens))
+	}
+}
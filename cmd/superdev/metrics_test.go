@@ -0,0 +1,84 @@
+package superdev
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAnswerMessageRecordsTokenUsage(t *testing.T) {
+	resetThreads(t)
+	addTestThread("thread-1", "", "")
+
+	answeredBefore := testutil.ToFloat64(messagesAnswered)
+	promptBefore := testutil.ToFloat64(tokensUsed.WithLabelValues("prompt"))
+	completionBefore := testutil.ToFloat64(tokensUsed.WithLabelValues("completion"))
+
+	body := `{"thread_id":"thread-1","payload":"done","deltas":[
+		{"type":"inference:completed","usage":{"promptTokens":120,"completionTokens":30,"totalTokens":150}},
+		{"type":"title","title":"ignored"}
+	]}`
+	rec := httptest.NewRecorder()
+	handleAnswerMessageRequest(rec, newWorkerRequest(http.MethodPost, "/answerMessage", body, "thread-1"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if got := testutil.ToFloat64(messagesAnswered) - answeredBefore; got != 1 {
+		t.Errorf("Expected 1 answered message, got %v", got)
+	}
+	if got := testutil.ToFloat64(tokensUsed.WithLabelValues("prompt")) - promptBefore; got != 120 {
+		t.Errorf("Expected 120 prompt tokens, got %v", got)
+	}
+	if got := testutil.ToFloat64(tokensUsed.WithLabelValues("completion")) - completionBefore; got != 30 {
+		t.Errorf("Expected 30 completion tokens, got %v", got)
+	}
+}
+
+func TestPullMessagesRecordsLatencyOnce(t *testing.T) {
+	resetThreads(t)
+	addTestThread("thread-1", "", "")
+
+	pulledBefore := testutil.ToFloat64(messagesPulled)
+	pull := func() {
+		rec := httptest.NewRecorder()
+		handlePullMessagesRequest(rec, newWorkerRequest(http.MethodGet, "/pullMessages?thread_id=thread-1", "", "thread-1"))
+	}
+
+	pull()
+	firstPulledAt := threads["thread-1"][0].PulledAt
+	if firstPulledAt.IsZero() {
+		t.Fatal("Expected message to be marked as pulled")
+	}
+
+	pull()
+	if !threads["thread-1"][0].PulledAt.Equal(firstPulledAt) {
+		t.Error("Expected pull latency to only be recorded on the first pull")
+	}
+
+	if got := testutil.ToFloat64(messagesPulled) - pulledBefore; got != 1 {
+		t.Errorf("Expected a message pulled twice to count once, got %v", got)
+	}
+}
+
+func TestInstrumentedHandlerExposesMetrics(t *testing.T) {
+	handler := instrumentHandler("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+
+	if got := testutil.ToFloat64(httpRequests.WithLabelValues("/ping", "get", "418")); got != 1 {
+		t.Errorf("Expected 1 request recorded for /ping, got %v", got)
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, name := range []string{"superdev_http_requests_total", "superdev_active_containers", "superdev_threads_started_total"} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("Expected /metrics to expose %s", name)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package superdev
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Default scheduler limits for the server command
+const (
+	defaultMaxRunning = 16
+	defaultMaxQueued  = 100
+)
+
+// maxPriority bounds the priority of a thread start, which may be from
+// -maxPriority to maxPriority
+const maxPriority = 10
+
+// Scheduler limits set by the server command's flags
+var (
+	maxRunningThreads int
+	maxRunningPerUser int
+	maxQueuedThreads  int
+)
+
+// Scheduler admits thread starts, capping how many threads run at once overall
+// and per user. Starts beyond the caps wait in a queue ordered by priority, then
+// arrival, and are started in the background as running threads finish.
+type Scheduler struct {
+	mu         sync.Mutex
+	maxRunning int // limits are unlimited when 0
+	maxPerUser int
+	maxQueued  int
+	running    map[string]string // thread ID to the user who started it
+	queue      []*pendingStart   // by priority, then arrival
+}
+
+// pendingStart is a queued thread start
+type pendingStart struct {
+	threadID string
+	user     string
+	priority int
+	start    func()
+}
+
+// threadScheduler admits every thread start. It is unlimited until the server
+// starts with its configured limits.
+var threadScheduler = NewScheduler(0, 0, 0)
+
+// NewScheduler creates a scheduler with the given limits; 0 means unlimited
+func NewScheduler(maxRunning, maxPerUser, maxQueued int) *Scheduler {
+	return &Scheduler{
+		maxRunning: maxRunning,
+		maxPerUser: maxPerUser,
+		maxQueued:  maxQueued,
+		running:    make(map[string]string),
+	}
+}
+
+// Admit reserves a slot for a thread. It returns 0 when the thread may start
+// right away; otherwise the thread is queued, start is called in its own
+// goroutine once a slot frees up, and its 1-based queue position is returned.
+// Starts are rejected when the queue is full.
+func (s *Scheduler) Admit(threadID, user string, priority int, start func()) (int, *apiError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Queued starts are dispatched as soon as they can run, so a start that can
+	// run now isn't jumping ahead of anything that could
+	if s.canRun(user) {
+		s.running[threadID] = user
+		s.updateMetrics()
+		return 0, nil
+	}
+
+	if s.maxQueued > 0 && len(s.queue) >= s.maxQueued {
+		threadsRejected.Inc()
+		return 0, newAPIError(http.StatusTooManyRequests, fmt.Sprintf("Too many threads are waiting to start (%d); try again later", len(s.queue)))
+	}
+
+	// Insert after every start of the same or a higher priority
+	job := &pendingStart{threadID: threadID, user: user, priority: priority, start: start}
+	i := sort.Search(len(s.queue), func(i int) bool { return s.queue[i].priority < priority })
+	s.queue = append(s.queue, nil)
+	copy(s.queue[i+1:], s.queue[i:])
+	s.queue[i] = job
+	s.updateMetrics()
+
+	return i + 1, nil
+}
+
+// Release frees a thread's slot, or drops it from the queue if it hasn't
+// started, and starts whatever queued threads can now run
+func (s *Scheduler) Release(threadID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.running, threadID)
+	for i, job := range s.queue {
+		if job.threadID == threadID {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	s.dispatch()
+	s.updateMetrics()
+}
+
+// Position returns a thread's 1-based place in the queue, or 0 if it isn't queued
+func (s *Scheduler) Position(threadID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, job := range s.queue {
+		if job.threadID == threadID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// dispatch starts queued threads in order while slots are free. Threads whose
+// user is at their limit keep their place. The caller must hold s.mu.
+func (s *Scheduler) dispatch() {
+	for i := 0; i < len(s.queue); {
+		if s.maxRunning > 0 && len(s.running) >= s.maxRunning {
+			return
+		}
+		job := s.queue[i]
+		if !s.canRun(job.user) {
+			i++
+			continue
+		}
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+		s.running[job.threadID] = job.user
+		go job.start()
+	}
+}
+
+// canRun reports whether a thread for user fits within the limits. The caller
+// must hold s.mu.
+func (s *Scheduler) canRun(user string) bool {
+	if s.maxRunning > 0 && len(s.running) >= s.maxRunning {
+		return false
+	}
+	if s.maxPerUser == 0 {
+		return true
+	}
+	count := 0
+	for _, owner := range s.running {
+		if owner == user {
+			count++
+		}
+	}
+	return count < s.maxPerUser
+}
+
+// updateMetrics publishes the scheduler's state. The caller must hold s.mu.
+func (s *Scheduler) updateMetrics() {
+	threadsRunning.Set(float64(len(s.running)))
+	threadsQueued.Set(float64(len(s.queue)))
+}
@@ -0,0 +1,183 @@
+package superdev
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+// setupScheduler installs a scheduler with the given limits for the test
+func setupScheduler(t *testing.T, maxRunning, maxPerUser, maxQueued int) *Scheduler {
+	t.Helper()
+	original := threadScheduler
+	threadScheduler = NewScheduler(maxRunning, maxPerUser, maxQueued)
+	t.Cleanup(func() { threadScheduler = original })
+	return threadScheduler
+}
+
+func TestSchedulerLimits(t *testing.T) {
+	s := NewScheduler(2, 1, 2)
+	started := make(chan string, 4)
+	admit := func(threadID, user string, priority int) (int, *apiError) {
+		return s.Admit(threadID, user, priority, func() { started <- threadID })
+	}
+	expectStarted := func(want string) {
+		t.Helper()
+		select {
+		case got := <-started:
+			if got != want {
+				t.Fatalf("Expected %s to start, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %s to start", want)
+		}
+	}
+
+	if position, _ := admit("a", "alice", 0); position != 0 {
+		t.Fatalf("Expected a to run right away, got position %d", position)
+	}
+	if position, _ := admit("b", "alice", 0); position != 1 {
+		t.Fatalf("Expected alice's second thread to queue at 1, got %d", position)
+	}
+	if position, _ := admit("c", "bob", 0); position != 0 {
+		t.Fatalf("Expected bob's thread to take the last slot, got position %d", position)
+	}
+	if position, _ := admit("d", "carol", 5); position != 1 {
+		t.Fatalf("Expected a higher priority start to queue first, got %d", position)
+	}
+	if _, apiErr := admit("e", "dave", 0); apiErr == nil || apiErr.Status != http.StatusTooManyRequests {
+		t.Fatalf("Expected a full queue to reject the start, got %+v", apiErr)
+	}
+	if s.Position("b") != 2 {
+		t.Fatalf("Expected b to be behind d, got %d", s.Position("b"))
+	}
+
+	// Bob's slot goes to carol; alice is still at her limit
+	s.Release("c")
+	expectStarted("d")
+	if s.Position("b") != 1 {
+		t.Fatalf("Expected b to wait for alice's running thread, got %d", s.Position("b"))
+	}
+
+	s.Release("a")
+	expectStarted("b")
+	if s.Position("b") != 0 || len(s.running) != 2 {
+		t.Fatalf("Expected b to be running, got %+v", s.running)
+	}
+
+	// Cancelling a queued start drops it without starting it
+	admit("f", "alice", 0)
+	s.Release("f")
+	s.Release("b")
+	select {
+	case id := <-started:
+		t.Fatalf("Expected nothing to start, got %s", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStartThreadQueued(t *testing.T) {
+	resetThreads(t)
+	setupDataDir(t)
+	scheduler := setupScheduler(t, 1, 0, 1)
+	scheduler.Admit("busy", "bob", 0, nil)
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	c := client.New(server.URL, client.WithCaller("alice", ""))
+
+	repo := filepath.Join(t.TempDir(), "missing.git")
+	_, err := c.StartThread(ctx, client.StartThreadRequest{RepositoryLink: repo, Prompt: "Jump the queue", Priority: maxPriority + 1})
+	expectStatus(t, err, http.StatusBadRequest)
+
+	resp, err := c.StartThread(ctx, client.StartThreadRequest{RepositoryLink: repo, Prompt: "Queue me"})
+	if err != nil {
+		t.Fatalf("StartThread failed: %v", err)
+	}
+	thread, _ := c.GetThread(ctx, resp.ThreadID, client.GetThreadOptions{})
+	if thread.Status != client.ThreadStatusQueued || thread.QueuePosition != 1 {
+		t.Fatalf("Expected the thread to be queued at 1, got %s at %d", thread.Status, thread.QueuePosition)
+	}
+	list, _ := c.ListThreads(ctx, client.ListThreadsOptions{})
+	if len(list.Threads) != 1 || list.Threads[0].QueuePosition != 1 {
+		t.Fatalf("Expected the listing to show the queue position, got %+v", list.Threads)
+	}
+	if _, err := c.SendMessage(ctx, resp.ThreadID, "And then this"); err != nil {
+		t.Fatalf("Expected messages to be accepted while queued, got %v", err)
+	}
+
+	_, err = c.StartThread(ctx, client.StartThreadRequest{RepositoryLink: repo, Prompt: "No room"})
+	expectStatus(t, err, http.StatusTooManyRequests)
+
+	// Freeing the slot starts the queued thread; its clone fails, releasing the slot again
+	scheduler.Release("busy")
+	deadline := time.Now().Add(5 * time.Second)
+	for thread.Status == client.ThreadStatusQueued && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		thread, _ = c.GetThread(ctx, resp.ThreadID, client.GetThreadOptions{})
+	}
+	if thread.Status != client.ThreadStatusFailed || thread.QueuePosition != 0 {
+		t.Fatalf("Expected the queued thread to be started and fail, got %s at %d", thread.Status, thread.QueuePosition)
+	}
+	if position, _ := scheduler.Admit("next", "alice", 0, nil); position != 0 {
+		t.Fatalf("Expected the failed thread's slot to be released, got position %d", position)
+	}
+}
+
+func TestCancelQueuedThread(t *testing.T) {
+	resetThreads(t)
+	setupDataDir(t)
+	scheduler := setupScheduler(t, 1, 0, 0)
+	scheduler.Admit("busy", "bob", 0, nil)
+
+	threadID, apiErr := startThread(context.Background(), Caller{User: "alice"}, client.StartThreadRequest{RepositoryLink: "https://example.com/repo.git", Prompt: "hi"})
+	if apiErr != nil {
+		t.Fatalf("startThread failed: %s", apiErr.Message)
+	}
+	req := newCallerRequest(http.MethodPost, "/cancel", "", "alice", "")
+	if apiErr := cancelThread(req, threadID); apiErr != nil {
+		t.Fatalf("cancelThread failed: %s", apiErr.Message)
+	}
+	if scheduler.Position(threadID) != 0 || threadInfos[threadID].Status != client.ThreadStatusCancelled {
+		t.Fatalf("Expected the thread to leave the queue cancelled, got %s", threadInfos[threadID].Status)
+	}
+
+	// Nothing is left to start when the slot frees up
+	scheduler.Release("busy")
+	if len(scheduler.running) != 0 {
+		t.Fatalf("Expected no threads to be running, got %v", scheduler.running)
+	}
+}
+
+func TestContainerExitEndsThread(t *testing.T) {
+	resetThreads(t)
+	setupDataDir(t)
+	scheduler := setupScheduler(t, 3, 0, 0)
+	stubDocker(t, func(args []string) (string, error) {
+		if args[0] == "wait" && args[1] == "container-crashed" {
+			return "137\n", nil
+		}
+		return "0\n", nil
+	})
+
+	for _, id := range []string{"done", "crashed", "stopped"} {
+		addTestThread(id, "alice", "")
+		scheduler.Admit(id, "alice", 0, nil)
+	}
+	threadInfos["stopped"].Status = client.ThreadStatusCancelled
+
+	for id, want := range map[string]string{"done": client.ThreadStatusCompleted, "crashed": client.ThreadStatusFailed, "stopped": client.ThreadStatusCancelled} {
+		followContainerLogs(id, "container-"+id)
+		if status := threadInfos[id].Status; status != want {
+			t.Errorf("Expected %s to end %s, got %s", id, want, status)
+		}
+	}
+	if len(scheduler.running) != 0 {
+		t.Fatalf("Expected every slot to be released, got %v", scheduler.running)
+	}
+}
@@ -0,0 +1,516 @@
+package superdev
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"superdev/cmd/superdev/client"
+	"superdev/cmd/superdev/tracing"
+)
+
+// Ways a secret can be exposed inside a thread container
+const (
+	SecretMountEnv  = "env"
+	SecretMountFile = "file"
+)
+
+// secretsDir is the tmpfs mount that file secrets are written to inside the container
+const secretsDir = "/run/superdev/secrets"
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedSecretNames are the environment variables the server sets for the
+// worker, which env secrets must not shadow
+var reservedSecretNames = map[string]bool{
+	"SERVER_URL":                true,
+	"THREAD_ID":                 true,
+	client.EnvWorkerToken:       true,
+	client.EnvRemoteEnv:         true,
+	client.EnvPostCreateCommand: true,
+	tracing.EnvTraceParent:      true,
+	tracing.EnvOTLPEndpoint:     true,
+	tracing.EnvTraceFile:        true,
+}
+
+// minSecretLength is the shortest value a secret may have. Shorter values
+// would be redacted wherever they happen to appear in ordinary text.
+const minSecretLength = 8
+
+// Secret is a named value stored encrypted at rest
+type Secret struct {
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner,omitempty"`
+	Team       string    `json:"team,omitempty"`
+	Nonce      []byte    `json:"nonce"`
+	Ciphertext []byte    `json:"ciphertext"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CanUse reports whether the caller may read or select the secret
+func (s *Secret) CanUse(caller Caller) bool {
+	if s.Owner == "" {
+		return true
+	}
+	if caller.User != "" && caller.User == s.Owner {
+		return true
+	}
+	return s.Team != "" && caller.Team == s.Team
+}
+
+// threadSecret is a resolved secret ready to be injected into a container
+type threadSecret struct {
+	Name  string
+	Value string
+	Mount string
+}
+
+// SecretStore keeps secrets encrypted in a JSON file on disk. Each user has
+// their own namespace of secret names.
+type SecretStore struct {
+	mu      sync.Mutex
+	path    string
+	salt    []byte // for deriving the key from the passphrase
+	aead    cipher.AEAD
+	secrets map[string]*Secret // by secretKey
+	values  map[string]string  // decrypted values, kept for redaction
+}
+
+// secretKey identifies a secret in the store by its owner and name
+func secretKey(owner, name string) string {
+	return owner + "/" + name
+}
+
+// secretStore is nil when the server was started without SUPERDEV_SECRETS_KEY
+var secretStore *SecretStore
+
+// secretsFileVersion is the version of the secrets file format that stores a
+// salt for the key derivation. Older files are a bare map of secrets,
+// encrypted with the passphrase's sha256.
+const secretsFileVersion = 2
+
+// secretsFile is the format of the secrets file
+type secretsFile struct {
+	Version int                `json:"version"`
+	Salt    []byte             `json:"salt"`
+	Secrets map[string]*Secret `json:"secrets"`
+}
+
+// secretKeyIterations is the PBKDF2 work factor for deriving the key
+const secretKeyIterations = 600_000
+
+// newSecretsAEAD returns the cipher for a 256-bit key
+func newSecretsAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return aead, nil
+}
+
+// deriveSecretsAEAD derives the cipher from the passphrase and salt
+func deriveSecretsAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, secretKeyIterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive secrets key: %w", err)
+	}
+	return newSecretsAEAD(key)
+}
+
+// NewSecretStore opens the store at path, deriving the encryption key from
+// passphrase. A file in the old format is re-encrypted with a derived key.
+func NewSecretStore(path, passphrase string) (*SecretStore, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("secrets passphrase is empty")
+	}
+
+	store := &SecretStore{
+		path:    path,
+		secrets: make(map[string]*Secret),
+		values:  make(map[string]string),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read secrets file: %w", err)
+	}
+
+	// A new store gets a fresh salt; it's written with the first secret
+	var file secretsFile
+	legacy := false
+	if data != nil {
+		if json.Unmarshal(data, &file) != nil || file.Version != secretsFileVersion {
+			legacy = true
+			file = secretsFile{}
+			if err := json.Unmarshal(data, &file.Secrets); err != nil {
+				return nil, fmt.Errorf("failed to parse secrets file: %w", err)
+			}
+		}
+	}
+	var aead cipher.AEAD
+	if legacy {
+		key := sha256.Sum256([]byte(passphrase))
+		aead, err = newSecretsAEAD(key[:])
+	} else {
+		if file.Salt == nil {
+			file.Salt = make([]byte, 16)
+			if _, err := rand.Read(file.Salt); err != nil {
+				return nil, fmt.Errorf("failed to generate salt: %w", err)
+			}
+		}
+		aead, err = deriveSecretsAEAD(passphrase, file.Salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store.salt, store.aead = file.Salt, aead
+
+	// Decrypt everything up front so a wrong key fails at startup rather than
+	// mid-thread. Files from before secrets were kept per owner are keyed by
+	// name alone.
+	for _, secret := range file.Secrets {
+		plaintext, err := aead.Open(nil, secret.Nonce, secret.Ciphertext, []byte(secret.Name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt secret %s: %w", secret.Name, err)
+		}
+		key := secretKey(secret.Owner, secret.Name)
+		store.secrets[key] = secret
+		store.values[key] = string(plaintext)
+	}
+
+	if legacy {
+		if err := store.rekey(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// rekey re-encrypts every secret with a key derived from the passphrase and a
+// new salt, and saves the store
+func (s *SecretStore) rekey(passphrase string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	aead, err := deriveSecretsAEAD(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, secret := range s.secrets {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		secret.Nonce = nonce
+		secret.Ciphertext = aead.Seal(nil, nonce, []byte(s.values[key]), []byte(secret.Name))
+	}
+	s.salt, s.aead = salt, aead
+	return s.save()
+}
+
+// Set creates or replaces the owner's secret with the given name
+func (s *SecretStore) Set(name, value, owner, team string) error {
+	if !secretNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid secret name %q", name)
+	}
+	if len(value) < minSecretLength {
+		return fmt.Errorf("secret %s is shorter than %d characters", name, minSecretLength)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := secretKey(owner, name)
+	s.secrets[key] = &Secret{
+		Name:       name,
+		Owner:      owner,
+		Team:       team,
+		Nonce:      nonce,
+		Ciphertext: s.aead.Seal(nil, nonce, []byte(value), []byte(name)),
+		CreatedAt:  time.Now(),
+	}
+	s.values[key] = value
+
+	return s.save()
+}
+
+// Get returns the owner's secret with the given name and its decrypted value
+func (s *SecretStore) Get(owner, name string) (*Secret, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := secretKey(owner, name)
+	secret, ok := s.secrets[key]
+	if !ok {
+		return nil, "", false
+	}
+	return secret, s.values[key], true
+}
+
+// Lookup returns the secret with the given name that the caller means: their
+// own if they have one, otherwise one shared with them
+func (s *SecretStore) Lookup(caller Caller, name string) (*Secret, string, bool) {
+	if secret, value, ok := s.Get(caller.User, name); ok {
+		return secret, value, true
+	}
+	for _, secret := range s.List() {
+		if secret.Name == name && secret.CanUse(caller) {
+			return s.Get(secret.Owner, name)
+		}
+	}
+	return nil, "", false
+}
+
+// Delete removes the owner's secret with the given name
+func (s *SecretStore) Delete(owner, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := secretKey(owner, name)
+	delete(s.secrets, key)
+	delete(s.values, key)
+
+	return s.save()
+}
+
+// List returns all secrets sorted by name, then owner
+func (s *SecretStore) List() []*Secret {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*Secret, 0, len(s.secrets))
+	for _, secret := range s.secrets {
+		list = append(list, secret)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Owner < list[j].Owner
+	})
+	return list
+}
+
+// Redact replaces every known secret value in text with a placeholder. Values
+// shorter than minSecretLength, stored before it was enforced, are left alone.
+func (s *SecretStore) Redact(text string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, value := range s.values {
+		if len(value) < minSecretLength {
+			continue
+		}
+		text = strings.ReplaceAll(text, value, "[REDACTED:"+s.secrets[key].Name+"]")
+	}
+	return text
+}
+
+// save writes the encrypted secrets to disk. The caller must hold s.mu.
+func (s *SecretStore) save() error {
+	data, err := json.MarshalIndent(secretsFile{Version: secretsFileVersion, Salt: s.salt, Secrets: s.secrets}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal secrets: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated store
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write secrets file: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace secrets file: %w", err)
+	}
+
+	return nil
+}
+
+// redactSecrets hides stored secrets and the server's API key in text destined
+// for thread messages or logs
+func redactSecrets(text string) string {
+	if key := os.Getenv("ANTHROPIC_API_KEY"); key != "" {
+		text = strings.ReplaceAll(text, key, "[REDACTED:ANTHROPIC_API_KEY]")
+	}
+	if secretStore == nil {
+		return text
+	}
+	return secretStore.Redact(text)
+}
+
+// resolveThreadSecrets looks up the secrets selected for a thread, checking the caller may use them
+func resolveThreadSecrets(caller Caller, refs []client.SecretRef) ([]threadSecret, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	if secretStore == nil {
+		return nil, fmt.Errorf("secrets are not configured on this server")
+	}
+
+	resolved := make([]threadSecret, 0, len(refs))
+	for _, ref := range refs {
+		mount := ref.Mount
+		if mount == "" {
+			mount = SecretMountEnv
+		}
+		if mount != SecretMountEnv && mount != SecretMountFile {
+			return nil, fmt.Errorf("invalid mount %q for secret %s", ref.Mount, ref.Name)
+		}
+
+		_, value, ok := secretStore.Lookup(caller, ref.Name)
+		if !ok {
+			return nil, fmt.Errorf("secret %s not found", ref.Name)
+		}
+
+		resolved = append(resolved, threadSecret{Name: ref.Name, Value: value, Mount: mount})
+	}
+
+	return resolved, nil
+}
+
+// errSecretsDisabled is returned by every secrets operation when no key is configured
+var errSecretsDisabled = newAPIError(http.StatusServiceUnavailable, "Secrets are not configured, set SUPERDEV_SECRETS_KEY")
+
+// listSecrets returns the secrets the caller may use. Values are never returned.
+func listSecrets(caller Caller) ([]client.SecretSummary, *apiError) {
+	if secretStore == nil {
+		return nil, errSecretsDisabled
+	}
+
+	secrets := make([]client.SecretSummary, 0)
+	for _, secret := range secretStore.List() {
+		if !secret.CanUse(caller) {
+			continue
+		}
+		secrets = append(secrets, client.SecretSummary{
+			Name:      secret.Name,
+			Owner:     secret.Owner,
+			Team:      secret.Team,
+			CreatedAt: secret.CreatedAt,
+		})
+	}
+
+	return secrets, nil
+}
+
+// storeSecret creates or replaces a secret owned by the caller. Other users'
+// secrets with the same name are left alone.
+func storeSecret(caller Caller, req client.StoreSecretRequest) *apiError {
+	if secretStore == nil {
+		return errSecretsDisabled
+	}
+
+	if !secretNamePattern.MatchString(req.Name) {
+		return newAPIError(http.StatusBadRequest, "Name must be a valid environment variable name")
+	}
+
+	if len(req.Value) < minSecretLength {
+		return newAPIError(http.StatusBadRequest, fmt.Sprintf("Value must be at least %d characters", minSecretLength))
+	}
+
+	if req.Team != "" && req.Team != caller.Team {
+		return newAPIError(http.StatusForbidden, "Cannot store a secret for another team")
+	}
+
+	if err := secretStore.Set(req.Name, req.Value, caller.User, req.Team); err != nil {
+		slog.Error("failed to store secret", "name", req.Name, "error", err)
+		return newAPIError(http.StatusInternalServerError, "Error storing secret")
+	}
+
+	return nil
+}
+
+// deleteSecret removes the caller's own secret with the given name. Secrets
+// shared with the caller can only be deleted by their owner.
+func deleteSecret(caller Caller, name string) *apiError {
+	if secretStore == nil {
+		return errSecretsDisabled
+	}
+
+	if name == "" {
+		return newAPIError(http.StatusBadRequest, "Missing name parameter")
+	}
+
+	if _, _, ok := secretStore.Get(caller.User, name); !ok {
+		return newAPIError(http.StatusNotFound, "Secret not found")
+	}
+
+	if err := secretStore.Delete(caller.User, name); err != nil {
+		slog.Error("failed to delete secret", "name", name, "error", err)
+		return newAPIError(http.StatusInternalServerError, "Error deleting secret")
+	}
+
+	return nil
+}
+
+// handleSecretsRequest lists (GET), stores (POST) or deletes (DELETE) secrets
+func handleSecretsRequest(w http.ResponseWriter, r *http.Request) {
+	caller := callerFromRequest(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		secrets, apiErr := listSecrets(caller)
+		if apiErr != nil {
+			http.Error(w, apiErr.Message, apiErr.Status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"secrets": secrets})
+
+	case http.MethodPost:
+		var req client.StoreSecretRequest
+		if !decodeLegacyRequest(w, r, &req) {
+			return
+		}
+
+		if apiErr := storeSecret(caller, req); apiErr != nil {
+			http.Error(w, apiErr.Message, apiErr.Status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"name": req.Name})
+
+	case http.MethodDelete:
+		if apiErr := deleteSecret(caller, r.URL.Query().Get("name")); apiErr != nil {
+			http.Error(w, apiErr.Message, apiErr.Status)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
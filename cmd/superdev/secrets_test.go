@@ -0,0 +1,207 @@
+package superdev
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"superdev/cmd/superdev/client"
+)
+
+func TestSecretStoreEncryptsAtRest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+
+	store, err := NewSecretStore(path, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	if err := store.Set("GITHUB_TOKEN", "ghp_supersecretvalue", "alice", ""); err != nil {
+		t.Fatalf("Failed to set secret: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read secrets file: %v", err)
+	}
+	if strings.Contains(string(data), "ghp_supersecretvalue") {
+		t.Error("Secrets file contains the plaintext value")
+	}
+
+	reopened, err := NewSecretStore(path, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	secret, value, ok := reopened.Get("alice", "GITHUB_TOKEN")
+	if !ok || value != "ghp_supersecretvalue" || secret.Owner != "alice" {
+		t.Errorf("Expected secret to round trip, got %v %q", secret, value)
+	}
+
+	if _, err := NewSecretStore(path, "wrong"); err == nil {
+		t.Error("Expected an error opening the store with the wrong passphrase")
+	}
+	var file secretsFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Version != secretsFileVersion || len(file.Salt) == 0 {
+		t.Errorf("Expected the file to store the key's salt, got %+v (%v)", file, err)
+	}
+
+	if err := store.Set("not a name", "ghp_supersecretvalue", "", ""); err == nil {
+		t.Error("Expected an error for an invalid secret name")
+	}
+	if err := store.Set("PIN", "1234", "alice", ""); err == nil {
+		t.Error("Expected an error for a value too short to redact")
+	}
+}
+
+func TestSecretStoreRekeysOldFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+
+	// Old files are a map by name, encrypted with the passphrase's sha256
+	key := sha256.Sum256([]byte("passphrase"))
+	aead, _ := newSecretsAEAD(key[:])
+	nonce := make([]byte, aead.NonceSize())
+	old := map[string]*Secret{"NPM_TOKEN": {
+		Name:       "NPM_TOKEN",
+		Owner:      "alice",
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, []byte("npm-token-value"), []byte("NPM_TOKEN")),
+	}}
+	data, _ := json.Marshal(old)
+	os.WriteFile(path, data, 0o600)
+
+	if _, err := NewSecretStore(path, "passphrase"); err != nil {
+		t.Fatalf("Failed to open the old store: %v", err)
+	}
+	reopened, err := NewSecretStore(path, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to reopen the rekeyed store: %v", err)
+	}
+	if _, value, ok := reopened.Get("alice", "NPM_TOKEN"); !ok || value != "npm-token-value" {
+		t.Errorf("Expected the secret to survive rekeying, got %q", value)
+	}
+	data, _ = os.ReadFile(path)
+	var file secretsFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Version != secretsFileVersion || len(file.Salt) == 0 {
+		t.Errorf("Expected the file to be rewritten with a salt, got %s", data)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	store, err := NewSecretStore(filepath.Join(t.TempDir(), "secrets.json"), "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	store.Set("DB_PASSWORD", "hunter2hunter2", "", "")
+	secretStore = store
+	defer func() { secretStore = nil }()
+
+	got := redactSecrets("connecting with password hunter2hunter2")
+	if got != "connecting with password [REDACTED:DB_PASSWORD]" {
+		t.Errorf("Unexpected redaction result: %q", got)
+	}
+
+	// Short values stored before the minimum length was enforced would mangle
+	// ordinary text, so they aren't redacted
+	store.secrets[secretKey("", "DEBUG")] = &Secret{Name: "DEBUG"}
+	store.values[secretKey("", "DEBUG")] = "1"
+	if got := redactSecrets("retry 1 of 3"); got != "retry 1 of 3" {
+		t.Errorf("Expected a short value to be left alone, got %q", got)
+	}
+}
+
+func TestResolveThreadSecrets(t *testing.T) {
+	store, err := NewSecretStore(filepath.Join(t.TempDir(), "secrets.json"), "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	store.Set("ALICE_TOKEN", "alice-token", "alice", "")
+	store.Set("TEAM_TOKEN", "team-token", "alice", "core")
+	secretStore = store
+	defer func() { secretStore = nil }()
+
+	resolved, err := resolveThreadSecrets(Caller{User: "bob", Team: "core"}, []client.SecretRef{{Name: "TEAM_TOKEN", Mount: SecretMountFile}})
+	if err != nil {
+		t.Fatalf("Expected teammate to use team secret, got %v", err)
+	}
+	if len(resolved) != 1 || resolved[0].Value != "team-token" || resolved[0].Mount != SecretMountFile {
+		t.Errorf("Unexpected resolved secrets: %+v", resolved)
+	}
+
+	if _, err := resolveThreadSecrets(Caller{User: "bob", Team: "core"}, []client.SecretRef{{Name: "ALICE_TOKEN"}}); err == nil {
+		t.Error("Expected bob to be denied alice's private secret")
+	}
+
+	if _, err := resolveThreadSecrets(Caller{User: "alice"}, []client.SecretRef{{Name: "ALICE_TOKEN", Mount: "volume"}}); err == nil {
+		t.Error("Expected an error for an invalid mount")
+	}
+
+	// Env secrets can't shadow the variables the worker is started with
+	if err := validateThreadOptions("", 0, nil, nil, nil, []client.SecretRef{{Name: client.EnvWorkerToken}}); err == nil {
+		t.Error("Expected a secret named like the worker token to be rejected")
+	}
+	if err := validateThreadOptions("", 0, nil, nil, nil, []client.SecretRef{{Name: "THREAD_ID", Mount: SecretMountFile}}); err != nil {
+		t.Errorf("Expected a file secret to be allowed any name, got %v", err)
+	}
+
+	// A caller's own secret wins over one shared with them under the same name
+	store.Set("TEAM_TOKEN", "bob-token", "bob", "")
+	resolved, err = resolveThreadSecrets(Caller{User: "bob", Team: "core"}, []client.SecretRef{{Name: "TEAM_TOKEN"}})
+	if err != nil || len(resolved) != 1 || resolved[0].Value != "bob-token" {
+		t.Errorf("Expected bob's own secret, got %+v (%v)", resolved, err)
+	}
+}
+
+func TestSecretsHandlerNeverReturnsValues(t *testing.T) {
+	store, err := NewSecretStore(filepath.Join(t.TempDir(), "secrets.json"), "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	secretStore = store
+	defer func() { secretStore = nil }()
+
+	rec := httptest.NewRecorder()
+	handleSecretsRequest(rec, newCallerRequest(http.MethodPost, "/secrets", `{"name":"API_TOKEN","value":"tok-12345"}`, "alice", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 storing secret, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handleSecretsRequest(rec, newCallerRequest(http.MethodGet, "/secrets", "", "alice", ""))
+	if !strings.Contains(rec.Body.String(), "API_TOKEN") || strings.Contains(rec.Body.String(), "tok-12345") {
+		t.Errorf("Expected listing with name but without value, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handleSecretsRequest(rec, newCallerRequest(http.MethodDelete, "/secrets?name=API_TOKEN", "", "eve", ""))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting someone else's secret, got %d", rec.Code)
+	}
+
+	// Sharing a secret with a team lets teammates use it, not delete it
+	store.Set("TEAM_TOKEN", "team-token", "alice", "core")
+	rec = httptest.NewRecorder()
+	handleSecretsRequest(rec, newCallerRequest(http.MethodDelete, "/secrets?name=TEAM_TOKEN", "", "bob", "core"))
+	if _, _, ok := store.Get("alice", "TEAM_TOKEN"); rec.Code != http.StatusNotFound || !ok {
+		t.Errorf("Expected 404 for a teammate deleting alice's secret, got %d", rec.Code)
+	}
+
+	// Names are per user, so eve can store her own API_TOKEN alongside alice's
+	rec = httptest.NewRecorder()
+	handleSecretsRequest(rec, newCallerRequest(http.MethodPost, "/secrets", `{"name":"API_TOKEN","value":"eve-token"}`, "eve", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 storing a secret with the same name, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, value, _ := store.Get("alice", "API_TOKEN"); value != "tok-12345" {
+		t.Errorf("Expected alice's secret to be untouched, got %q", value)
+	}
+
+	rec = httptest.NewRecorder()
+	handleSecretsRequest(rec, newCallerRequest(http.MethodPost, "/secrets", `{"name":"PIN","value":"1234"}`, "alice", ""))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 storing a short value, got %d", rec.Code)
+	}
+}
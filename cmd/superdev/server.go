@@ -1,41 +1,48 @@
 package superdev
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"superdev/cmd/superdev/client"
+	"superdev/cmd/superdev/tracing"
+
 	"github.com/spf13/cobra"
 )
 
-// ThreadMessage stores the output for each thread
-type ThreadMessage struct {
-	ID        string
-	Output    string
-	Direction string
-	Status    string    // "processing", "completed", or "error"
-	CreatedAt time.Time // For cleanup purposes
-	Error     string    // Error message if status is "error"
-}
-
 // In-memory storage for thread outputs
 var (
-	threads          = make(map[string][]*ThreadMessage)
+	threads          = make(map[string][]*client.ThreadMessage)
 	threadContainers = make(map[string]string)
 	outputMutex      = &sync.Mutex{}
 	maxOutputAge     = 24 * time.Hour // Outputs older than this will be cleaned up
 )
 
+// dataDir is where the server keeps state that must survive restarts
+var dataDir string
+
+// defaultDataDir returns ~/.superdev, falling back to the temp directory
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "superdev")
+	}
+	return filepath.Join(home, ".superdev")
+}
+
 // generateThreadID creates a unique thread ID
 func generateThreadID() (string, error) {
 	bytes := make([]byte, 16)
@@ -51,8 +58,8 @@ func corsMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, traceparent, tracestate, "+userHeader+", "+teamHeader+", "+shareHeader)
 
 		// Handle preflight requests
 		if r.Method == http.MethodOptions {
@@ -65,6 +72,49 @@ func corsMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// handleFunc registers a handler with CORS support, request metrics and tracing
+func handleFunc(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, instrumentHandler(pattern, corsMiddleware(traceHandler(pattern, handler))))
+}
+
+// newServerMux registers every server route
+func newServerMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Start a thread for a new conversation
+	handleFunc(mux, "/start", handleStartContainerRequest)
+	// Write a human message
+	handleFunc(mux, "/storeMessage", handleStoreMessageRequest)
+	// Worker pulls message
+	handleFunc(mux, "/pullMessages", handlePullMessagesRequest)
+	// Worker sends message response
+	handleFunc(mux, "/answerMessage", handleAnswerMessageRequest)
+
+	handleFunc(mux, "/output", handleOutputRequest)
+	handleFunc(mux, "/threads", handleThreadsRequest)
+
+	// Share a thread with other users
+	handleFunc(mux, "/share", handleShareRequest)
+	// Stop a running thread
+	handleFunc(mux, "/cancel", handleCancelRequest)
+	// Manage secrets that can be injected into threads
+	handleFunc(mux, "/secrets", handleSecretsRequest)
+	// Provisioning and container logs for a thread
+	handleFunc(mux, "/threads/{id}/logs", handleThreadLogsRequest)
+	// Worker images threads may run
+	handleFunc(mux, "GET /images", handleV1ListImages)
+	// Build an uploaded Dockerfile on the server
+	handleFunc(mux, "POST /images", handleV1BuildImage)
+
+	// Versioned API
+	registerV1Routes(mux)
+
+	// Prometheus metrics
+	mux.Handle("/metrics", metricsHandler())
+
+	return mux
+}
+
 var serverCmd = &cobra.Command{
 	Use:   "server [port]",
 	Short: "Start a server that accepts Docker build requests",
@@ -75,32 +125,98 @@ var serverCmd = &cobra.Command{
 			port = args[0]
 		}
 
+		logger, err := newLogger(os.Stdout, logFormat, logLevel)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		slog.SetDefault(logger)
+
+		shutdownTracing, err := tracing.Setup(context.Background(), "superdev-server", tracing.Config{
+			OTLPEndpoint: otlpEndpoint,
+			File:         traceFile,
+		})
+		if err != nil {
+			slog.Error("failed to set up tracing", "error", err)
+			os.Exit(1)
+		}
+		defer shutdownTracing(context.Background())
+
 		// Check for ANTHROPIC_API_KEY environment variable
 		if os.Getenv("ANTHROPIC_API_KEY") == "" {
-			fmt.Println("WARNING: ANTHROPIC_API_KEY environment variable is not set.")
-			fmt.Println("AMP execution will fail without an API key. Set the environment variable before starting the server.")
+			slog.Warn("ANTHROPIC_API_KEY environment variable is not set, AMP execution will fail without an API key")
+		}
+
+		// Secrets are only available when an encryption key is configured
+		if key := os.Getenv("SUPERDEV_SECRETS_KEY"); key != "" {
+			store, err := NewSecretStore(filepath.Join(dataDir, "secrets.json"), key)
+			if err != nil {
+				slog.Error("failed to load secrets", "error", err)
+				os.Exit(1)
+			}
+			secretStore = store
+		} else {
+			slog.Warn("SUPERDEV_SECRETS_KEY environment variable is not set, secrets are disabled")
+		}
+
+		// Threads may only run images built by superdev run unless configured otherwise
+		registry, err := NewImageRegistry(filepath.Join(dataDir, "images.json"))
+		if err != nil {
+			slog.Error("failed to load image registry", "error", err)
+			os.Exit(1)
+		}
+		imageRegistry = registry
+
+		templates, err := NewTemplateStore(filepath.Join(dataDir, "templates.json"))
+		if err != nil {
+			slog.Error("failed to load templates", "error", err)
+			os.Exit(1)
+		}
+		templateStore = templates
+
+		threadScheduler = NewScheduler(maxRunningThreads, maxRunningPerUser, maxQueuedThreads)
+
+		// Without a price table usage is still counted, but costs nothing
+		if priceTablePath != "" {
+			table, err := LoadPriceTable(priceTablePath)
+			if err != nil {
+				slog.Error("failed to load price table", "error", err)
+				os.Exit(1)
+			}
+			priceTable = table
+		}
+
+		switch threadRuntime {
+		case RuntimeDocker:
+		case RuntimeKubernetes:
+			clientset, namespace, err := newKubernetesClient()
+			if err != nil {
+				slog.Error("failed to connect to Kubernetes", "error", err)
+				os.Exit(1)
+			}
+			if kubeNamespace != "" {
+				namespace = kubeNamespace
+			}
+			kubeBackend = NewKubernetesBackend(clientset, namespace, kubeGitImage)
+			slog.Info("running threads on Kubernetes", "namespace", namespace)
+		default:
+			slog.Error("unknown runtime", "runtime", threadRuntime)
+			os.Exit(1)
+		}
+
+		// Host agents authenticate with a shared token; without one every thread runs here
+		if token := os.Getenv(agentTokenEnv); token != "" {
+			agentPool = NewAgentPool(token)
 		}
 
 		// Run the server command
-		fmt.Printf("Starting server on port %s...\n", port)
-
-		// Setup HTTP server
-		// Start a thread for a new conversation
-		http.HandleFunc("/start", corsMiddleware(handleStartContainerRequest))
-		// Write a human message
-		http.HandleFunc("/storeMessage", corsMiddleware(handleStoreMessageRequest))
-		// Worker pulls message
-		http.HandleFunc("/pullMessages", corsMiddleware(handlePullMessagesRequest))
-		// Worker sends message response
-		http.HandleFunc("/answerMessage", corsMiddleware(handleAnswerMessageRequest))
-
-		http.HandleFunc("/output", corsMiddleware(handleOutputRequest))
-		http.HandleFunc("/threads", corsMiddleware(handleThreadsRequest))
-
-		fmt.Printf("Server started on :%s\n", port)
-		err := http.ListenAndServe(":"+port, nil)
+		slog.Info("starting server", "port", port)
+
+		slog.Info("server started", "addr", ":"+port)
+		err = http.ListenAndServe(":"+port, newServerMux())
 		if err != nil {
-			fmt.Printf("Error starting server: %v\n", err)
+			slog.Error("failed to start server", "error", err)
+			shutdownTracing(context.Background())
 			os.Exit(1)
 		}
 
@@ -108,10 +224,9 @@ var serverCmd = &cobra.Command{
 	},
 }
 
-type Message struct {
-	ID      string
-	Content string
-}
+// The handlers below serve the original, unversioned API. They are kept as shims
+// over the same operations as the /v1 API and keep their original request and
+// response formats.
 
 func handlePullMessagesRequest(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -126,48 +241,16 @@ func handlePullMessagesRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get last message ID from query parameter
-	lastMessageID := r.URL.Query().Get("last_message_id")
-
-	// Check if thread exists
-	outputMutex.Lock()
-	defer outputMutex.Unlock()
-
-	_, exists := threads[threadID]
-	if !exists {
-		var response []Message
-		json.NewEncoder(w).Encode(response)
+	if apiErr := authorizeWorker(r, threadID); apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
 		return
 	}
 
-	// Filter messages: direction = "input" and after lastMessageID
-	var messages []*ThreadMessage
-	for _, msg := range threads[threadID] {
-		// Filter by direction
-		if msg.Direction != "input" {
-			continue
-		}
-
-		// Filter by lastMessageID if provided
-		if lastMessageID != "" && msg.ID <= lastMessageID {
-			continue
-		}
-
-		messages = append(messages, msg)
-	}
+	// Get last message ID from query parameter
+	lastMessageID := r.URL.Query().Get("last_message_id")
 
-	// Prepare response
 	w.Header().Set("Content-Type", "application/json")
-
-	var response []Message
-	for _, msg := range messages {
-		response = append(response, Message{
-			ID:      msg.ID,
-			Content: msg.Output,
-		})
-	}
-
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(pullMessages(threadID, lastMessageID))
 }
 
 func handleAnswerMessageRequest(w http.ResponseWriter, r *http.Request) {
@@ -176,102 +259,27 @@ func handleAnswerMessageRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
 	var req struct {
 		ThreadId string `json:"thread_id"`
-		Payload  string `json:"payload"`
-	}
-
-	if err := json.Unmarshal(body, &req); err != nil {
-		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
-		return
+		client.AnswerMessageRequest
 	}
-
-	if req.Payload == "" {
-		http.Error(w, "Payload is required", http.StatusBadRequest)
+	if !decodeLegacyRequest(w, r, &req) {
 		return
 	}
 
-	if req.ThreadId == "" {
-		http.Error(w, "ThreadId is required", http.StatusBadRequest)
+	if apiErr := authorizeWorker(r, req.ThreadId); apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
 		return
 	}
 
-	if threads[req.ThreadId] == nil {
-		http.Error(w, "Thread history for threadId not found", http.StatusNotFound)
+	messageID, apiErr := answerMessage(req.ThreadId, req.AnswerMessageRequest)
+	if apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
 		return
 	}
 
-	messageId := time.Now().String()
-	threads[req.ThreadId] = append(threads[req.ThreadId], &ThreadMessage{
-		ID:        messageId,
-		Direction: "output",
-		Output:    req.Payload,
-		CreatedAt: time.Now(),
-	})
-
 	w.Header().Set("Content-Type", "application/json")
-	response := map[string]string{
-		"message_id": messageId,
-	}
-
-	json.NewEncoder(w).Encode(response)
-
-	// Create new thread output entry
-	//outputMutex.Lock()
-	//threads[threadID] = &ThreadMessage{
-	//	ID:        threadID,
-	//	Status:    "processing",
-	//	CreatedAt: time.Now(),
-	//}
-	//outputMutex.Unlock()
-
-	// Add thread ID to response
-	//response := map[string]string{
-	//	"status":    "success",
-	//	"message":   "Request processed successfully",
-	//	"thread_id": threadID,
-	//}
-	//
-	//// Respond to client immediately with thread ID
-	//w.Header().Set("Content-Type", "application/json")
-	//json.NewEncoder(w).Encode(response)
-	//
-	//fmt.Printf("===== Starting thread %s processing =====\n", threadID)
-	//os.Stdout.Sync()
-	//// Process Docker execution in a goroutine
-	//go func() {
-	//	// Set up Docker run command
-	//	output, err := startDockerContainer(threadID, req.RepositoryLink, req.ContextFiles, req.Prompt, req.DockerImage)
-	//
-	//	// Update thread output in memory
-	//	outputMutex.Lock()
-	//	defer outputMutex.Unlock()
-	//
-	//	// Check if thread output still exists (might have been cleaned up)
-	//	threadOutput, exists := threads[threadID]
-	//	if !exists {
-	//		fmt.Printf("Warning: Thread %s was cleaned up before processing completed\n", threadID)
-	//		return
-	//	}
-	//
-	//	if err != nil {
-	//		threadOutput.Status = "error"
-	//		threadOutput.Error = err.Error()
-	//		fmt.Printf("Error running Docker container for thread %s: %v\n", threadID, err)
-	//	} else {
-	//		threadOutput.Status = "completed"
-	//		threadOutput.Output = output
-	//		// Log output to console for now
-	//		fmt.Printf("Thread %s completed with output:\n%s\n", threadID, output)
-	//	}
-	//}()
+	json.NewEncoder(w).Encode(client.MessageResponse{MessageID: messageID})
 }
 
 func handleStoreMessageRequest(w http.ResponseWriter, r *http.Request) {
@@ -280,469 +288,307 @@ func handleStoreMessageRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
 	var req struct {
 		ThreadId string `json:"thread_id"`
 		Prompt   string `json:"prompt"`
 	}
-
-	if err := json.Unmarshal(body, &req); err != nil {
-		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+	if !decodeLegacyRequest(w, r, &req) {
 		return
 	}
 
-	if req.Prompt == "" {
-		http.Error(w, "Prompt is required", http.StatusBadRequest)
+	if _, apiErr := storeMessage(r, req.ThreadId, req.Prompt); apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
 		return
 	}
+}
 
-	if req.ThreadId == "" {
-		http.Error(w, "ThreadId is required", http.StatusBadRequest)
+// handleStartContainerRequest processes Docker build requests
+func handleStartContainerRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if threadContainers[req.ThreadId] == "" {
-		http.Error(w, "Container for threadId not found", http.StatusNotFound)
+	var req struct {
+		client.StartThreadRequest
+		LegacyContextFiles [][]byte `json:"contextFiles,omitempty"`
+	}
+	if !decodeLegacyRequest(w, r, &req) {
 		return
 	}
-	if threads[req.ThreadId] == nil {
-		threads[req.ThreadId] = make([]*ThreadMessage, 0)
+	if len(req.LegacyContextFiles) > 0 {
+		req.ContextFiles = req.LegacyContextFiles
 	}
 
-	threads[req.ThreadId] = append(threads[req.ThreadId], &ThreadMessage{
-		ID:        time.Now().String(),
-		Direction: "input",
-		Output:    req.Prompt,
-		CreatedAt: time.Now(),
-	})
+	threadID, apiErr := startThread(r.Context(), callerFromRequest(r), req.StartThreadRequest)
+	if apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	}
 
-	// Create new thread output entry
-	//outputMutex.Lock()
-	//threads[threadID] = &ThreadMessage{
-	//	ID:        threadID,
-	//	Status:    "processing",
-	//	CreatedAt: time.Now(),
-	//}
-	//outputMutex.Unlock()
-
-	// Add thread ID to response
-	//response := map[string]string{
-	//	"status":    "success",
-	//	"message":   "Request processed successfully",
-	//	"thread_id": threadID,
-	//}
-	//
-	//// Respond to client immediately with thread ID
-	//w.Header().Set("Content-Type", "application/json")
-	//json.NewEncoder(w).Encode(response)
-	//
-	//fmt.Printf("===== Starting thread %s processing =====\n", threadID)
-	//os.Stdout.Sync()
-	//// Process Docker execution in a goroutine
-	//go func() {
-	//	// Set up Docker run command
-	//	output, err := startDockerContainer(threadID, req.RepositoryLink, req.ContextFiles, req.Prompt, req.DockerImage)
-	//
-	//	// Update thread output in memory
-	//	outputMutex.Lock()
-	//	defer outputMutex.Unlock()
-	//
-	//	// Check if thread output still exists (might have been cleaned up)
-	//	threadOutput, exists := threads[threadID]
-	//	if !exists {
-	//		fmt.Printf("Warning: Thread %s was cleaned up before processing completed\n", threadID)
-	//		return
-	//	}
-	//
-	//	if err != nil {
-	//		threadOutput.Status = "error"
-	//		threadOutput.Error = err.Error()
-	//		fmt.Printf("Error running Docker container for thread %s: %v\n", threadID, err)
-	//	} else {
-	//		threadOutput.Status = "completed"
-	//		threadOutput.Output = output
-	//		// Log output to console for now
-	//		fmt.Printf("Thread %s completed with output:\n%s\n", threadID, output)
-	//	}
-	//}()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(client.StartThreadResponse{ThreadID: threadID})
 }
 
-// handleStartContainerRequest processes Docker build requests
-func handleStartContainerRequest(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+// handleOutputRequest retrieves output for a specific thread ID
+func handleOutputRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusBadRequest)
+	// Get thread ID from query parameter
+	threadID := r.URL.Query().Get("thread_id")
+	threadOutput, apiErr := threadMessages(r, threadID)
+	if apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
 		return
 	}
-	defer r.Body.Close()
 
-	var req struct {
-		RepositoryLink string   `json:"repository_link"`
-		ContextFiles   [][]byte `json:"contextFiles,omitempty"`
-		DockerImage    string   `json:"docker_image,omitempty"`
-		ServerUrl      string   `json:"server_url,omitempty"`
-		Prompt         string   `json:"prompt,omitempty"`
-	}
+	// Respond with the stored messages, as /v1/threads/{id} does
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"thread_id": threadID,
+		"thread":    threadOutput,
+	})
+}
 
-	if err := json.Unmarshal(body, &req); err != nil {
-		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+// handleThreadsRequest returns the IDs of all threads visible to the caller, oldest
+// first. It accepts the same filters as /v1/threads.
+func handleThreadsRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Validate required fields
-	if req.DockerImage == "" {
-		// Default to the standard image if not specified
-		http.Error(w, "Docker image is required", http.StatusBadRequest)
+	query, apiErr := threadQueryFromRequest(r)
+	if apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
 		return
 	}
-
-	if req.RepositoryLink == "" {
-		http.Error(w, "Repository link is required", http.StatusBadRequest)
+	list, apiErr := listThreads(callerFromRequest(r), query)
+	if apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
 		return
 	}
 
-	if req.ServerUrl == "" {
-		req.ServerUrl = "http://localhost:8080"
-	}
-
-	// Process the request
-	fmt.Printf("Received request: Docker image: %s, Repo: %s, Context files count: %d\n",
-		req.DockerImage, req.RepositoryLink, len(req.ContextFiles))
-
-	// We'll respond with thread ID later
-
-	// Execute Docker command and store the output
-	// Generate a unique thread ID
-	threadID, err := generateThreadID()
-	if err != nil {
-		http.Error(w, "Error generating thread ID", http.StatusInternalServerError)
-		return
+	threadIDs := make([]string, 0, len(list.Threads))
+	for _, summary := range list.Threads {
+		threadIDs = append(threadIDs, summary.ThreadID)
 	}
 
-	dockerContainerId, err := startDockerContainer(threadID, req.RepositoryLink, req.ContextFiles, req.DockerImage, req.ServerUrl)
-	threadContainers[threadID] = strings.ReplaceAll(dockerContainerId, "\n", "")
-
-	fmt.Println(dockerContainerId)
-
 	w.Header().Set("Content-Type", "application/json")
+
+	// Return the list of thread IDs
 	response := map[string]interface{}{
-		"thread_id": threadID,
+		"thread_ids": threadIDs,
+		"threads":    list.Threads,
+		"total":      list.Total,
 	}
-
-	if threads[threadID] == nil {
-		threads[threadID] = make([]*ThreadMessage, 0)
+	if list.NextCursor != "" {
+		response["next_cursor"] = list.NextCursor
 	}
 
-	threads[threadID] = append(threads[threadID], &ThreadMessage{
-		ID:        time.Now().String(),
-		Direction: "input",
-		Output:    req.Prompt,
-		CreatedAt: time.Now(),
-	})
-
 	json.NewEncoder(w).Encode(response)
-
-	// Create new thread output entry
-	//outputMutex.Lock()
-	//threads[threadID] = &ThreadMessage{
-	//	ID:        threadID,
-	//	Status:    "processing",
-	//	CreatedAt: time.Now(),
-	//}
-	//outputMutex.Unlock()
-
-	// Add thread ID to response
-	//response := map[string]string{
-	//	"status":    "success",
-	//	"message":   "Request processed successfully",
-	//	"thread_id": threadID,
-	//}
-	//
-	//// Respond to client immediately with thread ID
-	//w.Header().Set("Content-Type", "application/json")
-	//json.NewEncoder(w).Encode(response)
-	//
-	//fmt.Printf("===== Starting thread %s processing =====\n", threadID)
-	//os.Stdout.Sync()
-	//// Process Docker execution in a goroutine
-	//go func() {
-	//	// Set up Docker run command
-	//	output, err := startDockerContainer(threadID, req.RepositoryLink, req.ContextFiles, req.Prompt, req.DockerImage)
-	//
-	//	// Update thread output in memory
-	//	outputMutex.Lock()
-	//	defer outputMutex.Unlock()
-	//
-	//	// Check if thread output still exists (might have been cleaned up)
-	//	threadOutput, exists := threads[threadID]
-	//	if !exists {
-	//		fmt.Printf("Warning: Thread %s was cleaned up before processing completed\n", threadID)
-	//		return
-	//	}
-	//
-	//	if err != nil {
-	//		threadOutput.Status = "error"
-	//		threadOutput.Error = err.Error()
-	//		fmt.Printf("Error running Docker container for thread %s: %v\n", threadID, err)
-	//	} else {
-	//		threadOutput.Status = "completed"
-	//		threadOutput.Output = output
-	//		// Log output to console for now
-	//		fmt.Printf("Thread %s completed with output:\n%s\n", threadID, output)
-	//	}
-	//}()
 }
 
-// handleOutputRequest retrieves output for a specific thread ID
-func handleOutputRequest(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+// handleCancelRequest stops the container running a thread
+func handleCancelRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Get thread ID from query parameter
-	threadID := r.URL.Query().Get("thread_id")
-	if threadID == "" {
-		http.Error(w, "Missing thread_id parameter", http.StatusBadRequest)
+	var req struct {
+		ThreadId string `json:"thread_id"`
+	}
+	if !decodeLegacyRequest(w, r, &req) {
 		return
 	}
 
-	// Lock for thread-safe access to output map
-	outputMutex.Lock()
-	threadOutput, exists := threads[threadID]
-	outputMutex.Unlock()
-
-	if !exists {
-		// Thread ID not found or processing not completed yet
-		http.Error(w, "Output not found for thread ID", http.StatusNotFound)
+	if apiErr := cancelThread(r, req.ThreadId); apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
 		return
 	}
 
-	// Respond with the stored output
 	w.Header().Set("Content-Type", "application/json")
-	b, err := json.Marshal(threadOutput)
-	if err != nil {
-		http.Error(w, "Error marshaling JSON", http.StatusInternalServerError)
-		return
-	}
 	response := map[string]string{
-		"thread_id": threadID,
-		"thread":    string(b),
+		"thread_id": req.ThreadId,
+		"status":    "cancelled",
 	}
 
-	// Add output or error depending on status
-	//if threadOutput.Status == "completed" {
-	//	response["output"] = threadOutput.Output
-	//} else if threadOutput.Status == "error" {
-	//	response["error"] = threadOutput.Error
-	//}
-
 	json.NewEncoder(w).Encode(response)
 }
 
-// startDockerContainer handles running a command in a Docker container and captures output
-// handleThreadsRequest returns all active thread IDs
-func handleThreadsRequest(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// decodeLegacyRequest reads a JSON request body, writing a plain text error on failure
+func decodeLegacyRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return false
 	}
+	defer r.Body.Close()
 
-	// Lock for thread-safe access to output map
-	outputMutex.Lock()
+	if err := json.Unmarshal(body, v); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return false
+	}
 
-	// Get all thread IDs
-	threadIDs := make([]string, 0, len(threads))
-	threadData := make([]map[string]interface{}, 0, len(threads))
+	return true
+}
 
-	for id, messages := range threads {
-		threadIDs = append(threadIDs, id)
-		if len(messages) > 0 {
-			threadData = append(threadData, map[string]interface{}{
-				"thread_id":  id,
-				"status":     messages[len(messages)-1].Status,
-				"created_at": time.Now(),
-			})
-		}
+// stopDockerContainer stops a running container; containers are started with --rm so this also removes it
+func stopDockerContainer(containerID string) error {
+	output, err := exec.Command("docker", "stop", containerID).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to stop container: %w, output: %s", err, string(output))
 	}
-	outputMutex.Unlock()
-
-	w.Header().Set("Content-Type", "application/json")
+	return nil
+}
 
-	// Return the list of thread IDs
-	response := map[string]interface{}{
-		"thread_ids": threadIDs,
-		"threads":    threadData,
+// startDockerContainer clones the repository and starts the thread's worker on
+// this server's Docker daemon. Without a Docker image the repository's dev
+// container spec is built and applied. It returns the container's output and
+// the image it runs.
+func startDockerContainer(ctx context.Context, threadID string, req client.StartThreadRequest, secrets []threadSecret, caller Caller) (string, string, error) {
+	spec := containerSpec{
+		ThreadID:       threadID,
+		RepositoryLink: req.RepositoryLink,
+		Ref:            req.Ref,
+		DockerImage:    req.DockerImage,
+		ServerURL:      req.ServerURL,
+		ContextFiles:   req.ContextFiles,
+		Guidance:       req.Guidance,
+		Sandbox:        req.Sandbox,
+		Secrets:        secrets,
+		prepare: func(repoDir string) (*devContainerPlan, string, error) {
+			return prepareDevContainer(threadID, repoDir, caller)
+		},
+	}
+
+	output, dockerImage, err := provisionContainer(ctx, spec, threadLogger(threadID))
+	if err != nil {
+		return output, dockerImage, err
 	}
 
-	json.NewEncoder(w).Encode(response)
+	// Capture the worker's output for as long as the container runs
+	go followContainerLogs(threadID, strings.TrimSpace(output))
+
+	return output, dockerImage, nil
+}
+
+// containerSpec is everything a Docker host needs to provision a thread's worker
+type containerSpec struct {
+	ThreadID       string
+	RepositoryLink string
+	Ref            string
+	DockerImage    string
+	ServerURL      string
+	ContextFiles   [][]byte
+	Guidance       map[string][]byte
+	Sandbox        *client.SandboxPolicy
+	Secrets        []threadSecret
+
+	// prepare builds the worker image from the cloned repository when the spec
+	// has no image; nil if that isn't possible on this host
+	prepare func(repoDir string) (*devContainerPlan, string, error)
 }
 
-func startDockerContainer(threadID, repoLink string, contextFiles [][]byte, dockerImage, serverUrl string) (string, error) {
-	// Create a buffer to store the output
-	var output bytes.Buffer
+// provisionContainer clones the repository and starts a worker container on the
+// local Docker daemon, logging each step through log. It returns the output of
+// docker run and the image the container runs.
+func provisionContainer(ctx context.Context, spec containerSpec, log logFunc) (string, string, error) {
+	threadID := spec.ThreadID
+	dockerImage := spec.DockerImage
+	if dockerImage == "" && spec.prepare == nil {
+		return "", "", fmt.Errorf("a Docker image is required to provision on this host")
+	}
 
 	// Create temporary directory for this execution
 	tempDir, err := os.MkdirTemp("", "superdev-"+threadID)
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp directory: %w", err)
+		return "", dockerImage, fmt.Errorf("failed to create temp directory: %w", err)
 	}
 	//defer os.RemoveAll(tempDir) // Clean up after execution
 
 	// Create repo directory for volume mounting
 	repoDir := tempDir + "/repo"
 	if err := os.Mkdir(repoDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create repo directory: %w", err)
+		return "", dockerImage, fmt.Errorf("failed to create repo directory: %w", err)
 	}
 
 	// Create context directory for context files
 	contextDir := tempDir + "/context"
 	if err := os.Mkdir(contextDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create guidance directory: %w", err)
+		return "", dockerImage, fmt.Errorf("failed to create guidance directory: %w", err)
 	}
 
 	// Write context files to context directory
-	for i, fileContent := range contextFiles {
+	for i, fileContent := range spec.ContextFiles {
 		filePath := fmt.Sprintf("%s/context_%d.txt", contextDir, i)
 		if err := os.WriteFile(filePath, fileContent, 0644); err != nil {
-			return "", fmt.Errorf("failed to write context file %d: %w", i, err)
+			return "", dockerImage, fmt.Errorf("failed to write context file %d: %w", i, err)
 		}
 	}
 
-	// Log that we're using a pre-built Docker image
-	fmt.Printf("===== Using Docker image %s for thread %s =====\n", dockerImage, threadID)
-	os.Stdout.Sync()
-
-	// Clone repository
-	fmt.Printf("===== Cloning repository for thread %s =====\n", threadID)
-	os.Stdout.Sync()
-
-	cloneCmd := exec.Command("git", "clone", repoLink, repoDir)
-
-	// Set up pipes for real-time output
-	cloneStdoutPipe, err := cloneCmd.StdoutPipe()
-	if err != nil {
-		return "", fmt.Errorf("failed to create stdout pipe for git clone: %w", err)
+	// Write the guidance bundle, if any, to its own directory
+	guidanceDir := tempDir + "/guidance"
+	if err := os.Mkdir(guidanceDir, 0755); err != nil {
+		return "", dockerImage, fmt.Errorf("failed to create guidance directory: %w", err)
 	}
-	cloneStderrPipe, err := cloneCmd.StderrPipe()
-	if err != nil {
-		return "", fmt.Errorf("failed to create stderr pipe for git clone: %w", err)
+	for name, content := range spec.Guidance {
+		if err := os.WriteFile(filepath.Join(guidanceDir, name), content, 0644); err != nil {
+			return "", dockerImage, fmt.Errorf("failed to write guidance file %s: %w", name, err)
+		}
 	}
 
-	// Log the command being executed
-	fmt.Printf("Executing git clone: %s\n", strings.Join(cloneCmd.Args, " "))
-	os.Stdout.Sync()
-
-	// Start the command
-	if err := cloneCmd.Start(); err != nil {
-		return "", fmt.Errorf("failed to start git clone: %w", err)
+	// Log that we're using a pre-built Docker image
+	if dockerImage != "" {
+		log(PhaseProvision, "", fmt.Sprintf("Using Docker image %s", dockerImage))
 	}
 
-	// Capture clone output
-	var cloneOutput bytes.Buffer
-
-	// Process stdout
-	go func() {
-		scanner := bufio.NewScanner(cloneStdoutPipe)
-		for scanner.Scan() {
-			line := scanner.Text()
-			fmt.Println("[CLONE]", line)
-			os.Stdout.Sync()
-			cloneOutput.WriteString(line + "\n")
-		}
-	}()
-
-	// Process stderr
-	go func() {
-		scanner := bufio.NewScanner(cloneStderrPipe)
-		for scanner.Scan() {
-			line := scanner.Text()
-			fmt.Println("[CLONE ERR]", line)
-			os.Stdout.Sync()
-			cloneOutput.WriteString(line + "\n")
-		}
-	}()
-
-	// Wait for clone to complete
-	if err := cloneCmd.Wait(); err != nil {
-		fmt.Printf("===== Git clone failed for thread %s =====\n", threadID)
-		return "", fmt.Errorf("failed to clone repository: %w, output: %s", err, cloneOutput.String())
+	// Clone repository
+	cloneCmd := exec.Command("git", "clone", spec.RepositoryLink, repoDir)
+	_, span := startSpan(ctx, "git.clone", threadID)
+	start := time.Now()
+	err = runLoggedCommand(log, PhaseClone, cloneCmd, nil)
+	observePhase(PhaseClone, start, err)
+	endSpan(span, err)
+	if err != nil {
+		return "", dockerImage, fmt.Errorf("failed to clone repository: %w", err)
 	}
 
-	fmt.Printf("===== Repository cloned successfully for thread %s =====\n", threadID)
-	os.Stdout.Sync()
-
-	// Pull latest from main branch
-	fmt.Printf("===== Pulling latest changes for thread %s =====\n", threadID)
-	os.Stdout.Sync()
-
+	// Pull latest from main branch, or check out the requested ref
 	pullCmd := exec.Command("git", "pull", "origin", "main")
+	if spec.Ref != "" {
+		pullCmd = exec.Command("git", "checkout", spec.Ref, "--")
+	}
 	pullCmd.Dir = repoDir
-
-	// Set up pipes for real-time output
-	pullStdoutPipe, err := pullCmd.StdoutPipe()
-	if err != nil {
-		return "", fmt.Errorf("failed to create stdout pipe for git pull: %w", err)
+	_, span = startSpan(ctx, "git.pull", threadID)
+	start = time.Now()
+	err = runLoggedCommand(log, PhasePull, pullCmd, nil)
+	observePhase(PhasePull, start, err)
+	endSpan(span, err)
+	if err != nil && spec.Ref != "" {
+		return "", dockerImage, fmt.Errorf("failed to check out %s: %w", spec.Ref, err)
 	}
-	pullStderrPipe, err := pullCmd.StderrPipe()
 	if err != nil {
-		return "", fmt.Errorf("failed to create stderr pipe for git pull: %w", err)
+		return "", dockerImage, fmt.Errorf("failed to pull from main branch: %w", err)
 	}
 
-	// Log the command being executed
-	fmt.Printf("Executing git pull: %s (in %s)\n", strings.Join(pullCmd.Args, " "), repoDir)
-	os.Stdout.Sync()
-
-	// Start the command
-	if err := pullCmd.Start(); err != nil {
-		return "", fmt.Errorf("failed to start git pull: %w", err)
-	}
-
-	// Capture pull output
-	var pullOutput bytes.Buffer
-
-	// Process stdout
-	go func() {
-		scanner := bufio.NewScanner(pullStdoutPipe)
-		for scanner.Scan() {
-			line := scanner.Text()
-			fmt.Println("[PULL]", line)
-			os.Stdout.Sync()
-			pullOutput.WriteString(line + "\n")
-		}
-	}()
-
-	// Process stderr
-	go func() {
-		scanner := bufio.NewScanner(pullStderrPipe)
-		for scanner.Scan() {
-			line := scanner.Text()
-			fmt.Println("[PULL ERR]", line)
-			os.Stdout.Sync()
-			pullOutput.WriteString(line + "\n")
+	// Without an image the repository's dev container spec describes the worker
+	var devContainer *devContainerPlan
+	if dockerImage == "" {
+		_, span = startSpan(ctx, "devcontainer.build", threadID)
+		start = time.Now()
+		devContainer, dockerImage, err = spec.prepare(repoDir)
+		observePhase(PhaseBuild, start, err)
+		endSpan(span, err)
+		if err != nil {
+			return "", dockerImage, fmt.Errorf("failed to prepare dev container: %w", err)
 		}
-	}()
-
-	// Wait for pull to complete
-	if err := pullCmd.Wait(); err != nil {
-		fmt.Printf("===== Git pull failed for thread %s =====\n", threadID)
-		return "", fmt.Errorf("failed to pull from main branch: %w, output: %s", err, pullOutput.String())
 	}
 
-	fmt.Printf("===== Repository pull completed for thread %s =====\n", threadID)
-	os.Stdout.Sync()
-
 	// Get ANTHROPIC_API_KEY from environment
 	anthropicKey := os.Getenv("ANTHROPIC_API_KEY")
 
@@ -751,15 +597,51 @@ func startDockerContainer(threadID, repoLink string, contextFiles [][]byte, dock
 		"run",
 		"--rm",
 		"-d",
-		"-e SERVER_URL=" + serverUrl,
-		"-e THREAD_ID=" + threadID,
+		"-e", "SERVER_URL=" + spec.ServerURL,
+		"-e", "THREAD_ID=" + threadID,
 		"-v", repoDir + ":/workdir/repo",
 		"-v", contextDir + ":/workdir/context",
+		"-v", guidanceDir + ":/workdir/guidance",
+	}
+	dockerArgs = append(dockerArgs, sandboxArgs(spec.Sandbox)...)
+
+	// Hand the trace context and exporter to the runner so its spans join this trace
+	runCtx, span := startSpan(ctx, "docker.run", threadID)
+	if traceParent := tracing.TraceParent(runCtx); traceParent != "" {
+		dockerArgs = append(dockerArgs, "-e", tracing.EnvTraceParent+"="+traceParent)
 	}
+	if otlpEndpoint != "" {
+		dockerArgs = append(dockerArgs, "-e", tracing.EnvOTLPEndpoint+"="+otlpEndpoint)
+	}
+
+	// Secret values are passed through the docker client's environment rather than
+	// its arguments so they never show up in the logged command line
+	var secretEnv []string
 
 	// Add ANTHROPIC_API_KEY as environment variable if available
 	if anthropicKey != "" {
-		dockerArgs = append(dockerArgs, "-e", "ANTHROPIC_API_KEY="+anthropicKey)
+		dockerArgs = append(dockerArgs, "-e", "ANTHROPIC_API_KEY")
+		secretEnv = append(secretEnv, "ANTHROPIC_API_KEY="+anthropicKey)
+	}
+
+	hasFileSecrets := false
+	for _, secret := range spec.Secrets {
+		if secret.Mount == SecretMountFile {
+			hasFileSecrets = true
+			continue
+		}
+		dockerArgs = append(dockerArgs, "-e", secret.Name)
+		secretEnv = append(secretEnv, secret.Name+"="+secret.Value)
+	}
+
+	// File secrets live on a tmpfs so they are never written to the host's disk
+	if hasFileSecrets {
+		dockerArgs = append(dockerArgs, "--tmpfs", secretsDir+":rw,noexec,nosuid,mode=0700")
+	}
+
+	// Environment, mounts and setup from the dev container spec
+	if devContainer != nil {
+		dockerArgs = append(dockerArgs, devContainer.dockerArgs()...)
 	}
 
 	// Add image
@@ -767,60 +649,130 @@ func startDockerContainer(threadID, repoLink string, contextFiles [][]byte, dock
 
 	// Create command
 	runCmd := exec.Command("docker", dockerArgs...)
+	runCmd.Env = append(os.Environ(), secretEnv...)
+
+	var output lockedBuffer
+	start = time.Now()
+	err = runLoggedCommand(log, PhaseDocker, runCmd, &output)
+	observePhase(PhaseDocker, start, err)
+	endSpan(span, err)
+	if err != nil {
+		return output.String(), dockerImage, fmt.Errorf("error running Docker container: %w", err)
+	}
+
+	// With -d the only output is the container ID
+	containerID := strings.TrimSpace(output.String())
+	slog.Info("container started", "thread_id", threadID, "phase", PhaseDocker, "container_id", containerID)
+
+	for _, secret := range spec.Secrets {
+		if secret.Mount != SecretMountFile {
+			continue
+		}
+		if err := writeSecretFile(log, containerID, secret); err != nil {
+			return output.String(), dockerImage, err
+		}
+	}
 
-	// Log the command being executed directly to stdout for visibility
-	fmt.Printf("Executing Docker command: %s\n", strings.Join(runCmd.Args, " "))
-	os.Stdout.Sync()
+	return output.String(), dockerImage, nil
+}
 
-	// Set up pipes for real-time streaming
-	stdoutPipe, err := runCmd.StdoutPipe()
+// runLoggedCommand runs cmd, streaming its stdout and stderr into log under
+// phase. When output is non-nil it also collects both streams.
+func runLoggedCommand(log logFunc, phase string, cmd *exec.Cmd, output *lockedBuffer) error {
+	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return "", fmt.Errorf("failed to create stdout pipe: %w", err)
+		return fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
-	stderrPipe, err := runCmd.StderrPipe()
+	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
-		return "", fmt.Errorf("failed to create stderr pipe: %w", err)
+		return fmt.Errorf("failed to create stderr pipe: %w", err)
 	}
 
-	// Start the command
-	if err := runCmd.Start(); err != nil {
-		return "", fmt.Errorf("failed to start docker command: %w", err)
-	}
+	// Log the command being executed
+	log(phase, "", "Executing: "+strings.Join(cmd.Args, " "))
 
-	fmt.Printf("===== Docker output for thread %s BEGIN =====\n", threadID)
-	os.Stdout.Sync()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", cmd.Args[0], err)
+	}
 
-	// Capture stdout
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
-		scanner := bufio.NewScanner(stdoutPipe)
-		for scanner.Scan() {
-			line := scanner.Text()
-			fmt.Println(line)
-			os.Stdout.Sync()
-			output.WriteString(line + "\n")
-		}
+		defer wg.Done()
+		streamLog(log, phase, "stdout", stdoutPipe, output)
 	}()
+	go func() {
+		defer wg.Done()
+		streamLog(log, phase, "stderr", stderrPipe, output)
+	}()
+
+	// All reads must finish before Wait closes the pipes
+	wg.Wait()
+
+	if err := cmd.Wait(); err != nil {
+		log(phase, "", fmt.Sprintf("Command failed: %v", err))
+		return fmt.Errorf("%s failed, see thread logs for phase %s: %w", cmd.Args[0], phase, err)
+	}
+
+	log(phase, "", "Command completed")
+	return nil
+}
 
-	// Capture stderr
+// followContainerLogs streams a container's logs into the thread's log until it exits,
+// then records how the worker ended and releases the thread's scheduler slot
+func followContainerLogs(threadID, containerID string) {
+	// The container is removed once it exits, so its exit code is waited for
+	// while it's still there
+	exitCode := make(chan string, 1)
 	go func() {
-		scanner := bufio.NewScanner(stderrPipe)
-		for scanner.Scan() {
-			line := scanner.Text()
-			fmt.Println(line)
-			os.Stdout.Sync()
-			output.WriteString(line + "\n")
+		var out bytes.Buffer
+		if err := runDocker(&out, "wait", containerID); err != nil {
+			slog.Warn("failed to wait for container", "thread_id", threadID, "container_id", containerID, "error", err)
+			exitCode <- ""
+			return
 		}
+		exitCode <- strings.TrimSpace(out.String())
 	}()
 
-	// Wait for command to complete
-	if err := runCmd.Wait(); err != nil {
-		fmt.Printf("===== Docker output for thread %s END (with error) =====\n", threadID)
-		os.Stdout.Sync()
-		return output.String(), fmt.Errorf("error running Docker container: %w", err)
+	cmd := exec.Command("docker", "logs", "-f", containerID)
+	if err := runLoggedCommand(threadLogger(threadID), PhaseContainer, cmd, nil); err != nil {
+		slog.Warn("container log stream ended", "thread_id", threadID, "container_id", containerID, "error", err)
 	}
 
-	fmt.Printf("===== Docker output for thread %s END (success) =====\n", threadID)
-	os.Stdout.Sync()
+	switch code := <-exitCode; code {
+	case "0":
+		appendThreadLog(threadID, PhaseContainer, "", "Container exited")
+		markThreadEnded(threadID, client.ThreadStatusCompleted)
+	case "":
+		appendThreadLog(threadID, PhaseContainer, "", "Container exited with an unknown code")
+		markThreadEnded(threadID, client.ThreadStatusFailed)
+	default:
+		appendThreadLog(threadID, PhaseContainer, "", "Container exited with code "+code)
+		markThreadEnded(threadID, client.ThreadStatusFailed)
+	}
+	threadScheduler.Release(threadID)
+}
+
+// writeSecretFile writes a secret into the container's secrets tmpfs, passing
+// the value on stdin so it never appears in a command line
+func writeSecretFile(log logFunc, containerID string, secret threadSecret) error {
+	target := secretsDir + "/" + secret.Name
+	cmd := exec.Command("docker", "exec", "-i", containerID, "sh", "-c", "umask 077 && cat > "+target)
+	cmd.Stdin = strings.NewReader(secret.Value)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to write secret %s: %w, output: %s", secret.Name, err, redactSecrets(string(output)))
+	}
+
+	log(PhaseProvision, "", fmt.Sprintf("Wrote secret %s to %s", secret.Name, target))
+	return nil
+}
 
-	return output.String(), nil
+// secretNames returns the names of the secrets selected for a thread
+func secretNames(secrets []threadSecret) []string {
+	names := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		names = append(names, secret.Name)
+	}
+	return names
 }
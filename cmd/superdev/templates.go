@@ -0,0 +1,354 @@
+package superdev
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+var (
+	templateNamePattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+	gitRefPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._/@+-]*$`)
+	guidanceNamePattern  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+	sandboxMemoryPattern = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+)
+
+// TemplateStore keeps thread templates, keyed by name, in a JSON file on disk
+type TemplateStore struct {
+	mu        sync.Mutex
+	path      string
+	templates map[string]*client.Template
+}
+
+// templateStore is nil until the server starts
+var templateStore *TemplateStore
+
+// NewTemplateStore opens the store at path
+func NewTemplateStore(path string) (*TemplateStore, error) {
+	store := &TemplateStore{
+		path:      path,
+		templates: make(map[string]*client.Template),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &store.templates); err != nil {
+		return nil, fmt.Errorf("failed to parse templates file: %w", err)
+	}
+	return store, nil
+}
+
+// templateVisible reports whether the caller may see and start threads from a template
+func templateVisible(template *client.Template, caller Caller) bool {
+	if template.Owner == "" {
+		return true
+	}
+	if caller.User != "" && caller.User == template.Owner {
+		return true
+	}
+	return template.Team != "" && caller.Team == template.Team
+}
+
+// Set creates or replaces a template
+func (s *TemplateStore) Set(template client.Template) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.templates[template.Name] = &template
+	return s.save()
+}
+
+// Get returns a template by name
+func (s *TemplateStore) Get(name string) (client.Template, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	template, ok := s.templates[name]
+	if !ok {
+		return client.Template{}, false
+	}
+	return *template, true
+}
+
+// Delete removes a template
+func (s *TemplateStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.templates, name)
+	return s.save()
+}
+
+// List returns all templates sorted by name
+func (s *TemplateStore) List() []client.Template {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]client.Template, 0, len(s.templates))
+	for _, template := range s.templates {
+		list = append(list, *template)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// save writes the store to disk. The caller must hold s.mu.
+func (s *TemplateStore) save() error {
+	data, err := json.MarshalIndent(s.templates, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal templates: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create templates directory: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated file
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write templates file: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace templates file: %w", err)
+	}
+
+	return nil
+}
+
+var errTemplatesDisabled = newAPIError(http.StatusServiceUnavailable, "Templates are not enabled on this server")
+
+// listTemplates returns the templates the caller may use
+func listTemplates(caller Caller) ([]client.Template, *apiError) {
+	if templateStore == nil {
+		return nil, errTemplatesDisabled
+	}
+
+	list := []client.Template{}
+	for _, template := range templateStore.List() {
+		if templateVisible(&template, caller) {
+			list = append(list, template)
+		}
+	}
+	return list, nil
+}
+
+// getTemplate returns a template the caller may use
+func getTemplate(caller Caller, name string) (*client.Template, *apiError) {
+	if templateStore == nil {
+		return nil, errTemplatesDisabled
+	}
+	template, ok := templateStore.Get(name)
+	if !ok || !templateVisible(&template, caller) {
+		return nil, newAPIError(http.StatusNotFound, fmt.Sprintf("Template %s not found", name))
+	}
+	return &template, nil
+}
+
+// storeTemplate creates or replaces a template owned by the caller. Replacing
+// keeps the original owner and creation time.
+func storeTemplate(caller Caller, name string, settings client.TemplateSettings) (*client.Template, *apiError) {
+	if templateStore == nil {
+		return nil, errTemplatesDisabled
+	}
+
+	if !templateNamePattern.MatchString(name) {
+		return nil, newAPIError(http.StatusBadRequest, "Template name must be lowercase letters, digits, '.', '_' or '-'")
+	}
+	if settings.Team != "" && settings.Team != caller.Team {
+		return nil, newAPIError(http.StatusForbidden, "Cannot share a template with another team")
+	}
+	if settings.DockerImage != "" && !imageTagPattern.MatchString(settings.DockerImage) {
+		return nil, newAPIError(http.StatusBadRequest, "Docker image must be a valid Docker tag")
+	}
+	if err := validateThreadOptions(settings.Ref, 0, settings.Guidance, settings.Sandbox, settings.ToolPolicy, settings.Secrets); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, err.Error())
+	}
+	if settings.Budget < 0 {
+		return nil, newAPIError(http.StatusBadRequest, "Budget must not be negative")
+	}
+
+	now := time.Now()
+	template := client.Template{
+		Name:             name,
+		TemplateSettings: settings,
+		Owner:            caller.User,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if existing, ok := templateStore.Get(name); ok {
+		// Existing templates can only be replaced by their owner
+		if !templateVisible(&existing, caller) {
+			return nil, newAPIError(http.StatusConflict, "Template already exists")
+		}
+		if existing.Owner != "" && existing.Owner != caller.User {
+			return nil, newAPIError(http.StatusForbidden, "Only the template's owner can change it")
+		}
+		template.Owner, template.CreatedAt = existing.Owner, existing.CreatedAt
+	}
+
+	if err := templateStore.Set(template); err != nil {
+		slog.Error("failed to store template", "name", name, "error", err)
+		return nil, newAPIError(http.StatusInternalServerError, "Error storing template")
+	}
+	return &template, nil
+}
+
+// deleteTemplate removes a template the caller owns
+func deleteTemplate(caller Caller, name string) *apiError {
+	template, apiErr := getTemplate(caller, name)
+	if apiErr != nil {
+		return apiErr
+	}
+	if template.Owner != "" && template.Owner != caller.User {
+		return newAPIError(http.StatusForbidden, "Only the template's owner can delete it")
+	}
+
+	if err := templateStore.Delete(name); err != nil {
+		slog.Error("failed to delete template", "name", name, "error", err)
+		return newAPIError(http.StatusInternalServerError, "Error deleting template")
+	}
+	return nil
+}
+
+// applyTemplate fills in a start request from the template it names. Fields set
+// on the request override the template's; guidance files are merged by name and
+// the template's prompt prefix is prepended to the prompt.
+func applyTemplate(caller Caller, req client.StartThreadRequest) (client.StartThreadRequest, *apiError) {
+	if req.Template == "" {
+		return req, nil
+	}
+	template, apiErr := getTemplate(caller, req.Template)
+	if apiErr != nil {
+		return req, apiErr
+	}
+
+	if req.DockerImage == "" {
+		req.DockerImage = template.DockerImage
+	}
+	if req.RepositoryLink == "" {
+		req.RepositoryLink = template.RepositoryLink
+	}
+	if req.Ref == "" {
+		req.Ref = template.Ref
+	}
+	if req.ServerURL == "" {
+		req.ServerURL = template.ServerURL
+	}
+	if len(req.ContextFiles) == 0 {
+		req.ContextFiles = template.ContextFiles
+	}
+	if len(req.Secrets) == 0 {
+		req.Secrets = template.Secrets
+	}
+	if req.Sandbox == nil {
+		req.Sandbox = template.Sandbox
+	}
+	if req.ToolPolicy == nil {
+		req.ToolPolicy = template.ToolPolicy
+	}
+	if req.Budget == 0 {
+		req.Budget = template.Budget
+	}
+
+	if len(template.Guidance) > 0 {
+		guidance := make(map[string][]byte, len(template.Guidance)+len(req.Guidance))
+		for name, content := range template.Guidance {
+			guidance[name] = content
+		}
+		for name, content := range req.Guidance {
+			guidance[name] = content
+		}
+		req.Guidance = guidance
+	}
+
+	if template.PromptPrefix != "" {
+		if req.Title == "" && req.Prompt != "" {
+			req.Title = threadTitle(req.Prompt)
+		}
+		req.Prompt = strings.TrimSpace(template.PromptPrefix + "\n\n" + req.Prompt)
+	}
+
+	return req, nil
+}
+
+// validateThreadOptions checks the settings that end up on a git or docker
+// command line, or with the runner, before a thread or template uses them
+func validateThreadOptions(ref string, priority int, guidance map[string][]byte, sandbox *client.SandboxPolicy, toolPolicy *client.ToolPolicy, secrets []client.SecretRef) error {
+	if priority < -maxPriority || priority > maxPriority {
+		return fmt.Errorf("priority must be from %d to %d", -maxPriority, maxPriority)
+	}
+	if ref != "" && (!gitRefPattern.MatchString(ref) || strings.Contains(ref, "..")) {
+		return fmt.Errorf("invalid ref %q", ref)
+	}
+	for name := range guidance {
+		if !guidanceNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid guidance file name %q", name)
+		}
+	}
+	for _, ref := range secrets {
+		if !secretNamePattern.MatchString(ref.Name) {
+			return fmt.Errorf("invalid secret name %q", ref.Name)
+		}
+		if ref.Mount != "" && ref.Mount != SecretMountEnv && ref.Mount != SecretMountFile {
+			return fmt.Errorf("invalid mount %q for secret %s", ref.Mount, ref.Name)
+		}
+		if ref.Mount != SecretMountFile && reservedSecretNames[ref.Name] {
+			return fmt.Errorf("secret %s would replace a variable the worker needs; mount it as a file", ref.Name)
+		}
+	}
+	if toolPolicy != nil {
+		if err := toolPolicy.Validate(); err != nil {
+			return err
+		}
+	}
+	if sandbox == nil {
+		return nil
+	}
+	if sandbox.Memory != "" && !sandboxMemoryPattern.MatchString(sandbox.Memory) {
+		return fmt.Errorf("invalid sandbox memory limit %q", sandbox.Memory)
+	}
+	if sandbox.CPUs != "" {
+		if cpus, err := strconv.ParseFloat(sandbox.CPUs, 64); err != nil || cpus <= 0 {
+			return fmt.Errorf("invalid sandbox CPU limit %q", sandbox.CPUs)
+		}
+	}
+	if sandbox.PidsLimit < 0 {
+		return fmt.Errorf("invalid sandbox pids limit %d", sandbox.PidsLimit)
+	}
+	return nil
+}
+
+// sandboxArgs returns the docker run flags enforcing a sandbox policy
+func sandboxArgs(sandbox *client.SandboxPolicy) []string {
+	if sandbox == nil {
+		return nil
+	}
+	var args []string
+	if sandbox.Memory != "" {
+		args = append(args, "--memory", sandbox.Memory)
+	}
+	if sandbox.CPUs != "" {
+		args = append(args, "--cpus", sandbox.CPUs)
+	}
+	if sandbox.PidsLimit > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(sandbox.PidsLimit))
+	}
+	return args
+}
@@ -0,0 +1,274 @@
+package superdev
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"superdev/cmd/superdev/client"
+)
+
+// setupTemplateStore installs an empty template store for the test
+func setupTemplateStore(t *testing.T) *TemplateStore {
+	t.Helper()
+	store, err := NewTemplateStore(filepath.Join(t.TempDir(), "templates.json"))
+	if err != nil {
+		t.Fatalf("Failed to create template store: %v", err)
+	}
+	templateStore = store
+	t.Cleanup(func() { templateStore = nil })
+	return store
+}
+
+// expectStatus checks that err is an API error with the given status
+func expectStatus(t *testing.T, err error, status int) {
+	t.Helper()
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != status {
+		t.Fatalf("Expected a %d error, got %v", status, err)
+	}
+}
+
+func TestTemplateStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "templates.json")
+	store, _ := NewTemplateStore(path)
+	store.Set(client.Template{Name: "web", TemplateSettings: client.TemplateSettings{RepositoryLink: "https://example.com/web.git"}})
+
+	reopened, err := NewTemplateStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	if template, ok := reopened.Get("web"); !ok || template.RepositoryLink != "https://example.com/web.git" {
+		t.Fatalf("Expected the template to persist, got %+v", template)
+	}
+}
+
+func TestV1Templates(t *testing.T) {
+	setupTemplateStore(t)
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	alice := client.New(server.URL, client.WithCaller("alice", "platform"))
+	bob := client.New(server.URL, client.WithCaller("bob", "platform"))
+	eve := client.New(server.URL, client.WithCaller("eve", "other"))
+
+	settings := client.TemplateSettings{
+		RepositoryLink: "https://example.com/web.git",
+		Ref:            "release/1.2",
+		Sandbox:        &client.SandboxPolicy{Memory: "4g", CPUs: "2"},
+		Team:           "platform",
+	}
+	created, err := alice.StoreTemplate(ctx, "web", settings)
+	if err != nil {
+		t.Fatalf("StoreTemplate failed: %v", err)
+	}
+	if created.Owner != "alice" || created.Ref != "release/1.2" || created.CreatedAt.IsZero() {
+		t.Fatalf("Unexpected template %+v", created)
+	}
+
+	// Team members can use the template; others can't see it
+	if template, err := bob.GetTemplate(ctx, "web"); err != nil || template.Sandbox.Memory != "4g" {
+		t.Fatalf("Expected bob to see the shared template, got %+v, %v", template, err)
+	}
+	if list, err := eve.ListTemplates(ctx); err != nil || len(list.Templates) != 0 {
+		t.Fatalf("Expected eve to see no templates, got %+v, %v", list, err)
+	}
+	_, err = eve.GetTemplate(ctx, "web")
+	expectStatus(t, err, http.StatusNotFound)
+
+	// Only the owner can replace or delete it
+	_, err = bob.StoreTemplate(ctx, "web", client.TemplateSettings{})
+	expectStatus(t, err, http.StatusForbidden)
+	_, err = eve.StoreTemplate(ctx, "web", client.TemplateSettings{})
+	expectStatus(t, err, http.StatusConflict)
+	expectStatus(t, bob.DeleteTemplate(ctx, "web"), http.StatusForbidden)
+
+	settings.Ref = "main"
+	updated, err := alice.StoreTemplate(ctx, "web", settings)
+	if err != nil || updated.Ref != "main" || !updated.CreatedAt.Equal(created.CreatedAt) {
+		t.Fatalf("Expected the template to be replaced keeping its creation time, got %+v, %v", updated, err)
+	}
+
+	for name, bad := range map[string]client.TemplateSettings{
+		"ref":      {Ref: "--upload-pack=evil"},
+		"guidance": {Guidance: map[string][]byte{"../escape": nil}},
+		"memory":   {Sandbox: &client.SandboxPolicy{Memory: "lots"}},
+		"cpus":     {Sandbox: &client.SandboxPolicy{CPUs: "-1"}},
+		"secret":   {Secrets: []client.SecretRef{{Name: "TOKEN", Mount: "disk"}}},
+		"command":  {ToolPolicy: &client.ToolPolicy{DeniedCommands: []string{"(unclosed"}}},
+		"path":     {ToolPolicy: &client.ToolPolicy{AllowedPaths: []string{"../other"}}},
+	} {
+		_, err := alice.StoreTemplate(ctx, "bad", bad)
+		var apiErr *client.Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected an invalid %s to be rejected, got %v", name, err)
+		}
+	}
+	_, err = alice.StoreTemplate(ctx, "Bad Name", client.TemplateSettings{})
+	expectStatus(t, err, http.StatusBadRequest)
+	_, err = alice.StoreTemplate(ctx, "other-team", client.TemplateSettings{Team: "other"})
+	expectStatus(t, err, http.StatusForbidden)
+
+	if err := alice.DeleteTemplate(ctx, "web"); err != nil {
+		t.Fatalf("DeleteTemplate failed: %v", err)
+	}
+	_, err = alice.GetTemplate(ctx, "web")
+	expectStatus(t, err, http.StatusNotFound)
+}
+
+func TestApplyTemplate(t *testing.T) {
+	store := setupTemplateStore(t)
+	store.Set(client.Template{
+		Name: "web",
+		TemplateSettings: client.TemplateSettings{
+			DockerImage:    "web:agent",
+			RepositoryLink: "https://example.com/web.git",
+			Ref:            "develop",
+			ContextFiles:   [][]byte{[]byte("style guide")},
+			Guidance:       map[string][]byte{"AGENTS.md": []byte("be careful"), "TESTING.md": []byte("run make test")},
+			Sandbox:        &client.SandboxPolicy{PidsLimit: 256},
+			ToolPolicy:     &client.ToolPolicy{AllowedTools: []string{"Read"}},
+			PromptPrefix:   "You are working on the web app.",
+		},
+	})
+
+	req, apiErr := applyTemplate(Caller{User: "alice"}, client.StartThreadRequest{
+		Template: "web",
+		Ref:      "feature/login",
+		Guidance: map[string][]byte{"AGENTS.md": []byte("be bold")},
+		Prompt:   "Fix the login page\nIt 500s",
+	})
+	if apiErr != nil {
+		t.Fatalf("applyTemplate failed: %s", apiErr.Message)
+	}
+	if req.DockerImage != "web:agent" || req.RepositoryLink != "https://example.com/web.git" || len(req.ContextFiles) != 1 || req.Sandbox.PidsLimit != 256 {
+		t.Errorf("Expected the template's settings, got %+v", req)
+	}
+	if req.ToolPolicy == nil || req.ToolPolicy.AllowedTools[0] != "Read" {
+		t.Errorf("Expected the template's tool policy, got %+v", req.ToolPolicy)
+	}
+	if req.Ref != "feature/login" {
+		t.Errorf("Expected the request's ref to win, got %s", req.Ref)
+	}
+	if string(req.Guidance["AGENTS.md"]) != "be bold" || string(req.Guidance["TESTING.md"]) != "run make test" {
+		t.Errorf("Expected guidance to be merged by name, got %q", req.Guidance)
+	}
+	if req.Prompt != "You are working on the web app.\n\nFix the login page\nIt 500s" || req.Title != "Fix the login page" {
+		t.Errorf("Expected the prefix on the prompt but not the title, got %q, %q", req.Prompt, req.Title)
+	}
+
+	if _, apiErr := applyTemplate(Caller{User: "alice"}, client.StartThreadRequest{Template: "missing"}); apiErr == nil || apiErr.Status != http.StatusNotFound {
+		t.Fatalf("Expected an unknown template to be a 404, got %+v", apiErr)
+	}
+}
+
+func TestStartThreadFromTemplate(t *testing.T) {
+	resetThreads(t)
+	setupDataDir(t)
+	setupTemplateStore(t)
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	c := client.New(server.URL, client.WithCaller("alice", ""))
+
+	// The clone fails, but the thread is recorded with the template's settings
+	repo := filepath.Join(t.TempDir(), "missing.git")
+	if _, err := c.StoreTemplate(ctx, "web", client.TemplateSettings{RepositoryLink: repo, PromptPrefix: "Read AGENTS.md first."}); err != nil {
+		t.Fatalf("StoreTemplate failed: %v", err)
+	}
+	resp, err := c.StartThread(ctx, client.StartThreadRequest{Template: "web", Prompt: "Add dark mode"})
+	if err != nil {
+		t.Fatalf("StartThread failed: %v", err)
+	}
+	thread, err := c.GetThread(ctx, resp.ThreadID, client.GetThreadOptions{})
+	if err != nil {
+		t.Fatalf("GetThread failed: %v", err)
+	}
+	if thread.Template != "web" || thread.Repository != repo || thread.Title != "Add dark mode" {
+		t.Fatalf("Expected the thread to come from the template, got %+v", thread)
+	}
+	if len(thread.Messages) != 1 || thread.Messages[0].Output != "Read AGENTS.md first.\n\nAdd dark mode" {
+		t.Fatalf("Expected the prompt prefix on the first message, got %+v", thread.Messages)
+	}
+
+	_, err = c.StartThread(ctx, client.StartThreadRequest{Template: "web", Ref: "-b"})
+	expectStatus(t, err, http.StatusBadRequest)
+	_, err = c.StartThread(ctx, client.StartThreadRequest{Template: "api"})
+	expectStatus(t, err, http.StatusNotFound)
+}
+
+func TestSandboxArgs(t *testing.T) {
+	if args := sandboxArgs(nil); args != nil {
+		t.Errorf("Expected no flags without a policy, got %v", args)
+	}
+	args := sandboxArgs(&client.SandboxPolicy{Memory: "512m", CPUs: "0.5", PidsLimit: 100})
+	if got := strings.Join(args, " "); got != "--memory 512m --cpus 0.5 --pids-limit 100" {
+		t.Errorf("Unexpected sandbox flags %s", got)
+	}
+}
+
+func TestTemplatesCommands(t *testing.T) {
+	resetThreads(t)
+	setupDataDir(t)
+	setupTemplateStore(t)
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	run := func(args ...string) (string, error) {
+		cmd := newTemplatesCmd()
+		var out bytes.Buffer
+		cmd.SetOut(&out)
+		cmd.SetErr(&out)
+		cmd.SetArgs(append(args, "--server", server.URL, "--user", "alice", "--team", "platform"))
+		err := cmd.ExecuteContext(context.Background())
+		return out.String(), err
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "web.json")
+	os.WriteFile(file, []byte(`{"repository_link": "https://example.com/web.git", "ref": "develop", "prompt_prefix": "Be brief."}`), 0o644)
+	guidance := filepath.Join(dir, "AGENTS.md")
+	os.WriteFile(guidance, []byte("Run make test"), 0o644)
+
+	out, err := run("save", "web", "-f", file, "--ref", "main", "--guidance", guidance, "--secret", "NPM_TOKEN:file", "--memory", "2g", "--shared")
+	if err != nil || out != "Saved template web\n" {
+		t.Fatalf("save failed: %v\n%s", err, out)
+	}
+	template, ok := templateStore.Get("web")
+	if !ok || template.Ref != "main" || template.PromptPrefix != "Be brief." || string(template.Guidance["AGENTS.md"]) != "Run make test" || template.Team != "platform" {
+		t.Fatalf("Expected the file and flags to be combined, got %+v", template)
+	}
+	if len(template.Secrets) != 1 || template.Secrets[0] != (client.SecretRef{Name: "NPM_TOKEN", Mount: SecretMountFile}) || template.Sandbox.Memory != "2g" {
+		t.Fatalf("Expected secrets and sandbox from flags, got %+v", template)
+	}
+
+	out, err = run("list")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); err != nil || len(lines) != 2 || !strings.HasPrefix(lines[1], "web") {
+		t.Fatalf("Expected a header and the template, got %v:\n%s", err, out)
+	}
+	out, err = run("show", "web")
+	if err != nil || !strings.Contains(out, "Guidance:      AGENTS.md") || !strings.Contains(out, "Sandbox:       memory 2g") {
+		t.Fatalf("Expected the template's settings, got %v:\n%s", err, out)
+	}
+
+	// Template secrets are resolved with the starting caller's access
+	secrets, _ := NewSecretStore(filepath.Join(dir, "secrets.json"), "passphrase")
+	secrets.Set("NPM_TOKEN", "npm-token", "alice", "")
+	secretStore = secrets
+	t.Cleanup(func() { secretStore = nil })
+
+	out, err = run("start", "web", "Fix the build", "--repo", filepath.Join(dir, "missing.git"))
+	if err != nil || !strings.HasPrefix(out, "Started thread ") {
+		t.Fatalf("start failed: %v\n%s", err, out)
+	}
+
+	if out, err := run("rm", "web"); err != nil || out != "Removed template web\n" {
+		t.Fatalf("rm failed: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,350 @@
+package superdev
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"superdev/cmd/superdev/client"
+
+	"github.com/spf13/cobra"
+)
+
+// newTemplatesCmd builds the `superdev templates` command group for managing
+// thread templates and starting threads from them
+func newTemplatesCmd() *cobra.Command {
+	opts := &threadsOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "templates",
+		Short: "Manage thread templates on a server and start threads from them",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return opts.validate()
+		},
+	}
+
+	addServerFlags(cmd, opts)
+	cmd.PersistentFlags().StringVar(&opts.format, "format", formatTable, "Output format: table or json")
+
+	cmd.AddCommand(
+		newTemplatesListCmd(opts),
+		newTemplatesShowCmd(opts),
+		newTemplatesSaveCmd(opts),
+		newTemplatesRemoveCmd(opts),
+		newTemplatesStartCmd(opts),
+	)
+
+	// Errors are printed once by Execute; usage only helps for bad arguments
+	for _, sub := range cmd.Commands() {
+		sub.SilenceErrors = true
+		sub.SilenceUsage = true
+	}
+
+	return cmd
+}
+
+func newTemplatesListCmd(opts *threadsOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the templates you may use",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			list, err := opts.client().ListTemplates(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("failed to list templates: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), list)
+			}
+			return writeTemplateTable(cmd.OutOrStdout(), list.Templates)
+		},
+	}
+}
+
+func newTemplatesShowCmd(opts *threadsOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "show <name>",
+		Short: "Show a template's settings",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			template, err := opts.client().GetTemplate(cmd.Context(), args[0])
+			if err != nil {
+				return fmt.Errorf("failed to get template: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), template)
+			}
+			return writeTemplate(cmd.OutOrStdout(), template)
+		},
+	}
+}
+
+func newTemplatesSaveCmd(opts *threadsOptions) *cobra.Command {
+	var (
+		file         string
+		settings     client.TemplateSettings
+		sandbox      client.SandboxPolicy
+		toolPolicy   client.ToolPolicy
+		contextPaths []string
+		guidance     []string
+		secrets      []string
+		shared       bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "save <name>",
+		Short: "Create or replace a template from a JSON file and flags",
+		Long: `Create or replace a template from a JSON file and flags.
+
+The file holds the template's settings in the same format as templates show
+--format json; flags override it. Replacing a template replaces all of its
+settings.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var saved client.TemplateSettings
+			if file != "" {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					return fmt.Errorf("failed to read template file: %w", err)
+				}
+				if err := json.Unmarshal(data, &saved); err != nil {
+					return fmt.Errorf("failed to parse template file %s: %w", file, err)
+				}
+			}
+
+			flags := cmd.Flags()
+			for _, field := range []struct {
+				flag   string
+				value  string
+				target *string
+			}{
+				{"description", settings.Description, &saved.Description},
+				{"image", settings.DockerImage, &saved.DockerImage},
+				{"repo", settings.RepositoryLink, &saved.RepositoryLink},
+				{"ref", settings.Ref, &saved.Ref},
+				{"thread-server", settings.ServerURL, &saved.ServerURL},
+				{"prompt-prefix", settings.PromptPrefix, &saved.PromptPrefix},
+			} {
+				if flags.Changed(field.flag) {
+					*field.target = field.value
+				}
+			}
+			if flags.Changed("memory") || flags.Changed("cpus") || flags.Changed("pids-limit") {
+				if saved.Sandbox == nil {
+					saved.Sandbox = &client.SandboxPolicy{}
+				}
+				if flags.Changed("memory") {
+					saved.Sandbox.Memory = sandbox.Memory
+				}
+				if flags.Changed("cpus") {
+					saved.Sandbox.CPUs = sandbox.CPUs
+				}
+				if flags.Changed("pids-limit") {
+					saved.Sandbox.PidsLimit = sandbox.PidsLimit
+				}
+			}
+
+			if flags.Changed("budget") {
+				saved.Budget = settings.Budget
+			}
+
+			if flags.Changed("allow-tool") || flags.Changed("deny-command") || flags.Changed("allow-path") || flags.Changed("on-violation") {
+				if saved.ToolPolicy == nil {
+					saved.ToolPolicy = &client.ToolPolicy{}
+				}
+				saved.ToolPolicy.AllowedTools = append(saved.ToolPolicy.AllowedTools, toolPolicy.AllowedTools...)
+				saved.ToolPolicy.DeniedCommands = append(saved.ToolPolicy.DeniedCommands, toolPolicy.DeniedCommands...)
+				saved.ToolPolicy.AllowedPaths = append(saved.ToolPolicy.AllowedPaths, toolPolicy.AllowedPaths...)
+				if flags.Changed("on-violation") {
+					saved.ToolPolicy.OnViolation = toolPolicy.OnViolation
+				}
+			}
+
+			for _, path := range contextPaths {
+				content, err := os.ReadFile(path)
+				if err != nil {
+					return fmt.Errorf("failed to read context file: %w", err)
+				}
+				saved.ContextFiles = append(saved.ContextFiles, content)
+			}
+			for _, path := range guidance {
+				content, err := os.ReadFile(path)
+				if err != nil {
+					return fmt.Errorf("failed to read guidance file: %w", err)
+				}
+				if saved.Guidance == nil {
+					saved.Guidance = make(map[string][]byte)
+				}
+				saved.Guidance[filepath.Base(path)] = content
+			}
+			for _, secret := range secrets {
+				name, mount, _ := strings.Cut(secret, ":")
+				saved.Secrets = append(saved.Secrets, client.SecretRef{Name: name, Mount: mount})
+			}
+			if shared {
+				if opts.team == "" {
+					return fmt.Errorf("--shared needs a team; set --team or $SUPERDEV_TEAM")
+				}
+				saved.Team = opts.team
+			}
+
+			template, err := opts.client().StoreTemplate(cmd.Context(), args[0], saved)
+			if err != nil {
+				return fmt.Errorf("failed to save template: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), template)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Saved template %s\n", template.Name)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&file, "file", "f", "", "JSON file with the template's settings")
+	cmd.Flags().StringVar(&settings.Description, "description", "", "What the template is for")
+	cmd.Flags().StringVar(&settings.DockerImage, "image", "", "Worker image; without one the repository's devcontainer.json is used")
+	cmd.Flags().StringVar(&settings.RepositoryLink, "repo", "", "Repository to clone")
+	cmd.Flags().StringVar(&settings.Ref, "ref", "", "Branch, tag or commit to check out instead of main")
+	cmd.Flags().StringVar(&settings.ServerURL, "thread-server", "", "Server URL the worker reports to")
+	cmd.Flags().StringVar(&settings.PromptPrefix, "prompt-prefix", "", "Text prepended to the first prompt of every thread")
+	cmd.Flags().StringArrayVar(&contextPaths, "context", nil, "Context file for /workdir/context (repeatable)")
+	cmd.Flags().StringArrayVar(&guidance, "guidance", nil, "Guidance file for /workdir/guidance, stored under its base name (repeatable)")
+	cmd.Flags().StringArrayVar(&secrets, "secret", nil, "Secret to inject as NAME or NAME:file (repeatable)")
+	cmd.Flags().StringVar(&sandbox.Memory, "memory", "", "Container memory limit such as 4g")
+	cmd.Flags().StringVar(&sandbox.CPUs, "cpus", "", "Container CPU limit such as 2")
+	cmd.Flags().IntVar(&sandbox.PidsLimit, "pids-limit", 0, "Maximum number of processes in the container")
+	cmd.Flags().StringArrayVar(&toolPolicy.AllowedTools, "allow-tool", nil, "Tool the agent may use; any if none are given (repeatable)")
+	cmd.Flags().StringArrayVar(&toolPolicy.DeniedCommands, "deny-command", nil, "Regular expression for shell commands the agent may not run (repeatable)")
+	cmd.Flags().StringArrayVar(&toolPolicy.AllowedPaths, "allow-path", nil, "File or directory, relative to the repository, tools may touch (repeatable)")
+	cmd.Flags().StringVar(&toolPolicy.OnViolation, "on-violation", "", "What to do with tool uses that break the policy: reject or escalate")
+	cmd.Flags().Float64Var(&settings.Budget, "budget", 0, "US dollars each thread may spend on inference (0 for no limit)")
+	cmd.Flags().BoolVar(&shared, "shared", false, "Share the template with your team")
+
+	return cmd
+}
+
+func newTemplatesRemoveCmd(opts *threadsOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:     "rm <name>",
+		Aliases: []string{"remove"},
+		Short:   "Remove a template you own",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := opts.client().DeleteTemplate(cmd.Context(), args[0]); err != nil {
+				return fmt.Errorf("failed to remove template: %w", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed template %s\n", args[0])
+			return nil
+		},
+	}
+}
+
+func newTemplatesStartCmd(opts *threadsOptions) *cobra.Command {
+	var req client.StartThreadRequest
+
+	cmd := &cobra.Command{
+		Use:   "start <name> [prompt]",
+		Short: "Start a thread from a template, overriding its settings with flags",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req.Template = args[0]
+			if len(args) > 1 {
+				req.Prompt = args[1]
+			}
+			req.Team = opts.team
+
+			resp, err := opts.client().StartThread(cmd.Context(), req)
+			if err != nil {
+				return fmt.Errorf("failed to start thread: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), resp)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Started thread %s from template %s\n", resp.ThreadID, req.Template)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&req.DockerImage, "image", "", "Override the template's worker image")
+	cmd.Flags().StringVar(&req.RepositoryLink, "repo", "", "Override the template's repository")
+	cmd.Flags().StringVar(&req.Ref, "ref", "", "Override the template's ref")
+	cmd.Flags().StringVar(&req.Title, "title", "", "Thread title; defaults to the first line of the prompt")
+
+	return cmd
+}
+
+// writeTemplateTable prints templates as aligned columns
+func writeTemplateTable(w io.Writer, templates []client.Template) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tREPOSITORY\tREF\tIMAGE\tOWNER\tTEAM\tUPDATED")
+	for _, template := range templates {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			template.Name,
+			template.RepositoryLink,
+			template.Ref,
+			template.DockerImage,
+			template.Owner,
+			template.Team,
+			template.UpdatedAt.Local().Format(time.DateTime),
+		)
+	}
+	return tw.Flush()
+}
+
+// writeTemplate prints a template's settings
+func writeTemplate(w io.Writer, template *client.Template) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fields := []struct{ name, value string }{
+		{"Name", template.Name},
+		{"Description", template.Description},
+		{"Repository", template.RepositoryLink},
+		{"Ref", template.Ref},
+		{"Image", template.DockerImage},
+		{"Server URL", template.ServerURL},
+		{"Prompt prefix", truncate(template.PromptPrefix, maxTitleColumn)},
+		{"Owner", template.Owner},
+		{"Team", template.Team},
+		{"Created", template.CreatedAt.Local().Format(time.DateTime)},
+		{"Updated", template.UpdatedAt.Local().Format(time.DateTime)},
+	}
+	if n := len(template.ContextFiles); n > 0 {
+		fields = append(fields, struct{ name, value string }{"Context files", fmt.Sprint(n)})
+	}
+	if len(template.Guidance) > 0 {
+		fields = append(fields, struct{ name, value string }{"Guidance", strings.Join(sortedKeys(template.Guidance), ", ")})
+	}
+	if len(template.Secrets) > 0 {
+		var names []string
+		for _, secret := range template.Secrets {
+			names = append(names, secret.Name)
+		}
+		sort.Strings(names)
+		fields = append(fields, struct{ name, value string }{"Secrets", strings.Join(names, ", ")})
+	}
+	if sandbox := template.Sandbox; sandbox != nil {
+		var limits []string
+		for _, arg := range sandboxArgs(sandbox) {
+			limits = append(limits, strings.TrimPrefix(arg, "--"))
+		}
+		fields = append(fields, struct{ name, value string }{"Sandbox", strings.Join(limits, " ")})
+	}
+	if template.Budget > 0 {
+		fields = append(fields, struct{ name, value string }{"Budget", fmt.Sprintf("$%.2f per thread", template.Budget)})
+	}
+	for _, field := range fields {
+		if field.value != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", field.name, field.value)
+		}
+	}
+	return tw.Flush()
+}
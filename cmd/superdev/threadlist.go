@@ -0,0 +1,289 @@
+package superdev
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+// Keys thread listings can be sorted by. Prefix with "-" for descending order.
+const (
+	SortCreated  = "created"
+	SortUpdated  = "updated"
+	SortTitle    = "title"
+	SortMessages = "messages"
+)
+
+// Page sizes for /v1/threads
+const (
+	defaultThreadPageSize = 50
+	maxThreadPageSize     = 500
+)
+
+// ThreadQuery filters, sorts and pages a thread listing
+type ThreadQuery struct {
+	Owner         string
+	Team          string
+	Status        string
+	Repository    string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Search        string // terms that must all appear in the title or the messages
+	Sort          string // one of the Sort keys, "created" if empty
+	Limit         int    // zero for no limit
+	Cursor        string // next_cursor of the previous page
+}
+
+// threadCursor records the sort position of the last thread on a page
+type threadCursor struct {
+	Sort      string    `json:"s"`
+	ThreadID  string    `json:"id"`
+	CreatedAt time.Time `json:"c"`
+	UpdatedAt time.Time `json:"u"`
+	Title     string    `json:"t,omitempty"`
+	Messages  int       `json:"m,omitempty"`
+}
+
+func encodeThreadCursor(sortKey string, summary client.ThreadSummary) string {
+	data, _ := json.Marshal(threadCursor{
+		Sort:      sortKey,
+		ThreadID:  summary.ThreadID,
+		CreatedAt: summary.CreatedAt,
+		UpdatedAt: summary.UpdatedAt,
+		Title:     summary.Title,
+		Messages:  summary.Messages,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeThreadCursor(cursor string) (*threadCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var decoded threadCursor
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	return &decoded, nil
+}
+
+// threadLess returns the ordering for a sort key. Ties are broken by thread ID so
+// the order, and therefore the cursors, are stable.
+func threadLess(sortKey string) (func(a, b client.ThreadSummary) bool, bool) {
+	descending := strings.HasPrefix(sortKey, "-")
+
+	var compare func(a, b client.ThreadSummary) int
+	switch strings.TrimPrefix(sortKey, "-") {
+	case SortCreated:
+		compare = func(a, b client.ThreadSummary) int { return a.CreatedAt.Compare(b.CreatedAt) }
+	case SortUpdated:
+		compare = func(a, b client.ThreadSummary) int { return a.UpdatedAt.Compare(b.UpdatedAt) }
+	case SortTitle:
+		compare = func(a, b client.ThreadSummary) int {
+			return strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+		}
+	case SortMessages:
+		compare = func(a, b client.ThreadSummary) int { return a.Messages - b.Messages }
+	default:
+		return nil, false
+	}
+
+	return func(a, b client.ThreadSummary) bool {
+		c := compare(a, b)
+		if c == 0 {
+			c = strings.Compare(a.ThreadID, b.ThreadID)
+		}
+		if descending {
+			return c > 0
+		}
+		return c < 0
+	}, true
+}
+
+// threadMatches reports whether every search term appears in the thread's title or messages
+func threadMatches(info *ThreadInfo, messages []*client.ThreadMessage, terms []string) bool {
+	for _, term := range terms {
+		found := strings.Contains(strings.ToLower(info.Title), term)
+		for _, msg := range messages {
+			if found {
+				break
+			}
+			found = strings.Contains(strings.ToLower(msg.Output), term)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// summarizeThread builds the listing entry for a thread
+func summarizeThread(info *ThreadInfo, messages []*client.ThreadMessage) client.ThreadSummary {
+	summary := client.ThreadSummary{
+		ThreadID:         info.ID,
+		Title:            info.Title,
+		Repository:       info.Repository,
+		Image:            info.Image,
+		Status:           info.Status,
+		QueuePosition:    threadScheduler.Position(info.ID),
+		Owner:            info.Owner,
+		Team:             info.Team,
+		PendingApprovals: pendingApprovals(info),
+		Usage:            threadUsage(info, time.Time{}),
+		Messages:         len(messages),
+		CreatedAt:        info.CreatedAt,
+		UpdatedAt:        info.CreatedAt,
+	}
+
+	for _, msg := range messages {
+		if msg.Direction == client.DirectionInput {
+			summary.InputCount++
+		} else {
+			summary.OutputCount++
+		}
+		if msg.CreatedAt.After(summary.UpdatedAt) {
+			summary.UpdatedAt = msg.CreatedAt
+		}
+	}
+
+	return summary
+}
+
+// listThreads returns a page of the threads visible to the caller that match the query
+func listThreads(caller Caller, query ThreadQuery) (*client.ThreadList, *apiError) {
+	sortKey := query.Sort
+	if sortKey == "" {
+		sortKey = SortCreated
+	}
+	less, ok := threadLess(sortKey)
+	if !ok {
+		return nil, newAPIError(http.StatusBadRequest, "sort must be one of created, updated, title or messages, optionally prefixed with -")
+	}
+
+	var after *threadCursor
+	if query.Cursor != "" {
+		cursor, err := decodeThreadCursor(query.Cursor)
+		if err != nil || cursor.Sort != sortKey {
+			return nil, newAPIError(http.StatusBadRequest, "Invalid cursor for this sort order")
+		}
+		after = cursor
+	}
+
+	terms := strings.Fields(strings.ToLower(query.Search))
+
+	outputMutex.Lock()
+	summaries := make([]client.ThreadSummary, 0, len(threads))
+	for id, messages := range threads {
+		info, exists := threadInfos[id]
+		if !exists || info.RoleFor(caller, "") == RoleNone {
+			continue
+		}
+		if query.Owner != "" && info.Owner != query.Owner {
+			continue
+		}
+		if query.Team != "" && info.Team != query.Team {
+			continue
+		}
+		if query.Status != "" && info.Status != query.Status {
+			continue
+		}
+		if query.Repository != "" && !strings.Contains(info.Repository, query.Repository) {
+			continue
+		}
+		if !query.CreatedAfter.IsZero() && info.CreatedAt.Before(query.CreatedAfter) {
+			continue
+		}
+		if !query.CreatedBefore.IsZero() && !info.CreatedAt.Before(query.CreatedBefore) {
+			continue
+		}
+		if !threadMatches(info, messages, terms) {
+			continue
+		}
+
+		summaries = append(summaries, summarizeThread(info, messages))
+	}
+	outputMutex.Unlock()
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return less(summaries[i], summaries[j])
+	})
+
+	list := &client.ThreadList{Total: len(summaries)}
+
+	// Skip everything up to and including the last thread of the previous page
+	start := 0
+	if after != nil {
+		position := client.ThreadSummary{
+			ThreadID:  after.ThreadID,
+			CreatedAt: after.CreatedAt,
+			UpdatedAt: after.UpdatedAt,
+			Title:     after.Title,
+			Messages:  after.Messages,
+		}
+		start = sort.Search(len(summaries), func(i int) bool {
+			return less(position, summaries[i])
+		})
+	}
+
+	end := len(summaries)
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+		list.NextCursor = encodeThreadCursor(sortKey, summaries[end-1])
+	}
+
+	list.Threads = summaries[start:end]
+	return list, nil
+}
+
+// threadQueryFromRequest reads listing filters from the query string. owner=me refers
+// to the caller; created_after and created_before take RFC 3339 times or dates.
+func threadQueryFromRequest(r *http.Request) (ThreadQuery, *apiError) {
+	values := r.URL.Query()
+	query := ThreadQuery{
+		Owner:      values.Get("owner"),
+		Team:       values.Get("team"),
+		Status:     values.Get("status"),
+		Repository: values.Get("repo"),
+		Search:     values.Get("q"),
+		Sort:       values.Get("sort"),
+		Cursor:     values.Get("cursor"),
+	}
+	if query.Owner == "me" {
+		query.Owner = callerFromRequest(r).User
+	}
+
+	var err error
+	if query.CreatedAfter, err = parseQueryTime(values.Get("created_after")); err != nil {
+		return query, newAPIError(http.StatusBadRequest, "created_after must be an RFC 3339 time or a YYYY-MM-DD date")
+	}
+	if query.CreatedBefore, err = parseQueryTime(values.Get("created_before")); err != nil {
+		return query, newAPIError(http.StatusBadRequest, "created_before must be an RFC 3339 time or a YYYY-MM-DD date")
+	}
+
+	if value := values.Get("limit"); value != "" {
+		query.Limit, err = strconv.Atoi(value)
+		if err != nil || query.Limit < 1 || query.Limit > maxThreadPageSize {
+			return query, newAPIError(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxThreadPageSize))
+		}
+	}
+
+	return query, nil
+}
+
+// parseQueryTime parses an optional RFC 3339 time or date
+func parseQueryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
@@ -0,0 +1,167 @@
+package superdev
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+// addListedThread registers a thread created at the given time with the given messages
+func addListedThread(id, title, repo, status string, created time.Time, outputs ...string) {
+	info := addTestThread(id, "alice", "core")
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	info.Title = title
+	info.Repository = repo
+	info.Status = status
+	info.CreatedAt = created
+	threads[id][0].CreatedAt = created
+	for i, output := range outputs {
+		threads[id] = append(threads[id], &client.ThreadMessage{
+			ID:        id + "-out-" + string(rune('a'+i)),
+			Direction: client.DirectionOutput,
+			Output:    output,
+			CreatedAt: created.Add(time.Duration(i+1) * time.Minute),
+		})
+	}
+}
+
+func listedIDs(list *client.ThreadList) []string {
+	ids := make([]string, 0, len(list.Threads))
+	for _, summary := range list.Threads {
+		ids = append(ids, summary.ThreadID)
+	}
+	return ids
+}
+
+func setupListedThreads(t *testing.T) time.Time {
+	resetThreads(t)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	addListedThread("t1", "Fix login", "https://github.com/acme/web", client.ThreadStatusRunning, base, "Patched the OAuth callback")
+	addListedThread("t2", "add metrics", "https://github.com/acme/api", client.ThreadStatusFailed, base.Add(time.Hour))
+	addListedThread("t3", "Bump deps", "https://github.com/acme/web", client.ThreadStatusCancelled, base.Add(2*time.Hour), "Updated go.mod", "Ran the tests")
+	addTestThread("hidden", "mallory", "other")
+	return base
+}
+
+func TestListThreadsMetadata(t *testing.T) {
+	setupListedThreads(t)
+
+	list, apiErr := listThreads(Caller{User: "alice"}, ThreadQuery{})
+	if apiErr != nil {
+		t.Fatalf("listThreads failed: %v", apiErr)
+	}
+	if list.Total != 3 || len(list.Threads) != 3 || list.NextCursor != "" {
+		t.Fatalf("Expected all three visible threads on one page, got %+v", list)
+	}
+
+	t3 := list.Threads[2]
+	if t3.ThreadID != "t3" || t3.Title != "Bump deps" || t3.Repository != "https://github.com/acme/web" || t3.Status != client.ThreadStatusCancelled {
+		t.Fatalf("Unexpected summary %+v", t3)
+	}
+	if t3.Messages != 3 || t3.InputCount != 1 || t3.OutputCount != 2 {
+		t.Fatalf("Expected 1 input and 2 outputs, got %+v", t3)
+	}
+	if !t3.UpdatedAt.Equal(t3.CreatedAt.Add(2 * time.Minute)) {
+		t.Fatalf("Expected updated_at to be the last message time, got %v", t3.UpdatedAt)
+	}
+}
+
+func TestListThreadsFilters(t *testing.T) {
+	base := setupListedThreads(t)
+	alice := Caller{User: "alice"}
+
+	tests := []struct {
+		name  string
+		query ThreadQuery
+		want  []string
+	}{
+		{"status", ThreadQuery{Status: client.ThreadStatusFailed}, []string{"t2"}},
+		{"repo", ThreadQuery{Repository: "acme/web"}, []string{"t1", "t3"}},
+		{"created after", ThreadQuery{CreatedAfter: base.Add(time.Hour)}, []string{"t2", "t3"}},
+		{"created before", ThreadQuery{CreatedBefore: base.Add(time.Hour)}, []string{"t1"}},
+		{"search title", ThreadQuery{Search: "METRICS"}, []string{"t2"}},
+		{"search messages", ThreadQuery{Search: "oauth"}, []string{"t1"}},
+		{"search all terms", ThreadQuery{Search: "tests go.mod"}, []string{"t3"}},
+		{"search no match", ThreadQuery{Search: "oauth go.mod"}, []string{}},
+		{"sort descending", ThreadQuery{Sort: "-created"}, []string{"t3", "t2", "t1"}},
+		{"sort title", ThreadQuery{Sort: "title"}, []string{"t2", "t3", "t1"}},
+		{"sort messages", ThreadQuery{Sort: "-messages"}, []string{"t3", "t1", "t2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, apiErr := listThreads(alice, tt.query)
+			if apiErr != nil {
+				t.Fatalf("listThreads failed: %v", apiErr)
+			}
+			got := listedIDs(list)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Expected %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestListThreadsCursorPagination(t *testing.T) {
+	setupListedThreads(t)
+	alice := Caller{User: "alice"}
+
+	var pages [][]string
+	query := ThreadQuery{Sort: "-created", Limit: 2}
+	for {
+		list, apiErr := listThreads(alice, query)
+		if apiErr != nil {
+			t.Fatalf("listThreads failed: %v", apiErr)
+		}
+		if list.Total != 3 {
+			t.Fatalf("Expected a total of 3 on every page, got %d", list.Total)
+		}
+		pages = append(pages, listedIDs(list))
+		if list.NextCursor == "" {
+			break
+		}
+		query.Cursor = list.NextCursor
+	}
+
+	if len(pages) != 2 || len(pages[0]) != 2 || pages[0][0] != "t3" || len(pages[1]) != 1 || pages[1][0] != "t1" {
+		t.Fatalf("Expected pages [t3 t2] [t1], got %v", pages)
+	}
+
+	// A cursor only makes sense for the sort it was issued for
+	if _, apiErr := listThreads(alice, ThreadQuery{Sort: "title", Cursor: query.Cursor}); apiErr == nil || apiErr.Status != http.StatusBadRequest {
+		t.Fatalf("Expected a 400 for a cursor from another sort, got %v", apiErr)
+	}
+}
+
+func TestV1ListThreadsQuery(t *testing.T) {
+	setupListedThreads(t)
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	resp := doV1Request(t, server, http.MethodGet, "/v1/threads?repo=acme/web&limit=1", "", "alice")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	var list client.ThreadList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode listing: %v", err)
+	}
+	if list.Total != 2 || len(list.Threads) != 1 || list.Threads[0].ThreadID != "t3" || list.NextCursor == "" {
+		t.Fatalf("Expected the newest web thread and a cursor, got %+v", list)
+	}
+
+	for _, query := range []string{"sort=size", "limit=0", "limit=abc", "created_after=yesterday", "cursor=garbage"} {
+		expectAPIError(t, doV1Request(t, server, http.MethodGet, "/v1/threads?"+query, "", "alice"), http.StatusBadRequest, "bad_request")
+	}
+}
@@ -0,0 +1,501 @@
+package superdev
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"superdev/cmd/superdev/client"
+	"superdev/cmd/superdev/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startThread provisions a container for a new thread and records its first prompt
+func startThread(ctx context.Context, caller Caller, req client.StartThreadRequest) (string, *apiError) {
+	req, apiErr := applyTemplate(caller, req)
+	if apiErr != nil {
+		return "", apiErr
+	}
+	return createThread(ctx, caller, req, nil)
+}
+
+// createThread validates a start request, records the new thread and launches
+// it or queues it. A forked thread starts with the copied history and
+// workspace; its prompt is optional.
+func createThread(ctx context.Context, caller Caller, req client.StartThreadRequest, fork *threadFork) (string, *apiError) {
+
+	// Validate required fields; without an image the repository's devcontainer.json is used
+	if req.RepositoryLink == "" {
+		return "", newAPIError(http.StatusBadRequest, "Repository link is required")
+	}
+
+	if err := validateThreadOptions(req.Ref, req.Priority, req.Guidance, req.Sandbox, req.ToolPolicy, req.Secrets); err != nil {
+		return "", newAPIError(http.StatusBadRequest, err.Error())
+	}
+	if req.Budget < 0 {
+		return "", newAPIError(http.StatusBadRequest, "Budget must not be negative")
+	}
+
+	if req.ServerURL == "" {
+		req.ServerURL = "http://localhost:8080"
+	}
+
+	// Agents and Kubernetes only run prebuilt images; dev containers are built
+	// by this server's Docker daemon
+	if kubeBackend != nil && req.DockerImage == "" {
+		return "", newAPIError(http.StatusBadRequest, "Threads on Kubernetes need a Docker image")
+	}
+	if len(req.AgentLabels) > 0 {
+		if agentPool == nil {
+			return "", errAgentsDisabled
+		}
+		if req.DockerImage == "" {
+			return "", newAPIError(http.StatusBadRequest, "Threads placed on agents need a Docker image")
+		}
+	}
+
+	// Threads can only be shared with the caller's own team
+	if req.Team != "" && req.Team != caller.Team {
+		return "", newAPIError(http.StatusForbidden, "Cannot start a thread for another team")
+	}
+
+	if req.DockerImage != "" {
+		if apiErr := checkImageAllowed(req.DockerImage); apiErr != nil {
+			return "", apiErr
+		}
+	}
+
+	secrets, err := resolveThreadSecrets(caller, req.Secrets)
+	if err != nil {
+		return "", newAPIError(http.StatusBadRequest, err.Error())
+	}
+
+	slog.Info("received start request", "docker_image", req.DockerImage, "repository", req.RepositoryLink, "context_files", len(req.ContextFiles))
+
+	// Generate a unique thread ID
+	threadID, err := generateThreadID()
+	if err != nil {
+		return "", newAPIError(http.StatusInternalServerError, "Error generating thread ID")
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("thread_id", threadID))
+
+	// The worker token reaches the container like a secret, so it stays out of
+	// logged command lines and pod specs
+	workerToken, err := generateThreadID()
+	if err != nil {
+		return "", newAPIError(http.StatusInternalServerError, "Error generating worker token")
+	}
+	containerSecrets := append(slices.Clone(secrets), threadSecret{Name: client.EnvWorkerToken, Value: workerToken, Mount: SecretMountEnv})
+
+	// The worker fetches the workspace to restore as soon as it starts
+	if fork != nil && fork.workspace != nil {
+		if err := saveWorkspace(threadID, fork.answered-1, fork.workspace); err != nil {
+			slog.Error("failed to copy workspace snapshot", "thread_id", threadID, "forked_from", fork.parentID, "error", err)
+			return "", newAPIError(http.StatusInternalServerError, "Error copying workspace")
+		}
+	}
+
+	title := req.Title
+	if title == "" {
+		title = threadTitle(req.Prompt)
+	}
+
+	// Queued threads start in the background, outliving this request
+	queuedAt := time.Now()
+	launchCtx := context.WithoutCancel(ctx)
+	launch := func() {
+		appendThreadLog(threadID, PhaseProvision, "", fmt.Sprintf("Starting after %s in the queue", time.Since(queuedAt).Round(time.Second)))
+		launchThread(launchCtx, threadID, req, containerSecrets, caller)
+	}
+
+	// The thread is recorded while its slot is reserved so a queued start can't
+	// be launched before the thread exists
+	outputMutex.Lock()
+	if apiErr := checkUserBudget(caller.User); apiErr != nil {
+		outputMutex.Unlock()
+		return "", apiErr
+	}
+	position, apiErr := threadScheduler.Admit(threadID, caller.User, req.Priority, launch)
+	if apiErr != nil {
+		outputMutex.Unlock()
+		return "", apiErr
+	}
+
+	status := client.ThreadStatusRunning
+	if position > 0 {
+		status = client.ThreadStatusQueued
+	}
+	info := &ThreadInfo{
+		ID:          threadID,
+		Title:       redactSecrets(title),
+		Repository:  req.RepositoryLink,
+		Image:       req.DockerImage,
+		Template:    req.Template,
+		Owner:       caller.User,
+		Team:        req.Team,
+		Status:      status,
+		Secrets:     secretNames(secrets),
+		Settings:    req,
+		CreatedAt:   time.Now(),
+		WorkerToken: workerToken,
+	}
+	info.Settings.Prompt = ""
+	info.Settings.Title = ""
+	threadInfos[threadID] = info
+
+	if fork != nil {
+		info.ForkedFrom = fork.parentID
+		info.ForkedAt = fork.at
+		info.Answered = fork.answered
+		threads[threadID] = fork.messages
+	}
+	if fork == nil || req.Prompt != "" {
+		threads[threadID] = append(threads[threadID], &client.ThreadMessage{
+			ID:          time.Now().String(),
+			Direction:   client.DirectionInput,
+			Output:      redactSecrets(req.Prompt),
+			CreatedAt:   time.Now(),
+			TraceParent: tracing.TraceParent(ctx),
+		})
+	}
+	outputMutex.Unlock()
+
+	if position > 0 {
+		slog.Info("thread queued", "thread_id", threadID, "position", position)
+		appendThreadLog(threadID, PhaseProvision, "", fmt.Sprintf("Queued at position %d", position))
+		return threadID, nil
+	}
+
+	launchThread(ctx, threadID, req, containerSecrets, caller)
+	return threadID, nil
+}
+
+// launchThread provisions the container for a thread holding a scheduler slot,
+// on a host agent if one can take it, and records the outcome. The slot is
+// released if the container doesn't start.
+func launchThread(ctx context.Context, threadID string, req client.StartThreadRequest, secrets []threadSecret, caller Caller) {
+	status := client.ThreadStatusRunning
+	var (
+		agent             string
+		dockerContainerId string
+		err               error
+	)
+	image := req.DockerImage
+	if agentPool != nil && req.DockerImage != "" {
+		agent, dockerContainerId, err = agentPool.Start(ctx, threadID, req, secrets)
+	}
+	if agent == "" && err == nil {
+		if kubeBackend != nil {
+			dockerContainerId, err = kubeBackend.Start(ctx, threadID, req, secrets)
+		} else {
+			dockerContainerId, image, err = startDockerContainer(ctx, threadID, req, secrets, caller)
+		}
+	}
+	if err != nil {
+		status = client.ThreadStatusFailed
+		threadsFailed.Inc()
+		slog.Error("failed to start thread container", "thread_id", threadID, "error", err)
+	} else {
+		threadsStarted.Inc()
+	}
+	containerID := strings.ReplaceAll(dockerContainerId, "\n", "")
+
+	outputMutex.Lock()
+	info := threadInfos[threadID]
+	info.Image = image
+	info.Agent = agent
+	cancelled := info.Status == client.ThreadStatusCancelled
+	if !cancelled {
+		info.Status = status
+		threadContainers[threadID] = containerID
+	}
+	outputMutex.Unlock()
+
+	// A thread cancelled while it was being provisioned has nothing to stop yet
+	if cancelled && err == nil {
+		if err := stopThreadContainer(threadID, containerID); err != nil {
+			slog.Error("failed to stop container", "thread_id", threadID, "container_id", containerID, "error", err)
+		}
+	}
+	if err != nil || cancelled {
+		threadScheduler.Release(threadID)
+	}
+}
+
+// storeMessage appends a human message to a thread for its worker to pick up
+func storeMessage(r *http.Request, threadID, prompt string) (string, *apiError) {
+	if prompt == "" {
+		return "", newAPIError(http.StatusBadRequest, "Prompt is required")
+	}
+
+	if threadID == "" {
+		return "", newAPIError(http.StatusBadRequest, "ThreadId is required")
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	info, apiErr := authorizeThread(r, threadID, RoleWrite)
+	if apiErr != nil {
+		return "", apiErr
+	}
+
+	if info.Status == client.ThreadStatusCancelled {
+		return "", newAPIError(http.StatusConflict, "Thread has been cancelled")
+	}
+	if apiErr := checkThreadBudget(info); apiErr != nil {
+		return "", apiErr
+	}
+
+	// Messages for queued threads wait for the worker like any other
+	if threadContainers[threadID] == "" && info.Status != client.ThreadStatusQueued {
+		return "", newAPIError(http.StatusNotFound, "Container for threadId not found")
+	}
+
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("thread_id", threadID))
+	messageID := time.Now().String()
+	threads[threadID] = append(threads[threadID], &client.ThreadMessage{
+		ID:          messageID,
+		Direction:   client.DirectionInput,
+		Output:      redactSecrets(prompt),
+		CreatedAt:   time.Now(),
+		TraceParent: tracing.TraceParent(r.Context()),
+	})
+
+	return messageID, nil
+}
+
+// pullMessages returns the input messages of a thread stored after lastMessageID
+func pullMessages(threadID, lastMessageID string) []client.Message {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	// Messages a fork inherited were answered by the thread it forked from
+	skip := 0
+	if info := threadInfos[threadID]; info != nil {
+		skip = info.Answered
+	}
+
+	var response []client.Message
+	for i, msg := range threads[threadID] {
+		if i < skip {
+			continue
+		}
+
+		// Filter by direction
+		if msg.Direction != client.DirectionInput {
+			continue
+		}
+
+		// Filter by lastMessageID if provided
+		if lastMessageID != "" && msg.ID <= lastMessageID {
+			continue
+		}
+
+		if msg.PulledAt.IsZero() {
+			msg.PulledAt = time.Now()
+			messagePullLatency.Observe(msg.PulledAt.Sub(msg.CreatedAt).Seconds())
+			messagesPulled.Inc()
+		}
+
+		response = append(response, client.Message{
+			ID:          msg.ID,
+			Content:     msg.Output,
+			TraceParent: msg.TraceParent,
+			Workspace:   msg.Restore,
+		})
+	}
+
+	return response
+}
+
+// answerMessage records a worker's output for a thread
+func answerMessage(threadID string, req client.AnswerMessageRequest) (string, *apiError) {
+	if req.Payload == "" {
+		return "", newAPIError(http.StatusBadRequest, "Payload is required")
+	}
+
+	if threadID == "" {
+		return "", newAPIError(http.StatusBadRequest, "ThreadId is required")
+	}
+
+	// The base ends up on git command lines, so it must be a plain object ID
+	if req.Workspace != nil && !objectIDPattern.MatchString(req.Workspace.Base) {
+		return "", newAPIError(http.StatusBadRequest, "Workspace base must be a full commit ID")
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	if threads[threadID] == nil {
+		return "", newAPIError(http.StatusNotFound, "Thread history for threadId not found")
+	}
+
+	messagesAnswered.Inc()
+	recordDeltas(req.Deltas)
+	if info := threadInfos[threadID]; info != nil {
+		recordUsage(info, req.Deltas)
+	}
+
+	messageID := time.Now().String()
+	threads[threadID] = append(threads[threadID], &client.ThreadMessage{
+		ID:        messageID,
+		Direction: client.DirectionOutput,
+		Output:    redactSecrets(req.Payload),
+		CreatedAt: time.Now(),
+	})
+
+	// A failed snapshot only means the workspace can't be restored to this answer
+	if req.Workspace != nil {
+		answer := threads[threadID][len(threads[threadID])-1]
+		if err := saveWorkspace(threadID, len(threads[threadID])-1, req.Workspace); err != nil {
+			slog.Error("failed to save workspace snapshot", "thread_id", threadID, "message_id", messageID, "error", err)
+		} else {
+			answer.Snapshot = true
+		}
+	}
+
+	return messageID, nil
+}
+
+// threadMessages returns a copy of a thread's messages if the caller may read it
+func threadMessages(r *http.Request, threadID string) ([]*client.ThreadMessage, *apiError) {
+	if threadID == "" {
+		return nil, newAPIError(http.StatusBadRequest, "Missing thread_id parameter")
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	if _, apiErr := authorizeThread(r, threadID, RoleRead); apiErr != nil {
+		return nil, apiErr
+	}
+
+	messages, exists := threads[threadID]
+	if !exists {
+		// Thread ID not found or processing not completed yet
+		return nil, newAPIError(http.StatusNotFound, "Output not found for thread ID")
+	}
+
+	return append([]*client.ThreadMessage(nil), messages...), nil
+}
+
+// maxTitleLength caps titles derived from a thread's first prompt
+const maxTitleLength = 80
+
+// threadTitle derives a title from the first line of a prompt
+func threadTitle(prompt string) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(prompt), "\n")
+	title = strings.TrimSpace(title)
+	if len(title) > maxTitleLength {
+		title = strings.TrimSpace(title[:maxTitleLength]) + "..."
+	}
+	return title
+}
+
+// getThread returns a thread's metadata and up to limit messages following the
+// message with ID after. A limit of zero returns every remaining message.
+func getThread(r *http.Request, threadID, after string, limit int) (*client.Thread, *apiError) {
+	if limit < 0 {
+		return nil, newAPIError(http.StatusBadRequest, "limit must be a non-negative integer")
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	info, apiErr := authorizeThread(r, threadID, RoleRead)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	messages := threads[threadID]
+	start := 0
+	if after != "" {
+		start = -1
+		for i, msg := range messages {
+			if msg.ID == after {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			return nil, newAPIError(http.StatusBadRequest, "No message with ID "+after+" in thread")
+		}
+	}
+
+	end := len(messages)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+
+	return &client.Thread{
+		ThreadID:         threadID,
+		Title:            info.Title,
+		Repository:       info.Repository,
+		Image:            info.Image,
+		Template:         info.Template,
+		Status:           info.Status,
+		QueuePosition:    threadScheduler.Position(threadID),
+		Owner:            info.Owner,
+		Team:             info.Team,
+		ContainerID:      threadContainers[threadID],
+		Agent:            info.Agent,
+		ForkedFrom:       info.ForkedFrom,
+		ForkedAt:         info.ForkedAt,
+		PendingApprovals: pendingApprovals(info),
+		Usage:            threadUsage(info, time.Time{}),
+		CreatedAt:        info.CreatedAt,
+		MessageCount:     len(messages),
+		Messages:         append([]*client.ThreadMessage{}, messages[start:end]...),
+		HasMore:          end < len(messages),
+	}, nil
+}
+
+// cancelThread stops the container running a thread
+func cancelThread(r *http.Request, threadID string) *apiError {
+	if threadID == "" {
+		return newAPIError(http.StatusBadRequest, "ThreadId is required")
+	}
+
+	outputMutex.Lock()
+	info, apiErr := authorizeThread(r, threadID, RoleWrite)
+	if apiErr != nil {
+		outputMutex.Unlock()
+		return apiErr
+	}
+	containerID := threadContainers[threadID]
+	if info.Status != client.ThreadStatusCancelled {
+		threadsCancelled.Inc()
+	}
+	info.Status = client.ThreadStatusCancelled
+	delete(threadContainers, threadID)
+	outputMutex.Unlock()
+
+	threadScheduler.Release(threadID)
+
+	if containerID != "" {
+		if err := stopThreadContainer(threadID, containerID); err != nil {
+			slog.Error("failed to stop container", "thread_id", threadID, "container_id", containerID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// stopThreadContainer stops a thread's container on whichever host runs it
+func stopThreadContainer(threadID, containerID string) error {
+	if agentPool != nil && agentPool.Stop(threadID, containerID) {
+		return nil
+	}
+	if kubeBackend != nil && kubeBackend.Stop(threadID) {
+		return nil
+	}
+	return stopDockerContainer(containerID)
+}
@@ -0,0 +1,546 @@
+package superdev
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"superdev/cmd/superdev/client"
+
+	"github.com/spf13/cobra"
+)
+
+// Output formats for the threads commands
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// maxTitleColumn is how much of a title the list table shows
+const maxTitleColumn = 40
+
+// threadsOptions holds the flags shared by the threads subcommands
+type threadsOptions struct {
+	server string
+	user   string
+	team   string
+	format string
+}
+
+func (o *threadsOptions) client() *client.Client {
+	return client.New(o.server, client.WithCaller(o.user, o.team))
+}
+
+func (o *threadsOptions) validate() error {
+	if o.format != formatTable && o.format != formatJSON {
+		return fmt.Errorf("--format must be %s or %s", formatTable, formatJSON)
+	}
+	return nil
+}
+
+// addServerFlags adds the flags selecting the server and the caller to act as
+func addServerFlags(cmd *cobra.Command, opts *threadsOptions) {
+	server := os.Getenv("SUPERDEV_SERVER")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+	cmd.PersistentFlags().StringVar(&opts.server, "server", server, "Server URL (defaults to $SUPERDEV_SERVER)")
+	cmd.PersistentFlags().StringVar(&opts.user, "user", os.Getenv("SUPERDEV_USER"), "User to act as (defaults to $SUPERDEV_USER)")
+	cmd.PersistentFlags().StringVar(&opts.team, "team", os.Getenv("SUPERDEV_TEAM"), "Team to act as (defaults to $SUPERDEV_TEAM)")
+}
+
+// newThreadsCmd builds the `superdev threads` command group for working with
+// threads on a server
+func newThreadsCmd() *cobra.Command {
+	opts := &threadsOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "threads",
+		Short: "List, inspect and converse with threads on a server",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return opts.validate()
+		},
+	}
+
+	addServerFlags(cmd, opts)
+	cmd.PersistentFlags().StringVar(&opts.format, "format", formatTable, "Output format: table or json")
+
+	cmd.AddCommand(
+		newThreadsListCmd(opts),
+		newThreadsShowCmd(opts),
+		newThreadsSendCmd(opts),
+		newThreadsTailCmd(opts),
+		newThreadsForkCmd(opts),
+		newThreadsSnapshotsCmd(opts),
+		newThreadsDiffCmd(opts),
+		newThreadsRestoreCmd(opts),
+		newThreadsApprovalsCmd(opts),
+		newThreadsDecisionCmd(opts, "approve", "Let a thread's agent run a tool it asked about", true),
+		newThreadsDecisionCmd(opts, "reject", "Stop a thread's agent from running a tool it asked about", false),
+		newThreadsCancelCmd(opts),
+	)
+
+	// Errors are printed once by Execute; usage only helps for bad arguments
+	for _, sub := range cmd.Commands() {
+		sub.SilenceErrors = true
+		sub.SilenceUsage = true
+	}
+
+	return cmd
+}
+
+func newThreadsListCmd(opts *threadsOptions) *cobra.Command {
+	var list client.ListThreadsOptions
+	var all bool
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List threads visible to you",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c := opts.client()
+			result := &client.ThreadList{}
+			for {
+				page, err := c.ListThreads(cmd.Context(), list)
+				if err != nil {
+					return fmt.Errorf("failed to list threads: %w", err)
+				}
+				result.Threads = append(result.Threads, page.Threads...)
+				result.Total = page.Total
+				result.NextCursor = page.NextCursor
+				if !all || page.NextCursor == "" {
+					break
+				}
+				list.Cursor = page.NextCursor
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), result)
+			}
+			return writeThreadTable(cmd.OutOrStdout(), result)
+		},
+	}
+
+	cmd.Flags().StringVar(&list.Owner, "owner", "", "Only threads owned by this user, \"me\" for yourself")
+	cmd.Flags().StringVar(&list.Status, "status", "", "Only threads with this status: running, failed or cancelled")
+	cmd.Flags().StringVar(&list.Repository, "repo", "", "Only threads whose repository link contains this string")
+	cmd.Flags().StringVarP(&list.Query, "query", "q", "", "Only threads whose title or messages contain all of these words")
+	cmd.Flags().StringVar(&list.Sort, "sort", "", "Sort by created, updated, title or messages; prefix with - for descending")
+	cmd.Flags().IntVar(&list.Limit, "limit", 0, "Threads per page (server default if unset)")
+	cmd.Flags().StringVar(&list.Cursor, "cursor", "", "Cursor printed by a previous page")
+	cmd.Flags().BoolVar(&all, "all", false, "Fetch every page")
+
+	return cmd
+}
+
+func newThreadsShowCmd(opts *threadsOptions) *cobra.Command {
+	var get client.GetThreadOptions
+
+	cmd := &cobra.Command{
+		Use:   "show <thread>",
+		Short: "Show a thread's metadata and messages",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			thread, err := opts.client().GetThread(cmd.Context(), args[0], get)
+			if err != nil {
+				return fmt.Errorf("failed to get thread: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), thread)
+			}
+			return writeThread(cmd.OutOrStdout(), thread)
+		},
+	}
+
+	cmd.Flags().StringVar(&get.After, "after", "", "Only show messages after this message ID")
+	cmd.Flags().IntVar(&get.Limit, "limit", 0, "Maximum number of messages to show")
+
+	return cmd
+}
+
+func newThreadsSendCmd(opts *threadsOptions) *cobra.Command {
+	var prompt string
+
+	cmd := &cobra.Command{
+		Use:   "send <thread>",
+		Short: "Send a follow-up prompt to a thread",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if prompt == "" {
+				return fmt.Errorf("--prompt is required")
+			}
+
+			resp, err := opts.client().SendMessage(cmd.Context(), args[0], prompt)
+			if err != nil {
+				return fmt.Errorf("failed to send message: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), resp)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Sent message %s to thread %s\n", resp.MessageID, args[0])
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&prompt, "prompt", "", "The prompt to send (required)")
+
+	return cmd
+}
+
+func newThreadsTailCmd(opts *threadsOptions) *cobra.Command {
+	var after string
+	var interval time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "tail <thread>",
+		Short: "Print a thread's messages as they arrive until interrupted",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer stop()
+
+			out := cmd.OutOrStdout()
+			encoder := json.NewEncoder(out)
+			err := opts.client().WatchThread(ctx, args[0], after, interval, func(message *client.ThreadMessage) error {
+				// JSON output is one message per line so it can be piped
+				if opts.format == formatJSON {
+					return encoder.Encode(message)
+				}
+				writeThreadMessage(out, message)
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to follow thread: %w", err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&after, "after", "", "Start after this message ID instead of the beginning of the thread")
+	cmd.Flags().DurationVar(&interval, "interval", client.DefaultPollInterval, "How often to poll for new messages")
+
+	return cmd
+}
+
+func newThreadsForkCmd(opts *threadsOptions) *cobra.Command {
+	var at string
+	var fork client.ForkThreadRequest
+
+	cmd := &cobra.Command{
+		Use:   "fork <thread>",
+		Short: "Start a new thread from a thread's history and workspace",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resp, err := opts.client().ForkThread(cmd.Context(), args[0], at, fork)
+			if err != nil {
+				return fmt.Errorf("failed to fork thread: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), resp)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Forked thread %s into %s\n", args[0], resp.ThreadID)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&at, "at", "", "Last message ID to keep (defaults to the latest message)")
+	cmd.Flags().StringVar(&fork.Prompt, "prompt", "", "First prompt of the fork")
+	cmd.Flags().StringVar(&fork.Title, "title", "", "Title of the fork (defaults to the thread's)")
+
+	return cmd
+}
+
+func newThreadsSnapshotsCmd(opts *threadsOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "snapshots <thread>",
+		Short: "List the workspace snapshots taken after each turn",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			list, err := opts.client().ListSnapshots(cmd.Context(), args[0])
+			if err != nil {
+				return fmt.Errorf("failed to list snapshots: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), list)
+			}
+			return writeSnapshotTable(cmd.OutOrStdout(), list)
+		},
+	}
+}
+
+func newThreadsDiffCmd(opts *threadsOptions) *cobra.Command {
+	var from, to string
+
+	cmd := &cobra.Command{
+		Use:   "diff <thread>",
+		Short: "Show how the workspace changed between two turns",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			diff, err := opts.client().DiffSnapshots(cmd.Context(), args[0], from, to)
+			if err != nil {
+				return fmt.Errorf("failed to diff snapshots: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), diff)
+			}
+			_, err = io.WriteString(cmd.OutOrStdout(), diff.Diff)
+			return err
+		},
+	}
+
+	cmd.Flags().StringVar(&from, "from", "", "Message ID of the earlier snapshot (defaults to the commit the thread started from)")
+	cmd.Flags().StringVar(&to, "to", "", "Message ID of the later snapshot (defaults to the latest)")
+
+	return cmd
+}
+
+func newThreadsRestoreCmd(opts *threadsOptions) *cobra.Command {
+	var at string
+
+	cmd := &cobra.Command{
+		Use:   "restore <thread>",
+		Short: "Restore a thread's workspace to a snapshot",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if at == "" {
+				return fmt.Errorf("--at is required")
+			}
+
+			resp, err := opts.client().RestoreSnapshot(cmd.Context(), args[0], at)
+			if err != nil {
+				return fmt.Errorf("failed to restore snapshot: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), resp)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Queued restore %s for thread %s\n", resp.MessageID, args[0])
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&at, "at", "", "Message ID of the snapshot to restore (required)")
+
+	return cmd
+}
+
+func newThreadsApprovalsCmd(opts *threadsOptions) *cobra.Command {
+	var all bool
+
+	cmd := &cobra.Command{
+		Use:   "approvals <thread>",
+		Short: "List the tool runs a thread's agent is waiting for a human to approve",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			status := client.ApprovalPending
+			if all {
+				status = ""
+			}
+			list, err := opts.client().ListApprovals(cmd.Context(), args[0], status)
+			if err != nil {
+				return fmt.Errorf("failed to list approvals: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), list)
+			}
+			return writeApprovalTable(cmd.OutOrStdout(), list)
+		},
+	}
+
+	cmd.Flags().BoolVar(&all, "all", false, "Include approvals that have been decided")
+
+	return cmd
+}
+
+// newThreadsDecisionCmd builds the approve and reject commands, which differ
+// only in the decision they send
+func newThreadsDecisionCmd(opts *threadsOptions, use, short string, approved bool) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " <thread> <approval>",
+		Short: short,
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			approval, err := opts.client().DecideApproval(cmd.Context(), args[0], args[1], approved)
+			if err != nil {
+				return fmt.Errorf("failed to %s tool run: %w", use, err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), approval)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Approval %s (%s) is %s\n", approval.ID, approval.Tool, approval.Status)
+			return nil
+		},
+	}
+}
+
+func newThreadsCancelCmd(opts *threadsOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "cancel <thread>",
+		Short: "Stop a thread's container",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resp, err := opts.client().CancelThread(cmd.Context(), args[0])
+			if err != nil {
+				return fmt.Errorf("failed to cancel thread: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), resp)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Thread %s is %s\n", resp.ThreadID, resp.Status)
+			return nil
+		},
+	}
+}
+
+func writeIndentedJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeThreadTable prints thread summaries as aligned columns
+func writeThreadTable(w io.Writer, list *client.ThreadList) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTITLE\tSTATUS\tOWNER\tREPOSITORY\tMESSAGES\tCOST\tUPDATED")
+	for _, summary := range list.Threads {
+		cost := 0.0
+		if summary.Usage != nil {
+			cost = summary.Usage.Cost
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t$%.2f\t%s\n",
+			summary.ThreadID,
+			truncate(summary.Title, maxTitleColumn),
+			summary.Status,
+			summary.Owner,
+			summary.Repository,
+			summary.Messages,
+			cost,
+			summary.UpdatedAt.Local().Format(time.DateTime),
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if list.NextCursor != "" {
+		fmt.Fprintf(w, "\nShowing %d of %d threads. Next page: --cursor %s\n", len(list.Threads), list.Total, list.NextCursor)
+	}
+	return nil
+}
+
+// writeSnapshotTable prints workspace snapshots as aligned columns
+func writeSnapshotTable(w io.Writer, list *client.SnapshotList) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MESSAGE\tCREATED\tFILES\tSIZE")
+	for _, snapshot := range list.Snapshots {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n",
+			snapshot.MessageID,
+			snapshot.CreatedAt.Local().Format(time.DateTime),
+			len(snapshot.Files),
+			snapshot.Size,
+		)
+	}
+	return tw.Flush()
+}
+
+// writeApprovalTable prints tool approvals as aligned columns
+func writeApprovalTable(w io.Writer, list *client.ApprovalList) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTOOL\tSTATUS\tREQUESTED\tDECIDED BY\tINPUT\tREASON")
+	for _, approval := range list.Approvals {
+		input, _ := json.Marshal(approval.Input)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			approval.ID,
+			approval.Tool,
+			approval.Status,
+			approval.CreatedAt.Local().Format(time.DateTime),
+			approval.DecidedBy,
+			truncate(string(input), maxTitleColumn),
+			approval.Reason,
+		)
+	}
+	return tw.Flush()
+}
+
+// writeThread prints a thread's metadata followed by its messages
+func writeThread(w io.Writer, thread *client.Thread) error {
+	status := thread.Status
+	if thread.QueuePosition > 0 {
+		status = fmt.Sprintf("%s (position %d)", status, thread.QueuePosition)
+	}
+	if thread.PendingApprovals > 0 {
+		status = fmt.Sprintf("%s (%d awaiting approval)", status, thread.PendingApprovals)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fields := []struct{ name, value string }{
+		{"Thread", thread.ThreadID},
+		{"Title", thread.Title},
+		{"Status", status},
+		{"Owner", thread.Owner},
+		{"Team", thread.Team},
+		{"Repository", thread.Repository},
+		{"Image", thread.Image},
+		{"Agent", thread.Agent},
+		{"Forked from", forkedFrom(thread)},
+		{"Created", thread.CreatedAt.Local().Format(time.DateTime)},
+		{"Messages", fmt.Sprint(thread.MessageCount)},
+		{"Usage", formatUsage(thread.Usage)},
+	}
+	for _, field := range fields {
+		if field.value != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", field.name, field.value)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, message := range thread.Messages {
+		writeThreadMessage(w, message)
+	}
+	if thread.HasMore {
+		fmt.Fprintln(w, "\n(more messages follow; use --after to page)")
+	}
+	return nil
+}
+
+// forkedFrom describes the thread and message a thread was forked at, if any
+func forkedFrom(thread *client.Thread) string {
+	if thread.ForkedFrom == "" {
+		return ""
+	}
+	if thread.ForkedAt == "" {
+		return thread.ForkedFrom
+	}
+	return fmt.Sprintf("%s at #%s", thread.ForkedFrom, thread.ForkedAt)
+}
+
+// writeThreadMessage prints a message under a header naming its direction and time
+func writeThreadMessage(w io.Writer, message *client.ThreadMessage) {
+	fmt.Fprintf(w, "\n--- %s #%s  %s\n", message.Direction, message.ID, message.CreatedAt.Local().Format(time.DateTime))
+	if message.Error != "" {
+		fmt.Fprintf(w, "error: %s\n", message.Error)
+	}
+	fmt.Fprintln(w, strings.TrimRight(message.Output, "\n"))
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max-3] + "..."
+}
@@ -0,0 +1,120 @@
+package superdev
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"superdev/cmd/superdev/client"
+)
+
+// runThreadsCmd runs `superdev threads <args>` as alice against server and returns its output
+func runThreadsCmd(t *testing.T, server *httptest.Server, args ...string) (string, error) {
+	t.Helper()
+	cmd := newThreadsCmd()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs(append(args, "--server", server.URL, "--user", "alice"))
+	err := cmd.ExecuteContext(context.Background())
+	return out.String(), err
+}
+
+func TestThreadsListCommand(t *testing.T) {
+	setupListedThreads(t)
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	out, err := runThreadsCmd(t, server, "list", "--repo", "acme/web")
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ID") || !strings.HasPrefix(lines[1], "t3") || !strings.Contains(lines[2], "Fix login") {
+		t.Fatalf("Expected a header and the two web threads newest first, got:\n%s", out)
+	}
+
+	out, err = runThreadsCmd(t, server, "list", "--limit", "1", "--all", "--format", "json")
+	if err != nil {
+		t.Fatalf("list --all failed: %v", err)
+	}
+	var list client.ThreadList
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		t.Fatalf("Expected JSON output, got %q: %v", out, err)
+	}
+	if len(list.Threads) != 3 || list.Total != 3 || list.NextCursor != "" {
+		t.Fatalf("Expected every page to be fetched, got %+v", list)
+	}
+
+	if _, err := runThreadsCmd(t, server, "list", "--format", "yaml"); err == nil {
+		t.Fatal("Expected an unknown format to be rejected")
+	}
+}
+
+func TestThreadsShowSendCancelCommands(t *testing.T) {
+	setupListedThreads(t)
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	out, err := runThreadsCmd(t, server, "show", "t1")
+	if err != nil {
+		t.Fatalf("show failed: %v", err)
+	}
+	if !strings.Contains(out, "Title:      Fix login") || !strings.Contains(out, "Patched the OAuth callback") {
+		t.Fatalf("Expected thread metadata and messages, got:\n%s", out)
+	}
+
+	out, err = runThreadsCmd(t, server, "send", "t1", "--prompt", "Now add a test")
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if !strings.HasPrefix(out, "Sent message ") {
+		t.Fatalf("Unexpected send output %q", out)
+	}
+	if _, err := runThreadsCmd(t, server, "send", "t1"); err == nil {
+		t.Fatal("Expected send without --prompt to fail")
+	}
+
+	out, err = runThreadsCmd(t, server, "cancel", "t1", "--format", "json")
+	if err != nil {
+		t.Fatalf("cancel failed: %v", err)
+	}
+	var cancelled client.CancelResponse
+	if err := json.Unmarshal([]byte(out), &cancelled); err != nil || cancelled.Status != client.ThreadStatusCancelled {
+		t.Fatalf("Expected a cancelled status, got %q (%v)", out, err)
+	}
+
+	if _, err := runThreadsCmd(t, server, "show", "hidden"); err == nil {
+		t.Fatal("Expected showing another user's thread to fail")
+	}
+}
+
+func TestThreadsTailCommand(t *testing.T) {
+	setupListedThreads(t)
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	cmd := newThreadsCmd()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"tail", "t3", "--server", server.URL, "--user", "alice", "--format", "json", "--interval", "10ms"})
+	if err := cmd.ExecuteContext(ctx); err != nil {
+		t.Fatalf("tail failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected each of the 3 messages once, got:\n%s", out.String())
+	}
+	var last client.ThreadMessage
+	if err := json.Unmarshal([]byte(lines[2]), &last); err != nil || last.Output != "Ran the tests" {
+		t.Fatalf("Expected the last line to be the last message, got %q (%v)", lines[2], err)
+	}
+}
@@ -0,0 +1,56 @@
+package superdev
+
+import (
+	"context"
+	"net/http"
+
+	"superdev/cmd/superdev/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Server tracing flags
+var (
+	otlpEndpoint string
+	traceFile    string
+)
+
+// tracer returns the server's tracer from the current global provider
+func tracer() trace.Tracer {
+	return otel.Tracer("superdev/server")
+}
+
+// traceHandler starts a server span for each request, continuing any trace
+// context sent by the caller
+func traceHandler(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.ExtractHeaders(r.Context(), r.Header)
+		ctx, span := tracer().Start(ctx, r.Method+" "+name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", name),
+			),
+		)
+		defer span.End()
+
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// startSpan starts an internal span for a thread
+func startSpan(ctx context.Context, name, threadID string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attribute.String("thread_id", threadID)))
+}
+
+// endSpan records err on the span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
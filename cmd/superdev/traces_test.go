@@ -0,0 +1,69 @@
+package superdev
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"superdev/cmd/superdev/client"
+	"superdev/cmd/superdev/tracing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestStoreMessagePropagatesTraceToWorker(t *testing.T) {
+	resetThreads(t)
+	addTestThread("thread-1", "", "")
+
+	// Setup replaces the global tracer provider and propagator
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+
+	traceFile := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := tracing.Setup(context.Background(), "superdev-test", tracing.Config{File: traceFile})
+	if err != nil {
+		t.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/storeMessage", strings.NewReader(`{"thread_id":"thread-1","prompt":"next"}`))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	traceHandler("/storeMessage", handleStoreMessageRequest)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handlePullMessagesRequest(rec, newWorkerRequest(http.MethodGet, "/pullMessages?thread_id=thread-1&last_message_id=1", "", "thread-1"))
+	var messages []client.Message
+	if err := json.NewDecoder(rec.Body).Decode(&messages); err != nil {
+		t.Fatalf("Failed to decode messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 new message, got %d", len(messages))
+	}
+	if !strings.Contains(messages[0].TraceParent, traceID) {
+		t.Errorf("Expected pulled message to carry trace %s, got %q", traceID, messages[0].TraceParent)
+	}
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down tracing: %v", err)
+	}
+
+	data, err := os.ReadFile(traceFile)
+	if err != nil {
+		t.Fatalf("Failed to read trace file: %v", err)
+	}
+	if !strings.Contains(string(data), "POST /storeMessage") || !strings.Contains(string(data), traceID) {
+		t.Errorf("Expected exported server span in trace %s, got %s", traceID, data)
+	}
+}
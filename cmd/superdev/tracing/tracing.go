@@ -0,0 +1,119 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Environment variables used to configure tracing and carry trace context into containers
+const (
+	EnvOTLPEndpoint = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	EnvTraceFile    = "SUPERDEV_TRACE_FILE"
+	EnvTraceParent  = "TRACEPARENT"
+)
+
+// Config selects where spans are exported. Either field may be empty.
+type Config struct {
+	OTLPEndpoint string // OTLP/HTTP endpoint, e.g. http://localhost:4318
+	File         string // path to write spans to as JSON, useful for tests and local debugging
+}
+
+// ConfigFromEnv reads the tracing configuration from the environment
+func ConfigFromEnv() Config {
+	return Config{
+		OTLPEndpoint: os.Getenv(EnvOTLPEndpoint),
+		File:         os.Getenv(EnvTraceFile),
+	}
+}
+
+// propagator is the W3C trace context format used between the server, runner and amp
+var propagator = propagation.TraceContext{}
+
+// Setup installs a global tracer provider for serviceName and returns a function that
+// flushes and shuts it down. When no exporter is configured tracing stays a no-op, but
+// trace context is still propagated.
+func Setup(ctx context.Context, serviceName string, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	var opts []sdktrace.TracerProviderOption
+	var closers []func() error
+
+	if cfg.OTLPEndpoint != "" {
+		exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to create file exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+		closers = append(closers, f.Close)
+	}
+
+	if len(opts) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts = append(opts, sdktrace.WithResource(resource.NewSchemaless(
+		attribute.String("service.name", serviceName),
+	)))
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+
+	shutdown := func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		for _, closer := range closers {
+			if closeErr := closer(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+
+	return shutdown, nil
+}
+
+// TraceParent returns the W3C traceparent for the span in ctx, or "" if there is none
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// WithTraceParent returns ctx with the remote span described by traceParent as its parent
+func WithTraceParent(ctx context.Context, traceParent string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{"traceparent": traceParent})
+}
+
+// InjectHeaders adds the trace context in ctx to outgoing HTTP headers
+func InjectHeaders(ctx context.Context, header http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// ExtractHeaders returns ctx with the trace context from incoming HTTP headers
+func ExtractHeaders(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,206 @@
+package superdev
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"superdev/cmd/superdev/client"
+	superdev "superdev/cmd/superdev/cliwrapper"
+)
+
+// Usage accounting settings set by the server command's flags
+var (
+	priceTablePath  string
+	userDailyBudget float64 // US dollars each user's threads may spend in 24 hours; no limit if 0
+)
+
+// priceTable prices the inferences workers report; without one they cost nothing
+var priceTable PriceTable
+
+// budgetWindow is the period userDailyBudget applies to
+const budgetWindow = 24 * time.Hour
+
+// defaultModelPrice is the price table entry used for models it doesn't list
+const defaultModelPrice = "default"
+
+// ModelPrice is what a model charges, in US dollars per million tokens
+type ModelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// PriceTable maps model names to their prices. The "default" entry prices the
+// models that aren't listed.
+type PriceTable map[string]ModelPrice
+
+// LoadPriceTable reads a price table from a JSON file
+func LoadPriceTable(path string) (PriceTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read price table: %w", err)
+	}
+	var table PriceTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("failed to parse price table %s: %w", path, err)
+	}
+	for model, price := range table {
+		if price.Prompt < 0 || price.Completion < 0 {
+			return nil, fmt.Errorf("invalid price for %s, prices must not be negative", model)
+		}
+	}
+	return table, nil
+}
+
+// Cost returns what an inference on model cost
+func (t PriceTable) Cost(model string, usage superdev.DebugUsage) float64 {
+	price, ok := t[model]
+	if !ok {
+		price = t[defaultModelPrice]
+	}
+	return (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1e6
+}
+
+// usageRecord is one inference reported by a thread's worker, priced when it
+// was reported
+type usageRecord struct {
+	At    time.Time
+	Model string
+	client.Usage
+}
+
+// recordUsage adds the inferences in a worker's deltas to its thread.
+// Callers hold outputMutex.
+func recordUsage(info *ThreadInfo, deltas []superdev.ThreadDelta) {
+	for _, delta := range deltas {
+		if delta.Type != superdev.ThreadDeltaInferenceComplete || delta.Usage == nil {
+			continue
+		}
+		params, _ := delta.Params.(map[string]interface{})
+		model, _ := params["model"].(string)
+
+		total := delta.Usage.TotalTokens
+		if total == 0 {
+			total = delta.Usage.PromptTokens + delta.Usage.CompletionTokens
+		}
+		record := usageRecord{
+			At:    time.Now(),
+			Model: model,
+			Usage: client.Usage{
+				Inferences:       1,
+				PromptTokens:     delta.Usage.PromptTokens,
+				CompletionTokens: delta.Usage.CompletionTokens,
+				TotalTokens:      total,
+				Cost:             priceTable.Cost(model, *delta.Usage),
+			},
+		}
+		info.Usage = append(info.Usage, record)
+		tokenCost.Add(record.Cost)
+	}
+}
+
+// threadUsage sums a thread's inferences from since on, or returns nil if it
+// had none. Callers hold outputMutex.
+func threadUsage(info *ThreadInfo, since time.Time) *client.Usage {
+	var usage *client.Usage
+	for _, record := range info.Usage {
+		if record.At.Before(since) {
+			continue
+		}
+		if usage == nil {
+			usage = &client.Usage{}
+		}
+		usage.Add(record.Usage)
+	}
+	return usage
+}
+
+// checkUserBudget returns a 429 if the user's threads have spent the daily
+// budget. Callers hold outputMutex.
+func checkUserBudget(user string) *apiError {
+	if userDailyBudget <= 0 {
+		return nil
+	}
+	since := time.Now().Add(-budgetWindow)
+	spent := 0.0
+	for _, info := range threadInfos {
+		if info.Owner != user {
+			continue
+		}
+		if usage := threadUsage(info, since); usage != nil {
+			spent += usage.Cost
+		}
+	}
+	if spent >= userDailyBudget {
+		return newAPIError(http.StatusTooManyRequests, fmt.Sprintf("Your threads have spent $%.2f of the $%.2f budget for the last 24 hours", spent, userDailyBudget))
+	}
+	return nil
+}
+
+// checkThreadBudget returns a 429 if the thread, or its owner, has spent its
+// budget. Callers hold outputMutex.
+func checkThreadBudget(info *ThreadInfo) *apiError {
+	if budget := info.Settings.Budget; budget > 0 {
+		if usage := threadUsage(info, time.Time{}); usage != nil && usage.Cost >= budget {
+			return newAPIError(http.StatusTooManyRequests, fmt.Sprintf("Thread has spent $%.2f of its $%.2f budget", usage.Cost, budget))
+		}
+	}
+	return checkUserBudget(info.Owner)
+}
+
+// usageReport groups the usage of the threads visible to the caller by thread,
+// owner or template, counting inferences from since on
+func usageReport(caller Caller, groupBy string, since time.Time) (*client.UsageReport, *apiError) {
+	if groupBy == "" {
+		groupBy = client.UsageByUser
+	}
+	var key func(info *ThreadInfo) string
+	switch groupBy {
+	case client.UsageByThread:
+		key = func(info *ThreadInfo) string { return info.ID }
+	case client.UsageByUser:
+		key = func(info *ThreadInfo) string { return info.Owner }
+	case client.UsageByTemplate:
+		key = func(info *ThreadInfo) string { return info.Template }
+	default:
+		return nil, newAPIError(http.StatusBadRequest, "group_by must be thread, user or template")
+	}
+
+	report := &client.UsageReport{GroupBy: groupBy, Since: since, Groups: []client.UsageGroup{}}
+	groups := make(map[string]*client.UsageGroup)
+
+	outputMutex.Lock()
+	for _, info := range threadInfos {
+		if info.RoleFor(caller, "") == RoleNone {
+			continue
+		}
+		usage := threadUsage(info, since)
+		if usage == nil {
+			continue
+		}
+		group := groups[key(info)]
+		if group == nil {
+			group = &client.UsageGroup{Key: key(info)}
+			groups[group.Key] = group
+		}
+		group.Threads++
+		group.Add(*usage)
+		report.Total.Add(*usage)
+	}
+	outputMutex.Unlock()
+
+	for _, group := range groups {
+		report.Groups = append(report.Groups, *group)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		a, b := report.Groups[i], report.Groups[j]
+		if a.Cost != b.Cost {
+			return a.Cost > b.Cost
+		}
+		return a.Key < b.Key
+	})
+	return report, nil
+}
@@ -0,0 +1,212 @@
+package superdev
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"superdev/cmd/superdev/client"
+	superdev "superdev/cmd/superdev/cliwrapper"
+)
+
+// setupPriceTable prices tokens with table for the rest of the test
+func setupPriceTable(t *testing.T, table PriceTable) {
+	t.Helper()
+	original := priceTable
+	priceTable = table
+	t.Cleanup(func() { priceTable = original })
+}
+
+// inference builds the inference:completed delta a runner reports
+func inference(model string, prompt, completion int) superdev.ThreadDelta {
+	return superdev.ThreadDelta{
+		Type:   superdev.ThreadDeltaInferenceComplete,
+		Usage:  &superdev.DebugUsage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion},
+		Params: map[string]interface{}{"model": model},
+	}
+}
+
+func expectCost(t *testing.T, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 1e-9 {
+		t.Fatalf("Expected a cost of %v, got %v", want, got)
+	}
+}
+
+func TestLoadPriceTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prices.json")
+	os.WriteFile(path, []byte(`{"claude-sonnet": {"prompt": 3, "completion": 15}, "default": {"prompt": 1, "completion": 5}}`), 0o600)
+	table, err := LoadPriceTable(path)
+	if err != nil {
+		t.Fatalf("LoadPriceTable failed: %v", err)
+	}
+
+	usage := superdev.DebugUsage{PromptTokens: 1_000_000, CompletionTokens: 100_000}
+	expectCost(t, table.Cost("claude-sonnet", usage), 4.5)
+	expectCost(t, table.Cost("unknown", usage), 1.5)
+	expectCost(t, PriceTable(nil).Cost("claude-sonnet", usage), 0)
+
+	os.WriteFile(path, []byte(`{"default": {"prompt": -1}}`), 0o600)
+	if _, err := LoadPriceTable(path); err == nil {
+		t.Fatal("Expected negative prices to be rejected")
+	}
+}
+
+func TestAnswerMessageRecordsThreadUsage(t *testing.T) {
+	resetThreads(t)
+	addTestThread("t1", "alice", "")
+	setupPriceTable(t, PriceTable{"claude-sonnet": {Prompt: 3, Completion: 15}})
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	alice := client.New(server.URL, client.WithCaller("alice", ""))
+
+	thread, _ := alice.GetThread(ctx, "t1", client.GetThreadOptions{})
+	if thread.Usage != nil {
+		t.Fatalf("Expected no usage before any inference, got %+v", thread.Usage)
+	}
+
+	deltas := []superdev.ThreadDelta{inference("claude-sonnet", 100_000, 10_000), inference("claude-sonnet", 200_000, 20_000), {Type: superdev.ThreadDeltaTitle}}
+	if _, err := workerClient(server.URL, "t1").AnswerMessage(ctx, "t1", client.AnswerMessageRequest{Payload: "done", Deltas: deltas}); err != nil {
+		t.Fatalf("AnswerMessage failed: %v", err)
+	}
+
+	thread, err := alice.GetThread(ctx, "t1", client.GetThreadOptions{})
+	if err != nil || thread.Usage == nil {
+		t.Fatalf("Expected the thread to carry its usage, got %+v (%v)", thread, err)
+	}
+	if thread.Usage.Inferences != 2 || thread.Usage.PromptTokens != 300_000 || thread.Usage.CompletionTokens != 30_000 || thread.Usage.TotalTokens != 330_000 {
+		t.Fatalf("Expected both inferences to be counted, got %+v", thread.Usage)
+	}
+	expectCost(t, thread.Usage.Cost, 1.35)
+
+	list, err := alice.ListThreads(ctx, client.ListThreadsOptions{})
+	if err != nil || len(list.Threads) != 1 || list.Threads[0].Usage == nil || list.Threads[0].Usage.TotalTokens != 330_000 {
+		t.Fatalf("Expected the listing to carry the usage, got %+v (%v)", list, err)
+	}
+}
+
+func TestUsageReport(t *testing.T) {
+	resetThreads(t)
+	setupPriceTable(t, PriceTable{defaultModelPrice: {Prompt: 1, Completion: 1}})
+	web := addTestThread("t1", "alice", "core")
+	web.Template = "web"
+	api := addTestThread("t2", "bob", "core")
+	addTestThread("t3", "alice", "")
+	hidden := addTestThread("t4", "mallory", "other")
+
+	outputMutex.Lock()
+	recordUsage(web, []superdev.ThreadDelta{inference("m", 1_000_000, 0)})
+	recordUsage(api, []superdev.ThreadDelta{inference("m", 2_000_000, 0)})
+	recordUsage(hidden, []superdev.ThreadDelta{inference("m", 5_000_000, 0)})
+	web.Usage[0].At = time.Now().Add(-48 * time.Hour)
+	outputMutex.Unlock()
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	alice := client.New(server.URL, client.WithCaller("alice", "core"))
+
+	// Threads without usage and threads alice can't see are left out
+	report, err := alice.GetUsage(ctx, client.UsageOptions{})
+	if err != nil {
+		t.Fatalf("GetUsage failed: %v", err)
+	}
+	if report.GroupBy != client.UsageByUser || len(report.Groups) != 2 || report.Groups[0].Key != "bob" || report.Groups[1].Key != "alice" {
+		t.Fatalf("Expected alice and bob by cost, got %+v", report.Groups)
+	}
+	expectCost(t, report.Total.Cost, 3)
+
+	report, err = alice.GetUsage(ctx, client.UsageOptions{GroupBy: client.UsageByTemplate, Since: time.Now().Add(-24 * time.Hour)})
+	if err != nil || len(report.Groups) != 1 || report.Groups[0].Key != "" || report.Groups[0].Threads != 1 {
+		t.Fatalf("Expected only the untemplated thread in the last day, got %+v (%v)", report, err)
+	}
+
+	report, err = alice.GetUsage(ctx, client.UsageOptions{GroupBy: client.UsageByThread})
+	if err != nil || len(report.Groups) != 2 || report.Groups[0].Key != "t2" || report.Groups[0].Inferences != 1 {
+		t.Fatalf("Expected a group per thread, got %+v (%v)", report, err)
+	}
+
+	_, err = alice.GetUsage(ctx, client.UsageOptions{GroupBy: "repository"})
+	expectStatus(t, err, http.StatusBadRequest)
+}
+
+func TestBudgets(t *testing.T) {
+	resetThreads(t)
+	setupScheduler(t, 0, 0, 0)
+	setupPriceTable(t, PriceTable{defaultModelPrice: {Prompt: 10, Completion: 10}})
+	info := addTestThread("t1", "alice", "")
+	info.Settings.Budget = 1
+	addTestThread("t2", "alice", "")
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	alice := client.New(server.URL, client.WithCaller("alice", ""))
+	worker := workerClient(server.URL, "t1")
+
+	// The thread takes messages until it has spent its budget
+	if _, err := alice.SendMessage(ctx, "t1", "go on"); err != nil {
+		t.Fatalf("Expected a message within budget, got %v", err)
+	}
+	worker.AnswerMessage(ctx, "t1", client.AnswerMessageRequest{Payload: "done", Deltas: []superdev.ThreadDelta{inference("m", 100_000, 0)}})
+	_, err := alice.SendMessage(ctx, "t1", "and more")
+	expectStatus(t, err, http.StatusTooManyRequests)
+	if _, err := alice.SendMessage(ctx, "t2", "hello"); err != nil {
+		t.Fatalf("Expected other threads to be unaffected, got %v", err)
+	}
+
+	// Once the user's daily budget is spent nothing new runs for them
+	userDailyBudget = 1
+	t.Cleanup(func() { userDailyBudget = 0 })
+	_, err = alice.SendMessage(ctx, "t2", "hello again")
+	expectStatus(t, err, http.StatusTooManyRequests)
+	_, err = alice.StartThread(ctx, client.StartThreadRequest{RepositoryLink: "https://example.com/web.git", Prompt: "hi"})
+	expectStatus(t, err, http.StatusTooManyRequests)
+
+	_, err = alice.StartThread(ctx, client.StartThreadRequest{RepositoryLink: "https://example.com/web.git", Budget: -1})
+	expectStatus(t, err, http.StatusBadRequest)
+}
+
+func TestUsageCommand(t *testing.T) {
+	resetThreads(t)
+	setupPriceTable(t, PriceTable{defaultModelPrice: {Prompt: 1, Completion: 1}})
+	info := addTestThread("t1", "alice", "")
+	outputMutex.Lock()
+	recordUsage(info, []superdev.ThreadDelta{inference("m", 1_500_000, 500_000)})
+	outputMutex.Unlock()
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+
+	cmd := newUsageCmd()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"--by", "thread", "--since", "1h", "--server", server.URL, "--user", "alice"})
+	if err := cmd.ExecuteContext(context.Background()); err != nil {
+		t.Fatalf("usage failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "THREAD") || !strings.Contains(lines[1], "2000000") || !strings.HasPrefix(lines[2], "TOTAL") || !strings.Contains(lines[2], "$2.00") {
+		t.Fatalf("Expected a row for the thread and a total, got:\n%s", out.String())
+	}
+
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	if since, err := parseSince("36h", now); err != nil || !since.Equal(now.Add(-36*time.Hour)) {
+		t.Errorf("Expected a duration to count back from now, got %v (%v)", since, err)
+	}
+	if since, err := parseSince("2025-02-01", now); err != nil || since.Day() != 1 || since.Month() != time.February {
+		t.Errorf("Expected a date, got %v (%v)", since, err)
+	}
+	if _, err := parseSince("last week", now); err == nil {
+		t.Error("Expected an invalid --since to be rejected")
+	}
+}
@@ -0,0 +1,124 @@
+package superdev
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"superdev/cmd/superdev/client"
+
+	"github.com/spf13/cobra"
+)
+
+// newUsageCmd builds `superdev usage`, which reports the token usage and cost
+// of the threads visible to the caller
+func newUsageCmd() *cobra.Command {
+	opts := &threadsOptions{}
+	var (
+		usage client.UsageOptions
+		since string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Report the token usage and cost of threads",
+		Long: `Report the token usage and cost of the threads visible to you.
+
+Usage is grouped by user unless --by is given, and covers every inference unless
+--since is. Costs come from the server's price table.`,
+		Args:          cobra.NoArgs,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return opts.validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if since != "" {
+				parsed, err := parseSince(since, time.Now())
+				if err != nil {
+					return err
+				}
+				usage.Since = parsed
+			}
+
+			report, err := opts.client().GetUsage(cmd.Context(), usage)
+			if err != nil {
+				return fmt.Errorf("failed to get usage: %w", err)
+			}
+
+			if opts.format == formatJSON {
+				return writeIndentedJSON(cmd.OutOrStdout(), report)
+			}
+			return writeUsageTable(cmd.OutOrStdout(), report)
+		},
+	}
+
+	addServerFlags(cmd, opts)
+	cmd.PersistentFlags().StringVar(&opts.format, "format", formatTable, "Output format: table or json")
+	cmd.Flags().StringVar(&usage.GroupBy, "by", client.UsageByUser, "Group by thread, user or template")
+	cmd.Flags().StringVar(&since, "since", "", "Only count inferences since a duration ago such as 24h, a date or an RFC 3339 time")
+
+	return cmd
+}
+
+// parseSince parses a duration before now, a YYYY-MM-DD date or an RFC 3339 time
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := parseQueryTime(value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("--since must be a duration such as 24h, a YYYY-MM-DD date or an RFC 3339 time")
+}
+
+// writeUsageTable prints a usage report as aligned columns followed by its total
+func writeUsageTable(w io.Writer, report *client.UsageReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tTHREADS\tINFERENCES\tPROMPT\tCOMPLETION\tTOTAL\tCOST\n", usageKeyColumn(report.GroupBy))
+	row := func(key string, threads int, usage client.Usage) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t$%.2f\n",
+			key,
+			threads,
+			usage.Inferences,
+			usage.PromptTokens,
+			usage.CompletionTokens,
+			usage.TotalTokens,
+			usage.Cost,
+		)
+	}
+
+	threads := 0
+	for _, group := range report.Groups {
+		key := group.Key
+		if key == "" {
+			key = "-"
+		}
+		row(key, group.Threads, group.Usage)
+		threads += group.Threads
+	}
+	row("TOTAL", threads, report.Total)
+	return tw.Flush()
+}
+
+// usageKeyColumn is the header of the column a usage report is grouped by
+func usageKeyColumn(groupBy string) string {
+	switch groupBy {
+	case client.UsageByThread:
+		return "THREAD"
+	case client.UsageByTemplate:
+		return "TEMPLATE"
+	default:
+		return "USER"
+	}
+}
+
+// formatUsage describes a thread's usage, or returns "" if it has none
+func formatUsage(usage *client.Usage) string {
+	if usage == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d tokens (%d prompt, %d completion) in %d inferences, $%.2f",
+		usage.TotalTokens, usage.PromptTokens, usage.CompletionTokens, usage.Inferences, usage.Cost)
+}
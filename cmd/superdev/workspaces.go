@@ -0,0 +1,345 @@
+package superdev
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"superdev/cmd/superdev/client"
+	"superdev/cmd/superdev/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// objectIDPattern matches a full SHA-1 or SHA-256 git object ID
+var objectIDPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// workspacePath returns the file holding the snapshot of a thread's workspace
+// taken with the message at index in its history
+func workspacePath(threadID string, index int) string {
+	return filepath.Join(dataDir, "workspaces", threadID, strconv.Itoa(index)+".json")
+}
+
+// saveWorkspace persists a snapshot of a thread's workspace as of the message at index
+func saveWorkspace(threadID string, index int, snapshot *client.WorkspaceSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode workspace snapshot: %w", err)
+	}
+
+	path := workspacePath(threadID, index)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create workspace directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write workspace snapshot: %w", err)
+	}
+	return nil
+}
+
+// loadWorkspace returns the latest snapshot of a thread's workspace taken with
+// a message at or before index, or nil if there is none
+func loadWorkspace(threadID string, index int) (*client.WorkspaceSnapshot, error) {
+	for ; index >= 0; index-- {
+		data, err := os.ReadFile(workspacePath(threadID, index))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read workspace snapshot: %w", err)
+		}
+
+		var snapshot client.WorkspaceSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, fmt.Errorf("failed to decode workspace snapshot: %w", err)
+		}
+		return &snapshot, nil
+	}
+	return nil, nil
+}
+
+// threadWorkspace returns the latest snapshot of a thread's workspace, which a
+// forked thread's worker restores before its first turn
+func threadWorkspace(threadID string) (*client.WorkspaceSnapshot, *apiError) {
+	outputMutex.Lock()
+	messages, exists := threads[threadID]
+	outputMutex.Unlock()
+	if !exists {
+		return nil, newAPIError(http.StatusNotFound, "Thread not found")
+	}
+
+	snapshot, err := loadWorkspace(threadID, len(messages)-1)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, err.Error())
+	}
+	if snapshot == nil {
+		return nil, newAPIError(http.StatusNotFound, "Thread has no workspace snapshot")
+	}
+	return snapshot, nil
+}
+
+// snapshotMessage finds the answer with ID messageID in a thread's history,
+// returning its index. An empty ID picks the latest answer with a snapshot.
+// Callers hold outputMutex.
+func snapshotMessage(threadID, messageID string) (int, *apiError) {
+	messages := threads[threadID]
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg := messages[i]
+		if (messageID == "" && msg.Snapshot) || msg.ID == messageID {
+			if !msg.Snapshot {
+				return 0, newAPIError(http.StatusNotFound, "No workspace snapshot with message "+messageID)
+			}
+			return i, nil
+		}
+	}
+	if messageID == "" {
+		return 0, newAPIError(http.StatusNotFound, "Thread has no workspace snapshots")
+	}
+	return 0, newAPIError(http.StatusBadRequest, "No message with ID "+messageID+" in thread")
+}
+
+// listSnapshots describes the workspace snapshots taken with a thread's answers
+func listSnapshots(r *http.Request, threadID string) (*client.SnapshotList, *apiError) {
+	outputMutex.Lock()
+	if _, apiErr := authorizeThread(r, threadID, RoleRead); apiErr != nil {
+		outputMutex.Unlock()
+		return nil, apiErr
+	}
+	type taken struct {
+		index   int
+		message client.ThreadMessage
+	}
+	var snapshots []taken
+	for i, msg := range threads[threadID] {
+		if msg.Snapshot {
+			snapshots = append(snapshots, taken{i, *msg})
+		}
+	}
+	outputMutex.Unlock()
+
+	list := &client.SnapshotList{Snapshots: []client.Snapshot{}}
+	for _, snapshot := range snapshots {
+		workspace, err := loadWorkspace(threadID, snapshot.index)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, err.Error())
+		}
+		if workspace == nil {
+			continue
+		}
+		list.Snapshots = append(list.Snapshots, client.Snapshot{
+			MessageID: snapshot.message.ID,
+			CreatedAt: snapshot.message.CreatedAt,
+			Base:      workspace.Base,
+			Files:     patchFiles(workspace.Patch),
+			Size:      len(workspace.Patch),
+		})
+	}
+	return list, nil
+}
+
+// patchFiles lists the paths a git diff changes
+func patchFiles(patch []byte) []string {
+	files := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(patch))
+	scanner.Buffer(nil, len(patch)+1)
+	for scanner.Scan() {
+		header, ok := strings.CutPrefix(scanner.Text(), "diff --git ")
+		if !ok {
+			continue
+		}
+		if i := strings.LastIndex(header, " b/"); i >= 0 {
+			files = append(files, header[i+len(" b/"):])
+		}
+	}
+	return files
+}
+
+// restoreSnapshot queues a message asking a thread's worker to restore its
+// workspace to the snapshot taken with the answer at. The worker answers once
+// it has, with a snapshot of the restored workspace.
+func restoreSnapshot(r *http.Request, threadID, at string) (string, *apiError) {
+	if at == "" {
+		return "", newAPIError(http.StatusBadRequest, "at is required")
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	info, apiErr := authorizeThread(r, threadID, RoleWrite)
+	if apiErr != nil {
+		return "", apiErr
+	}
+	if info.Status == client.ThreadStatusCancelled {
+		return "", newAPIError(http.StatusConflict, "Thread has been cancelled")
+	}
+
+	index, apiErr := snapshotMessage(threadID, at)
+	if apiErr != nil {
+		return "", apiErr
+	}
+	workspace, err := loadWorkspace(threadID, index)
+	if err != nil {
+		return "", newAPIError(http.StatusInternalServerError, err.Error())
+	}
+
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("thread_id", threadID))
+	messageID := time.Now().String()
+	threads[threadID] = append(threads[threadID], &client.ThreadMessage{
+		ID:          messageID,
+		Direction:   client.DirectionInput,
+		Output:      "Restore the workspace to message " + at,
+		CreatedAt:   time.Now(),
+		TraceParent: tracing.TraceParent(r.Context()),
+		Restore:     workspace,
+	})
+	snapshotsRestored.Inc()
+
+	return messageID, nil
+}
+
+// diffSnapshots returns the changes between the workspace snapshots taken with
+// the answers from and to. An empty from diffs against the commit the thread
+// started from; an empty to uses the latest snapshot.
+func diffSnapshots(r *http.Request, threadID, from, to string) (*client.SnapshotDiff, *apiError) {
+	outputMutex.Lock()
+	info, apiErr := authorizeThread(r, threadID, RoleRead)
+	if apiErr != nil {
+		outputMutex.Unlock()
+		return nil, apiErr
+	}
+	repository := info.Repository
+	toIndex, apiErr := snapshotMessage(threadID, to)
+	if apiErr != nil {
+		outputMutex.Unlock()
+		return nil, apiErr
+	}
+	to = threads[threadID][toIndex].ID
+	fromIndex := -1
+	if from != "" {
+		fromIndex, apiErr = snapshotMessage(threadID, from)
+		if apiErr != nil {
+			outputMutex.Unlock()
+			return nil, apiErr
+		}
+	}
+	outputMutex.Unlock()
+
+	toWorkspace, err := loadWorkspace(threadID, toIndex)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, err.Error())
+	}
+	fromWorkspace := &client.WorkspaceSnapshot{Base: toWorkspace.Base}
+	if fromIndex >= 0 {
+		if fromWorkspace, err = loadWorkspace(threadID, fromIndex); err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	diff, err := diffWorkspaces(repository, fromWorkspace, toWorkspace)
+	if err != nil {
+		slog.Error("failed to diff workspace snapshots", "thread_id", threadID, "error", err)
+		return nil, newAPIError(http.StatusInternalServerError, "Error diffing snapshots: "+err.Error())
+	}
+	return &client.SnapshotDiff{From: from, To: to, Diff: diff}, nil
+}
+
+// snapshotRepoMutex serializes use of the repositories cached for diffing snapshots
+var snapshotRepoMutex = &sync.Mutex{}
+
+// snapshotRepoDir returns where a repository is cached for diffing snapshots
+func snapshotRepoDir(repository string) string {
+	sum := sha256.Sum256([]byte(repository))
+	return filepath.Join(dataDir, "repos", hex.EncodeToString(sum[:8]))
+}
+
+// diffWorkspaces rebuilds both snapshots on top of their base commits in a
+// cached clone of the repository and diffs the results
+func diffWorkspaces(repository string, from, to *client.WorkspaceSnapshot) (string, error) {
+	snapshotRepoMutex.Lock()
+	defer snapshotRepoMutex.Unlock()
+
+	// Blobs are fetched on demand, so the clone only holds the files snapshots touch
+	dir := snapshotRepoDir(repository)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return "", fmt.Errorf("failed to create repository cache: %w", err)
+		}
+		if _, err := runGit("", nil, nil, "clone", "--quiet", "--bare", "--filter=blob:none", "--end-of-options", repository, dir); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+
+	fromTree, err := workspaceTree(dir, from)
+	if err != nil {
+		return "", err
+	}
+	toTree, err := workspaceTree(dir, to)
+	if err != nil {
+		return "", err
+	}
+	diff, err := runGit(dir, nil, nil, "diff", "--binary", "--end-of-options", fromTree, toTree)
+	return string(diff), err
+}
+
+// workspaceTree writes the tree of a snapshot's base commit with its changes
+// applied, fetching the commit if the clone doesn't have it yet
+func workspaceTree(dir string, workspace *client.WorkspaceSnapshot) (string, error) {
+	if _, err := runGit(dir, nil, nil, "cat-file", "-e", "--end-of-options", workspace.Base+"^{commit}"); err != nil {
+		if _, err := runGit(dir, nil, nil, "fetch", "--quiet", "--end-of-options", "origin", workspace.Base); err != nil {
+			return "", fmt.Errorf("commit %s isn't in the repository: %w", workspace.Base, err)
+		}
+	}
+
+	index, err := os.CreateTemp("", "superdev-index-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create index: %w", err)
+	}
+	index.Close()
+	defer os.Remove(index.Name())
+
+	env := []string{"GIT_INDEX_FILE=" + index.Name()}
+	if _, err := runGit(dir, env, nil, "read-tree", "--end-of-options", workspace.Base); err != nil {
+		return "", err
+	}
+	if len(workspace.Patch) > 0 {
+		if _, err := runGit(dir, env, workspace.Patch, "apply", "--cached", "--binary", "-"); err != nil {
+			return "", err
+		}
+	}
+	tree, err := runGit(dir, env, nil, "write-tree")
+	return strings.TrimSpace(string(tree)), err
+}
+
+// runGit runs git in dir (the working directory if empty) with extra
+// environment and stdin, returning its output. Callers put --end-of-options
+// before any revision or URL that came from a request.
+func runGit(dir string, env []string, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
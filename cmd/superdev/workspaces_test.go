@@ -0,0 +1,129 @@
+package superdev
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"superdev/cmd/superdev/client"
+)
+
+// git runs git in dir, failing the test on error
+func git(t *testing.T, dir string, env []string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// snapshotOf captures a working copy's changes since base as the runner does
+func snapshotOf(t *testing.T, dir, base string) *client.WorkspaceSnapshot {
+	t.Helper()
+	env := []string{"GIT_INDEX_FILE=" + filepath.Join(t.TempDir(), "index")}
+	git(t, dir, env, "add", "--all")
+	cmd := exec.Command("git", "diff", "--cached", "--binary", base)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	patch, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git diff failed: %v", err)
+	}
+	return &client.WorkspaceSnapshot{Base: base, Patch: patch}
+}
+
+func TestWorkspaceSnapshots(t *testing.T) {
+	resetThreads(t)
+	setupDataDir(t)
+
+	// A repository with one commit, and a working copy the agent changes
+	origin := t.TempDir()
+	git(t, origin, nil, "init", "--quiet")
+	os.WriteFile(filepath.Join(origin, "main.go"), []byte("package main\n"), 0644)
+	git(t, origin, nil, "add", "--all")
+	git(t, origin, nil, "commit", "--quiet", "-m", "initial")
+	base := git(t, origin, nil, "rev-parse", "HEAD")
+	work := t.TempDir()
+	git(t, work, nil, "clone", "--quiet", origin, ".")
+
+	info := addTestThread("t1", "alice", "")
+	info.Repository = origin
+
+	server := httptest.NewServer(newServerMux())
+	defer server.Close()
+	ctx := context.Background()
+	c := client.New(server.URL, client.WithCaller("alice", ""))
+	worker := workerClient(server.URL, "t1")
+	answer := func(workspace *client.WorkspaceSnapshot) string {
+		t.Helper()
+		resp, err := worker.AnswerMessage(ctx, "t1", client.AnswerMessageRequest{Payload: "done", Workspace: workspace})
+		if err != nil {
+			t.Fatalf("AnswerMessage failed: %v", err)
+		}
+		return resp.MessageID
+	}
+
+	os.WriteFile(filepath.Join(work, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644)
+	first := answer(snapshotOf(t, work, base))
+	os.WriteFile(filepath.Join(work, "README.md"), []byte("# Project\n"), 0644)
+	second := answer(snapshotOf(t, work, base))
+	unsnapshotted := answer(nil)
+
+	// Only full commit IDs reach git, so options can't be smuggled in as the base
+	_, err := worker.AnswerMessage(ctx, "t1", client.AnswerMessageRequest{Payload: "done", Workspace: &client.WorkspaceSnapshot{Base: "--upload-pack=touch /tmp/pwned"}})
+	expectStatus(t, err, http.StatusBadRequest)
+
+	list, err := c.ListSnapshots(ctx, "t1")
+	if err != nil || len(list.Snapshots) != 2 {
+		t.Fatalf("Expected two snapshots, got %+v (%v)", list, err)
+	}
+	if got := list.Snapshots[1]; got.MessageID != second || got.Base != base || strings.Join(got.Files, ",") != "README.md,main.go" {
+		t.Fatalf("Expected the second snapshot to change both files, got %+v", got)
+	}
+	thread, _ := c.GetThread(ctx, "t1", client.GetThreadOptions{})
+	if !thread.Messages[1].Snapshot || thread.Messages[3].Snapshot {
+		t.Fatalf("Expected answers to be marked when they have a snapshot, got %+v", thread.Messages)
+	}
+
+	// Diffs rebuild both snapshots from a clone of the repository
+	diff, err := c.DiffSnapshots(ctx, "t1", "", first)
+	if err != nil || !strings.Contains(diff.Diff, "+func main() {}") || strings.Contains(diff.Diff, "README.md") {
+		t.Fatalf("Expected the first turn's changes, got %+v (%v)", diff, err)
+	}
+	diff, err = c.DiffSnapshots(ctx, "t1", first, "")
+	if err != nil || diff.To != second || !strings.Contains(diff.Diff, "+# Project") || strings.Contains(diff.Diff, "main.go") {
+		t.Fatalf("Expected only the second turn's changes, got %+v (%v)", diff, err)
+	}
+	_, err = c.DiffSnapshots(ctx, "t1", unsnapshotted, "")
+	expectStatus(t, err, http.StatusNotFound)
+	_, err = c.DiffSnapshots(ctx, "t1", "missing", "")
+	expectStatus(t, err, http.StatusBadRequest)
+
+	// Restores are delivered to the worker like a message
+	restore, err := c.RestoreSnapshot(ctx, "t1", first)
+	if err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	pending, err := worker.PullMessages(ctx, "t1", unsnapshotted)
+	if err != nil || len(pending) != 1 || pending[0].ID != restore.MessageID || pending[0].Workspace == nil {
+		t.Fatalf("Expected the restore to be pending, got %+v (%v)", pending, err)
+	}
+	if got := string(pending[0].Workspace.Patch); strings.Contains(got, "README.md") || !strings.Contains(got, "func main") {
+		t.Fatalf("Expected the first snapshot to be restored, got %q", got)
+	}
+
+	// Only writers may restore
+	_, err = client.New(server.URL, client.WithCaller("bob", "")).RestoreSnapshot(ctx, "t1", first)
+	expectStatus(t, err, http.StatusNotFound)
+	_, err = c.RestoreSnapshot(ctx, "t1", unsnapshotted)
+	expectStatus(t, err, http.StatusNotFound)
+}
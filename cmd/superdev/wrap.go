@@ -0,0 +1,446 @@
+package superdev
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Base distributions the wrapper knows how to install tools on
+const (
+	DistroDebian = "debian"
+	DistroAlpine = "alpine"
+	DistroRHEL   = "rhel"
+)
+
+// Defaults for wrapped images
+const (
+	defaultBaseTag     = "superdev-image"
+	defaultWrappedTag  = "superdev-wrapped-image"
+	defaultNodeVersion = "22"
+	defaultPnpmVersion = "latest"
+	defaultAmpVersion  = "latest"
+)
+
+// WrapConfig describes how `superdev run` wraps a user's image with the tools the
+// agent needs. It is read from a JSON file and can be overridden with flags.
+type WrapConfig struct {
+	BaseTag        string            `json:"base_tag,omitempty"`     // tag for the user's image
+	Tag            string            `json:"tag,omitempty"`          // tag for the wrapped image
+	Distro         string            `json:"distro,omitempty"`       // detected from /etc/os-release if empty
+	NodeVersion    string            `json:"node_version,omitempty"` // major version; Alpine uses the distro's Node.js
+	PnpmVersion    string            `json:"pnpm_version,omitempty"`
+	AmpVersion     string            `json:"amp_version,omitempty"`   // version or dist-tag of @sourcegraph/amp
+	Packages       []string          `json:"packages,omitempty"`      // extra distro packages to install
+	BuildArgs      map[string]string `json:"build_args,omitempty"`    // --build-arg values for the user's Dockerfile
+	Target         string            `json:"target,omitempty"`        // stage of the user's Dockerfile to build
+	RunnerBinary   string            `json:"runner_binary,omitempty"` // prebuilt linux superdev-amprunner; built from source if empty
+	SkipValidation bool              `json:"skip_validation,omitempty"`
+}
+
+// RunnerSource holds the source of superdev-amprunner and the packages it imports,
+// embedded by the superdev binary so wrapped images can build the runner without a
+// local Go toolchain
+var RunnerSource fs.FS
+
+// runnerBuilderImage compiles the runner in the first stage of the wrapper build
+const runnerBuilderImage = "golang:1.24"
+
+// Patterns for values interpolated into the wrapper Dockerfile's shell commands
+var (
+	imageTagPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/:@-]*$`)
+	versionPattern  = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+	packagePattern  = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.+_:=~-]*$`)
+	nodeVersionExpr = regexp.MustCompile(`^[0-9]+$`)
+	buildArgPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// loadWrapConfig reads a wrap config file. An empty path returns an empty config.
+func loadWrapConfig(path string) (WrapConfig, error) {
+	var cfg WrapConfig
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read wrap config: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse wrap config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// merge overrides the config with the set fields of other
+func (c *WrapConfig) merge(other WrapConfig) {
+	for _, field := range []struct {
+		dst *string
+		src string
+	}{
+		{&c.BaseTag, other.BaseTag},
+		{&c.Tag, other.Tag},
+		{&c.Distro, other.Distro},
+		{&c.NodeVersion, other.NodeVersion},
+		{&c.PnpmVersion, other.PnpmVersion},
+		{&c.AmpVersion, other.AmpVersion},
+		{&c.Target, other.Target},
+		{&c.RunnerBinary, other.RunnerBinary},
+	} {
+		if field.src != "" {
+			*field.dst = field.src
+		}
+	}
+	c.Packages = append(c.Packages, other.Packages...)
+	for name, value := range other.BuildArgs {
+		if c.BuildArgs == nil {
+			c.BuildArgs = make(map[string]string)
+		}
+		c.BuildArgs[name] = value
+	}
+	c.SkipValidation = c.SkipValidation || other.SkipValidation
+}
+
+// applyDefaults fills in unset tags and versions
+func (c *WrapConfig) applyDefaults() {
+	if c.BaseTag == "" {
+		c.BaseTag = defaultBaseTag
+	}
+	if c.Tag == "" {
+		c.Tag = defaultWrappedTag
+	}
+	if c.NodeVersion == "" {
+		c.NodeVersion = defaultNodeVersion
+	}
+	if c.PnpmVersion == "" {
+		c.PnpmVersion = defaultPnpmVersion
+	}
+	if c.AmpVersion == "" {
+		c.AmpVersion = defaultAmpVersion
+	}
+}
+
+// validate checks the config before anything is interpolated into a Dockerfile
+func (c WrapConfig) validate() error {
+	switch c.Distro {
+	case "", DistroDebian, DistroAlpine, DistroRHEL:
+	default:
+		return fmt.Errorf("distro must be %s, %s or %s, got %q", DistroDebian, DistroAlpine, DistroRHEL, c.Distro)
+	}
+
+	for name, tag := range map[string]string{"base_tag": c.BaseTag, "tag": c.Tag} {
+		if !imageTagPattern.MatchString(tag) {
+			return fmt.Errorf("%s %q is not a valid image tag", name, tag)
+		}
+	}
+	if c.BaseTag == c.Tag {
+		return fmt.Errorf("base_tag and tag must differ, both are %q", c.Tag)
+	}
+
+	if !nodeVersionExpr.MatchString(c.NodeVersion) {
+		return fmt.Errorf("node_version must be a major version such as 22, got %q", c.NodeVersion)
+	}
+	for name, version := range map[string]string{"pnpm_version": c.PnpmVersion, "amp_version": c.AmpVersion} {
+		if !versionPattern.MatchString(version) {
+			return fmt.Errorf("%s %q is not a valid version or dist-tag", name, version)
+		}
+	}
+
+	for _, pkg := range c.Packages {
+		if !packagePattern.MatchString(pkg) {
+			return fmt.Errorf("package %q is not a valid package name", pkg)
+		}
+	}
+
+	// Build args and the target are passed as docker arguments, never through a shell
+	for name := range c.BuildArgs {
+		if !buildArgPattern.MatchString(name) {
+			return fmt.Errorf("build arg %q is not a valid name", name)
+		}
+	}
+	if c.Target != "" && !versionPattern.MatchString(c.Target) {
+		return fmt.Errorf("target %q is not a valid stage name", c.Target)
+	}
+	return nil
+}
+
+// detectDistro maps the contents of /etc/os-release to a supported distribution,
+// checking ID before the distributions listed in ID_LIKE
+func detectDistro(osRelease string) (string, error) {
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(osRelease))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok {
+			fields[key] = strings.Trim(value, `"'`)
+		}
+	}
+
+	candidates := append([]string{fields["ID"]}, strings.Fields(fields["ID_LIKE"])...)
+	for _, id := range candidates {
+		switch id {
+		case "debian", "ubuntu":
+			return DistroDebian, nil
+		case "alpine":
+			return DistroAlpine, nil
+		case "rhel", "fedora", "centos":
+			return DistroRHEL, nil
+		}
+	}
+
+	if fields["ID"] == "" {
+		return "", fmt.Errorf("could not read the base image's /etc/os-release; set distro explicitly")
+	}
+	return "", fmt.Errorf("unsupported base distribution %q; set distro to %s, %s or %s if it is compatible", fields["ID"], DistroDebian, DistroAlpine, DistroRHEL)
+}
+
+// distroInstallTemplates install Node.js, git, ripgrep and the extra packages on
+// each supported distribution
+var distroInstallTemplates = map[string]string{
+	DistroDebian: `# Install Node.js {{.NodeVersion}}, git, ripgrep and extra packages with apt
+RUN apt-get update && \
+    apt-get install -y --no-install-recommends bash ca-certificates curl git gnupg ripgrep{{range .Packages}} {{.}}{{end}} && \
+    mkdir -p /etc/apt/keyrings && \
+    curl -fsSL https://deb.nodesource.com/gpgkey/nodesource-repo.gpg.key | gpg --dearmor -o /etc/apt/keyrings/nodesource.gpg && \
+    echo "deb [signed-by=/etc/apt/keyrings/nodesource.gpg] https://deb.nodesource.com/node_{{.NodeVersion}}.x nodistro main" > /etc/apt/sources.list.d/nodesource.list && \
+    apt-get update && \
+    apt-get install -y nodejs && \
+    apt-get clean && \
+    rm -rf /var/lib/apt/lists/*`,
+
+	DistroAlpine: `# Install Node.js, git, ripgrep and extra packages with apk. Alpine's Node.js
+# is built against musl, so the distribution's package is used.
+RUN apk add --no-cache bash ca-certificates curl git ripgrep nodejs npm{{range .Packages}} {{.}}{{end}}`,
+
+	DistroRHEL: `# Install Node.js {{.NodeVersion}}, git, ripgrep and extra packages with dnf or yum
+RUN PM=$(command -v dnf || command -v yum) && \
+    $PM install -y bash ca-certificates git{{range .Packages}} {{.}}{{end}} && \
+    ($PM install -y ripgrep || ($PM install -y epel-release && $PM install -y ripgrep)) && \
+    curl -fsSL https://rpm.nodesource.com/setup_{{.NodeVersion}}.x | bash - && \
+    $PM install -y nodejs && \
+    $PM clean all`,
+}
+
+// wrapperTemplate installs the agent's tools directly on top of the user's image
+// and makes superdev-amprunner its entrypoint, so every wrapped image is a worker
+const wrapperTemplate = `{{if not .RunnerBinary}}# Build superdev-amprunner from the source embedded in superdev
+FROM ` + runnerBuilderImage + ` AS runner
+WORKDIR /src
+COPY runner-src/ .
+RUN CGO_ENABLED=0 go build -o /superdev-amprunner ./cmd/superdev-amprunner
+
+{{end}}FROM {{.BaseTag}}
+
+# Additional wrapper configuration
+LABEL wrapped.by="superdev"
+LABEL original.dockerfile="{{.OriginalFile}}"
+LABEL superdev.distro="{{.Distro}}"
+LABEL superdev.amp.version="{{.AmpVersion}}"
+
+USER root
+
+{{.Install}}
+
+# Install pnpm and Sourcegraph Amp
+ENV PNPM_HOME=/usr/local/pnpm-global
+ENV PATH="$PNPM_HOME:$PNPM_HOME/node_modules/.bin:$PATH"
+ENV SHELL=/bin/bash
+RUN mkdir -p $PNPM_HOME && \
+    npm install -g pnpm@{{.PnpmVersion}} && \
+    pnpm add -g @sourcegraph/amp@{{.AmpVersion}}
+
+# The server mounts the repository and context files here
+RUN mkdir -p /workdir/repo /workdir/context /workdir/guidance
+VOLUME ["/workdir/repo", "/workdir/context", "/workdir/guidance"]
+WORKDIR /workdir
+
+# Run the worker that connects the container to the server
+{{if .RunnerBinary}}COPY superdev-amprunner /usr/local/bin/superdev-amprunner{{else}}COPY --from=runner /superdev-amprunner /usr/local/bin/superdev-amprunner{{end}}
+RUN chmod +x /usr/local/bin/superdev-amprunner
+ENTRYPOINT ["superdev-amprunner"]
+CMD ["run"]
+`
+
+// renderWrapperDockerfile renders the wrapper Dockerfile for a validated config
+// with a known distro
+func renderWrapperDockerfile(cfg WrapConfig, originalFile string) (string, error) {
+	installTemplate, ok := distroInstallTemplates[cfg.Distro]
+	if !ok {
+		return "", fmt.Errorf("no install strategy for distro %q", cfg.Distro)
+	}
+
+	var install bytes.Buffer
+	if err := template.Must(template.New("install").Parse(installTemplate)).Execute(&install, cfg); err != nil {
+		return "", fmt.Errorf("failed to render install steps: %w", err)
+	}
+
+	data := struct {
+		WrapConfig
+		OriginalFile string
+		Install      string
+	}{cfg, originalFile, install.String()}
+
+	var dockerfile bytes.Buffer
+	if err := template.Must(template.New("wrapper").Parse(wrapperTemplate)).Execute(&dockerfile, data); err != nil {
+		return "", fmt.Errorf("failed to render wrapper Dockerfile: %w", err)
+	}
+	return dockerfile.String(), nil
+}
+
+// wrapCheck is a command that must succeed in a wrapped image
+type wrapCheck struct {
+	Name    string
+	Command string
+}
+
+// wrapChecks are run against every wrapped image unless validation is skipped
+var wrapChecks = []wrapCheck{
+	{Name: "node", Command: "node --version"},
+	{Name: "ripgrep", Command: "rg --version"},
+	{Name: "git", Command: "git --version"},
+	{Name: "amp", Command: "amp --version"},
+	{Name: "runner", Command: "superdev-amprunner --help"},
+}
+
+// runDocker runs a docker CLI command, writing its output to out
+var runDocker = func(out io.Writer, args ...string) error {
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
+
+// imageHashLabel is the label wrapped images carry with the content hash they
+// were built for. The server only registers images whose label matches.
+const imageHashLabel = "dev.superdev.image-hash"
+
+// wrapImage builds the user's Dockerfile, wraps it with the agent's tools and
+// checks that the result can run them. The wrapped image is labelled with hash.
+// Progress and build output go to out. It returns the config with defaults
+// applied and the distro resolved.
+func wrapImage(cfg WrapConfig, hash, dockerfilePath, contextDir string, out io.Writer) (WrapConfig, error) {
+	cfg.applyDefaults()
+	if err := cfg.validate(); err != nil {
+		return cfg, err
+	}
+
+	fmt.Fprintf(out, "Building Docker image %s from %s...\n", cfg.BaseTag, dockerfilePath)
+	if err := runDocker(out, baseBuildArgs(cfg, dockerfilePath, contextDir)...); err != nil {
+		return cfg, fmt.Errorf("failed to build %s: %w", dockerfilePath, err)
+	}
+
+	if cfg.Distro == "" {
+		var osRelease bytes.Buffer
+		if err := runDocker(&osRelease, "run", "--rm", "--entrypoint", "cat", cfg.BaseTag, "/etc/os-release"); err != nil {
+			return cfg, fmt.Errorf("failed to detect the base distribution of %s (set distro explicitly): %w", cfg.BaseTag, err)
+		}
+		distro, err := detectDistro(osRelease.String())
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Distro = distro
+		fmt.Fprintf(out, "Detected %s base image\n", distro)
+	}
+
+	dockerfile, err := renderWrapperDockerfile(cfg, dockerfilePath)
+	if err != nil {
+		return cfg, err
+	}
+
+	// The wrapper only needs its own build context
+	wrapperDir, err := os.MkdirTemp("", "superdev-wrapper")
+	if err != nil {
+		return cfg, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(wrapperDir)
+
+	if err := stageRunner(cfg, wrapperDir); err != nil {
+		return cfg, err
+	}
+
+	wrapperPath := filepath.Join(wrapperDir, "Dockerfile.wrapper")
+	if err := os.WriteFile(wrapperPath, []byte(dockerfile), 0o644); err != nil {
+		return cfg, fmt.Errorf("failed to write wrapper Dockerfile: %w", err)
+	}
+
+	fmt.Fprintf(out, "Building wrapped Docker image %s...\n", cfg.Tag)
+	if err := runDocker(out, "build", "-f", wrapperPath, "-t", cfg.Tag, "--label", imageHashLabel+"="+hash, wrapperDir); err != nil {
+		return cfg, fmt.Errorf("failed to build wrapped image: %w", err)
+	}
+
+	if cfg.SkipValidation {
+		return cfg, nil
+	}
+	return cfg, validateWrappedImage(cfg.Tag, out)
+}
+
+// baseBuildArgs returns the docker arguments that build the user's Dockerfile.
+// Any hash label the Dockerfile sets is cleared, so only wrapping adds one.
+func baseBuildArgs(cfg WrapConfig, dockerfilePath, contextDir string) []string {
+	args := []string{"build", "-f", dockerfilePath, "-t", cfg.BaseTag, "--label", imageHashLabel + "="}
+	names := make([]string, 0, len(cfg.BuildArgs))
+	for name := range cfg.BuildArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "--build-arg", name+"="+cfg.BuildArgs[name])
+	}
+	if cfg.Target != "" {
+		args = append(args, "--target", cfg.Target)
+	}
+	return append(args, contextDir)
+}
+
+// stageRunner puts the runner binary, or the source to build it from, into the
+// wrapper's build context
+func stageRunner(cfg WrapConfig, wrapperDir string) error {
+	if cfg.RunnerBinary != "" {
+		data, err := os.ReadFile(cfg.RunnerBinary)
+		if err != nil {
+			return fmt.Errorf("failed to read runner binary: %w", err)
+		}
+		return os.WriteFile(filepath.Join(wrapperDir, "superdev-amprunner"), data, 0o755)
+	}
+
+	if RunnerSource == nil {
+		return fmt.Errorf("this superdev binary does not include the runner source; pass --runner-binary")
+	}
+	if err := os.CopyFS(filepath.Join(wrapperDir, "runner-src"), RunnerSource); err != nil {
+		return fmt.Errorf("failed to stage runner source: %w", err)
+	}
+	return nil
+}
+
+// validateWrappedImage runs each wrap check in the image and reports every failure
+func validateWrappedImage(tag string, out io.Writer) error {
+	fmt.Fprintf(out, "Validating %s...\n", tag)
+
+	var failed []string
+	for _, check := range wrapChecks {
+		var output bytes.Buffer
+		if err := runDocker(&output, "run", "--rm", "--entrypoint", "sh", tag, "-c", check.Command); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%s): %s", check.Name, check.Command, strings.TrimSpace(output.String())))
+			continue
+		}
+		fmt.Fprintf(out, "  %s: %s\n", check.Name, strings.TrimSpace(output.String()))
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("wrapped image %s failed validation:\n  %s", tag, strings.Join(failed, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package superdev
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// stubDocker replaces runDocker for the test, recording each invocation. respond
+// returns the output and error for a command.
+func stubDocker(t *testing.T, respond func(args []string) (string, error)) *[][]string {
+	t.Helper()
+	var calls [][]string
+	original := runDocker
+	runDocker = func(out io.Writer, args ...string) error {
+		calls = append(calls, args)
+		output, err := respond(args)
+		io.WriteString(out, output)
+		return err
+	}
+	t.Cleanup(func() { runDocker = original })
+	return &calls
+}
+
+func TestDetectDistro(t *testing.T) {
+	tests := []struct {
+		osRelease string
+		want      string
+	}{
+		{"NAME=\"Ubuntu\"\nID=ubuntu\nID_LIKE=debian\n", DistroDebian},
+		{"ID=alpine\nVERSION_ID=3.20.0\n", DistroAlpine},
+		{"ID=\"rocky\"\nID_LIKE=\"rhel centos fedora\"\n", DistroRHEL},
+		{"ID=\"amzn\"\nID_LIKE=\"centos rhel fedora\"\n", DistroRHEL},
+		{"ID=linuxmint\nID_LIKE=\"ubuntu debian\"\n", DistroDebian},
+	}
+	for _, tt := range tests {
+		got, err := detectDistro(tt.osRelease)
+		if err != nil || got != tt.want {
+			t.Errorf("detectDistro(%q) = %q, %v; want %q", tt.osRelease, got, err, tt.want)
+		}
+	}
+
+	if _, err := detectDistro("ID=arch\n"); err == nil || !strings.Contains(err.Error(), "arch") {
+		t.Errorf("Expected an unsupported distribution error, got %v", err)
+	}
+	if _, err := detectDistro(""); err == nil {
+		t.Error("Expected an error for a missing os-release")
+	}
+}
+
+func TestWrapConfigValidation(t *testing.T) {
+	valid := WrapConfig{Packages: []string{"ffmpeg", "libssl-dev", "python3.12"}}
+	valid.applyDefaults()
+	if err := valid.validate(); err != nil {
+		t.Fatalf("Expected defaults to be valid, got %v", err)
+	}
+
+	for name, mutate := range map[string]func(*WrapConfig){
+		"distro":       func(c *WrapConfig) { c.Distro = "gentoo" },
+		"package":      func(c *WrapConfig) { c.Packages = []string{"git; rm -rf /"} },
+		"amp version":  func(c *WrapConfig) { c.AmpVersion = "1.0 && curl evil" },
+		"node version": func(c *WrapConfig) { c.NodeVersion = "22.1" },
+		"tag":          func(c *WrapConfig) { c.Tag = "Bad Tag" },
+		"same tags":    func(c *WrapConfig) { c.Tag = c.BaseTag },
+	} {
+		cfg := valid
+		mutate(&cfg)
+		if err := cfg.validate(); err == nil {
+			t.Errorf("Expected an invalid %s to be rejected", name)
+		}
+	}
+}
+
+func TestLoadWrapConfigMergesFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wrap.json")
+	os.WriteFile(path, []byte(`{"tag": "team/app:agent", "amp_version": "0.0.1", "packages": ["ffmpeg"]}`), 0o644)
+
+	cfg, err := loadWrapConfig(path)
+	if err != nil {
+		t.Fatalf("loadWrapConfig failed: %v", err)
+	}
+	cfg.merge(WrapConfig{AmpVersion: "0.0.2", Packages: []string{"jq"}})
+	cfg.applyDefaults()
+
+	if cfg.Tag != "team/app:agent" || cfg.AmpVersion != "0.0.2" || len(cfg.Packages) != 2 || cfg.BaseTag != defaultBaseTag {
+		t.Fatalf("Unexpected merged config %+v", cfg)
+	}
+
+	os.WriteFile(path, []byte(`{"amp_versoin": "typo"}`), 0o644)
+	if _, err := loadWrapConfig(path); err == nil {
+		t.Fatal("Expected unknown fields to be rejected")
+	}
+}
+
+func TestRenderWrapperDockerfile(t *testing.T) {
+	cfg := WrapConfig{Distro: DistroAlpine, AmpVersion: "0.0.1", Packages: []string{"ffmpeg"}}
+	cfg.applyDefaults()
+
+	dockerfile, err := renderWrapperDockerfile(cfg, "Dockerfile")
+	if err != nil {
+		t.Fatalf("renderWrapperDockerfile failed: %v", err)
+	}
+	for _, want := range []string{"FROM superdev-image", "apk add --no-cache", "nodejs npm ffmpeg", "@sourcegraph/amp@0.0.1"} {
+		if !strings.Contains(dockerfile, want) {
+			t.Errorf("Expected %q in:\n%s", want, dockerfile)
+		}
+	}
+	// Copying glibc userland from another distribution breaks musl images
+	if strings.Contains(dockerfile, "COPY --from=wrapper") || strings.Contains(dockerfile, "apt-get") {
+		t.Errorf("Expected an Alpine-only Dockerfile, got:\n%s", dockerfile)
+	}
+
+	// Every wrapped image runs the worker, built from source unless a binary is given
+	for _, want := range []string{"FROM " + runnerBuilderImage + " AS runner", "COPY --from=runner /superdev-amprunner", "VOLUME [\"/workdir/repo\", \"/workdir/context\", \"/workdir/guidance\"]", `ENTRYPOINT ["superdev-amprunner"]`, `CMD ["run"]`} {
+		if !strings.Contains(dockerfile, want) {
+			t.Errorf("Expected %q in:\n%s", want, dockerfile)
+		}
+	}
+
+	cfg.Distro = DistroDebian
+	cfg.NodeVersion = "20"
+	dockerfile, _ = renderWrapperDockerfile(cfg, "Dockerfile")
+	if !strings.Contains(dockerfile, "node_20.x") || !strings.Contains(dockerfile, "ripgrep ffmpeg") {
+		t.Errorf("Expected a Debian install of Node 20, got:\n%s", dockerfile)
+	}
+
+	cfg.RunnerBinary = "bin/superdev-amprunner"
+	dockerfile, _ = renderWrapperDockerfile(cfg, "Dockerfile")
+	if strings.Contains(dockerfile, "AS runner") || !strings.Contains(dockerfile, "COPY superdev-amprunner /usr/local/bin/superdev-amprunner") {
+		t.Errorf("Expected the prebuilt runner to be copied, got:\n%s", dockerfile)
+	}
+}
+
+func TestWrapImage(t *testing.T) {
+	original := RunnerSource
+	RunnerSource = fstest.MapFS{"cmd/superdev-amprunner/main.go": {Data: []byte("package main")}}
+	t.Cleanup(func() { RunnerSource = original })
+
+	var staged bool
+	calls := stubDocker(t, func(args []string) (string, error) {
+		if args[0] == "build" && args[4] == "team/app:agent" {
+			_, err := os.Stat(filepath.Join(args[len(args)-1], "runner-src", "cmd", "superdev-amprunner", "main.go"))
+			staged = err == nil
+		}
+		switch {
+		case args[0] == "run" && args[len(args)-1] == "/etc/os-release":
+			return "ID=alpine\n", nil
+		case args[0] == "run" && args[len(args)-1] == "amp --version":
+			return "sh: amp: not found", errors.New("exit status 127")
+		case args[0] == "run":
+			return "v1.0.0", nil
+		}
+		return "", nil
+	})
+
+	cfg := WrapConfig{Tag: "team/app:agent"}
+	_, err := wrapImage(cfg, testImageHash, "Dockerfile", ".", io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "amp (amp --version): sh: amp: not found") {
+		t.Fatalf("Expected amp validation to fail, got %v", err)
+	}
+
+	build := fmt.Sprint((*calls)[0])
+	if build != "[build -f Dockerfile -t superdev-image --label dev.superdev.image-hash= .]" {
+		t.Fatalf("Expected the user's image to be built first, got %s", build)
+	}
+	wrapped := (*calls)[2]
+	if wrapped[0] != "build" || wrapped[4] != "team/app:agent" || wrapped[6] != imageHashLabel+"="+testImageHash {
+		t.Fatalf("Expected the wrapper to be built with the custom tag, got %v", wrapped)
+	}
+	if len(*calls) != 3+len(wrapChecks) {
+		t.Fatalf("Expected every check to run, got %d docker calls", len(*calls))
+	}
+	if !staged {
+		t.Fatal("Expected the runner source in the wrapper's build context")
+	}
+
+	// Skipping validation and setting the distro avoids running the image
+	*calls = nil
+	cfg.Distro = DistroAlpine
+	cfg.SkipValidation = true
+	if _, err := wrapImage(cfg, testImageHash, "Dockerfile", ".", io.Discard); err != nil {
+		t.Fatalf("Expected the wrap to succeed, got %v", err)
+	}
+	if len(*calls) != 2 {
+		t.Fatalf("Expected only the two builds, got %v", *calls)
+	}
+}
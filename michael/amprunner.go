@@ -1,20 +1,27 @@
 package superdev
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"regexp"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"superdev/cmd/superdev/client"
+	superdev "superdev/cmd/superdev/cliwrapper"
+	"superdev/cmd/superdev/tracing"
+
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 var rootCmd = &cobra.Command{
@@ -37,6 +44,14 @@ func init() {
 	rootCmd.AddCommand(runCmd)
 }
 
+// Execute runs the runner's CLI
+func Execute() {
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
 // runAmpWithServer reads from a remote server, sends content to amp CLI,
 // and writes output back to the server
 func runAmpWithServer() error {
@@ -50,6 +65,53 @@ func runAmpWithServer() error {
 		return fmt.Errorf("THREAD_ID environment variable is not set")
 	}
 
+	// The agent's tools inherit this process's environment, so the token is
+	// taken out of it before amp runs
+	workerToken := os.Getenv(client.EnvWorkerToken)
+	if workerToken == "" {
+		return fmt.Errorf("%s environment variable is not set", client.EnvWorkerToken)
+	}
+	os.Unsetenv(client.EnvWorkerToken)
+
+	// Export spans to wherever the server told us to, continuing the trace that started this container
+	shutdownTracing, err := tracing.Setup(context.Background(), "superdev-amprunner", tracing.ConfigFromEnv())
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Stopping the container ends the turn in progress and any wait for approval
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	threadCtx := tracing.WithTraceParent(runCtx, os.Getenv(tracing.EnvTraceParent))
+	tracer := otel.Tracer("superdev/amprunner")
+
+	server := client.New(serverURL, client.WithWorkerToken(workerToken))
+
+	// Forked threads continue from the workspace of the thread they forked from.
+	// Later snapshots are taken against the same base commit.
+	base, err := restoreWorkspace(threadCtx, server, threadID)
+	if err != nil {
+		return err
+	}
+
+	// A dev container's remoteEnv applies to every command run for the thread
+	env, err := remoteEnv(os.Getenv(client.EnvRemoteEnv))
+	if err != nil {
+		return err
+	}
+	if command := os.Getenv(client.EnvPostCreateCommand); command != "" {
+		if err := runPostCreateCommand(command, env); err != nil {
+			return err
+		}
+	}
+
+	// The thread's tool policy, if any, is enforced on every tool the agent runs
+	policy, err := server.ThreadToolPolicy(threadCtx, threadID)
+	if err != nil && !client.IsNotFound(err) {
+		return fmt.Errorf("failed to fetch tool policy: %w", err)
+	}
+
 	// Variable to track the last message ID we've processed
 	var lastMessageID string
 
@@ -59,10 +121,12 @@ func runAmpWithServer() error {
 	for {
 		// Check for new input messages
 		lock.Lock()
-		newMessages, err := pullMessages(serverURL, threadID, lastMessageID)
+		fmt.Println("Checking server for new messages at", time.Now().Format("2006-01-02 15:04:05"))
+		newMessages, err := server.PullMessages(threadCtx, threadID, lastMessageID)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to fetch messages: %w", err)
 		}
+		fmt.Printf("Found %d new messages\n", len(newMessages))
 		lock.Unlock()
 
 		// Process each new input message
@@ -70,42 +134,47 @@ func runAmpWithServer() error {
 			fmt.Printf("Processing input: %s\n", input.Content)
 			lastMessageID = input.ID
 
-			// todo: we need to set that up earlier and then pipe input and output
-			// Create and set up the amp command
-			cmd := exec.Command("amp")
-			cmd.Stdin = bufio.NewReader(strings.NewReader(input.Content))
-
-			// Capture stdout
-			stdout, err := cmd.StdoutPipe()
-			if err != nil {
-				return fmt.Errorf("failed to create stdout pipe: %w", err)
+			// Each turn continues the trace of the request that stored the message
+			turnCtx := threadCtx
+			if input.TraceParent != "" {
+				turnCtx = tracing.WithTraceParent(runCtx, input.TraceParent)
 			}
-
-			// Start the command
-			if err := cmd.Start(); err != nil {
-				return fmt.Errorf("failed to start amp command: %w", err)
+			turnCtx, span := tracer.Start(turnCtx, "amp.turn")
+			span.SetAttributes(attribute.String("thread_id", threadID), attribute.String("message_id", input.ID))
+
+			// Restores replace the workspace instead of running a prompt
+			var output string
+			var deltas []superdev.ThreadDelta
+			if input.Workspace != nil {
+				output = "Restored the workspace"
+				if err := applyWorkspace(input.Workspace); err != nil {
+					output = fmt.Sprintf("Failed to restore the workspace: %v", err)
+				} else {
+					base = input.Workspace.Base
+				}
+			} else {
+				output, deltas, err = runAmpTurn(turnCtx, server, threadID, input.Content, env, policy)
 			}
-
-			// Read all output
-			outputBytes, err := io.ReadAll(stdout)
 			if err != nil {
-				return fmt.Errorf("failed to read amp output: %w", err)
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				span.End()
+				return err
 			}
-			output := string(outputBytes)
 
-			// Wait for the command to finish
-			if err := cmd.Wait(); err != nil {
-				return fmt.Errorf("amp command failed: %w", err)
+			// Send output to server along with the workspace it left behind and the turn's token usage
+			workspace, err := snapshotWorkspace(base)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Skipping workspace snapshot: %v\n", err)
 			}
-
-			// Send output to server
-			newLastMessageID, err := answerMessage(serverURL, threadID, output)
+			answer, err := server.AnswerMessage(turnCtx, threadID, client.AnswerMessageRequest{Payload: output, Deltas: deltas, Workspace: workspace})
+			span.End()
 			if err != nil {
 				return fmt.Errorf("failed to send output to server: %w", err)
 			}
 
 			// Update last message ID
-			lastMessageID = newLastMessageID
+			lastMessageID = answer.MessageID
 
 			fmt.Printf("Sent output to server: %s\n", output)
 		}
@@ -115,91 +184,224 @@ func runAmpWithServer() error {
 	}
 }
 
-// Message represents a message from the server
-type Message struct {
-	ID      string
-	Content string
+// workspaceDir is where the server mounts the thread's repository
+const workspaceDir = "/workdir/repo"
+
+var containerEnvPattern = regexp.MustCompile(`\$\{containerEnv:([^}:]+)(?::([^}]*))?\}`)
+
+// remoteEnv decodes the dev container's remoteEnv, resolving ${containerEnv:NAME}
+// references against the container's environment
+func remoteEnv(encoded string) ([]string, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	var values map[string]string
+	if err := json.Unmarshal([]byte(encoded), &values); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", client.EnvRemoteEnv, err)
+	}
+
+	env := make([]string, 0, len(values))
+	for name, value := range values {
+		value = containerEnvPattern.ReplaceAllStringFunc(value, func(match string) string {
+			parts := containerEnvPattern.FindStringSubmatch(match)
+			if resolved, ok := os.LookupEnv(parts[1]); ok {
+				return resolved
+			}
+			return parts[2]
+		})
+		env = append(env, name+"="+value)
+	}
+	return env, nil
 }
 
-// pullMessages fetches new messages from the server
-func pullMessages(serverURL, threadID, lastMessageID string) ([]Message, error) {
-	fmt.Println("Checking server for new messages at", time.Now().Format("2006-01-02 15:04:05"))
+// maxWorkspacePatch caps the size of a workspace snapshot sent to the server
+const maxWorkspacePatch = 16 << 20
 
-	// Build the URL with query parameters
-	baseURL, err := url.Parse(serverURL + "/pullMessages")
+// restoreWorkspace applies the snapshot a forked thread starts from, if any,
+// and returns the commit snapshots of this thread are taken against
+func restoreWorkspace(ctx context.Context, server *client.Client, threadID string) (string, error) {
+	snapshot, err := server.ThreadWorkspace(ctx, threadID)
+	if client.IsNotFound(err) {
+		base, err := gitCommand(nil, nil, "rev-parse", "HEAD")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Workspace snapshots disabled: %v\n", err)
+			return "", nil
+		}
+		return strings.TrimSpace(string(base)), nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("invalid server URL: %w", err)
+		return "", fmt.Errorf("failed to fetch workspace: %w", err)
+	}
+
+	if err := applyWorkspace(snapshot); err != nil {
+		return "", err
 	}
+	return snapshot.Base, nil
+}
 
-	// Add query parameters
-	params := url.Values{}
-	params.Add("thread_id", threadID)
-	if lastMessageID != "" {
-		params.Add("last_message_id", lastMessageID)
+// applyWorkspace discards the repository's changes, including new files that
+// aren't ignored, and replaces them with a snapshot's
+func applyWorkspace(snapshot *client.WorkspaceSnapshot) error {
+	fmt.Println("Restoring workspace from", snapshot.Base)
+	if _, err := gitCommand(nil, nil, "checkout", "--quiet", "--force", "--detach", snapshot.Base); err != nil {
+		return fmt.Errorf("failed to check out workspace base: %w", err)
+	}
+	if _, err := gitCommand(nil, nil, "clean", "--quiet", "--force", "-d"); err != nil {
+		return fmt.Errorf("failed to remove new files: %w", err)
+	}
+	if len(snapshot.Patch) > 0 {
+		if _, err := gitCommand(nil, snapshot.Patch, "apply", "--binary", "-"); err != nil {
+			return fmt.Errorf("failed to apply workspace changes: %w", err)
+		}
 	}
-	baseURL.RawQuery = params.Encode()
+	return nil
+}
 
-	// Make the request
-	resp, err := http.Get(baseURL.String())
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch messages: %w", err)
+// snapshotWorkspace captures the repository's changes since base, including
+// new files that aren't ignored. It returns nil when snapshots are disabled.
+func snapshotWorkspace(base string) (*client.WorkspaceSnapshot, error) {
+	if base == "" {
+		return nil, nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned error: %s", resp.Status)
+	// Stage everything into a scratch index so the worker's own index is untouched
+	index, err := os.CreateTemp("", "superdev-index-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index: %w", err)
 	}
+	index.Close()
+	os.Remove(index.Name())
+	defer os.Remove(index.Name())
 
-	// Parse the response
-	var messages []Message
-	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
-		return nil, fmt.Errorf("failed to decode server response: %w", err)
+	env := []string{"GIT_INDEX_FILE=" + index.Name()}
+	if _, err := gitCommand(env, nil, "add", "--all"); err != nil {
+		return nil, err
 	}
+	patch, err := gitCommand(env, nil, "diff", "--cached", "--binary", base)
+	if err != nil {
+		return nil, err
+	}
+	if len(patch) > maxWorkspacePatch {
+		return nil, fmt.Errorf("changes are %d bytes, more than the %d allowed", len(patch), maxWorkspacePatch)
+	}
+	return &client.WorkspaceSnapshot{Base: base, Patch: patch}, nil
+}
 
-	fmt.Printf("Found %d new messages\n", len(messages))
-	return messages, nil
+// gitCommand runs git in the repository with extra environment and stdin,
+// returning its output
+func gitCommand(env []string, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = workspaceDir
+	cmd.Env = append(os.Environ(), env...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
 }
 
-// answerMessage sends the amp output back to the server
-func answerMessage(serverURL, threadID, output string) (string, error) {
-	// Prepare the request payload
-	payload := struct {
-		ThreadID string `json:"thread_id"`
-		Payload  string `json:"payload"`
-	}{
-		ThreadID: threadID,
-		Payload:  output,
+// runPostCreateCommand runs the dev container's postCreateCommand in the
+// repository before the first turn
+func runPostCreateCommand(command string, env []string) error {
+	fmt.Println("Running postCreateCommand:", command)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = workspaceDir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("postCreateCommand failed: %w", err)
 	}
+	return nil
+}
 
-	// Convert payload to JSON
-	payloadBytes, err := json.Marshal(payload)
+// approvalPollInterval is how often the runner checks whether a human has
+// decided on a tool run
+const approvalPollInterval = 2 * time.Second
+
+// runAmpTurn sends a prompt to the thread on an amp worker and returns the
+// thread's messages from the turn as JSON, with an inference:completed delta
+// reporting the usage of each of its inferences. Tool runs are checked against the
+// thread's tool policy, if any, and those that need confirmation wait for a
+// human to decide on them through the server. The trace context is passed to
+// amp through the TRACEPARENT environment variable, along with any extra
+// environment.
+func runAmpTurn(ctx context.Context, server *client.Client, threadID, prompt string, env []string, policy *client.ToolPolicy) (string, []superdev.ThreadDelta, error) {
+	env = append(append([]string{}, env...), tracing.EnvTraceParent+"="+tracing.TraceParent(ctx))
+	// With a policy Amp asks before every tool run, so none starts unchecked
+	thread, inferences, err := superdev.RunThreadTurn(ctx, threadID, prompt, env, policy != nil, func(toolUse superdev.AmpContent) (bool, error) {
+		return decideToolUse(ctx, server, threadID, policy, toolUse)
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal payload: %w", err)
+		return "", nil, fmt.Errorf("amp turn failed: %w", err)
 	}
 
-	// Make POST request
-	resp, err := http.Post(
-		serverURL+"/answerMessage",
-		"application/json",
-		bytes.NewBuffer(payloadBytes),
-	)
+	// The thread repeats the whole conversation; keep the turn from its prompt on.
+	// The debug information holds the model's whole input, which isn't output.
+	thread.Messages = thread.Messages[thread.LastPrompt()+1:]
+	thread.Debug = nil
+	output, err := json.Marshal(thread)
 	if err != nil {
-		return "", fmt.Errorf("failed to send answer to server: %w", err)
+		return "", nil, fmt.Errorf("failed to encode amp thread: %w", err)
+	}
+	return string(output), inferences, nil
+}
+
+// decideToolUse decides whether a tool run waiting for confirmation may go
+// ahead. Without a policy a human decides. With one, runs that comply are
+// approved and runs that break it are rejected, or passed to a human if the
+// policy escalates them. Every decision the policy makes is recorded on the
+// thread.
+func decideToolUse(ctx context.Context, server *client.Client, threadID string, policy *client.ToolPolicy, toolUse superdev.AmpContent) (bool, error) {
+	request := client.RequestApprovalRequest{ToolUseID: toolUse.ID, Tool: toolUse.Name, Input: toolUse.Input}
+	if policy == nil {
+		return awaitApproval(ctx, server, threadID, request)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("server returned error: %s", resp.Status)
+	request.Reason = policy.Check(toolUse.Name, toolUse.Input, workspaceDir)
+	switch {
+	case request.Reason == "":
+		request.Decision = client.ApprovalApproved
+	case policy.OnViolation == client.PolicyEscalate:
+		return awaitApproval(ctx, server, threadID, request)
+	default:
+		request.Decision = client.ApprovalRejected
+		fmt.Printf("Rejecting %s: %s\n", toolUse.Name, request.Reason)
 	}
 
-	// Parse response to get lastMessageId
-	var response struct {
-		MessageID string `json:"message_id"`
+	if _, err := server.RequestApproval(ctx, threadID, request); err != nil {
+		return false, fmt.Errorf("failed to record tool policy decision: %w", err)
 	}
+	return request.Decision == client.ApprovalApproved, nil
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return "", fmt.Errorf("failed to decode server response: %w", err)
+// awaitApproval asks the server for a human to approve a tool run and waits
+// until one has decided, the server has rejected it for taking too long, or
+// ctx ends
+func awaitApproval(ctx context.Context, server *client.Client, threadID string, request client.RequestApprovalRequest) (bool, error) {
+	approval, err := server.RequestApproval(ctx, threadID, request)
+	if err != nil {
+		return false, fmt.Errorf("failed to request approval: %w", err)
 	}
 
-	return response.MessageID, nil
+	fmt.Printf("Waiting for approval %s to run %s\n", approval.ID, request.Tool)
+	ticker := time.NewTicker(approvalPollInterval)
+	defer ticker.Stop()
+	for approval.Status == client.ApprovalPending {
+		select {
+		case <-ctx.Done():
+			return false, fmt.Errorf("stopped waiting for approval %s: %w", approval.ID, ctx.Err())
+		case <-ticker.C:
+		}
+		if approval, err = server.GetApproval(ctx, threadID, approval.ID); err != nil {
+			return false, fmt.Errorf("failed to check approval: %w", err)
+		}
+	}
+	fmt.Printf("Approval %s was %s\n", approval.ID, approval.Status)
+	return approval.Status == client.ApprovalApproved, nil
 }
@@ -16,7 +16,7 @@ function ThreadCard({ thread, outputRefs }) {
   return (
     <div key={thread.thread_id} className="thread-card">
       <div className="thread-header">
-        <h3 className="thread-title">Thread ID: {thread.thread_id.substring(0, 8)}...</h3>
+        <h3 className="thread-title">{thread.title || `Thread ID: ${thread.thread_id.substring(0, 8)}...`}</h3>
         <div className="thread-meta">
           <div title={new Date(thread.created_at).toLocaleString()}>
             Created: {new Date(thread.created_at).toLocaleTimeString()}
@@ -82,6 +82,7 @@ export const useThreads = () => {
                 threadData.error !== thread.error) {
               return {
                 ...thread,
+                title: threadData.title || thread.title,
                 output: threadData.output || '',
                 error: threadData.error || '',
                 status: threadData.status,
@@ -8,6 +8,19 @@ export const fetchThreads = async () => {
 };
 
 export const fetchThreadOutput = async (threadId) => {
-  const response = await axios.get(`${API_BASE_URL}/output?thread_id=${threadId}`);
-  return response.data;
+  const response = await axios.get(`${API_BASE_URL}/v1/threads/${threadId}`);
+  const thread = response.data;
+  const messages = thread.messages || [];
+  const last = messages[messages.length - 1];
+
+  // Flatten the thread document into the fields the thread cards render
+  return {
+    ...thread,
+    output: messages
+      .filter((message) => message.direction === 'output')
+      .map((message) => message.output)
+      .join('\n'),
+    error: last && last.error ? last.error : '',
+    status: last && last.direction === 'input' && thread.status === 'running' ? 'processing' : thread.status,
+  };
 };
\ No newline at end of file